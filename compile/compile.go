@@ -45,6 +45,9 @@ type Parser struct {
 
 // main function
 func main() {
+// the command line flags override the settings above
+crawler.ParseFlags()
+
 // config spider
 %s
 
@@ -56,8 +59,8 @@ builder := crawler.DefaultCrawlerBuilder()
 parser := &Parser{DefaultParser: builder.DefaultParser()}
 %s
 
-// build and run
-builder.Build().Crawl(spider)
+// build and run, the exit code tells how the crawl ended
+builder.Build().Run(spider)
 }
 `
 
@@ -72,6 +75,9 @@ patterns := map[string]crawler.PatternFunc{}
 %s
 
 p.RunPattern(patterns, res, spider)
+
+// follow the cursor of the next page
+%s
 }
 `
 
@@ -129,11 +135,21 @@ func main() {
 				case "crawler":
 					ConfigCrawler(val.(map[string]interface{}))
 
+				// "rewrite" is the list of the url rewrite rules of the spider, each rule is a regular expression,
+				// which is removed from the urls, or a pair of the expression and its replacement.
+				case "rewrite":
+					ConfigRewrite(val.([]interface{}))
+
 				// "log" indicates the logger package, users can change the loglevel
 				// among "Fatal", "Error", "Info", "Debug", "Trace".
 				case "log":
 					ConfigLogger(val.(string))
 
+				// "loglevels" overrides the levels of the loggers by their names, like {"Downloader": "Debug"},
+				// and of the spiders by "spider:" and their names.
+				case "loglevels":
+					ConfigLogLevels(val.(map[string]interface{}))
+
 				// "spider" indicates the spider which the user wants to create, it should
 				// be a json object including Name, StartURLs and AllowedDomains.
 				case "spider":
@@ -169,9 +185,12 @@ func main() {
 	}
 }
 
+// The packages may be imported by the other settings too, like "log", so each one is imported once.
 func ConfigImports(a []interface{}) {
 	for _, val := range a {
-		CodeImports += fmt.Sprintf("import \"%s\"\n", val.(string))
+		if imp := fmt.Sprintf("import \"%s\"\n", val.(string)); !strings.Contains(CodeImports, imp) {
+			CodeImports += imp
+		}
 	}
 }
 
@@ -189,9 +208,53 @@ func ConfigCrawler(dic map[string]interface{}) {
 	}
 }
 
+// The rules are quoted as go strings, so the backslashes of the regular expressions are kept.
+func ConfigRewrite(a []interface{}) {
+	for _, val := range a {
+		var pattern, replacement string
+		switch x := val.(type) {
+		case string:
+			pattern = x
+		case []interface{}:
+			pattern = x[0].(string)
+			if len(x) > 1 {
+				replacement = x[1].(string)
+			}
+		}
+		CodeCrawler += fmt.Sprintf("crawler.URLRewriteRules = append(crawler.URLRewriteRules, middleware.RewriteRule{Pattern: %q, Replacement: %q})\n",
+			pattern, replacement)
+	}
+	importMiddleware()
+}
+
 func ConfigLogger(level string) {
-	CodeLogger = fmt.Sprintf("log.LogLevel = log.%s", level)
-	CodeImports += "import \"github.com/SteveZhangBit/leiogo/log\"\n"
+	CodeLogger += fmt.Sprintf("log.LogLevel = log.%s\n", level)
+	importLog()
+}
+
+func ConfigLogLevels(dic map[string]interface{}) {
+	for name, level := range dic {
+		if strings.HasPrefix(name, "spider:") {
+			CodeLogger += fmt.Sprintf("log.SetSpiderLevel(%q, log.%s)\n", strings.TrimPrefix(name, "spider:"), level)
+		} else {
+			CodeLogger += fmt.Sprintf("log.SetLevel(%q, log.%s)\n", name, level)
+		}
+	}
+	importLog()
+}
+
+// Both "log" and "loglevels" need the log package, but it can be imported only once.
+func importLog() {
+	if imp := "import \"github.com/SteveZhangBit/leiogo/log\"\n"; !strings.Contains(CodeImports, imp) {
+		CodeImports += imp
+	}
+}
+
+// Like importLog, for the settings of the middleware types.
+func importMiddleware() {
+	if imp := "import \"github.com/SteveZhangBit/leiogo/middleware\"\n"; !strings.Contains(CodeImports, imp) {
+		CodeImports += imp
+	}
 }
 
 func ConfigSpider(dic map[string]interface{}) {
@@ -232,15 +295,39 @@ func ConfigParser(name string, dic map[string]interface{}) {
 	// Generate functions to the Parser type
 	patterns := ""
 	vars := ""
+	cursor := ""
 	for key, val := range dic {
 		if key == "vars" {
 			vars = createPatternVars(val.([]interface{}))
+		} else if key == "cursor" {
+			cursor = createCursor(val.(map[string]interface{}))
 		} else {
 			patterns += fmt.Sprintf(PatternFuncTemplate, key, createPatternFunc(val.(map[string]interface{})))
 		}
 	}
 
-	CodeFunctions += fmt.Sprintf(ParseFuncTemplate, funcName, vars, patterns)
+	CodeFunctions += fmt.Sprintf(ParseFuncTemplate, funcName, vars, patterns, cursor)
+}
+
+// "cursor" follows the cursor of a cursor-paginated JSON API, for example:
+// "cursor": {"path": "$.paging.next", "url": "https://api.example.com/items?after={cursor}", "max": 100}
+// See crawler.Pagination for more information.
+func createCursor(dic map[string]interface{}) (code string) {
+	code = "p.FollowCursor(crawler.Pagination{"
+	for key, val := range dic {
+		switch key {
+		case "path":
+			code += fmt.Sprintf("CursorPath: %v, ", eval(val))
+		case "url":
+			code += fmt.Sprintf("URLTemplate: %v, ", eval(val))
+		case "max":
+			code += fmt.Sprintf("MaxPages: %v, ", eval(val))
+		default:
+			panic(fmt.Sprintf("Unknown cursor keyword at %s, %v", key, val))
+		}
+	}
+	code += "}, res, req, spider)"
+	return
 }
 
 func createPatternVars(a []interface{}) (code string) {
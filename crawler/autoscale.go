@@ -0,0 +1,172 @@
+package crawler
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// Tokens controls the concurrent requests at the same time. A worker should first acquire a token,
+// and release it after the request has completed. Unlike a buffered channel, the limit of the tokens
+// can be changed when the crawler is running.
+type Tokens struct {
+	limit int
+	used  int
+	mutex sync.Mutex
+	cond  *sync.Cond
+}
+
+func NewTokens(limit int) *Tokens {
+	t := &Tokens{limit: limit}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+func (t *Tokens) Acquire() {
+	t.mutex.Lock()
+	for t.used >= t.limit {
+		t.cond.Wait()
+	}
+	t.used++
+	t.mutex.Unlock()
+}
+
+// TryAcquire acquires a token if there's one remaining, without waiting.
+func (t *Tokens) TryAcquire() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.used >= t.limit {
+		return false
+	}
+	t.used++
+	return true
+}
+
+func (t *Tokens) Release() {
+	t.mutex.Lock()
+	t.used--
+	t.mutex.Unlock()
+	// Both Acquire and Wait are waiting on the cond, so we have to wake them all.
+	t.cond.Broadcast()
+}
+
+// Wait until all the tokens are released.
+func (t *Tokens) Wait() {
+	t.mutex.Lock()
+	for t.used > 0 {
+		t.cond.Wait()
+	}
+	t.mutex.Unlock()
+}
+
+// When the limit decreases, the running workers won't be stopped,
+// but no more token will be given until the used ones are less than the new limit.
+func (t *Tokens) SetLimit(limit int) {
+	t.mutex.Lock()
+	t.limit = limit
+	t.mutex.Unlock()
+	t.cond.Broadcast()
+}
+
+func (t *Tokens) Limit() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.limit
+}
+
+// AutoScaler adjusts the concurrent requests of the crawler by the download latency and the error rate.
+// For every Interval, it increases the concurrency by 1 if the average latency is lower than TargetLatency
+// and the error rate is lower than MaxErrorRate, otherwise it cuts the concurrency in half.
+// The concurrency is always between Min and Max.
+type AutoScaler struct {
+	Logger log.Logger
+	Tokens *Tokens
+
+	Min, Max      int
+	Interval      time.Duration
+	TargetLatency time.Duration
+	MaxErrorRate  float64
+
+	// The statistics of the current interval.
+	requests int
+	errors   int
+	latency  time.Duration
+
+	mutex  sync.Mutex
+	closed chan bool
+}
+
+func (a *AutoScaler) Open(spider *leiogo.Spider) error {
+	a.closed = make(chan bool)
+	ticker := time.NewTicker(a.Interval)
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.scale(spider)
+			case <-a.closed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (a *AutoScaler) Close(reason string, spider *leiogo.Spider) error {
+	a.closed <- true
+	return nil
+}
+
+// Observe is called by the crawler for every downloaded response.
+func (a *AutoScaler) Observe(res *leiogo.Response) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.requests++
+	a.latency += res.Latency
+	if res.Err != nil || res.StatusCode >= 500 {
+		// A finished file download also comes with a DropTaskError.
+		if _, ok := res.Err.(*middleware.DropTaskError); !ok {
+			a.errors++
+		}
+	}
+}
+
+func (a *AutoScaler) scale(spider *leiogo.Spider) {
+	a.mutex.Lock()
+	requests, errors, latency := a.requests, a.errors, a.latency
+	a.requests, a.errors, a.latency = 0, 0, 0
+	a.mutex.Unlock()
+
+	// Nothing to learn from an idle interval.
+	if requests == 0 {
+		return
+	}
+
+	avgLatency := latency / time.Duration(requests)
+	errorRate := float64(errors) / float64(requests)
+	old := a.Tokens.Limit()
+
+	limit := old
+	if avgLatency < a.TargetLatency && errorRate < a.MaxErrorRate {
+		limit++
+	} else {
+		limit /= 2
+	}
+	if limit < a.Min {
+		limit = a.Min
+	} else if limit > a.Max {
+		limit = a.Max
+	}
+
+	if limit != old {
+		a.Tokens.SetLimit(limit)
+		a.Logger.Info(spider.Name, "Scale concurrency from %d to %d, latency: %.3fs, error rate: %.2f",
+			old, limit, avgLatency.Seconds(), errorRate)
+	}
+}
@@ -1,37 +1,252 @@
 package crawler
 
 import (
+	"context"
+	"fmt"
 	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
-	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo/log"
 	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
 )
 
 type CrawlerBuilder struct {
 	Crawler *Crawler
+
+	warc    *middleware.WARCWriter
+	sampled bool
+	sitemap bool
+	shots   bool
+	phantom bool
+	temps   bool
+	seo     bool
+
+	// The names of the parsers referred by the components, and the components, see referParser.
+	referred map[string]string
 }
 
+// Build returns the crawler. The downloader is wrapped for Chrome, the time travel and the fixtures here,
+// so the downloaders set by SetDownloader are never used in the time travel or the replay either.
+// The item sample is added here too, so it's after all the pipelines.
+// It panics if a parser referred by the components is not added, and there's no fallback parser,
+// or the crawler breaks the strict compliance profile, see StrictCompliance.
 func (c *CrawlerBuilder) Build() *Crawler {
+	if StrictCompliance {
+		c.checkCompliance()
+	}
+	if c.Crawler.FallbackParser == nil {
+		for name, by := range c.referred {
+			if _, ok := c.Crawler.Parsers[name]; !ok {
+				panic("No parser named " + name + ", which is referred by " + by)
+			}
+		}
+	}
+	if ItemSampleSize > 0 && !c.sampled {
+		c.sampled = true
+		c.AddItemPipelines(NewSamplePipeline(ItemSampleSize, ItemSampleFile))
+	}
+	if SitemapFile != "" && !c.sitemap {
+		if SitemapFormat != middleware.SitemapXML && SitemapFormat != middleware.SitemapText {
+			panic("Unknown sitemap format " + SitemapFormat)
+		}
+		c.sitemap = true
+		c.AddSpiderMiddlewares(NewSitemapMiddleware(SitemapFile))
+	}
+	if SEOReportFile != "" && !c.seo {
+		c.seo = true
+		// The auditor goes first, so it records the error pages before the HttpErrorMiddleware drops them.
+		m := NewSEOAuditMiddleware(SEOReportFile)
+		c.addYielder(m)
+		c.Crawler.SpiderMiddlewares = append([]middleware.SpiderMiddleware{m}, c.Crawler.SpiderMiddlewares...)
+	}
+	if ScreenshotDir != "" && !c.shots {
+		c.shots = true
+		c.AddSpiderMiddlewares(NewScreenshotMiddleware(ScreenshotDir))
+	}
+	if c.warc != nil {
+		d, ok := c.Crawler.Downloader.(*middleware.DefaultDownloader)
+		if !ok {
+			panic("WARC recording needs a DefaultDownloader")
+		}
+		d.WARC = c.warc
+	}
+	if len(c.Crawler.StatusParsers) != 0 {
+		for _, m := range c.Crawler.SpiderMiddlewares {
+			if h, ok := m.(*middleware.HttpErrorMiddleware); ok && h.Handled == nil {
+				h.Handled = c.Crawler.handlesStatus
+			}
+		}
+	}
+	if d, ok := c.Crawler.Downloader.(*middleware.DefaultDownloader); ok && d.Phantom != nil && !c.phantom {
+		c.phantom = true
+		// The workers are killed when the spider closes.
+		c.AddOpenCloses(d.Phantom)
+	}
+	if d, ok := c.Crawler.Downloader.(*middleware.DefaultDownloader); ok && (d.WriteRetries > 0 || d.FallbackWriter != nil) && !c.temps {
+		c.temps = true
+		// The temporary files of the writes never retried are removed when the spider closes.
+		c.AddOpenCloses(d)
+	}
+	if _, ok := c.Crawler.Downloader.(*middleware.ChromeDownloader); !ok && ChromeEnabled {
+		chrome := NewChromeDownloader(c.Crawler.Downloader)
+		c.Crawler.Downloader = chrome
+		// The browsers are killed when the spider closes.
+		c.AddOpenCloses(chrome)
+	}
+	if _, ok := c.Crawler.Downloader.(*middleware.CacheDownloader); !ok && !HttpCacheSnapshot.IsZero() {
+		c.Crawler.Downloader = NewCacheDownloader(c.Crawler.Downloader)
+	}
+	if _, ok := c.Crawler.Downloader.(*middleware.FixtureDownloader); !ok && FixtureMode != "" {
+		if FixtureMode != middleware.FixtureRecord && FixtureMode != middleware.FixtureReplay {
+			panic("Unknown fixture mode " + FixtureMode)
+		}
+		c.Crawler.Downloader = NewFixtureDownloader(c.Crawler.Downloader)
+	}
 	return c.Crawler
 }
 
+// Panic with all the violations of the strict compliance profile, so the crawl never starts with them.
+func (c *CrawlerBuilder) checkCompliance() {
+	var violations []string
+	if UserAgent == "" {
+		violations = append(violations, "the UserAgent is empty")
+	}
+	if ComplianceFrom == "" {
+		violations = append(violations, "the ComplianceFrom contact is empty")
+	}
+	for host, settings := range HostSettings {
+		if _, ok := settings["UserAgent"]; ok {
+			violations = append(violations, "the host "+host+" overrides the UserAgent")
+		}
+	}
+	for _, m := range c.Crawler.components() {
+		if s, ok := m.(middleware.StealthComponent); ok {
+			for _, feature := range s.StealthFeatures() {
+				violations = append(violations, fmt.Sprintf("%T has %s", m, feature))
+			}
+		}
+	}
+	if len(violations) != 0 {
+		panic("The crawler breaks the strict compliance: " + strings.Join(violations, ", "))
+	}
+}
+
 func CreateCrawlerBuilder() *CrawlerBuilder {
+	// A wrong hasher would silently change all the file names, so it's better to stop here.
+	if err := util.SetHasher(Hasher); err != nil {
+		panic(err.Error())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	builder := &CrawlerBuilder{Crawler: &Crawler{
-		requests:   make(chan *leiogo.Request, 1),
-		tokens:     make(chan struct{}, ConcurrentRequests),
-		count:      ConcurrentCount{done: make(chan bool, 1)},
+		ctx:        ctx,
+		cancel:     cancel,
+		tokens:     NewTokens(ConcurrentRequests),
+		count:      NewConcurrentCount(),
+		running:    NewConcurrentCount(),
 		Logger:     log.New("Crawler"),
 		Parsers:    make(map[string]middleware.Parser),
+		Errbacks:   make(map[string]middleware.Errback),
 		Downloader: NewDownloader(),
+		Scheduler:  NewScheduler(),
 		StatusInfo: StatusInfo{Logger: log.New("Crawler")},
+
+		ParserTimeout:       time.Duration(ParserTimeout*1000) * time.Millisecond,
+		ParserSlowThreshold: time.Duration(ParserSlowThreshold*1000) * time.Millisecond,
+		JobDir:              JobDir,
+		SummaryFile:         RunSummaryFile,
+		PolitenessFile:      PolitenessFile,
+		RunID:               RunID,
+		RunIDField:          RunIDField,
+		ManifestFile:        ManifestFile,
+		VerifyManifest:      VerifyManifest,
+		HostSettings:        HostSettings,
+		LookupRetryTimes:    LookupRetryTimes,
+		LookupCacheSize:     LookupCacheSize,
+		RerenderEmpty:       RerenderEmptyPages,
+		FileItems:           FileItemsEnabled,
+		ConsumerBuffer:      ConsumerBufferSize,
+
+		ConcurrentRequestsPerDomain: ConcurrentRequestsPerDomain,
 	}}
 
 	builder.AddOpenCloses(
-		&UserInterrupt{Logger: log.New("Crawler"), StatusInfo: &builder.Crawler.StatusInfo},
+		&UserInterrupt{Logger: log.New("Crawler"), StatusInfo: &builder.Crawler.StatusInfo, Cancel: builder.Crawler.Cancel},
 		&builder.Crawler.StatusInfo,
 	)
 
+	if CloseOnPageCount > 0 || CloseOnItemCount > 0 || CloseOnErrorCount > 0 || CloseOnDuration > 0 {
+		builder.AddOpenCloses(&CloseSpider{
+			Logger:     log.New("CloseSpider"),
+			StatusInfo: &builder.Crawler.StatusInfo,
+			PageCount:  CloseOnPageCount,
+			ItemCount:  CloseOnItemCount,
+			ErrorCount: CloseOnErrorCount,
+			Duration:   time.Duration(CloseOnDuration*1000) * time.Millisecond,
+		})
+	}
+
+	// The composite writers wait for their backups when the crawler closes.
+	for _, w := range []middleware.FileWriter{DownloaderFileWriter, FallbackFileWriter} {
+		if oc, ok := w.(middleware.OpenClose); ok {
+			builder.AddOpenCloses(oc)
+		}
+	}
+
+	if WARCDir != "" {
+		builder.AddWARCWriter(NewWARCWriter())
+	}
+
+	// The compliance goes first, so no request is sent or answered from the cache against robots.txt.
+	if StrictCompliance {
+		builder.AddDownloadMiddlewares(NewComplianceMiddleware())
+		builder.AddSpiderMiddlewares(NewRobotsMetaMiddleware())
+	}
+
+	if HttpCacheEnabled && HttpCacheSnapshot.IsZero() {
+		builder.AddDownloadMiddlewares(NewHttpCacheMiddleware())
+	}
+
+	// The urls are rewritten before the other spider middlewares see them.
+	if len(URLRewriteRules) != 0 {
+		// An invalid rule would leave the urls as they are, so it's better to stop here.
+		if _, err := middleware.CompileRewriteRules(URLRewriteRules); err != nil {
+			panic(err.Error())
+		}
+		builder.AddSpiderMiddlewares(NewURLRewriteMiddleware())
+	}
+
+	if TrapDetectorEnabled {
+		if _, err := middleware.CompileDenyRules(TrapDenyRules); err != nil {
+			panic(err.Error())
+		}
+		builder.AddSpiderMiddlewares(NewTrapDetectorMiddleware())
+	}
+
+	rate := MaxRequestsPerMinute
+	if StrictCompliance && (rate <= 0 || rate > ComplianceMaxRequestsPerMinute) {
+		rate = ComplianceMaxRequestsPerMinute
+	}
+	if rate > 0 {
+		builder.Crawler.RateLimiter = NewRateLimiter(rate)
+	}
+
+	if AutoScaleEnabled {
+		builder.Crawler.AutoScaler = &AutoScaler{
+			Logger:        log.New("AutoScaler"),
+			Tokens:        builder.Crawler.tokens,
+			Min:           AutoScaleMin,
+			Max:           AutoScaleMax,
+			Interval:      time.Duration(AutoScaleInterval*1000) * time.Millisecond,
+			TargetLatency: time.Duration(AutoScaleTargetLatency*1000) * time.Millisecond,
+			MaxErrorRate:  AutoScaleMaxErrorRate,
+		}
+		builder.AddOpenCloses(builder.Crawler.AutoScaler)
+	}
+
 	return builder
 }
 
@@ -42,6 +257,7 @@ func DefaultCrawlerBuilder() *CrawlerBuilder {
 		NewDelayMiddleware(),
 		NewRetryMiddleware(),
 		NewCacheMiddleware(),
+		NewCookiesMiddleware(),
 	)
 	c.AddSpiderMiddlewares(
 		NewHttpErrorMiddleware(),
@@ -53,10 +269,17 @@ func DefaultCrawlerBuilder() *CrawlerBuilder {
 }
 
 func (c *CrawlerBuilder) addYielder(m interface{}) {
-	v := reflect.ValueOf(m).Elem()
+	c.setYielder(reflect.ValueOf(m).Elem())
+}
+
+// The Yielders of the embedded structs are set too, like the FilePipeline of the ImagesPipeline.
+func (c *CrawlerBuilder) setYielder(v reflect.Value) {
 	for i := 0; i < v.NumField(); i++ {
-		if v.Type().Field(i).Type.String() == "middleware.Yielder" {
+		field := v.Type().Field(i)
+		if field.Type.String() == "middleware.Yielder" {
 			v.Field(i).Set(reflect.ValueOf(c.Crawler))
+		} else if field.Anonymous && field.Type.Kind() == reflect.Struct && v.Field(i).CanSet() {
+			c.setYielder(v.Field(i))
 		}
 	}
 }
@@ -81,16 +304,92 @@ func (c *CrawlerBuilder) AddSpiderMiddlewares(ms ...middleware.SpiderMiddleware)
 	return c
 }
 
+func (c *CrawlerBuilder) SetScheduler(s middleware.Scheduler) *CrawlerBuilder {
+	c.Crawler.Scheduler = s
+	return c
+}
+
+// Replace the DupeFilter of all the CacheMiddlewares, for example, to share the crawled urls
+// among several crawler processes with a redis DupeFilter.
+func (c *CrawlerBuilder) SetDupeFilter(f middleware.DupeFilter) *CrawlerBuilder {
+	for _, m := range c.Crawler.DownloadMiddlewares {
+		if cache, ok := m.(*middleware.CacheMiddleware); ok {
+			cache.DupeFilter = f
+		}
+	}
+	return c
+}
+
 func (c *CrawlerBuilder) SetDownloader(d middleware.Downloader) *CrawlerBuilder {
 	c.Crawler.Downloader = d
 	return c
 }
 
+// AddParser adds the parser named name. It panics if there's already a parser of the name,
+// since the later one would silently replace the former.
 func (c *CrawlerBuilder) AddParser(name string, p middleware.Parser) *CrawlerBuilder {
+	if _, ok := c.Crawler.Parsers[name]; ok {
+		panic("Parser " + name + " is already added")
+	}
 	c.Crawler.Parsers[name] = p
 	return c
 }
 
+// SetFallbackParser sets the parser of the requests whose parsers are not found, instead of
+// logging an error and dropping the responses. See Crawler.FallbackParser.
+func (c *CrawlerBuilder) SetFallbackParser(p middleware.Parser) *CrawlerBuilder {
+	c.Crawler.FallbackParser = p
+	return c
+}
+
+// The parser is referred by a component, like the FollowParser of a feed, it's checked by Build.
+func (c *CrawlerBuilder) referParser(name string, by string) {
+	if c.referred == nil {
+		c.referred = make(map[string]string)
+	}
+	c.referred[name] = by
+}
+
+// AddURLParser adds a parser of the requests without a ParserName, it parses the responses whose urls
+// match the regular expression. A redirected response is matched by the url it came from, the last hop. The patterns are matched in the order they are added.
+// It panics if the pattern is invalid, since the spider can't work without its parsers.
+func (c *CrawlerBuilder) AddURLParser(pattern string, p middleware.Parser) *CrawlerBuilder {
+	c.Crawler.URLParsers = append(c.Crawler.URLParsers, URLParser{Pattern: regexp.MustCompile(pattern), Parser: p})
+	return c
+}
+
+var statusBand = regexp.MustCompile(`^[1-5]([0-9]{2}|xx)$`)
+
+// AddStatusParser adds a parser of the responses of the requests with the ParserName name, whose status codes
+// match the status, which is a code like "404", or a band like "4xx" or "5xx". So the same request can be
+// scraped normally when it's 200, and reported as a dead link when it's 404. The responses handled by
+// a status parser are not dropped by the HttpErrorMiddleware, while the retried statuses, like 503,
+// still reach the parser after the retries. It panics if the status is invalid.
+func (c *CrawlerBuilder) AddStatusParser(name string, status string, p middleware.Parser) *CrawlerBuilder {
+	if !statusBand.MatchString(status) {
+		panic("Invalid status " + status + ", should be a code like 404 or a band like 4xx")
+	}
+	if c.Crawler.StatusParsers == nil {
+		c.Crawler.StatusParsers = make(map[string][]StatusParser)
+	}
+	c.Crawler.StatusParsers[name] = append(c.Crawler.StatusParsers[name], StatusParser{Status: status, Parser: p})
+	return c
+}
+
+// Log in with the form at loginURL before crawling, see middleware.FormLogin.
+func (c *CrawlerBuilder) AddFormLogin(loginURL string, fields map[string]string, sessionFile string) *CrawlerBuilder {
+	return c.AddDownloadMiddlewares(NewFormLogin(loginURL, fields, sessionFile))
+}
+
+// AddErrback adds the errback named name. It panics if there's already an errback of the name.
+func (c *CrawlerBuilder) AddErrback(name string, e middleware.Errback) *CrawlerBuilder {
+	if _, ok := c.Crawler.Errbacks[name]; ok {
+		panic("Errback " + name + " is already added")
+	}
+	c.Crawler.Errbacks[name] = e
+	return c
+}
+
 func (c *CrawlerBuilder) AddItemPipelines(ps ...middleware.ItemPipeline) *CrawlerBuilder {
 	for _, p := range ps {
 		c.addYielder(p)
@@ -99,6 +398,51 @@ func (c *CrawlerBuilder) AddItemPipelines(ps ...middleware.ItemPipeline) *Crawle
 	return c
 }
 
+// The consumers implementing OpenClose are also opened and closed with the spider.
+func (c *CrawlerBuilder) AddResponseConsumers(cs ...middleware.ResponseConsumer) *CrawlerBuilder {
+	for _, consumer := range cs {
+		c.addYielder(consumer)
+		if oc, ok := consumer.(middleware.OpenClose); ok {
+			c.AddOpenCloses(oc)
+		}
+		c.Crawler.Consumers = append(c.Crawler.Consumers, consumer)
+	}
+	return c
+}
+
+func (c *CrawlerBuilder) OnItemDropped(f ItemDropHandler) *CrawlerBuilder {
+	c.Crawler.OnItemDropped = f
+	return c
+}
+
+// Post the final status to the url when the spider closes, see SummaryWebhook.
+func (c *CrawlerBuilder) AddSummaryWebhook(url string) *CrawlerBuilder {
+	return c.AddOpenCloses(&SummaryWebhook{
+		Logger:         log.New("SummaryWebhook"),
+		StatusInfo:     &c.Crawler.StatusInfo,
+		URL:            url,
+		MinItems:       SummaryMinItems,
+		MinSucceedRate: SummaryMinSucceedRate,
+		Timeout:        time.Duration(SummaryTimeout*1000) * time.Millisecond,
+	})
+}
+
+// Serve the control API on addr, like "localhost:6023", see ControlServer.
+func (c *CrawlerBuilder) AddControlServer(addr string) *CrawlerBuilder {
+	return c.AddOpenCloses(&ControlServer{
+		Logger:  log.New("ControlServer"),
+		Crawler: c.Crawler,
+		Addr:    addr,
+	})
+}
+
+// AddWARCWriter records the http exchanges of the downloader by the writer, see middleware.WARCWriter.
+// The downloader must be a DefaultDownloader when the crawler is built.
+func (c *CrawlerBuilder) AddWARCWriter(w *middleware.WARCWriter) *CrawlerBuilder {
+	c.warc = w
+	return c.AddOpenCloses(w)
+}
+
 func (c *CrawlerBuilder) AddOpenCloses(ms ...middleware.OpenClose) *CrawlerBuilder {
 	for _, m := range ms {
 		c.Crawler.OpenCloses = append(c.Crawler.OpenCloses, m)
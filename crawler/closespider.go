@@ -0,0 +1,76 @@
+package crawler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// CloseSpider stops the spider when one of the conditions is met, so the unattended crawls
+// stop themselves instead of running forever. It stops the spider like the user interrupt,
+// the new requests are refused and the running ones complete.
+// The conditions are checked every second, so the counts may go a little beyond the limits.
+// 0 means no limitation.
+type CloseSpider struct {
+	Logger     log.Logger
+	StatusInfo *StatusInfo
+
+	// The number of the crawled pages, the yielded items, and the errors.
+	PageCount  int
+	ItemCount  int
+	ErrorCount int
+
+	// The max running time of the spider.
+	Duration time.Duration
+
+	closed chan bool
+}
+
+func (c *CloseSpider) Open(spider *leiogo.Spider) error {
+	c.closed = make(chan bool)
+	start := time.Now()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if reason, outcome := c.check(start); reason != "" && !c.StatusInfo.IsInterrupt() {
+					c.Logger.Info(spider.Name, "Closing spider, %s", reason)
+					c.StatusInfo.StopWith(reason, outcome)
+				}
+			case <-c.closed:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+func (c *CloseSpider) Close(reason string, spider *leiogo.Spider) error {
+	close(c.closed)
+	return nil
+}
+
+// Return the reason if a condition is met, the crawl fails if it's closed by the errors.
+func (c *CloseSpider) check(start time.Time) (string, Outcome) {
+	s := c.StatusInfo
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case c.PageCount > 0 && s.Crawled >= c.PageCount:
+		return fmt.Sprintf("Closed by page count %d", c.PageCount), OutcomeCompleted
+	case c.ItemCount > 0 && s.Items >= c.ItemCount:
+		return fmt.Sprintf("Closed by item count %d", c.ItemCount), OutcomeCompleted
+	case c.ErrorCount > 0 && s.Errors >= c.ErrorCount:
+		return fmt.Sprintf("Closed by error count %d", c.ErrorCount), OutcomeFailed
+	case c.Duration > 0 && time.Since(start) >= c.Duration:
+		return fmt.Sprintf("Closed by duration %s", util.FormatDuration(c.Duration)), OutcomeCompleted
+	}
+	return "", ""
+}
@@ -0,0 +1,188 @@
+package crawler
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// Pass the response to the consumers in background. The body is shared, and a stream is teed to the consumers
+// while the parser reads it. The errors and the panics of a consumer are logged, they never affect the parser
+// or the other consumers.
+func (c *Crawler) fanOut(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	if len(c.Consumers) == 0 {
+		return
+	}
+
+	var tee *teeStream
+	if res.Stream != nil {
+		tee = &teeStream{ReadCloser: res.Stream}
+		res.Stream = tee
+	}
+
+	for _, consumer := range c.Consumers {
+		copied := *res
+		var reader *consumerStream
+		if tee != nil {
+			reader = newConsumerStream(c.ConsumerBuffer)
+			tee.writers = append(tee.writers, reader)
+			copied.Stream = reader
+		}
+
+		c.addWork()
+		go func(consumer middleware.ResponseConsumer, res *leiogo.Response, reader *consumerStream) {
+			defer c.doneWork()
+			var err error
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic, %v", r)
+				}
+				if err != nil {
+					c.Logger.Error(req.LogContext(spider), "Consumer %T failed on %s, %s", consumer, req.URL, err)
+				}
+				// The tee stops writing to a consumer once its reader is closed.
+				if reader != nil {
+					reader.Close()
+				}
+			}()
+			err = consumer.Consume(res, req, spider)
+		}(consumer, &copied, reader)
+	}
+}
+
+// teeStream copies the stream to the consumers when the parser reads it.
+// The consumers still get the rest of the stream if the parser closes it early.
+type teeStream struct {
+	io.ReadCloser
+	writers []*consumerStream
+	once    sync.Once
+}
+
+func (t *teeStream) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		for i, w := range t.writers {
+			if w == nil {
+				continue
+			}
+			if _, werr := w.Write(p[:n]); werr != nil {
+				t.writers[i] = nil
+			}
+		}
+	}
+	if err != nil {
+		t.closeWriters(err)
+	}
+	return n, err
+}
+
+func (t *teeStream) closeWriters(err error) {
+	t.once.Do(func() {
+		if err == io.EOF {
+			err = nil
+		}
+		for _, w := range t.writers {
+			if w != nil {
+				w.CloseWithError(err)
+			}
+		}
+	})
+}
+
+func (t *teeStream) Close() error {
+	for _, w := range t.writers {
+		if w != nil {
+			io.Copy(ioutil.Discard, t)
+			break
+		}
+	}
+	t.closeWriters(io.ErrUnexpectedEOF)
+	return t.ReadCloser.Close()
+}
+
+var errSlowConsumer = errors.New("Consumer falls behind the stream too far")
+
+// consumerStream is the stream of a consumer. The tee writes to it without blocking, and the consumer reads
+// from it at its own pace. A consumer falling behind by more than max bytes gets errSlowConsumer, and the tee
+// stops writing to it, so the slowest consumer never blocks the parser. 0 means no limitation.
+type consumerStream struct {
+	buf    bytes.Buffer
+	max    int
+	err    error
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func newConsumerStream(max int) *consumerStream {
+	s := &consumerStream{max: max}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (s *consumerStream) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.err != nil {
+		return 0, s.err
+	}
+	if s.max > 0 && s.buf.Len()+len(p) > s.max {
+		s.buf.Reset()
+		s.err = errSlowConsumer
+		s.cond.Broadcast()
+		return 0, s.err
+	}
+	s.buf.Write(p)
+	s.cond.Broadcast()
+	return len(p), nil
+}
+
+// CloseWithError ends the stream, the consumer gets the err after reading the buffered bytes, EOF if it's nil.
+func (s *consumerStream) CloseWithError(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err == nil {
+		err = io.EOF
+	}
+	if s.err == nil {
+		s.err = err
+	}
+	s.cond.Broadcast()
+}
+
+func (s *consumerStream) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.buf.Len() == 0 && s.err == nil && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return 0, io.ErrClosedPipe
+	}
+	if s.buf.Len() > 0 {
+		return s.buf.Read(p)
+	}
+	return 0, s.err
+}
+
+func (s *consumerStream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.closed = true
+	s.buf.Reset()
+	s.cond.Broadcast()
+	return nil
+}
@@ -1,10 +1,16 @@
 package crawler
 
 import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"time"
+
 	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo-css/selector"
 	"github.com/SteveZhangBit/leiogo/log"
 	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
 )
 
 var (
@@ -18,11 +24,354 @@ var (
 	UserAgent          = ""
 	FileSaveDir        = "./files"
 
+	// The max concurrent requests to each host, so a slow site can't take all the ConcurrentRequests.
+	// 0 means no limitation, the hosts may override it, see HostSettings.
+	ConcurrentRequestsPerDomain = 0
+
+	// The max requests the crawler downloads per minute, to all the hosts. 0 means no limitation.
+	// Unlike the DownloadDelay, it limits the aggregate rate of the crawl, see RateLimiter.
+	MaxRequestsPerMinute = 0
+
+	// The spider stops itself after crawling CloseOnPageCount pages, yielding CloseOnItemCount items,
+	// meeting CloseOnErrorCount errors, or running for CloseOnDuration seconds. 0 means no limitation.
+	CloseOnPageCount  = 0
+	CloseOnItemCount  = 0
+	CloseOnErrorCount = 0
+	CloseOnDuration   = 0.0
+
+	// The connection pool and the protocol of the downloaders, 0 means the default of net/http,
+	// see middleware.TransportConfig. HTTPVersion is "1.1", "2", or empty for the default.
+	MaxIdleConns        = 100
+	MaxIdleConnsPerHost = 32
+	MaxConnsPerHost     = 0
+	DisableKeepAlives   = false
+	HTTPVersion         = ""
+
+	// The max redirects the downloader follows for a request, the requests may change it
+	// with 'maxredirects' in the meta, or forbid the redirects with 'dontredirect'.
+	MaxRedirects = 10
+
+	// The max size of a page in bytes, the larger pages are dropped. 0 means no limitation.
+	MaxResponseSize int64 = 1 << 30
+
+	// The seed of the random generators, like the randomized delay. With the same seed,
+	// the crawls behave the same, which helps in testing and debugging. 0 means a random seed.
+	RandomSeed int64 = 0
+
+	// The hash function of the file names, the fingerprints and the dedup keys, one of
+	// "md5", "sha1", "sha256" and "xxhash". See util.Hashers.
+	Hasher = "md5"
+
+	// The OffSiteMiddleware allows the subdomains of the allowed domains if OffSiteSubdomains is true,
+	// and all the hosts of the same registrable domain if OffSiteRegistrableDomain is true.
+	// The hosts matching OffSiteDeniedDomains are always dropped.
+	OffSiteSubdomains        = true
+	OffSiteRegistrableDomain = false
+	OffSiteDeniedDomains     = []string{}
+
+	// Besides the download errors, the responses with RetryStatuses are also retried. A retried request
+	// waits for RetryBackoffBase * 2^(retry-1) seconds with a jitter, or the Retry-After header,
+	// but never more than RetryBackoffMax seconds.
+	RetryStatuses    = []int{429, 500, 502, 503}
+	RetryBackoffBase = 1.0
+	RetryBackoffMax  = 60.0
+
+	// If RetryBudget is not 0, the retries to a host are limited to RetryBudget of the requests to the host,
+	// plus RetryBudgetMin. See RetryMiddleware for more information.
+	RetryBudget    = 0.0
+	RetryBudgetMin = 10
+
+	// The quotas of the tenants, and the usages shared by all the crawlers in the process.
+	// Set the quotas by TenantQuotas[tenant] = quota, since Tenants holds the map.
+	// See TenantQuotaMiddleware in middleware package.
+	TenantQuotas = map[string]middleware.Quota{}
+	Tenants      = middleware.NewTenants(TenantQuotas)
+
+	// Override the settings for the hosts matching the patterns, see HostSettings in middleware package.
+	HostSettings = middleware.HostSettings{}
+
+	// The number of items written in a transaction by the SQL pipeline. A row failing for more than
+	// SQLMaxRetries times is dropped, and at most SQLMaxBuffered rows are kept while the database fails.
+	SQLBatchSize   = 100
+	SQLMaxRetries  = 3
+	SQLMaxBuffered = 10000
+
+	// The number of items in a bulk write of the Mongo pipeline.
+	MongoBatchSize = 100
+
+	// The number of messages in a batch of the Kafka pipeline.
+	KafkaBatchSize = 100
+
+	// The ES pipeline sends a bulk request for every ESBatchSize items, or every ESFlushInterval seconds,
+	// and retries a rejected bulk request for ESMaxRetries times.
+	ESBatchSize     = 500
+	ESFlushInterval = 5.0
+	ESMaxRetries    = 5
+
+	// The file Crawler.Run saves the result of the crawl to, as JSON, like "run-summary.json".
+	// Empty means not to save it, which is the default.
+	RunSummaryFile = ""
+
+	// The ID of the run, empty means a new one is generated when the spider starts.
+	// If RunIDField is not empty, the ID is added to every item in that field.
+	RunID      = ""
+	RunIDField = ""
+
+	// The directory to save the crawl state, so the crawl can be resumed by the next run.
+	// Empty means the state won't be saved.
+	JobDir = ""
+
+	// Retried requests get their priority increased by RetryPriorityAdjust, so they are
+	// crawled before the newly discovered links. And new requests get depth * DepthPriority.
+	RetryPriorityAdjust = 1
+	DepthPriority       = 0
+
+	// Settings of the AutoThrottleMiddleware, which adjusts the delay by the download latency.
+	// The min delay is DownloadDelay.
+	AutoThrottleStartDelay        = 5.0
+	AutoThrottleMaxDelay          = 60.0
+	AutoThrottleTargetConcurrency = 1.0
+
+	// If AutoScaleEnabled is true, the concurrent requests will start from ConcurrentRequests,
+	// and be adjusted between AutoScaleMin and AutoScaleMax every AutoScaleInterval seconds,
+	// by comparing the average latency and the error rate with the targets.
+	AutoScaleEnabled       = false
+	AutoScaleMin           = 4
+	AutoScaleMax           = 128
+	AutoScaleInterval      = 10.0
+	AutoScaleTargetLatency = 2.0
+	AutoScaleMaxErrorRate  = 0.1
+
+	// Parsers running longer than ParserSlowThreshold seconds will be reported,
+	// and the crawler stops waiting for a parser after ParserTimeout seconds, and cancels the context
+	// of the response, see leiogo.Response.Context. 0 means no limitation.
+	ParserTimeout       = 0.0
+	ParserSlowThreshold = 10.0
+
+	// A consumer of the streams may fall behind the parser by ConsumerBufferSize bytes,
+	// then its stream fails, so the parser never waits for a slow consumer.
+	ConsumerBufferSize = 4 << 20
+
+	// The archive middleware submits a page every ArchiveInterval seconds,
+	// and retries a page for ArchiveMaxRetries times when the service is busy.
+	ArchiveInterval   = 5.0
+	ArchiveMaxRetries = 3
+
+	// The summary webhook reports a failed crawl if it yields less than SummaryMinItems items,
+	// or less than SummaryMinSucceedRate of the pages succeed. 0 means no limitation.
+	SummaryMinItems       = 0
+	SummaryMinSucceedRate = 0.0
+
+	// The summary webhook gives up the post after SummaryTimeout seconds.
+	SummaryTimeout = 30.0
+
+	// The max times the access gate middleware tries to unlock a gated request.
+	AccessGateMaxUnlocks = 1
+
 	// When we want to change the default file writer in downloader,
-	// we simply change this value.
-	DownloaderFileWriter middleware.FileWriter = &middleware.FSWriter{}
+	// we simply change this value. The FSWriter resumes the failed downloads with Range requests.
+	DownloaderFileWriter middleware.FileWriter = &middleware.FSWriter{Resume: true}
+
+	// The downloader retries a failed write of a file for FileWriteRetries times, and then writes it
+	// with the FallbackFileWriter if it's not nil. Either of them makes the files to be downloaded into temporary files,
+	// and the writes are retried with the requests rescheduled by the RetryMiddleware.
+	FileWriteRetries                         = 0
+	FallbackFileWriter middleware.FileWriter = nil
+
+	// If ManifestFile is not empty, the saved files are recorded in it, see middleware.Manifest.
+	// With VerifyManifest, the crawl re-downloads the missing or corrupt files of the manifest
+	// instead of starting from the start urls.
+	ManifestFile   = ""
+	VerifyManifest = false
+
+	// If WARCDir is not empty, the http exchanges are recorded into the WARC files in it, named by WARCPrefix.
+	// A new file is started after WARCMaxSize bytes, and the bodies are truncated after WARCMaxBody bytes,
+	// 0 means no limitation. See middleware.WARCWriter.
+	WARCDir     = ""
+	WARCPrefix  = "leiogo"
+	WARCMaxSize = int64(1 << 30)
+	WARCMaxBody = int64(64 << 20)
+
+	// With HttpCacheEnabled, the builder adds the HttpCacheMiddleware, the pages are cached in HttpCacheDir,
+	// and answered from the cache later. The policy is either "ttl" or "rfc7234",
+	// and the ttl is in seconds, 0 means never expires.
+	// A non-zero HttpCacheSnapshot travels back in time, every page is answered as it was cached by then,
+	// and the pages not cached are never downloaded, see middleware.CacheDownloader.
+	// HttpCacheStorage replaces the files in HttpCacheDir with a shared storage, like redis.CacheStorage,
+	// so the workers of a fleet share one cache. The pages of a tenant are cached apart from the others,
+	// in HttpCacheDir/tenant with the files.
+	HttpCacheEnabled  = false
+	HttpCacheDir      = "./httpcache"
+	HttpCachePolicy   = middleware.CachePolicyTTL
+	HttpCacheTTL      = 0.0
+	HttpCacheSnapshot time.Time
+	HttpCacheStorage  middleware.HttpCacheStorage
+
+	// FixtureMode is "record" to record the responses into FixtureDir, or "replay" to answer the requests
+	// only from the recorded ones, empty means neither. See middleware.FixtureDownloader.
+	FixtureMode = ""
+	FixtureDir  = "./fixtures"
+
+	// The block detector climbs the mitigation ladder for a host, when BlockThreshold of its last
+	// BlockWindow responses look blocked. See middleware.BlockDetectorMiddleware.
+	BlockWindow          = 20
+	BlockThreshold       = 0.5
+	BlockStatuses        = []int{403, 429}
+	BlockCaptchaMarkers  = []string{"captcha", "are you a robot", "unusual traffic"}
+	BlockRedirectMarkers = []string{"captcha", "challenge", "blocked", "denied"}
+	BlockSlowDelay       = 10.0
+	BlockUserAgents      = []string{}
+	BlockProxies         = []string{}
+	BlockPauseDuration   = 600.0
+	BlockCalmResponses   = 50
+
+	// The cookie jar shared by the downloaders, the CookiesMiddleware and the FormLogin,
+	// so the pages are crawled in the session. The jar is exported to CookiesFile if it's not empty.
+	CookieJar   = middleware.NewCookieJar()
+	CookiesFile = ""
+
+	// With TrapDetectorEnabled, the builder adds the TrapDetectorMiddleware, which stops following the url families
+	// yielding less than TrapMinYield new urls per page, see middleware.TrapDetectorMiddleware.
+	// The urls matching TrapDenyRules, the regular expressions reported for the traps, are always dropped.
+	TrapDetectorEnabled = false
+	TrapMinPages        = 200
+	TrapMinYield        = 0.05
+	TrapCalendarPages   = 24
+	TrapMaxQueryKeySets = 32
+	TrapMaxSessionIDs   = 3
+	TrapDenyRules       = []string{}
+
+	// If URLRewriteRules is not empty, the builder adds the URLRewriteMiddleware, which rewrites the urls
+	// of the new requests by the rules before they are scheduled and deduplicated, like removing the session ids
+	// in the paths with middleware.SessionIDRewriteRules.
+	URLRewriteRules = []middleware.RewriteRule{}
+
+	// The link checker checks the external links if LinkCheckExternal, and checks the links which are not crawled
+	// by HEAD requests if LinkCheckHEAD. The broken links are saved to LinkCheckReport. See LinkChecker.
+	LinkCheckExternal = true
+	LinkCheckHEAD     = true
+	LinkCheckReport   = "./broken-links.json"
+
+	// The search index pipeline indexes the pages in batches of SearchIndexBatchSize, and tries the pages
+	// of a failed batch again with the next batches for SearchIndexMaxRetries times.
+	SearchIndexBatchSize  = 100
+	SearchIndexMaxRetries = 3
+
+	// The lookups of the parsers are retried for LookupRetryTimes on the download errors and the 5xx responses,
+	// and the latest LookupCacheSize lookups are remembered, see Crawler.Lookup.
+	LookupRetryTimes = 2
+	LookupCacheSize  = 1000
+
+	// With RerenderEmptyPages, the html pages yielding nothing are requested again with phantomjs, once.
+	RerenderEmptyPages = false
+
+	// The politeness report of the hosts is saved to PolitenessFile when the spider closes,
+	// empty means it's only logged.
+	PolitenessFile = ""
+
+	// With FileContentNames, the files are named by the SHA-256 of their contents, see FilePipeline.ContentNames.
+	// With FileItemsEnabled, the crawler yields an item for every saved file, with its url, path, size and SHA-256,
+	// so the pipelines can keep the mapping from the urls to the files.
+	FileContentNames = false
+	FileItemsEnabled = false
+
+	// With ItemSampleSize, a random sample of the items is written to ItemSampleFile when the spider closes,
+	// or to the log if it's empty. The sample is taken after all the other pipelines, see SamplePipeline.
+	ItemSampleSize = 0
+	ItemSampleFile = ""
+
+	// The ImagesPipeline removes the images smaller than ImagesMinWidth x ImagesMinHeight,
+	// and saves the thumbnails with the JPEG quality ImagesThumbQuality, see NewImagesPipeline.
+	ImagesMinWidth     = 0
+	ImagesMinHeight    = 0
+	ImagesThumbQuality = 75
+
+	// With ChromeEnabled, the requests with 'render' = true in the meta are rendered by headless Chrome,
+	// which is ChromeExec, in up to ChromeBrowsers browsers with ChromeTabs tabs each. A page is done when
+	// the network has been idle for ChromeIdleTime seconds, and fails after ChromeTimeout seconds.
+	// A message from Chrome larger than ChromeMaxMessageSize bytes, like a huge DOM, fails the page.
+	// See middleware.ChromeDownloader.
+	ChromeEnabled  = false
+	ChromeExec     = "google-chrome"
+	ChromeBrowsers = 1
+	ChromeTabs     = 4
+	ChromeIdleTime = 0.5
+	ChromeTimeout  = 30.0
+
+	ChromeMaxMessageSize = 32 << 20
+
+	// If BodyStoreDir is not empty, the bodies of the HTTP cache and the WARC records are stored once
+	// by their contents in it, however many urls serve them. BodyStore replaces the files with another store.
+	// See middleware.BodyStore.
+	BodyStoreDir = ""
+	BodyStore    middleware.BodyStore
+
+	// If SitemapFile is not empty, the pages crawled successfully are written to it when the spider closes,
+	// as a sitemap if SitemapFormat is "xml", or a list of the urls and their lastmod if it's "txt".
+	// SitemapBaseURL is where the split sitemaps are served, see middleware.SitemapMiddleware.
+	SitemapFile    = ""
+	SitemapFormat  = middleware.SitemapXML
+	SitemapBaseURL = ""
+
+	// If ScreenshotDir is not empty, the screenshots of the rendered pages with 'screenshot' = true in the meta
+	// are saved in it by the DownloaderFileWriter, see middleware.ScreenshotMiddleware.
+	ScreenshotDir = ""
+
+	// The pages with 'phantomjs' = true in the meta are rendered by up to PhantomWorkers long-lived phantomjs,
+	// 0 means a new phantomjs for every page, which is the default, since the workers need the worker mode
+	// of download.js. A worker is restarted if it takes longer than PhantomTimeout seconds for a page,
+	// or fails the health check every PhantomHealthInterval seconds. See middleware.PhantomPool.
+	PhantomWorkers        = 0
+	PhantomTimeout        = 60.0
+	PhantomHealthInterval = 30.0
+
+	// If SEOReportFile is not empty, the builder adds the SEOAuditMiddleware, and the SEO report of the pages
+	// is saved to it when the spider closes. The titles and the meta descriptions out of the lengths are issues,
+	// 0 means no limitation. See middleware.SEOAuditMiddleware.
+	SEOReportFile           = ""
+	SEOTitleMinLength       = 30
+	SEOTitleMaxLength       = 60
+	SEODescriptionMinLength = 70
+	SEODescriptionMaxLength = 160
+
+	// The order of the default scheduler, "priority" pops the requests with higher Priority first,
+	// "fifo" crawls breadth-first and "lifo" crawls depth-first, both ignoring the priorities.
+	// Replace the scheduler by SetScheduler of the builder, like a redis.Scheduler.
+	SchedulerOrder = middleware.SchedulePriority
+
+	// If SchedulerDir is not empty, the default scheduler spills the queue to the segment files in it,
+	// so the queue is bounded by the disk instead of the memory. It only supports the "priority" and
+	// the "fifo" orders. See middleware.DiskScheduler.
+	SchedulerDir         = ""
+	SchedulerSegmentSize = middleware.DefaultSegmentSize
+
+	// If SchedulerClasses is not empty, the requests are queued by their traffic classes, the 'class' meta,
+	// and the classes are dispatched in proportion to their weights here, 1 for the ones not here.
+	// Each class has its own queue in the SchedulerOrder, in a sub directory of SchedulerDir if it's set.
+	// See middleware.ClassScheduler.
+	SchedulerClasses = map[string]int{}
+
+	// If DepthAdaptivePages is larger than 0, the DepthMiddleware stops deepening a branch of the site,
+	// the host and the first DepthBranchSegments segments of the path, when its pages at DepthPatience depths
+	// in a row yield at most DepthAdaptiveYield items per page, counted after DepthAdaptivePages pages at each depth.
+	DepthAdaptivePages  = 0
+	DepthAdaptiveYield  = 0.0
+	DepthPatience       = 2
+	DepthBranchSegments = 1
+
+	// With StrictCompliance, the crawl follows the strict compliance profile. The builder adds the ComplianceMiddleware
+	// and the RobotsMetaMiddleware, so robots.txt and the noindex and nofollow directives are followed, and the requests
+	// are sent with the UserAgent and the From header of ComplianceFrom, the contact of the operator. The requests
+	// per minute are capped by ComplianceMaxRequestsPerMinute. The crawler refuses to start if the UserAgent or
+	// ComplianceFrom is empty, a host overrides the UserAgent, or a component has stealth features,
+	// like the user agent rotation of the block detector, see middleware.StealthComponent.
+	StrictCompliance               = false
+	ComplianceFrom                 = ""
+	ComplianceMaxRequestsPerMinute = 60
 )
 
+const WaybackEndpoint = "https://web.archive.org/save/"
+
 type PatternFunc func(el *selector.Elements) []interface{}
 
 type DefaultParser struct {
@@ -30,71 +379,309 @@ type DefaultParser struct {
 }
 
 func (d *DefaultParser) RunPattern(patterns map[string]PatternFunc, res *leiogo.Response, spider *leiogo.Spider) {
-	doc := selector.Parse(string(res.Body))
+	// There's no need to parse the body if there's no pattern at all.
+	if len(patterns) == 0 {
+		return
+	}
+
+	// The document is shared with other patterns running on the same response, see DocumentPool.
+	doc := d.Documents.Get(res)
 	if doc.Err != nil {
-		d.Logger.Error(spider.Name, "Error at parsing response body, %s", doc.Err)
+		d.Logger.Error(res.LogContext(spider), "Error at parsing response body, %s", doc.Err)
 		return
 	}
 
 	for key, f := range patterns {
+		// The parser has timed out, see ParserTimeout.
+		if res.Context().Err() != nil {
+			return
+		}
 		var el *selector.Elements
 
 		// Sometimes, we can define an empty pattern, meaning that it should not do any css selection
 		if key != "" {
 			if el = doc.Find(key); el.Err != nil {
-				d.Logger.Error(spider.Name, "Error at querying %s, %s", key, el.Err)
+				d.Logger.Error(res.LogContext(spider), "Error at querying %s, %s", key, el.Err)
 				continue
 			}
 		} else {
 			el = doc
 		}
 
-		products := f(el)
-		// If there's nothing produced by this pattern, make a warning to the user
-		// that the pattern may be invalid.
-		if len(products) == 0 {
-			d.Logger.Fatal(spider.Name, "Nothing produced by pattern '%s' for %s, check if it's still valid!", key, res.URL)
+		d.yield(key, f(el), res, spider)
+	}
+}
+
+// JSONPatternFunc is the pattern function of a JSON response, the value is at the path of its key.
+type JSONPatternFunc func(data *util.JSON) []interface{}
+
+// RunJSONPattern is RunPattern for the JSON APIs. The body is decoded once, the key of a pattern
+// is a path of util.JSONPath, and empty means the whole document.
+func (d *DefaultParser) RunJSONPattern(patterns map[string]JSONPatternFunc, res *leiogo.Response, spider *leiogo.Spider) {
+	if len(patterns) == 0 {
+		return
+	}
+
+	var data interface{}
+	var err error
+	if res.Stream != nil {
+		err = json.NewDecoder(res.Stream).Decode(&data)
+	} else {
+		err = json.Unmarshal(res.Body, &data)
+	}
+	if err != nil {
+		d.Logger.Error(res.LogContext(spider), "Error at decoding JSON of %s, %s", res.URL, err)
+		return
+	}
+
+	for key, f := range patterns {
+		if res.Context().Err() != nil {
+			return
+		}
+		doc := &util.JSON{Value: data}
+		if key != "" {
+			if doc = doc.Get(key); doc == nil {
+				d.Logger.Error(res.LogContext(spider), "Nothing at path '%s' for %s", key, res.URL)
+				continue
+			}
 		}
+		d.yield(key, f(doc), res, spider)
+	}
+}
 
-		for _, val := range products {
-			switch x := val.(type) {
-			case *leiogo.Item:
-				// Somtimes user may produce a file download item, but there's nothing in it,
-				// because of the invalidation of the pattern.
-				if us, ok := x.Data["fileurls"]; ok && len(us.([]string)) == 0 {
-					d.Logger.Fatal(spider.Name, "Nothing in the item by pattern '%s' for %s, check if it's still valid!", key, res.URL)
-				}
-				d.NewItem(x, spider)
-			case *leiogo.Request:
-				d.NewRequest(x, res, spider)
-			default:
-				d.Logger.Error(spider.Name, "Unknown return type for patter function %T", x)
+// Add the items and the requests produced by the pattern.
+func (d *DefaultParser) yield(key string, products []interface{}, res *leiogo.Response, spider *leiogo.Spider) {
+	// If there's nothing produced by this pattern, make a warning to the user
+	// that the pattern may be invalid.
+	if len(products) == 0 {
+		d.Logger.Fatal(res.LogContext(spider), "Nothing produced by pattern '%s' for %s, check if it's still valid!", key, res.URL)
+	}
+
+	for _, val := range products {
+		switch x := val.(type) {
+		case *leiogo.Item:
+			// Somtimes user may produce a file download item, but there's nothing in it,
+			// because of the invalidation of the pattern.
+			if us, ok := x.Data["fileurls"]; ok && len(us.([]string)) == 0 {
+				d.Logger.Fatal(res.LogContext(spider), "Nothing in the item by pattern '%s' for %s, check if it's still valid!", key, res.URL)
 			}
+			d.NewPageItem(x, res, spider)
+		case *leiogo.Request:
+			d.NewRequest(x, res, spider)
+		default:
+			d.Logger.Error(res.LogContext(spider), "Unknown return type for patter function %T", x)
 		}
 	}
 }
 
+func transportConfig() middleware.TransportConfig {
+	return middleware.TransportConfig{
+		MaxIdleConns:        MaxIdleConns,
+		MaxIdleConnsPerHost: MaxIdleConnsPerHost,
+		MaxConnsPerHost:     MaxConnsPerHost,
+		DisableKeepAlives:   DisableKeepAlives,
+		HTTPVersion:         HTTPVersion,
+	}
+}
+
 func NewDownloader() middleware.Downloader {
 	return &middleware.DefaultDownloader{
 		Logger:       log.New("Downloader"),
-		ClientConfig: &middleware.DefaultConfig{Timeout: Timeout},
+		ClientConfig: &middleware.DefaultConfig{Timeout: Timeout, Jar: CookieJar, Transport: transportConfig()},
 		UserAgent:    UserAgent,
-		FileWriter:   DownloaderFileWriter,
+		FileWriter:   newFileWriter(DownloaderFileWriter),
+		HostSettings: HostSettings,
+
+		MaxRedirects:    MaxRedirects,
+		MaxResponseSize: MaxResponseSize,
+		WriteRetries:    FileWriteRetries,
+		FallbackWriter:  newFileWriter(FallbackFileWriter),
+		Phantom:         newPhantomPool(),
+		Tenants:         Tenants,
 	}
 }
 
 func NewProxyDownloader(url string) middleware.Downloader {
 	return &middleware.DefaultDownloader{
 		Logger:       log.New("ProxyDownloader"),
-		ClientConfig: &middleware.ProxyConfig{Timeout: Timeout, ProxyURL: url},
+		ClientConfig: &middleware.ProxyConfig{Timeout: Timeout, ProxyURL: url, Jar: CookieJar, Transport: transportConfig()},
 		UserAgent:    UserAgent,
-		FileWriter:   DownloaderFileWriter,
+		FileWriter:   newFileWriter(DownloaderFileWriter),
+		HostSettings: HostSettings,
+
+		MaxRedirects:    MaxRedirects,
+		MaxResponseSize: MaxResponseSize,
+		WriteRetries:    FileWriteRetries,
+		FallbackWriter:  newFileWriter(FallbackFileWriter),
+		Phantom:         newPhantomPool(),
+		Tenants:         Tenants,
+	}
+}
+
+// The workers of phantomjs, nil if PhantomWorkers is 0.
+func newPhantomPool() *middleware.PhantomPool {
+	if PhantomWorkers <= 0 {
+		return nil
+	}
+	return &middleware.PhantomPool{
+		Logger:         log.New("PhantomPool"),
+		Exec:           "phantomjs",
+		Script:         "download.js",
+		Size:           PhantomWorkers,
+		Timeout:        time.Duration(PhantomTimeout*1000) * time.Millisecond,
+		HealthInterval: time.Duration(PhantomHealthInterval*1000) * time.Millisecond,
+	}
+}
+
+// The storage of the HTTP cache, the HttpCacheStorage or the files in HttpCacheDir,
+// with the bodies in the body store if there's one.
+func httpCacheStorage() middleware.HttpCacheStorage {
+	var storage middleware.HttpCacheStorage = &middleware.FSCacheStorage{Dir: HttpCacheDir}
+	if HttpCacheStorage != nil {
+		storage = HttpCacheStorage
+	}
+	if bodies := bodyStore(); bodies != nil {
+		return &middleware.DedupCacheStorage{HttpCacheStorage: storage, Bodies: bodies}
+	}
+	return storage
+}
+
+// The BodyStore or the files in BodyStoreDir, nil if neither is set.
+func bodyStore() middleware.BodyStore {
+	if BodyStore != nil {
+		return BodyStore
+	}
+	if BodyStoreDir != "" {
+		return &middleware.FSBodyStore{Dir: BodyStoreDir}
+	}
+	return nil
+}
+
+// Wrap the downloader with the HTTP cache, see middleware.CacheDownloader.
+func NewCacheDownloader(d middleware.Downloader) middleware.Downloader {
+	return &middleware.CacheDownloader{
+		Downloader: d,
+		Logger:     log.New("CacheDownloader"),
+		Storage:    httpCacheStorage(),
+		Snapshot:   HttpCacheSnapshot,
+	}
+}
+
+// Wrap the downloader to render the pages with headless Chrome, see middleware.ChromeDownloader.
+func NewChromeDownloader(d middleware.Downloader) *middleware.ChromeDownloader {
+	return &middleware.ChromeDownloader{
+		Downloader: d,
+		Logger:     log.New("ChromeDownloader"),
+		Exec:       ChromeExec,
+		Browsers:   ChromeBrowsers,
+		Tabs:       ChromeTabs,
+		IdleTime:   time.Duration(ChromeIdleTime*1000) * time.Millisecond,
+		Timeout:    time.Duration(ChromeTimeout*1000) * time.Millisecond,
+		Tenants:    Tenants,
+
+		MaxMessageSize: ChromeMaxMessageSize,
+	}
+}
+
+// Wrap the downloader to record or replay the fixtures, see middleware.FixtureDownloader.
+func NewFixtureDownloader(d middleware.Downloader) middleware.Downloader {
+	return &middleware.FixtureDownloader{
+		Downloader: d,
+		Logger:     log.New("FixtureDownloader"),
+		Storage:    &middleware.FSCacheStorage{Dir: FixtureDir},
+		Mode:       FixtureMode,
+	}
+}
+
+func NewWARCWriter() *middleware.WARCWriter {
+	return &middleware.WARCWriter{
+		Base:    middleware.NewBasePipeline("WARCWriter"),
+		Dir:     WARCDir,
+		Prefix:  WARCPrefix,
+		MaxSize: WARCMaxSize,
+		MaxBody: WARCMaxBody,
+		Bodies:  bodyStore(),
+	}
+}
+
+func NewLinkChecker() *LinkChecker {
+	return &LinkChecker{
+		Logger:   log.New("LinkChecker"),
+		External: LinkCheckExternal,
+		UseHEAD:  LinkCheckHEAD,
+		Report:   LinkCheckReport,
 	}
 }
 
+// The form login logs in when the spider opens, the session is saved to the sessionFile if it's not empty.
+func NewFormLogin(loginURL string, fields map[string]string, sessionFile string) *middleware.FormLogin {
+	return &middleware.FormLogin{
+		BaseMiddleware: middleware.NewBaseMiddleware("FormLogin"),
+		LoginURL:       loginURL,
+		Fields:         fields,
+		Jar:            CookieJar,
+		UserAgent:      UserAgent,
+		Timeout:        time.Duration(Timeout) * time.Second,
+		SessionFile:    sessionFile,
+	}
+}
+
+func NewScheduler() middleware.Scheduler {
+	// The queues of the classes are created by their first requests in the middle of the crawl,
+	// when the settings may have been changed for another spider, see Process, so they're taken now.
+	dir, segmentSize, order := SchedulerDir, SchedulerSegmentSize, SchedulerOrder
+	if len(SchedulerClasses) != 0 {
+		return middleware.NewClassScheduler(SchedulerClasses, func(class string) middleware.Scheduler {
+			// A disk queue which can't be created falls back to a queue in the memory.
+			s, err := newQueue(dir, segmentSize, order, class)
+			if err != nil {
+				log.New("ClassScheduler").Error("scheduler", "Create the disk queue of class %s failed, keep its requests in memory, %s", class, err)
+				return newMemoryQueue(order)
+			}
+			return s
+		})
+	}
+	s, err := newQueue(dir, segmentSize, order, "")
+	if err != nil {
+		panic(err.Error())
+	}
+	return s
+}
+
+// The queue of a traffic class, or of all the requests if the class is empty.
+func newQueue(dir string, segmentSize int, order string, class string) (middleware.Scheduler, error) {
+	if dir != "" {
+		if order != middleware.SchedulePriority && order != middleware.ScheduleFIFO {
+			panic("The disk scheduler doesn't support the scheduler order " + order)
+		}
+		s, err := middleware.NewDiskScheduler(filepath.Join(dir, class), segmentSize)
+		if err != nil {
+			return nil, err
+		}
+		s.IgnorePriority = order == middleware.ScheduleFIFO
+		return s, nil
+	}
+	return newMemoryQueue(order), nil
+}
+
+func newMemoryQueue(order string) middleware.Scheduler {
+	switch order {
+	case middleware.SchedulePriority:
+		return middleware.NewPriorityScheduler()
+	case middleware.ScheduleFIFO:
+		return middleware.NewFIFOScheduler()
+	case middleware.ScheduleLIFO:
+		return middleware.NewLIFOScheduler()
+	}
+	panic("Unknown scheduler order " + order)
+}
+
 func NewOffSiteMiddleware() middleware.DownloadMiddleware {
 	return &middleware.OffSiteMiddleware{
-		BaseMiddleware: middleware.NewBaseMiddleware("OffSiteMiddleware"),
+		BaseMiddleware:    middleware.NewBaseMiddleware("OffSiteMiddleware"),
+		Subdomains:        OffSiteSubdomains,
+		RegistrableDomain: OffSiteRegistrableDomain,
+		DeniedDomains:     OffSiteDeniedDomains,
 	}
 }
 
@@ -103,6 +690,26 @@ func NewDelayMiddleware() middleware.DownloadMiddleware {
 		BaseMiddleware: middleware.NewBaseMiddleware("DelayMiddleware"),
 		DownloadDelay:  DownloadDelay,
 		RandomizeDelay: RandomizeDelay,
+		Rand:           util.NewRand(RandomSeed, "DelayMiddleware"),
+		HostSettings:   HostSettings,
+	}
+}
+
+func NewAutoThrottleMiddleware() middleware.DownloadMiddleware {
+	return &middleware.AutoThrottleMiddleware{
+		BaseMiddleware:    middleware.NewBaseMiddleware("AutoThrottleMiddleware"),
+		StartDelay:        AutoThrottleStartDelay,
+		MinDelay:          DownloadDelay,
+		MaxDelay:          AutoThrottleMaxDelay,
+		TargetConcurrency: AutoThrottleTargetConcurrency,
+	}
+}
+
+func NewTenantQuotaMiddleware() middleware.DownloadMiddleware {
+	return &middleware.TenantQuotaMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("TenantQuotaMiddleware"),
+		Tenants:        Tenants,
+		HostSettings:   HostSettings,
 	}
 }
 
@@ -111,19 +718,70 @@ func NewRetryMiddleware() middleware.DownloadMiddleware {
 		BaseMiddleware: middleware.NewBaseMiddleware("RetryMiddleware"),
 		RetryEnabled:   RetryEnabled,
 		RetryTimes:     RetryTimes,
+		PriorityAdjust: RetryPriorityAdjust,
+		HostSettings:   HostSettings,
+		RetryBudget:    RetryBudget,
+		RetryBudgetMin: RetryBudgetMin,
+		RetryStatuses:  RetryStatuses,
+		BackoffBase:    RetryBackoffBase,
+		BackoffMax:     RetryBackoffMax,
+		Rand:           util.NewRand(RandomSeed, "RetryMiddleware"),
+	}
+}
+
+func NewBlockDetectorMiddleware() middleware.DownloadMiddleware {
+	return &middleware.BlockDetectorMiddleware{
+		BaseMiddleware:  middleware.NewBaseMiddleware("BlockDetectorMiddleware"),
+		Window:          BlockWindow,
+		Threshold:       BlockThreshold,
+		BlockStatuses:   BlockStatuses,
+		CaptchaMarkers:  BlockCaptchaMarkers,
+		RedirectMarkers: BlockRedirectMarkers,
+		SlowDelay:       time.Duration(BlockSlowDelay*1000) * time.Millisecond,
+		UserAgents:      BlockUserAgents,
+		Proxies:         BlockProxies,
+		PauseDuration:   time.Duration(BlockPauseDuration*1000) * time.Millisecond,
+		CalmResponses:   BlockCalmResponses,
+	}
+}
+
+func NewHttpCacheMiddleware() middleware.DownloadMiddleware {
+	return &middleware.HttpCacheMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("HttpCacheMiddleware"),
+		Storage:        httpCacheStorage(),
+		Policy:         HttpCachePolicy,
+		TTL:            time.Duration(HttpCacheTTL*1000) * time.Millisecond,
+	}
+}
+
+func NewCookiesMiddleware() middleware.DownloadMiddleware {
+	return &middleware.CookiesMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("CookiesMiddleware"),
+		Jar:            CookieJar,
+		File:           CookiesFile,
 	}
 }
 
 func NewCacheMiddleware() middleware.DownloadMiddleware {
 	return &middleware.CacheMiddleware{
 		BaseMiddleware: middleware.NewBaseMiddleware("CacheMiddleware"),
-		Cache:          make(map[string]struct{}),
+		DupeFilter:     middleware.NewMapDupeFilter(),
+	}
+}
+
+// The bloom cache middleware uses a fixed size of memory, which is good for the large crawls.
+// The capacity is the expected number of urls, and fpRate is the false positive rate.
+func NewBloomCacheMiddleware(capacity int, fpRate float64) middleware.DownloadMiddleware {
+	return &middleware.CacheMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("BloomCacheMiddleware"),
+		DupeFilter:     middleware.NewBloomDupeFilter(capacity, fpRate),
 	}
 }
 
 func NewHttpErrorMiddleware() middleware.SpiderMiddleware {
 	return &middleware.HttpErrorMiddleware{
 		BaseMiddleware: middleware.NewBaseMiddleware("HttpErrorMiddleware"),
+		HostSettings:   HostSettings,
 	}
 }
 
@@ -131,6 +789,46 @@ func NewDepthMiddleware() middleware.SpiderMiddleware {
 	return &middleware.DepthMiddleware{
 		BaseMiddleware: middleware.NewBaseMiddleware("DepthMiddleware"),
 		DepthLimit:     DepthLimit,
+		DepthPriority:  DepthPriority,
+		AdaptivePages:  DepthAdaptivePages,
+		AdaptiveYield:  DepthAdaptiveYield,
+		Patience:       DepthPatience,
+		BranchSegments: DepthBranchSegments,
+	}
+}
+
+func NewTrapDetectorMiddleware() middleware.SpiderMiddleware {
+	return &middleware.TrapDetectorMiddleware{
+		BaseMiddleware:  middleware.NewBaseMiddleware("TrapDetectorMiddleware"),
+		MinPages:        TrapMinPages,
+		MinYield:        TrapMinYield,
+		CalendarPages:   TrapCalendarPages,
+		MaxQueryKeySets: TrapMaxQueryKeySets,
+		MaxSessionIDs:   TrapMaxSessionIDs,
+		DenyRules:       TrapDenyRules,
+	}
+}
+
+func NewURLRewriteMiddleware() middleware.SpiderMiddleware {
+	return &middleware.URLRewriteMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("URLRewriteMiddleware"),
+		Rules:          URLRewriteRules,
+	}
+}
+
+func NewComplianceMiddleware() middleware.DownloadMiddleware {
+	return &middleware.ComplianceMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("ComplianceMiddleware"),
+		UserAgent:      UserAgent,
+		From:           ComplianceFrom,
+		Client:         &http.Client{Timeout: time.Duration(Timeout) * time.Second},
+	}
+}
+
+func NewRobotsMetaMiddleware() middleware.SpiderMiddleware {
+	return &middleware.RobotsMetaMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("RobotsMetaMiddleware"),
+		UserAgent:      UserAgent,
 	}
 }
 
@@ -140,11 +838,197 @@ func NewReferenceURLMiddleware() middleware.SpiderMiddleware {
 	}
 }
 
+// The archive middleware submits the crawled pages to the archive service, the page URL is appended
+// to the endpoint. Use WaybackEndpoint for the Wayback Machine.
+func NewArchiveMiddleware(endpoint string) middleware.SpiderMiddleware {
+	return &middleware.ArchiveMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("ArchiveMiddleware"),
+		Endpoint:       endpoint,
+		Interval:       time.Duration(ArchiveInterval*1000) * time.Millisecond,
+		MaxRetries:     ArchiveMaxRetries,
+	}
+}
+
 func NewFilePipeline(dir string) middleware.ItemPipeline {
 	return &middleware.FilePipeline{
-		Base:       middleware.NewBasePipeline("FilePipeline"),
-		DirPath:    dir,
-		FileWriter: DownloaderFileWriter,
+		Base:         middleware.NewBasePipeline("FilePipeline"),
+		DirPath:      dir,
+		ContentNames: FileContentNames,
+		FileWriter:   newFileWriter(DownloaderFileWriter),
+	}
+}
+
+// NewImagesPipeline downloads the imageurls of the items to the dir, and saves the thumbnails
+// of the sizes by their names, like {"small": {Width: 50, Height: 50}}.
+func NewImagesPipeline(dir string, thumbs map[string]middleware.ThumbSize) middleware.ItemPipeline {
+	return &middleware.ImagesPipeline{
+		FilePipeline: middleware.FilePipeline{
+			Base:         middleware.NewBasePipeline("ImagesPipeline"),
+			DirPath:      dir,
+			ContentNames: FileContentNames,
+			FileWriter:   newFileWriter(DownloaderFileWriter),
+		},
+		MinWidth:     ImagesMinWidth,
+		MinHeight:    ImagesMinHeight,
+		Thumbs:       thumbs,
+		ThumbQuality: ImagesThumbQuality,
+	}
+}
+
+// The saved files are recorded by the writers if there's a ManifestFile.
+func newFileWriter(w middleware.FileWriter) middleware.FileWriter {
+	if w == nil || ManifestFile == "" {
+		return w
+	}
+	return middleware.NewManifestWriter(w, ManifestFile)
+}
+
+// The join pipeline merges the parts of an item, and yields the merged item when all the parts
+// have arrived or after the timeout (in seconds).
+func NewJoinPipeline(timeout float64, parts ...string) middleware.ItemPipeline {
+	return &middleware.JoinPipeline{
+		Base:    middleware.NewBasePipeline("JoinPipeline"),
+		Parts:   parts,
+		Timeout: time.Duration(timeout*1000) * time.Millisecond,
+	}
+}
+
+// The JSON Lines pipeline writes one item per line, the file can be compressed with gzip,
+// and rotated when it's larger than maxSize bytes (0 means no rotation).
+func NewJSONLinesPipeline(name string, gzip bool, maxSize int64) middleware.ItemPipeline {
+	return &middleware.JSONLinesPipeline{
+		Base:     middleware.NewBasePipeline("JSONLinesPipeline"),
+		FileName: name,
+		Gzip:     gzip,
+		MaxSize:  maxSize,
+	}
+}
+
+// The SQL pipeline writes the items into the table, keyed by the idempotency key in keyColumn
+// if it's not empty. Remember to import the driver in your spider.
+func NewSQLPipeline(driverName string, dsn string, table string, keyColumn string) middleware.ItemPipeline {
+	return &middleware.SQLPipeline{
+		Base:        middleware.NewBasePipeline("SQLPipeline"),
+		DriverName:  driverName,
+		DSN:         dsn,
+		Table:       table,
+		KeyColumn:   keyColumn,
+		BatchSize:   SQLBatchSize,
+		MaxRetries:  SQLMaxRetries,
+		MaxBuffered: SQLMaxBuffered,
+	}
+}
+
+// The Mongo pipeline inserts the items into the collection, or upserts them by the keys
+// made up of keyFields if it's not empty.
+func NewMongoPipeline(uri string, database string, collection string, keyFields ...string) middleware.ItemPipeline {
+	return &middleware.MongoPipeline{
+		Base:       middleware.NewBasePipeline("MongoPipeline"),
+		URI:        uri,
+		Database:   database,
+		Collection: collection,
+		KeyFields:  keyFields,
+		BatchSize:  MongoBatchSize,
+	}
+}
+
+// The Kafka pipeline publishes the items to the topic, the keyField of an item is used as the message key.
+func NewKafkaPipeline(brokers []string, topic string, keyField string) middleware.ItemPipeline {
+	return &middleware.KafkaPipeline{
+		Base:      middleware.NewBasePipeline("KafkaPipeline"),
+		Brokers:   brokers,
+		Topic:     topic,
+		KeyField:  keyField,
+		BatchSize: KafkaBatchSize,
+	}
+}
+
+// The ES pipeline indexes the items into the index, which may contain time layouts like "items-{2006.01.02}".
+func NewESPipeline(url string, index string, keyFields ...string) middleware.ItemPipeline {
+	return &middleware.ESPipeline{
+		Base:          middleware.NewBasePipeline("ESPipeline"),
+		URL:           url,
+		Index:         index,
+		KeyFields:     keyFields,
+		BatchSize:     ESBatchSize,
+		FlushInterval: time.Duration(ESFlushInterval*1000) * time.Millisecond,
+		MaxRetries:    ESMaxRetries,
+	}
+}
+
+// The search index pipeline indexes the html pages into the index, like a BleveSearchIndex or an ESSearchIndex,
+// the tokens are lowercased by default. Add it by AddResponseConsumers.
+func NewSearchIndexPipeline(index middleware.SearchIndex, filters ...middleware.TokenFilter) middleware.ResponseConsumer {
+	if len(filters) == 0 {
+		filters = []middleware.TokenFilter{middleware.LowerCase}
+	}
+	return &middleware.SearchIndexPipeline{
+		Base:       middleware.NewBasePipeline("SearchIndexPipeline"),
+		Index:      index,
+		Filters:    filters,
+		BatchSize:  SearchIndexBatchSize,
+		MaxRetries: SearchIndexMaxRetries,
+	}
+}
+
+func NewBleveSearchIndex(path string) middleware.SearchIndex {
+	return &middleware.BleveSearchIndex{Path: path}
+}
+
+func NewESSearchIndex(url string, index string) middleware.SearchIndex {
+	return &middleware.ESSearchIndex{URL: url, IndexName: index}
+}
+
+func NewSitemapMiddleware(filename string) middleware.SpiderMiddleware {
+	return &middleware.SitemapMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("SitemapMiddleware"),
+		FileName:       filename,
+		Format:         SitemapFormat,
+		BaseURL:        SitemapBaseURL,
+	}
+}
+
+func NewScreenshotMiddleware(dir string) middleware.SpiderMiddleware {
+	return &middleware.ScreenshotMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("ScreenshotMiddleware"),
+		DirPath:        dir,
+		FileWriter:     newFileWriter(DownloaderFileWriter),
+	}
+}
+
+func NewSEOAuditMiddleware(report string) middleware.SpiderMiddleware {
+	return &middleware.SEOAuditMiddleware{
+		BaseMiddleware:       middleware.NewBaseMiddleware("SEOAuditMiddleware"),
+		Report:               report,
+		TitleMinLength:       SEOTitleMinLength,
+		TitleMaxLength:       SEOTitleMaxLength,
+		DescriptionMinLength: SEODescriptionMinLength,
+		DescriptionMaxLength: SEODescriptionMaxLength,
+	}
+}
+
+func NewSamplePipeline(size int, filename string) middleware.ItemPipeline {
+	return &middleware.SamplePipeline{
+		Base:     middleware.NewBasePipeline("SamplePipeline"),
+		Size:     size,
+		FileName: filename,
+		Rand:     util.NewRand(RandomSeed, "SamplePipeline"),
+	}
+}
+
+func NewSchemaPipeline(schema middleware.Schema) middleware.ItemPipeline {
+	return &middleware.SchemaPipeline{
+		Base:   middleware.NewBasePipeline("SchemaPipeline"),
+		Schema: schema,
+	}
+}
+
+func NewCSVPipeline(name string, columns ...string) middleware.ItemPipeline {
+	return &middleware.CSVPipeline{
+		Base:     middleware.NewBasePipeline("CSVPipeline"),
+		FileName: name,
+		Columns:  columns,
+		Header:   true,
 	}
 }
 
@@ -154,3 +1038,26 @@ func NewJSONPipeline(name string) middleware.ItemPipeline {
 		FileName: name,
 	}
 }
+
+// Wrap an exporting pipeline so that every item is exported only once,
+// the keys of the exported items are stored in keyFile.
+func NewExactlyOncePipeline(p middleware.ItemPipeline, keyFile string, keyFields ...string) middleware.ItemPipeline {
+	return &middleware.ExactlyOncePipeline{
+		Base:      middleware.NewBasePipeline("ExactlyOncePipeline"),
+		Pipeline:  p,
+		KeyFields: keyFields,
+		Store:     &middleware.FileKeyStore{FileName: keyFile},
+	}
+}
+
+func NewAccessGateMiddleware(strategy middleware.UnlockStrategy, markers ...string) middleware.SpiderMiddleware {
+	m := &middleware.AccessGateMiddleware{
+		BaseMiddleware: middleware.NewBaseMiddleware("AccessGateMiddleware"),
+		Strategy:       strategy,
+		MaxUnlocks:     AccessGateMaxUnlocks,
+	}
+	for _, marker := range markers {
+		m.Markers = append(m.Markers, []byte(marker))
+	}
+	return m
+}
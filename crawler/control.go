@@ -0,0 +1,277 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// ControlServer is an HTTP server to watch and control a running crawler, like the telnet console of Scrapy.
+// It serves these endpoints:
+//
+//	GET  /status           the StatusInfo as JSON
+//	GET  /running          the urls of the running pages
+//	POST /pause            stop popping the requests from the scheduler, the running ones still complete
+//	POST /resume           continue the paused crawl
+//	GET  /delay            the DownloadDelay of the DelayMiddlewares
+//	POST /delay?value=1.5  change the DownloadDelay
+//	GET  /loglevel         the log level, and the levels of the logger names and the spiders
+//	POST /loglevel?logger=Downloader&level=Debug
+//	                       change the level of a logger name, or of a spider with spider=name,
+//	                       an empty level removes the override
+//	POST /shutdown         stop the spider like the user interrupt
+//
+// There's no authentication, so listen on a local address. See CrawlerBuilder.AddControlServer.
+type ControlServer struct {
+	Logger  log.Logger
+	Crawler *Crawler
+	Addr    string
+
+	server *http.Server
+}
+
+type controlStatus struct {
+	Spider      string                 `json:"spider"`
+	RunID       string                 `json:"run_id"`
+	StartDate   time.Time              `json:"start_date"`
+	Duration    float64                `json:"duration"`
+	Paused      bool                   `json:"paused"`
+	Interrupted bool                   `json:"interrupted"`
+	Reason      string                 `json:"reason"`
+	Running     int                    `json:"running"`
+	Queued      int                    `json:"queued"`
+	Pages       int                    `json:"pages"`
+	Crawled     int                    `json:"crawled"`
+	Succeed     int                    `json:"succeed"`
+	Items       int                    `json:"items"`
+	Files       int                    `json:"files"`
+	SlowParsers int                    `json:"slow_parsers"`
+	Errors      int                    `json:"errors"`
+	OverBudget  int                    `json:"over_budget"`
+	Hosts       map[string]*HostStatus `json:"hosts"`
+
+	// The hosts on the mitigation ladder of the BlockDetectorMiddleware, if the crawler has one.
+	Blocking map[string]*middleware.BlockState `json:"blocking,omitempty"`
+
+	// The url traps found by the TrapDetectorMiddleware, if the crawler has one.
+	Traps []*middleware.Trap `json:"traps,omitempty"`
+}
+
+func (c *ControlServer) Open(spider *leiogo.Spider) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.get(func() interface{} { return c.status(spider) }))
+	mux.HandleFunc("/running", c.get(c.running))
+	mux.HandleFunc("/pause", c.post(spider, "Paused", c.Crawler.Pause))
+	mux.HandleFunc("/resume", c.post(spider, "Resumed", c.Crawler.Resume))
+	mux.HandleFunc("/shutdown", c.post(spider, "Shutting down", func() {
+		c.Crawler.StatusInfo.Stop("Shutdown by control API")
+	}))
+	mux.HandleFunc("/delay", func(w http.ResponseWriter, r *http.Request) {
+		c.delay(w, r, spider)
+	})
+	mux.HandleFunc("/loglevel", func(w http.ResponseWriter, r *http.Request) {
+		c.logLevel(w, r, spider)
+	})
+
+	// Listen before serving, so a busy port fails the Open instead of a log after it.
+	ln, err := net.Listen("tcp", c.Addr)
+	if err != nil {
+		c.Logger.Error(spider.Name, "Listen on %s fail, %s", c.Addr, err)
+		return err
+	}
+	c.server = &http.Server{Addr: c.Addr, Handler: mux}
+	go func() {
+		if err := c.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			c.Logger.Error(spider.Name, "Control server on %s stopped, %s", c.Addr, err)
+		}
+	}()
+	c.Logger.Info(spider.Name, "Control server listening on %s", ln.Addr())
+	return nil
+}
+
+func (c *ControlServer) Close(reason string, spider *leiogo.Spider) error {
+	if c.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return c.server.Shutdown(ctx)
+}
+
+func (c *ControlServer) get(f func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, f())
+	}
+}
+
+func (c *ControlServer) post(spider *leiogo.Spider, action string, f func()) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		f()
+		c.Logger.Info(spider.Name, "%s by control API", action)
+		writeJSON(w, c.status(spider))
+	}
+}
+
+func (c *ControlServer) status(spider *leiogo.Spider) interface{} {
+	var blocking map[string]*middleware.BlockState
+	for _, m := range c.Crawler.DownloadMiddlewares {
+		if d, ok := m.(*middleware.BlockDetectorMiddleware); ok {
+			blocking = d.States()
+		}
+	}
+	traps := c.Crawler.traps()
+	overBudget := c.Crawler.overBudget()
+	queued := c.Crawler.Scheduler.Len()
+
+	s := &c.Crawler.StatusInfo
+	paused := s.IsPaused()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	hosts := make(map[string]*HostStatus, len(s.Hosts))
+	for host, h := range s.Hosts {
+		hosts[host] = &HostStatus{Crawled: h.Crawled, Failed: h.Failed}
+	}
+	return controlStatus{
+		Spider:      spider.Name,
+		RunID:       spider.RunID,
+		StartDate:   s.StartDate,
+		Duration:    time.Since(s.StartDate).Seconds(),
+		Paused:      paused,
+		Interrupted: s.Interrupted,
+		Reason:      s.Reason,
+		Running:     len(s.RunningPages),
+		Queued:      queued,
+		Pages:       s.Pages,
+		Crawled:     s.Crawled,
+		Succeed:     s.Succeed,
+		Items:       s.Items,
+		Files:       s.Files,
+		SlowParsers: s.SlowParsers,
+		Errors:      s.Errors,
+		OverBudget:  overBudget,
+		Hosts:       hosts,
+		Blocking:    blocking,
+		Traps:       traps,
+	}
+}
+
+func (c *ControlServer) running() interface{} {
+	s := &c.Crawler.StatusInfo
+	s.mutex.Lock()
+	urls := make([]string, 0, len(s.RunningPages))
+	for url := range s.RunningPages {
+		urls = append(urls, url)
+	}
+	s.mutex.Unlock()
+
+	sort.Strings(urls)
+	return urls
+}
+
+func (c *ControlServer) delay(w http.ResponseWriter, r *http.Request, spider *leiogo.Spider) {
+	var ms []*middleware.DelayMiddleware
+	for _, m := range c.Crawler.DownloadMiddlewares {
+		if d, ok := m.(*middleware.DelayMiddleware); ok {
+			ms = append(ms, d)
+		}
+	}
+	if len(ms) == 0 {
+		http.Error(w, "no DelayMiddleware", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		delay, err := strconv.ParseFloat(r.FormValue("value"), 64)
+		if err != nil || delay < 0 {
+			http.Error(w, fmt.Sprintf("invalid delay '%s'", r.FormValue("value")), http.StatusBadRequest)
+			return
+		}
+		for _, m := range ms {
+			m.SetDownloadDelay(delay)
+		}
+		c.Logger.Info(spider.Name, "DownloadDelay set to %.3f by control API", delay)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, map[string]float64{"delay": ms[0].GetDownloadDelay()})
+}
+
+type controlLogLevels struct {
+	Level   string            `json:"level"`
+	Loggers map[string]string `json:"loggers"`
+	Spiders map[string]string `json:"spiders"`
+}
+
+func (c *ControlServer) logLevel(w http.ResponseWriter, r *http.Request, spider *leiogo.Spider) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		logger, target := r.FormValue("logger"), r.FormValue("spider")
+		if (logger == "") == (target == "") {
+			http.Error(w, "either logger or spider is required", http.StatusBadRequest)
+			return
+		}
+		level := -1
+		if value := r.FormValue("level"); value != "" {
+			var err error
+			if level, err = log.ParseLevel(value); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		switch {
+		case logger != "" && level < 0:
+			log.UnsetLevel(logger)
+		case logger != "":
+			log.SetLevel(logger, level)
+		case level < 0:
+			log.UnsetSpiderLevel(target)
+		default:
+			log.SetSpiderLevel(target, level)
+		}
+		if level < 0 {
+			c.Logger.Info(spider.Name, "Log level of %s%s reset by control API", logger, target)
+		} else {
+			c.Logger.Info(spider.Name, "Log level of %s%s set to %s by control API", logger, target, log.LevelName(level))
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	names, spiders := log.Levels()
+	levels := controlLogLevels{Level: log.LevelName(log.LogLevel), Loggers: map[string]string{}, Spiders: map[string]string{}}
+	for name, level := range names {
+		levels.Loggers[name] = log.LevelName(level)
+	}
+	for name, level := range spiders {
+		levels.Spiders[name] = log.LevelName(level)
+	}
+	writeJSON(w, levels)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -1,22 +1,55 @@
 package crawler
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo/log"
 	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
 )
 
 type Crawler struct {
-	// The buffered channel object for producing and consuming requests.
-	requests chan *leiogo.Request
+	// The queue of the pending requests, the default one pops the requests by their priority.
+	// See the Scheduler interface in middleware package.
+	Scheduler middleware.Scheduler
 
 	// Tokens are used to controll the concurrent requests at the same time.
 	// See ConcurrentRequests in context.go for more information.
-	tokens chan struct{}
+	tokens *Tokens
+
+	// If RateLimiter is not nil, it limits the requests downloaded per minute.
+	RateLimiter *RateLimiter
+
+	// If AutoScaler is not nil, it adjusts the concurrent requests when the crawler is running.
+	AutoScaler *AutoScaler
+
+	// OnItemDropped is called when a pipeline drops an item, so the spiders which must guarantee
+	// the coverage can re-queue the source page or alert, instead of the drop being only in the debug logs.
+	OnItemDropped ItemDropHandler
+
+	// The max concurrent requests to each host, 0 means no limitation.
+	// The hosts may override it with "ConcurrentRequests" in the HostSettings.
+	ConcurrentRequestsPerDomain int
+
+	// The hosts may override the settings of the crawler, and the middlewares.
+	HostSettings middleware.HostSettings
+	hostTokens   HostTokens
 
 	// This is similar to os/signal workgroup, in order to make the crawler to wait
-	// for all the requests to complete.
-	count ConcurrentCount
+	// for all the requests to complete. The count includes the requests pushed to the scheduler,
+	// it closes the scheduler when it drops to 0. The running only counts the work of this crawler,
+	// the crawling requests, the items and the parsers, since the requests pushed to a scheduler
+	// shared by several crawlers may be popped and done by the others.
+	count   *ConcurrentCount
+	running *ConcurrentCount
 
 	Logger              log.Logger
 	DownloadMiddlewares []middleware.DownloadMiddleware
@@ -30,8 +63,80 @@ type Crawler struct {
 	// There should be at least one parser named 'default'.
 	Parsers map[string]middleware.Parser
 
+	// The parser of the responses whose parsers are not found, like a request with an unknown ParserName.
+	// If it's nil, the responses are dropped with an error.
+	FallbackParser middleware.Parser
+
+	// The parsers of the requests with an empty ParserName, the first one matching the final url
+	// of the response, after the redirects, is used, see CrawlerBuilder.AddURLParser.
+	URLParsers []URLParser
+
+	// The parsers of the responses by their status codes, by the ParserName of the requests,
+	// see CrawlerBuilder.AddStatusParser.
+	StatusParsers map[string][]StatusParser
+
+	// The errbacks of the failed requests, by the ErrbackName of the requests.
+	Errbacks map[string]middleware.Errback
+
 	ItemPipelines []middleware.ItemPipeline
 
+	// The consumers get the parsed responses in background, see middleware.ResponseConsumer.
+	// The stream of a consumer buffers ConsumerBuffer bytes at most, see consumerStream.
+	Consumers      []middleware.ResponseConsumer
+	ConsumerBuffer int
+
+	// A parser running longer than ParserSlowThreshold will be reported, and the crawler
+	// stops waiting for a parser after ParserTimeout. Zero means no limitation.
+	// See ParserTimeout in context.go for more information.
+	ParserTimeout       time.Duration
+	ParserSlowThreshold time.Duration
+
+	// With RerenderEmpty, the pages yielding nothing are requested again with phantomjs, see checkYields.
+	RerenderEmpty bool
+	yields        pageYields
+
+	// The parsers' lookups are retried for LookupRetryTimes, and the latest LookupCacheSize lookups
+	// are remembered, see Lookup.
+	LookupRetryTimes int
+	LookupCacheSize  int
+	lookups          lookupCache
+
+	// The parsed documents of the responses which are being parsed.
+	Documents DocumentPool
+
+	// If JobDir is not empty, the crawler will save its state to the directory when it stops,
+	// and resume from the state when it starts. See jobdir.go for more information.
+	JobDir       string
+	pending      []*leiogo.Request
+	pendingMutex sync.Mutex
+
+	// With FileItems, an item is yielded for every saved file, see newFileItem.
+	FileItems bool
+
+	// The file Run saves the RunResult to, see RunSummaryFile.
+	SummaryFile string
+
+	// The components shared with the other crawlers of a CrawlerProcess, they are opened and closed by the process.
+	shared map[interface{}]bool
+
+	// The politeness report of the hosts is logged when the spider closes, and saved to PolitenessFile
+	// if it's not empty, see HostPoliteness.
+	PolitenessFile string
+	politeness     politeness
+
+	// The unique ID of the run, it's generated when the spider starts if it's empty.
+	// It's in the logs, the results, the manifest and the job directory, and in the RunIDField of the items.
+	RunID      string
+	RunIDField string
+
+	// With VerifyManifest, the spider only re-downloads the missing or corrupt files in the ManifestFile.
+	ManifestFile   string
+	VerifyManifest bool
+
+	// All the downloads run with the contexts derived from ctx, see Cancel.
+	ctx    context.Context
+	cancel context.CancelFunc
+
 	// StatusInfo contains the basic information about this crawler,
 	// and the crawler will print this information when it stops.
 	// More details can be found in the struct defination.
@@ -39,81 +144,303 @@ type Crawler struct {
 }
 
 func (c *Crawler) addRequest(req *leiogo.Request) {
-	// Add a new request to the queue. Pay attention that we call the channel method
-	// in a new goroutine, in case deadlock problem.
+	trace(req)
+	// Add a new request to the queue. The scheduler never blocks on pushing,
+	// so there's no deadlock problem here.
 	if !c.StatusInfo.IsInterrupt() {
 		c.StatusInfo.AddPage()
 		c.count.Add()
-		go func() { c.requests <- req }()
+		c.Scheduler.Push(req)
+	} else {
+		c.addPending(req)
 	}
 }
 
+// The work of this crawler besides the requests, like the items, keeps the scheduler open,
+// since it may yield new requests.
+func (c *Crawler) addWork() {
+	c.count.Add()
+	c.running.Add()
+}
+
+func (c *Crawler) doneWork() {
+	c.running.Done()
+	c.count.Done()
+}
+
 // After finishing initializing the crawler, call this method to start the spider.
-func (c *Crawler) Crawl(spider *leiogo.Spider) {
-	c.Logger.Info(spider.Name, "Start spider")
+// It returns the result when the spider is closed.
+func (c *Crawler) Crawl(spider *leiogo.Spider) *RunResult {
+	// The crawlers which are not built by the CrawlerBuilder get their contexts here.
+	if c.ctx == nil {
+		c.ctx, c.cancel = context.WithCancel(context.Background())
+	}
+	if c.RunID == "" {
+		c.RunID = NewRunID()
+	}
+	spider.RunID = c.RunID
+	log.SetRunID(spider.Name, c.RunID)
+	if c.ManifestFile != "" {
+		middleware.OpenManifest(c.ManifestFile).RunID = c.RunID
+	}
+
+	// A start url referring an unknown parser fails the crawl before any middleware is opened.
+	if err := c.Validate(spider); err != nil {
+		c.Logger.Error(spider.Name, "Invalid spider, %s", err)
+		c.StatusInfo.StartDate = time.Now()
+		c.StatusInfo.EndDate = c.StatusInfo.StartDate
+		c.StatusInfo.StopWith(err.Error(), OutcomeFailed)
+		return c.StatusInfo.Result(spider)
+	}
+
+	c.Logger.Info(spider.Name, "Start spider, run %s", c.RunID)
+	// The requests lost by the scheduler are never popped, so they are done here.
+	if s, ok := c.Scheduler.(middleware.LossyScheduler); ok {
+		s.SetOnLost(func(n int) {
+			c.Logger.Error(spider.Name, "%d requests are lost by the scheduler", n)
+			for i := 0; i < n; i++ {
+				c.count.Done()
+			}
+		})
+	}
 	// When starting the spider, we have to call all the Open methods of the middlewares.
 	// TODO: These lines should be refined in the future.
 	for _, m := range c.OpenCloses {
-		m.Open(spider)
+		c.open(m, spider)
 	}
 	for _, m := range c.DownloadMiddlewares {
-		m.Open(spider)
+		c.open(m, spider)
 	}
 	for _, m := range c.SpiderMiddlewares {
-		m.Open(spider)
+		c.open(m, spider)
 	}
-	for _, m := range c.ItemPipelines {
-		m.Open(spider)
+	for i, m := range c.ItemPipelines {
+		// The held items go on from the next pipeline.
+		if h, ok := m.(middleware.ItemHolder); ok {
+			next := i + 1
+			h.SetRelease(func(item *leiogo.Item, spider *leiogo.Spider) {
+				c.processItem(item, next, spider)
+			})
+		}
+		c.open(m, spider)
+	}
+
+	var resumed []*leiogo.Request
+	if c.JobDir != "" {
+		resumed = c.loadJob(spider)
+	}
+
+	startURLs := spider.StartURLs
+	if c.VerifyManifest {
+		startURLs = c.verifyManifest(spider)
 	}
 
 	// If there isn't any start urls, then directly close the spider.
 	// Otherwise, the program will wait forever.
-	if len(spider.StartURLs) != 0 {
+	if len(startURLs) != 0 || len(resumed) != 0 {
+
+		c.Logger.Info(spider.Name, "Adding start URLs")
+		for _, req := range startURLs {
+			c.addRequest(req)
+		}
+		// The resumed requests have been counted by the previous run.
+		for _, req := range resumed {
+			c.count.Add()
+			c.Scheduler.Push(req)
+		}
 
 		// Wait for all the requests to complete.
-		// This should be invoked before any addRequest,
-		// otherwise the program will block forever.
+		// This should be invoked after the start requests are added,
+		// otherwise the count is 0 and the scheduler will be closed immediately.
 		go func() {
 			c.count.Wait()
-			close(c.requests)
+			c.Scheduler.Close()
 		}()
 
-		c.Logger.Info(spider.Name, "Adding start URLs")
-		for _, req := range spider.StartURLs {
-			c.addRequest(req)
-		}
+		for {
+			req, ok := c.Scheduler.Pop()
+			if !ok {
+				break
+			}
+			c.StatusInfo.WaitResumed()
+
+			// After the user interrupt, or a close condition, the requests in the queue are not crawled,
+			// so the spider stops as soon as the running requests complete. They are saved if there's a JobDir.
+			if c.StatusInfo.IsInterrupt() {
+				c.addPending(req)
+				c.count.Done()
+				continue
+			}
+
+			// The requests put off by the middlewares, like the retries in their backoff,
+			// wait outside of the scheduler without holding the tokens.
+			if until := c.deferUntil(req, spider); until.After(time.Now()) {
+				c.reschedule(req, until, spider)
+				continue
+			}
 
-		for req := range c.requests {
 			// In order to controll the concurrent requests, we use a special channel.
 			// To process a new request, we should first get a token. If there's no token remaining,
 			// the thread will wait.
-			c.tokens <- struct{}{}
+			c.tokens.Acquire()
+			c.running.Add()
 			go func(_req *leiogo.Request) {
 				c.crawl(_req, spider)
+				c.running.Done()
 				c.count.Done()
 
 				// After a request has completed, release a token.
-				<-c.tokens
+				c.tokens.Release()
 			}(req)
 		}
 	}
 
+	// The loop may also stop because a shared scheduler runs out of requests,
+	// then we still have to wait for the running requests.
+	c.tokens.Wait()
+
+	// Some pipelines buffer the items, they have to flush them before the pipelines are closed.
+	// The items on their way, like the ones released by a flushed pipeline, reach the next pipelines
+	// before they're flushed.
+	c.running.Wait()
+	for _, p := range c.ItemPipelines {
+		if f, ok := p.(middleware.Flusher); ok {
+			f.Flush(spider)
+			c.running.Wait()
+		}
+	}
+
 	c.Logger.Info(spider.Name, "Closing spider")
 	// TODO: These lines are the same to the Open methods above and should be refined in the future.
 	for _, m := range c.ItemPipelines {
-		m.Close(c.StatusInfo.Reason, spider)
+		c.close(m, spider)
 	}
 	for _, m := range c.SpiderMiddlewares {
-		m.Close(c.StatusInfo.Reason, spider)
+		c.close(m, spider)
 	}
 	for _, m := range c.DownloadMiddlewares {
-		m.Close(c.StatusInfo.Reason, spider)
+		c.close(m, spider)
 	}
 	for _, m := range c.OpenCloses {
+		c.close(m, spider)
+	}
+
+	if c.JobDir != "" {
+		c.saveJob(spider)
+	} else if n := len(c.pending); n != 0 {
+		c.Logger.Error(spider.Name, "%d requests are not crawled, set JobDir to resume them in the next run", n)
+	}
+
+	result := c.StatusInfo.Result(spider)
+	result.Pending = len(c.pending)
+	result.Traps = c.traps()
+	result.OverBudget = c.overBudget()
+	result.Pruned = c.prunedBranches()
+	result.StrictCompliance = c.strictCompliance()
+	result.Politeness = c.politenessReport(spider)
+	c.reportPoliteness(result.Politeness, spider)
+	return result
+}
+
+// Open the component, unless it's shared in a CrawlerProcess.
+func (c *Crawler) open(m middleware.OpenClose, spider *leiogo.Spider) {
+	if !c.isShared(m) {
+		m.Open(spider)
+	}
+}
+
+func (c *Crawler) close(m middleware.OpenClose, spider *leiogo.Spider) {
+	if !c.isShared(m) {
 		m.Close(c.StatusInfo.Reason, spider)
 	}
 }
 
+// Pause stops dispatching the requests in the queue, the running requests still complete,
+// and the new requests they yield are queued. The spider doesn't close while it's paused.
+func (c *Crawler) Pause() {
+	c.StatusInfo.Pause()
+}
+
+// Resume dispatching the requests.
+func (c *Crawler) Resume() {
+	c.StatusInfo.Resume()
+}
+
+// Cancel stops the spider, and aborts the running downloads by cancelling their contexts.
+// The cancelled requests are kept as pending like the queued ones, so they are saved if there's a JobDir.
+// The middlewares which are sleeping, like the DelayMiddleware, are not woken up,
+// their requests are kept as pending when they wake up.
+func (c *Crawler) Cancel() {
+	c.StatusInfo.Cancel()
+	if c.cancel != nil {
+		c.cancel()
+	}
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// Ask the download middlewares which cache the responses, the first cached response skips the downloader.
+func (c *Crawler) cachedResponse(req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response {
+	for _, m := range c.DownloadMiddlewares {
+		if cache, ok := m.(middleware.ResponseCache); ok {
+			if res := cache.CachedResponse(req, spider); res != nil {
+				return res
+			}
+		}
+	}
+	return nil
+}
+
+// Ask the download middlewares which put the requests off, it returns the time of the first one
+// deferring the request, or the zero time if the request can be crawled now.
+func (c *Crawler) deferUntil(req *leiogo.Request, spider *leiogo.Spider) time.Time {
+	now := time.Now()
+	for _, m := range c.DownloadMiddlewares {
+		if d, ok := m.(middleware.Deferrer); ok {
+			if until := d.DeferUntil(req, spider); until.After(now) {
+				return until
+			}
+		}
+	}
+	return time.Time{}
+}
+
+// Push the deferred request back to the scheduler at the time. It's still counted,
+// so the scheduler is kept open, and as running work of this crawler until it's pushed.
+func (c *Crawler) reschedule(req *leiogo.Request, until time.Time, spider *leiogo.Spider) {
+	c.Logger.Trace(req.LogContext(spider), "Defer %s until %s", req.URL, until.Format(time.RFC3339))
+	c.running.Add()
+	time.AfterFunc(time.Until(until), func() {
+		c.Scheduler.Push(req)
+		c.running.Done()
+	})
+}
+
+// The context of a download, it's done when the crawler is cancelled, or after the 'timeout'
+// seconds in the meta of the request.
+func (c *Crawler) requestContext(req *leiogo.Request) (context.Context, context.CancelFunc) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if timeout, ok := req.Meta.Float("timeout"); ok && timeout > 0 {
+		return context.WithTimeout(ctx, time.Duration(timeout*1000)*time.Millisecond)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (c *Crawler) IsPaused() bool {
+	return c.StatusInfo.IsPaused()
+}
+
 // When there's a error from the middleware, first we need to identify whether it's a DropTaskError.
 // And for other error, we just call the HandleErr method in each middleware. Users are able to override
 // the method.
@@ -122,8 +449,11 @@ func (c *Crawler) handleErr(err error, req *leiogo.Request,
 	if err != nil {
 		switch err.(type) {
 		case *middleware.DropTaskError:
-			c.Logger.Debug(spider.Name, "Drop task %s, %s", req.URL, err.Error())
+			c.Logger.Debug(req.LogContext(spider), "Drop task %s, %s", req.URL, err.Error())
 		default:
+			// The handlers don't know the request, so the error is logged with its trace here.
+			c.Logger.Debug(req.LogContext(spider), "Task %s failed, %s", req.URL, err.Error())
+			c.StatusInfo.AddError(err)
 			handler.HandleErr(err, spider)
 		}
 		return false
@@ -134,21 +464,72 @@ func (c *Crawler) handleErr(err error, req *leiogo.Request,
 // This is the main method of crawler. Every request, after passing through the processNewRequest method
 // in spider middleware, it wil start its journey here: processRequest in download middleware ->
 // downlader -> processResponse in download middleware -> processResponse in spider middleware ->
-// user defined parser (by ParserName in request).
+// user defined parser (by Callback or ParserName in request).
 // PS: these's a exception here, all the new requests in startURLs will not pass through the processNewRequest method
 // in spider middleware. This is a technical design :)
 // See more information about middlewares in middleware package.
 func (c *Crawler) crawl(req *leiogo.Request, spider *leiogo.Spider) {
 	c.StatusInfo.AddRunningPage(req)
 
+	release := c.acquireHost(req, c.tokens)
+	defer release()
+
 	for _, m := range c.DownloadMiddlewares {
-		if ok := c.handleErr(m.ProcessRequest(req, spider), req, m, spider); !ok {
+		if err := m.ProcessRequest(req, spider); !c.handleErr(err, req, m, spider) {
+			c.politeness.drop(req, err)
+			c.fileDone(req, err, spider)
 			return
 		}
 	}
 
-	res := c.Downloader.Download(req, spider)
+	if c.StatusInfo.IsCancelled() {
+		c.addPending(req)
+		return
+	}
+
+	res := c.cachedResponse(req, spider)
+	if res == nil {
+		// Only the requests going to the network take the tokens, not the dropped or the cached ones.
+		if c.RateLimiter != nil {
+			c.RateLimiter.Wait()
+		}
+		ctx, cancel := c.requestContext(req)
+		downloaded := c.politeness.download(req)
+		res = c.Downloader.Download(ctx, req, spider)
+		downloaded(res)
+		release()
+		// The stream is still read with the context, so it's cancelled when the stream is closed.
+		if res.Stream != nil {
+			res.Stream = &cancelOnClose{ReadCloser: res.Stream, cancel: cancel}
+		} else {
+			cancel()
+		}
+	}
+	parsing := false
+	defer func() {
+		// The parser closes the stream by itself, see runParser.
+		if !parsing {
+			res.Close()
+		}
+	}()
+	if res.Err != nil && c.StatusInfo.IsCancelled() {
+		c.Logger.Debug(req.LogContext(spider), "Cancelled %s, %s", req.URL, res.Err)
+		c.addPending(req)
+		return
+	}
 	c.StatusInfo.AddCrawled()
+	_, isFile := res.Err.(*middleware.DropTaskError)
+	_, isStorage := res.Err.(*middleware.StorageError)
+	if isStorage {
+		c.StatusInfo.AddStorageError(fmt.Errorf("Save %s failed, %s", req.URL, res.Err))
+	} else if res.Err != nil && !isFile {
+		c.StatusInfo.AddError(fmt.Errorf("Download %s failed, %s", req.URL, res.Err))
+	}
+	// The host is fine if the file is downloaded but can't be saved.
+	c.StatusInfo.AddHost(util.GetHost(req.URL), (res.Err != nil && !isFile && !isStorage) || res.StatusCode >= 400)
+	if c.AutoScaler != nil {
+		c.AutoScaler.Observe(res)
+	}
 
 	// Check whether the request is a static file request.
 	if typeName, ok := req.Meta["__type__"]; ok && typeName.(string) == "file" {
@@ -159,34 +540,259 @@ func (c *Crawler) crawl(req *leiogo.Request, spider *leiogo.Spider) {
 		switch res.Err.(type) {
 		case *middleware.DropTaskError:
 			c.StatusInfo.AddFiles()
+			if c.FileItems {
+				c.newFileItem(req, spider)
+			}
+			c.fileDone(req, nil, spider)
 		default:
 		}
 	}
 
 	for _, m := range c.DownloadMiddlewares {
-		if ok := c.handleErr(m.ProcessResponse(res, req, spider), req, m, spider); !ok {
+		if err := m.ProcessResponse(res, req, spider); !c.handleErr(err, req, m, spider) {
+			c.fileFailed(err, res, req, spider)
+			c.errback(err, res, req, spider)
 			return
 		}
 	}
 
 	for _, m := range c.SpiderMiddlewares {
-		if ok := c.handleErr(m.ProcessResponse(res, req, spider), req, m, spider); !ok {
+		if err := m.ProcessResponse(res, req, spider); !c.handleErr(err, req, m, spider) {
+			c.fileFailed(err, res, req, spider)
+			c.errback(err, res, req, spider)
 			return
 		}
 	}
 
-	if parser, ok := c.Parsers[req.ParserName]; !ok {
-		c.Logger.Error(spider.Name, "No parser named %s", req.ParserName)
+	c.fanOut(res, req, spider)
+
+	if parser, ok := c.parser(res, req); !ok {
+		if req.ParserName == "" {
+			c.Logger.Error(req.LogContext(spider), "No parser matches %s", res.FinalURL())
+		} else {
+			c.Logger.Error(req.LogContext(spider), "No parser named %s", req.ParserName)
+		}
 	} else {
-		parser(res, req, spider)
+		c.yields.track(res)
+		parsing = true
+		c.runParser(parser, res, req, spider)
 	}
 	c.StatusInfo.AddSucceed(req)
 }
 
+// Tell the FileListeners that the file request is done, unless it's rescheduled. A duplicate is told
+// with the error of the dupe filter, the file may have been saved by the first request.
+func (c *Crawler) fileDone(req *leiogo.Request, err error, spider *leiogo.Spider) {
+	if typeName, ok := req.Meta["__type__"].(string); !ok || typeName != "file" {
+		return
+	}
+	if drop, ok := err.(*middleware.DropTaskError); ok && drop.Rescheduled {
+		return
+	}
+	for _, p := range c.ItemPipelines {
+		if l, ok := p.(middleware.FileListener); ok {
+			l.FileDone(req, err, spider)
+		}
+	}
+}
+
+// Tell the FileListeners that the file request has failed, the saved files are told when they are downloaded.
+func (c *Crawler) fileFailed(err error, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	if drop, ok := err.(*middleware.DropTaskError); ok && drop.Rescheduled {
+		return
+	}
+	if _, ok := res.Err.(*middleware.DropTaskError); ok {
+		return
+	}
+	// The download error tells more than the error of the retry middleware.
+	if res.Err != nil {
+		err = res.Err
+	}
+	c.fileDone(req, err, spider)
+}
+
+// Yield an item of the saved file, with its url, path, size and SHA-256, the writers which don't compute
+// the checksums, like the ObjectWriter, have no size and no sha256.
+func (c *Crawler) newFileItem(req *leiogo.Request, spider *leiogo.Spider) {
+	data := leiogo.Dict{"fileurl": req.URL, "filepath": req.Meta["__filepath__"]}
+	if sum, ok := req.Meta["__sha256__"].(string); ok {
+		data["sha256"] = sum
+		data["size"] = req.Meta["__size__"]
+	}
+	item := leiogo.NewItem(data)
+	item.TraceID = req.TraceID()
+	c.NewItem(item, spider)
+}
+
+// URLParser parses the responses whose final urls, see leiogo.Response.FinalURL, match the Pattern.
+type URLParser struct {
+	Pattern *regexp.Regexp
+	Parser  middleware.Parser
+}
+
+// StatusParser parses the responses whose status codes match the Status, which is a code like "404",
+// or a band like "4xx".
+type StatusParser struct {
+	Status string
+	Parser middleware.Parser
+}
+
+func (p StatusParser) match(code int) bool {
+	s := strconv.Itoa(code)
+	if strings.HasSuffix(p.Status, "xx") {
+		return s[:1] == p.Status[:1]
+	}
+	return s == p.Status
+}
+
+// The status parser of the response, an exact code goes before a band.
+func (c *Crawler) statusParser(res *leiogo.Response, req *leiogo.Request) (middleware.Parser, bool) {
+	var band middleware.Parser
+	for _, p := range c.StatusParsers[req.ParserName] {
+		if p.match(res.StatusCode) {
+			if !strings.HasSuffix(p.Status, "xx") {
+				return p.Parser, true
+			} else if band == nil {
+				band = p.Parser
+			}
+		}
+	}
+	return band, band != nil
+}
+
+// Whether the response is handled by a status parser, so the HttpErrorMiddleware lets it pass.
+func (c *Crawler) handlesStatus(res *leiogo.Response, req *leiogo.Request) bool {
+	_, ok := c.statusParser(res, req)
+	return ok
+}
+
+// The parser of the request, a matching status parser goes first, and then the Callback,
+// and then the parser named ParserName. If the ParserName is empty, the parser is selected by the url of the response.
+// The FallbackParser parses the response if none is found.
+func (c *Crawler) parser(res *leiogo.Response, req *leiogo.Request) (middleware.Parser, bool) {
+	if parser, ok := c.findParser(res, req); ok {
+		return parser, true
+	}
+	return c.FallbackParser, c.FallbackParser != nil
+}
+
+func (c *Crawler) findParser(res *leiogo.Response, req *leiogo.Request) (middleware.Parser, bool) {
+	if parser, ok := c.statusParser(res, req); ok {
+		return parser, true
+	}
+	if req.Callback != nil {
+		return middleware.Parser(req.Callback), true
+	}
+	if req.ParserName == "" {
+		for _, p := range c.URLParsers {
+			if p.Pattern.MatchString(res.FinalURL()) {
+				return p.Parser, true
+			}
+		}
+		return nil, false
+	}
+	parser, ok := c.Parsers[req.ParserName]
+	return parser, ok
+}
+
+// The name of the parser in the logs.
+func parserName(req *leiogo.Request) string {
+	if req.Callback != nil {
+		return "callback of " + req.ParserName
+	} else if req.ParserName == "" {
+		return "by url"
+	}
+	return req.ParserName
+}
+
+// Call the errback of the request which has failed with err. The rescheduled requests,
+// and the files which have been saved, are not failures.
+func (c *Crawler) errback(err error, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	if req.ErrbackName == "" {
+		return
+	}
+	if drop, ok := err.(*middleware.DropTaskError); ok && drop.Rescheduled {
+		return
+	}
+	if _, ok := res.Err.(*middleware.DropTaskError); ok {
+		if typeName, ok := req.Meta["__type__"].(string); ok && typeName == "file" {
+			return
+		}
+	}
+	// The download error tells more than the error of the retry middleware.
+	if res.Err != nil {
+		err = res.Err
+	}
+
+	if errback, ok := c.Errbacks[req.ErrbackName]; !ok {
+		c.Logger.Error(req.LogContext(spider), "No errback named %s", req.ErrbackName)
+	} else {
+		errback(err, res, req, spider)
+	}
+}
+
+// A pathological regex or selector on a huge page may hang the parser, and the worker with it.
+// So we run the parser in a new goroutine and wait for it with a timeout.
+// Golang has no way to kill a goroutine, so the parser is told by the context of the response,
+// which is cancelled at the timeout, see leiogo.Response.Context. The DefaultParser stops at the next pattern,
+// and the other parsers have to check it by themselves. A parser ignoring it keeps running in background,
+// we release the worker's token, but still count the parser as running, otherwise the crawler
+// might close the request queue while the parser is yielding new requests.
+func (c *Crawler) runParser(parser middleware.Parser, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if c.ParserTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, c.ParserTimeout)
+	}
+	defer cancel()
+	res.SetContext(ctx)
+
+	start := time.Now()
+	done := make(chan struct{})
+	go func() {
+		// Only this goroutine closes the stream, after the parser returns, even if it has timed out,
+		// since the parser may still be reading it, and the consumers get their copies as it reads.
+		defer close(done)
+		defer res.Close()
+
+		parser(res, req, spider)
+		yields, items := c.yields.done(res)
+		if c.RerenderEmpty {
+			c.checkYields(yields, res, req, spider)
+		}
+		for _, m := range c.SpiderMiddlewares {
+			if l, ok := m.(middleware.PageListener); ok {
+				l.PageParsed(res, req, items, spider)
+			}
+		}
+		c.Documents.Release(res)
+	}()
+
+	select {
+	case <-done:
+		if delta := time.Since(start); c.ParserSlowThreshold > 0 && delta > c.ParserSlowThreshold {
+			c.StatusInfo.AddSlowParser()
+			c.Logger.Error(req.LogContext(spider), "Parser %s is slow on %s, took %s",
+				parserName(req), req.URL, util.FormatDuration(delta))
+		}
+	case <-ctx.Done():
+		c.StatusInfo.AddSlowParser()
+		c.Logger.Error(req.LogContext(spider), "Parser %s timed out on %s after %s",
+			parserName(req), req.URL, util.FormatDuration(c.ParserTimeout))
+
+		c.addWork()
+		go func() {
+			<-done
+			c.doneWork()
+		}()
+	}
+}
+
 // Create a new request, pay attention that we have to pass in the parent response here.
 // Eevry request will first pass through the processNewRequest method here.
 func (c *Crawler) NewRequest(req *leiogo.Request, parRes *leiogo.Response, spider *leiogo.Spider) error {
 	if parRes != nil {
+		trace(req)
+		c.yields.add(parRes)
 		for _, m := range c.SpiderMiddlewares {
 			if ok := c.handleErr(m.ProcessNewRequest(req, parRes, spider), req, m, spider); !ok {
 				return nil
@@ -197,23 +803,55 @@ func (c *Crawler) NewRequest(req *leiogo.Request, parRes *leiogo.Response, spide
 	return nil
 }
 
+// ItemDropHandler receives the dropped item and the error with the reason.
+type ItemDropHandler func(item *leiogo.Item, err *middleware.DropItemError, spider *leiogo.Spider)
+
 // Create a new item, and make it pass through the item pipelines.
+// An item with the trace ID of a page being parsed counts as a yield of the page, so the page is not
+// rendered again, see RerenderEmpty, and the items of the pages are told to the PageListeners, like the adaptive
+// DepthMiddleware. The items of a noindex page are dropped, see middleware.RobotsMetaMiddleware.
+// The items of the default parser have the trace IDs, other parsers can set them by NewPageItem.
 func (c *Crawler) NewItem(item *leiogo.Item, spider *leiogo.Spider) error {
+	if res := c.yields.addItem(item.TraceID); res != nil {
+		if noindex, _ := res.Meta["__noindex__"].(bool); noindex {
+			c.Logger.Debug(res.LogContext(spider), "Drop the item of the noindex page %s", res.URL)
+			return nil
+		}
+	}
+	if c.RunIDField != "" {
+		if item.Data == nil {
+			item.Data = make(leiogo.Dict)
+		}
+		item.Data[c.RunIDField] = spider.RunID
+		item.RunIDField = c.RunIDField
+	}
 	c.StatusInfo.AddItem()
-	c.count.Add()
+	c.processItem(item, 0, spider)
+	return nil
+}
+
+// Pass the item through the item pipelines from the from-th one in background.
+func (c *Crawler) processItem(item *leiogo.Item, from int, spider *leiogo.Spider) {
+	c.addWork()
 	go func() {
-		for _, p := range c.ItemPipelines {
+		defer c.doneWork()
+		for _, p := range c.ItemPipelines[from:] {
 			if err := p.Process(item, spider); err != nil {
-				switch err.(type) {
+				switch x := err.(type) {
+				case *middleware.HoldItemError:
+					c.Logger.Debug(item.LogContext(spider), "Hold item %s, %s", item.String(), err.Error())
 				case *middleware.DropItemError:
-					c.Logger.Debug(spider.Name, "Drop item %s, %s", item.String(), err.Error())
+					c.Logger.Debug(item.LogContext(spider), "Drop item %s, %s", item.String(), err.Error())
+					if c.OnItemDropped != nil {
+						c.OnItemDropped(item, x, spider)
+					}
 				default:
+					c.Logger.Debug(item.LogContext(spider), "Item %s failed, %s", item.String(), err.Error())
 					p.HandleErr(err, spider)
 				}
-				break
+				// An item stops at the first pipeline returning an error.
+				return
 			}
 		}
-		c.count.Done()
 	}()
-	return nil
 }
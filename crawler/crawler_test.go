@@ -0,0 +1,197 @@
+package crawler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// frontier is a request queue shared by several crawlers, like the redis.Scheduler.
+type frontier struct {
+	queue []*leiogo.Request
+	mutex sync.Mutex
+}
+
+// frontierScheduler is the view of a crawler on the frontier, Pop returns false
+// after the frontier has been empty for the idle timeout, or at once after Close.
+type frontierScheduler struct {
+	frontier *frontier
+	idle     time.Duration
+	closed   bool
+	mutex    sync.Mutex
+}
+
+func (s *frontierScheduler) Push(req *leiogo.Request) {
+	s.frontier.mutex.Lock()
+	s.frontier.queue = append(s.frontier.queue, req)
+	s.frontier.mutex.Unlock()
+}
+
+func (s *frontierScheduler) Pop() (*leiogo.Request, bool) {
+	for idle := time.Duration(0); ; idle += 10 * time.Millisecond {
+		s.frontier.mutex.Lock()
+		if len(s.frontier.queue) != 0 {
+			req := s.frontier.queue[0]
+			s.frontier.queue = s.frontier.queue[1:]
+			s.frontier.mutex.Unlock()
+			return req, true
+		}
+		s.frontier.mutex.Unlock()
+
+		s.mutex.Lock()
+		closed := s.closed
+		s.mutex.Unlock()
+		if closed || idle >= s.idle {
+			return nil, false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *frontierScheduler) Len() int {
+	s.frontier.mutex.Lock()
+	defer s.frontier.mutex.Unlock()
+	return len(s.frontier.queue)
+}
+
+func (s *frontierScheduler) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+}
+
+func TestCrawlersSharingFrontier(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(w, "ok")
+	}))
+	defer srv.Close()
+
+	delay, concurrent := DownloadDelay, ConcurrentRequests
+	DownloadDelay, ConcurrentRequests = 0, 2
+	defer func() { DownloadDelay, ConcurrentRequests = delay, concurrent }()
+
+	shared := &frontier{}
+	newCrawler := func() *Crawler {
+		var c *Crawler
+		b := DefaultCrawlerBuilder()
+		b.SetScheduler(&frontierScheduler{frontier: shared, idle: 500 * time.Millisecond})
+		b.AddParser("parser", func(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+			// The start page of the first crawler yields the pages for both crawlers,
+			// and the second crawler is kept running to pop some of them.
+			switch req.URL {
+			case srv.URL + "/a":
+				for i := 0; i < 20; i++ {
+					c.NewRequest(leiogo.NewRequest(fmt.Sprintf("%s/page/%d", srv.URL, i)), res, spider)
+				}
+			case srv.URL + "/b":
+				time.Sleep(300 * time.Millisecond)
+			}
+		})
+		c = b.Build()
+		return c
+	}
+	crawlers := []*Crawler{newCrawler(), newCrawler()}
+	starts := []string{"/a", "/b"}
+
+	done := make(chan int, 2)
+	var crawled [2]int
+	for i, c := range crawlers {
+		go func(i int, c *Crawler) {
+			spider := &leiogo.Spider{Name: fmt.Sprintf("shared%d", i), StartURLs: []*leiogo.Request{leiogo.NewRequest(srv.URL + starts[i])}}
+			crawled[i] = c.Crawl(spider).Crawled
+			done <- i
+		}(i, c)
+	}
+
+	for range crawlers {
+		select {
+		case <-done:
+		case <-time.After(20 * time.Second):
+			t.Fatal("the crawlers sharing the frontier never close")
+		}
+	}
+	if crawled[1] <= 1 {
+		t.Errorf("the second crawler crawled %d pages, want some of the first one's", crawled[1])
+	}
+	if total := crawled[0] + crawled[1]; total != 22 {
+		t.Errorf("crawled %d pages in total, want 22", total)
+	}
+}
+
+// streamConsumer reads the whole stream of the responses.
+type streamConsumer struct {
+	read int
+	err  error
+}
+
+func (c *streamConsumer) Consume(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	body, err := ioutil.ReadAll(res.Stream)
+	c.read, c.err = len(body), err
+	return err
+}
+
+func TestStreamAfterParserTimeout(t *testing.T) {
+	const size = 1 << 20
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", size))
+	}))
+	defer srv.Close()
+
+	delay := DownloadDelay
+	DownloadDelay = 0
+	defer func() { DownloadDelay = delay }()
+
+	consumer := &streamConsumer{}
+	var parsed int
+	var parseErr error
+	b := DefaultCrawlerBuilder()
+	b.AddResponseConsumers(consumer)
+	b.AddParser("parser", func(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+		// The parser ignores the timeout, and keeps reading the stream after it.
+		buf := make([]byte, size/20)
+		for i := 0; i < 10; i++ {
+			n, err := res.Stream.Read(buf)
+			parsed += n
+			if err != nil {
+				parseErr = err
+				return
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	})
+	c := b.Build()
+	c.ParserTimeout = 50 * time.Millisecond
+
+	req := leiogo.NewRequest(srv.URL)
+	req.Meta["stream"] = true
+	c.Crawl(&leiogo.Spider{Name: "stream", StartURLs: []*leiogo.Request{req}})
+
+	if parseErr != nil || parsed == 0 {
+		t.Errorf("the parser read %d bytes, %v, want the stream open until it returns", parsed, parseErr)
+	}
+	if consumer.err != nil || consumer.read != size {
+		t.Errorf("the consumer read %d bytes, %v, want %d", consumer.read, consumer.err, size)
+	}
+}
+
+func TestSlowConsumerStream(t *testing.T) {
+	s := newConsumerStream(8)
+	if _, err := s.Write([]byte("12345")); err != nil {
+		t.Fatalf("write within the buffer failed, %v", err)
+	}
+	// The consumer hasn't read anything, the next write never waits for it.
+	if _, err := s.Write([]byte("67890")); err != errSlowConsumer {
+		t.Errorf("write beyond the buffer returned %v, want %v", err, errSlowConsumer)
+	}
+	if _, err := ioutil.ReadAll(s); err != errSlowConsumer {
+		t.Errorf("the slow consumer read %v, want %v", err, errSlowConsumer)
+	}
+}
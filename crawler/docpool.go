@@ -0,0 +1,52 @@
+package crawler
+
+import (
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo-css/selector"
+)
+
+// DocumentPool shares the parsed documents among the parsers.
+// Parsing a megabyte HTML page allocates heavily, and a parser may run several groups of patterns
+// on the same response, even in different goroutines. With the pool, each response is parsed only once,
+// when the first pattern needs it, and the crawler releases the document after the parser returns,
+// so a document lives no longer than its response. The bodies are read into the pooled buffers by the downloader,
+// see util.ReadAll.
+// The pool is safe for concurrent use, and the zero value is ready to use.
+type DocumentPool struct {
+	docs  map[*leiogo.Response]*pooledDocument
+	mutex sync.Mutex
+}
+
+type pooledDocument struct {
+	once sync.Once
+	doc  *selector.Elements
+}
+
+// Get returns the parsed document of the response, the response body will be parsed
+// if it's the first time. Concurrent callers of the same response will wait for one parsing.
+func (p *DocumentPool) Get(res *leiogo.Response) *selector.Elements {
+	p.mutex.Lock()
+	if p.docs == nil {
+		p.docs = make(map[*leiogo.Response]*pooledDocument)
+	}
+	d, ok := p.docs[res]
+	if !ok {
+		d = &pooledDocument{}
+		p.docs[res] = d
+	}
+	p.mutex.Unlock()
+
+	d.once.Do(func() {
+		d.doc = selector.Parse(string(res.Body))
+	})
+	return d.doc
+}
+
+// Release drops the document of the response, so it can be collected by the GC.
+func (p *DocumentPool) Release(res *leiogo.Response) {
+	p.mutex.Lock()
+	delete(p.docs, res)
+	p.mutex.Unlock()
+}
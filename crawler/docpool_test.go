@@ -0,0 +1,43 @@
+package crawler
+
+import (
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo-css/selector"
+)
+
+// A page of about a megabyte, parsed by the patterns of a parser.
+var benchPage = []byte("<html><body>" + strings.Repeat(`<div class="item"><a href="/p">Page</a><p>Some text of the item</p></div>`, 15000) + "</body></html>")
+
+const benchPatterns = 4
+
+func BenchmarkParsePerPattern(b *testing.B) {
+	res := &leiogo.Response{URL: "http://example.com/", Body: benchPage}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchPatterns; j++ {
+			selector.Parse(string(res.Body))
+		}
+	}
+}
+
+func BenchmarkDocumentPool(b *testing.B) {
+	var pool DocumentPool
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		res := &leiogo.Response{URL: "http://example.com/", Body: benchPage}
+		var wg sync.WaitGroup
+		for j := 0; j < benchPatterns; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				pool.Get(res)
+			}()
+		}
+		wg.Wait()
+		pool.Release(res)
+	}
+}
@@ -0,0 +1,178 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// FeedEntry is an entry of a RSS or Atom feed. PubDate is zero if the date is missing or unknown.
+type FeedEntry struct {
+	Title       string
+	Link        string
+	PubDate     time.Time
+	Description string
+}
+
+// The elements of RSS 2.0, RSS 1.0 (RDF) and Atom share the same struct, the root element tells them apart.
+type xmlFeed struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []xmlFeedItem `xml:"item"`
+	} `xml:"channel"`
+	Items   []xmlFeedItem `xml:"item"`
+	Entries []xmlFeedItem `xml:"entry"`
+}
+
+type xmlFeedItem struct {
+	Title       string `xml:"title"`
+	Description string `xml:"description"`
+	PubDate     string `xml:"pubDate"`
+	Date        string `xml:"date"`
+	Summary     string `xml:"summary"`
+	Content     string `xml:"content"`
+	Published   string `xml:"published"`
+	Updated     string `xml:"updated"`
+	GUID        string `xml:"guid"`
+	Links       []struct {
+		Href string `xml:"href,attr"`
+		Rel  string `xml:"rel,attr"`
+		Text string `xml:",chardata"`
+	} `xml:"link"`
+}
+
+// The layouts of the dates in the feeds, RSS uses RFC 822 with many variants, and Atom uses RFC 3339.
+var feedDateLayouts = []string{
+	time.RFC1123Z, time.RFC1123, time.RFC822Z, time.RFC822, time.RFC3339,
+	"Mon, 2 Jan 2006 15:04:05 -0700", "Mon, 2 Jan 2006 15:04:05 MST", "2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05", "2006-01-02",
+}
+
+func parseFeedDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, layout := range feedDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// ParseFeed parses a RSS 2.0, RSS 1.0 or Atom feed. The relative links are resolved against base.
+// The body should be UTF-8, the downloader has decoded it, so the declared encoding is ignored.
+func ParseFeed(body []byte, base string) ([]*FeedEntry, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	decoder.Strict = false
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) { return input, nil }
+
+	var feed xmlFeed
+	if err := decoder.Decode(&feed); err != nil {
+		return nil, err
+	}
+
+	var items []xmlFeedItem
+	switch strings.ToLower(feed.XMLName.Local) {
+	case "rss":
+		items = feed.Channel.Items
+	case "rdf":
+		items = feed.Items
+	case "feed":
+		items = feed.Entries
+	default:
+		return nil, fmt.Errorf("Unknown feed type %s", feed.XMLName.Local)
+	}
+
+	baseURL, _ := url.Parse(base)
+	entries := make([]*FeedEntry, 0, len(items))
+	for _, item := range items {
+		entry := &FeedEntry{
+			Title:       strings.TrimSpace(item.Title),
+			Description: strings.TrimSpace(firstNonEmpty(item.Description, item.Summary, item.Content)),
+			PubDate:     parseFeedDate(firstNonEmpty(item.PubDate, item.Date, item.Published, item.Updated)),
+		}
+
+		// Atom links are in the href attributes, the alternate one is the entry page.
+		// RSS links are the text, and the guid may be the permalink if there's no link.
+		for _, link := range item.Links {
+			if link.Href != "" && (link.Rel == "" || link.Rel == "alternate") {
+				entry.Link = link.Href
+				break
+			} else if text := strings.TrimSpace(link.Text); text != "" && entry.Link == "" {
+				entry.Link = text
+			}
+		}
+		if entry.Link == "" && strings.HasPrefix(strings.TrimSpace(item.GUID), "http") {
+			entry.Link = strings.TrimSpace(item.GUID)
+		}
+		if baseURL != nil && entry.Link != "" {
+			if u, err := baseURL.Parse(entry.Link); err == nil {
+				entry.Link = u.String()
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if strings.TrimSpace(s) != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// Feed converts the responses of RSS or Atom feeds into items with title, link, pubdate and description,
+// the pubdate is in RFC 3339, and empty if it's unknown. The items also have the url of the feed as feed.
+// If FollowParser isn't empty, the links of the entries are followed and parsed by the parser named FollowParser.
+type Feed struct {
+	FollowParser string
+}
+
+// ParseFeed yields the entries of the feed as items, and follows their links if it's configured.
+func (d *DefaultParser) ParseFeed(f Feed, res *leiogo.Response, spider *leiogo.Spider) {
+	entries, err := ParseFeed(res.Body, res.URL)
+	if err != nil {
+		d.Logger.Error(res.LogContext(spider), "Error at parsing feed %s, %s", res.URL, err)
+		return
+	}
+
+	for _, entry := range entries {
+		pubDate := ""
+		if !entry.PubDate.IsZero() {
+			pubDate = entry.PubDate.Format(time.RFC3339)
+		}
+		d.NewItem(leiogo.NewItem(leiogo.Dict{
+			"title":       entry.Title,
+			"link":        entry.Link,
+			"pubdate":     pubDate,
+			"description": entry.Description,
+			"feed":        res.URL,
+		}), spider)
+
+		if f.FollowParser != "" && entry.Link != "" {
+			req := leiogo.NewRequest(entry.Link)
+			req.ParserName = f.FollowParser
+			d.NewRequest(req, res, spider)
+		}
+	}
+}
+
+// AddFeedParser adds a parser which parses the responses as feeds, see Feed.
+func (c *CrawlerBuilder) AddFeedParser(name string, f Feed) *CrawlerBuilder {
+	if f.FollowParser != "" {
+		c.referParser(f.FollowParser, "feed parser "+name)
+	}
+	d := c.DefaultParser()
+	return c.AddParser(name, middleware.Parser(func(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+		d.ParseFeed(f, res, spider)
+	}))
+}
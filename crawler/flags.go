@@ -0,0 +1,158 @@
+package crawler
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+// The arguments passed to the spider with -a name=value, the spiders read them to
+// decide things like the start urls or the search keywords.
+var SpiderArgs = map[string]string{}
+
+type spiderArgs map[string]string
+
+func (a spiderArgs) String() string {
+	return fmt.Sprint(map[string]string(a))
+}
+
+func (a spiderArgs) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("spider argument should be name=value, get %s", s)
+	}
+	a[kv[0]] = kv[1]
+	return nil
+}
+
+type classWeights map[string]int
+
+func (w classWeights) String() string {
+	return fmt.Sprint(map[string]int(w))
+}
+
+func (w classWeights) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("class weight should be class=weight, get %s", s)
+	}
+	weight, err := strconv.Atoi(kv[1])
+	if err != nil || weight <= 0 {
+		return fmt.Errorf("class weight should be a positive integer, get %s", kv[1])
+	}
+	w[kv[0]] = weight
+	return nil
+}
+
+type logLevel struct{}
+
+func (logLevel) String() string {
+	return log.LevelName(log.LogLevel)
+}
+
+func (logLevel) Set(s string) error {
+	level, err := log.ParseLevel(s)
+	if err == nil {
+		log.LogLevel = level
+	}
+	return err
+}
+
+// The level of a logger name or a spider, like -loglevelfor Downloader=Debug, or -loglevelfor spider:name=Debug.
+type loggerLevel struct{}
+
+func (loggerLevel) String() string {
+	return ""
+}
+
+func (loggerLevel) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("logger level should be name=level, get %s", s)
+	}
+	level, err := log.ParseLevel(kv[1])
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(kv[0], "spider:") {
+		log.SetSpiderLevel(strings.TrimPrefix(kv[0], "spider:"), level)
+	} else {
+		log.SetLevel(kv[0], level)
+	}
+	return nil
+}
+
+type snapshotTime struct{}
+
+func (snapshotTime) String() string {
+	if HttpCacheSnapshot.IsZero() {
+		return ""
+	}
+	return HttpCacheSnapshot.Format(time.RFC3339)
+}
+
+// The snapshot is a RFC 3339 time, or a date which means the end of the day.
+func (snapshotTime) Set(s string) error {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		HttpCacheSnapshot = t
+		return nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", s, time.Local)
+	if err != nil {
+		return fmt.Errorf("snapshot should be a RFC 3339 time or a date, get %s", s)
+	}
+	HttpCacheSnapshot = t.AddDate(0, 0, 1).Add(-time.Nanosecond)
+	return nil
+}
+
+// ParseFlags parses the command line flags into the settings, so the operators can tune a spider
+// without changing the code. The default values of the flags are the current settings,
+// so it should be called after the settings are configured, and before CreateCrawlerBuilder,
+// since the components copy the settings when they are created.
+func ParseFlags() {
+	flag.Var(logLevel{}, "loglevel", "The log level, one of Fatal, Error, Info, Debug, Trace")
+	flag.Var(loggerLevel{}, "loglevelfor", "The log level of a logger name=level, or of a spider spider:name=level, can be repeated")
+	flag.Float64Var(&DownloadDelay, "delay", DownloadDelay, "The delay seconds between the requests")
+	flag.IntVar(&ConcurrentRequests, "concurrency", ConcurrentRequests, "The max concurrent requests")
+	flag.IntVar(&ConcurrentRequestsPerDomain, "concurrency-per-domain", ConcurrentRequestsPerDomain,
+		"The max concurrent requests to each host, 0 means no limitation")
+	flag.IntVar(&MaxConnsPerHost, "conns-per-host", MaxConnsPerHost, "The max connections to each host, 0 means no limitation")
+	flag.StringVar(&HTTPVersion, "http", HTTPVersion, "The HTTP version of the downloader, one of 1.1, 2, empty means the default")
+	flag.IntVar(&DepthLimit, "depth", DepthLimit, "The max depth of the requests, 0 means no limitation")
+	flag.StringVar(&FileSaveDir, "output", FileSaveDir, "The directory to save the downloaded files")
+	flag.StringVar(&JobDir, "jobdir", JobDir, "The directory to save the crawl state, so the crawl can be resumed")
+	flag.StringVar(&ManifestFile, "manifest", ManifestFile, "The file to record the saved files, empty means no manifest")
+	flag.BoolVar(&VerifyManifest, "verify", VerifyManifest, "Only re-download the missing or corrupt files of the manifest")
+	flag.BoolVar(&HttpCacheEnabled, "httpcache", HttpCacheEnabled, "Cache the pages, and answer the requests from the cache")
+	flag.Var(snapshotTime{}, "snapshot", "Answer the requests from the HTTP cache as of the time, and never download the pages")
+	flag.StringVar(&FixtureMode, "fixtures", FixtureMode, "Record the responses as the fixtures, or replay them, one of record, replay")
+	flag.StringVar(&FixtureDir, "fixturedir", FixtureDir, "The directory of the fixtures")
+	flag.StringVar(&WARCDir, "warc", WARCDir, "The directory to record the WARC files, empty means no recording")
+	flag.StringVar(&BodyStoreDir, "bodystore", BodyStoreDir, "The directory to store the bodies of the cache and the WARC files once by their contents")
+	flag.BoolVar(&RerenderEmptyPages, "rerender", RerenderEmptyPages, "Render the pages yielding nothing again with phantomjs")
+	flag.StringVar(&PolitenessFile, "politeness", PolitenessFile, "The file to save the politeness report of the hosts, empty means not to save it")
+	flag.IntVar(&ItemSampleSize, "sample", ItemSampleSize, "The number of the random items to log when the spider closes, 0 means no sample")
+	flag.StringVar(&ItemSampleFile, "samplefile", ItemSampleFile, "The file to save the item sample, empty means to log it")
+	flag.StringVar(&SitemapFile, "sitemap", SitemapFile, "The file to write the sitemap of the crawled pages, empty means no sitemap")
+	flag.StringVar(&SitemapFormat, "sitemapformat", SitemapFormat, "The format of the sitemap, one of xml, txt")
+	flag.StringVar(&ScreenshotDir, "screenshots", ScreenshotDir, "The directory to save the screenshots of the rendered pages, empty means not to save them")
+	flag.IntVar(&PhantomWorkers, "phantomworkers", PhantomWorkers, "The number of the long-lived phantomjs workers, 0 means a new phantomjs for every page")
+	flag.StringVar(&SEOReportFile, "seoreport", SEOReportFile, "The file to save the SEO report of the crawled pages, empty means no audit")
+	flag.StringVar(&SchedulerOrder, "scheduler", SchedulerOrder, "The order of the requests, one of priority, fifo, lifo")
+	flag.StringVar(&SchedulerDir, "schedulerdir", SchedulerDir, "The directory the request queue spills to, empty keeps the queue in memory")
+	flag.Var(classWeights(SchedulerClasses), "class", "The weight of a traffic class class=weight, can be repeated")
+	flag.IntVar(&DepthAdaptivePages, "adaptivedepth", DepthAdaptivePages, "The pages at each depth before pruning the branches yielding no items, 0 disables it")
+	flag.BoolVar(&StrictCompliance, "strict", StrictCompliance, "Follow the strict compliance profile, like robots.txt and the identity headers")
+	flag.StringVar(&ComplianceFrom, "from", ComplianceFrom, "The contact of the operator in the From header, required by -strict")
+	flag.StringVar(&UserAgent, "useragent", UserAgent, "The user agent of the requests")
+	flag.BoolVar(&ChromeEnabled, "chrome", ChromeEnabled, "Render the requests with 'render' in the meta by headless Chrome")
+	flag.StringVar(&RunID, "runid", RunID, "The ID of the run, empty means a generated one")
+	flag.StringVar(&RunSummaryFile, "summary", RunSummaryFile, "The file to save the result of the crawl, empty means not to save it")
+	flag.Int64Var(&RandomSeed, "seed", RandomSeed, "The seed of the random generators, 0 means a random seed")
+	flag.Var(spiderArgs(SpiderArgs), "a", "A spider argument name=value, can be repeated")
+	flag.Parse()
+}
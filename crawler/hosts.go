@@ -0,0 +1,57 @@
+package crawler
+
+import (
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// HostTokens limits the concurrent requests to each host, the limit of a host is
+// the "ConcurrentRequests" of the HostSettings, or the ConcurrentRequestsPerDomain of the crawler,
+// and 0 means no limitation.
+// The worker acquires the host token after it has got the global one. If the host is busy,
+// the worker gives the global token back while it waits, and gets it again after the host token,
+// so the requests of a host with a low limit don't take all the global tokens from the others.
+type HostTokens struct {
+	tokens map[string]*Tokens
+	mutex  sync.Mutex
+}
+
+func (h *HostTokens) get(host string, limit int) *Tokens {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.tokens == nil {
+		h.tokens = make(map[string]*Tokens)
+	}
+	t, ok := h.tokens[host]
+	if !ok {
+		t = NewTokens(limit)
+		h.tokens[host] = t
+	}
+	return t
+}
+
+// Acquire a token for the host of the request, and return the function to release it,
+// which is safe to call more than once. The token is held only for the download, not for the parser,
+// so a parser looking up another host never holds a host token while waiting for one, see Lookup.
+// If global isn't nil, it's the token held by the worker, which is released while waiting for the host.
+func (c *Crawler) acquireHost(req *leiogo.Request, global *Tokens) func() {
+	limit := c.HostSettings.Int(req.URL, "ConcurrentRequests", c.ConcurrentRequestsPerDomain)
+	if limit <= 0 {
+		return func() {}
+	}
+	t := c.hostTokens.get(util.GetHost(req.URL), limit)
+	if !t.TryAcquire() {
+		if global != nil {
+			global.Release()
+		}
+		t.Acquire()
+		if global != nil {
+			global.Acquire()
+		}
+	}
+	var once sync.Once
+	return func() { once.Do(t.Release) }
+}
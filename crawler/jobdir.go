@@ -0,0 +1,117 @@
+package crawler
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// The crawler is able to persist its state to the JobDir, so a long crawl can be stopped by ctrl+c
+// and resumed by the next run with the same JobDir. The state contains:
+// the pending requests, which are refused, not crawled yet, or cancelled after the user interrupt;
+// and the states of all the components implementing the Persistent interface,
+// like the urls in the CacheMiddleware and the counters in the StatusInfo.
+
+// All the components which may implement the Persistent interface.
+func (c *Crawler) components() []interface{} {
+	var cs []interface{}
+	for _, m := range c.OpenCloses {
+		cs = append(cs, m)
+	}
+	for _, m := range c.DownloadMiddlewares {
+		cs = append(cs, m)
+	}
+	for _, m := range c.SpiderMiddlewares {
+		cs = append(cs, m)
+	}
+	for _, p := range c.ItemPipelines {
+		cs = append(cs, p)
+	}
+	return cs
+}
+
+// The job directory of the spider, the spiders of different tenants never share their states,
+// so it's the directory of the tenant under the JobDir if the spider has a Tenant.
+func (c *Crawler) jobDir(spider *leiogo.Spider) string {
+	if spider.Tenant == "" {
+		return c.JobDir
+	}
+	return path.Join(c.JobDir, spider.Tenant)
+}
+
+// Load the states from the job directory, and return the pending requests of the previous run.
+func (c *Crawler) loadJob(spider *leiogo.Spider) []*leiogo.Request {
+	dir := c.jobDir(spider)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		c.Logger.Error(spider.Name, "Create job directory failed, %s", err.Error())
+		return nil
+	}
+
+	for _, m := range c.components() {
+		if p, ok := m.(middleware.Persistent); ok {
+			if err := p.LoadState(dir); err != nil {
+				c.Logger.Error(spider.Name, "Load state of %T failed, %s", m, err.Error())
+			}
+		}
+	}
+
+	var reqs []*leiogo.Request
+	if err := util.LoadGob(path.Join(dir, "requests.gob"), &reqs); err != nil {
+		c.Logger.Error(spider.Name, "Load pending requests failed, %s", err.Error())
+	} else if len(reqs) != 0 {
+		c.Logger.Info(spider.Name, "Resume %d pending requests from %s", len(reqs), dir)
+	}
+	if runs := c.StatusInfo.PreviousRuns; len(runs) != 0 {
+		c.Logger.Info(spider.Name, "Continue the runs %s", strings.Join(runs, ", "))
+	}
+	return reqs
+}
+
+// Save the states and the pending requests to the job directory.
+// When the crawl completes, there's no pending request, so the next run will start over
+// from the start urls, but still skip the cached ones.
+func (c *Crawler) saveJob(spider *leiogo.Spider) {
+	dir := c.jobDir(spider)
+	for _, m := range c.components() {
+		if p, ok := m.(middleware.Persistent); ok {
+			if err := p.SaveState(dir); err != nil {
+				c.Logger.Error(spider.Name, "Save state of %T failed, %s", m, err.Error())
+			}
+		}
+	}
+
+	c.pendingMutex.Lock()
+	defer c.pendingMutex.Unlock()
+
+	// The callbacks can't be saved, the requests will be parsed by ParserName in the next run.
+	callbacks := 0
+	for _, req := range c.pending {
+		if req.Callback != nil {
+			callbacks++
+		}
+	}
+	if callbacks != 0 {
+		c.Logger.Error(spider.Name, "%d pending requests have callbacks, they will be parsed by ParserName after resuming", callbacks)
+	}
+
+	if err := util.SaveGob(path.Join(dir, "requests.gob"), c.pending); err != nil {
+		// The pending requests are lost, it is counted in the storage errors of the result.
+		err = fmt.Errorf("Save %d pending requests failed, they will not be resumed, %s", len(c.pending), err)
+		c.Logger.Error(spider.Name, "%s", err)
+		c.StatusInfo.AddStorageError(err)
+	} else {
+		c.Logger.Info(spider.Name, "Saved %d pending requests to %s", len(c.pending), dir)
+	}
+}
+
+// Keep a request which won't be crawled in this run, it will be saved to the job directory.
+func (c *Crawler) addPending(req *leiogo.Request) {
+	c.pendingMutex.Lock()
+	c.pending = append(c.pending, req)
+	c.pendingMutex.Unlock()
+}
@@ -0,0 +1,44 @@
+package crawler
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+func TestSaveJobWithHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jobdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	req := leiogo.NewRequest("http://example.com/a")
+	req.Meta["headers"] = map[string]string{"Referer": "http://example.com/"}
+	req.Meta["cookies"] = map[string]string{"session": "abc"}
+	req.Meta["__retryat__"] = time.Now().UnixNano()
+
+	spider := &leiogo.Spider{Name: "test"}
+	c := &Crawler{Logger: log.New("Crawler"), JobDir: dir, StatusInfo: StatusInfo{Logger: log.New("StatusInfo")}}
+	c.addPending(req)
+	c.saveJob(spider)
+	if c.StatusInfo.StorageErrors != 0 {
+		t.Fatalf("save pending requests failed, %v", c.StatusInfo.ErrorSamples)
+	}
+
+	resumed := (&Crawler{Logger: log.New("Crawler"), JobDir: dir}).loadJob(spider)
+	if len(resumed) != 1 {
+		t.Fatalf("got %d resumed requests, want 1", len(resumed))
+	}
+	headers, ok := resumed[0].Meta["headers"].(map[string]string)
+	if !ok || headers["Referer"] != "http://example.com/" {
+		t.Errorf("got headers %v, want the Referer", resumed[0].Meta["headers"])
+	}
+	if cookies, _ := resumed[0].Meta["cookies"].(map[string]string); cookies["session"] != "abc" {
+		t.Errorf("got cookies %v, want the session", resumed[0].Meta["cookies"])
+	}
+}
@@ -0,0 +1,309 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
+	"golang.org/x/net/html"
+)
+
+// The parsers of the link checker, the pages are crawled by LinkCheckParser, and the other links
+// are only checked by linkCheckHead.
+const (
+	LinkCheckParser = "linkcheck"
+	linkCheckHead   = "linkcheck-head"
+)
+
+// BrokenLink is a link which responds 4xx or 5xx, or can't be downloaded, and the pages linking to it.
+type BrokenLink struct {
+	URL       string   `json:"url"`
+	Status    int      `json:"status,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Referrers []string `json:"referrers"`
+}
+
+// LinkChecker crawls a site and checks all its links, the internal pages are crawled, and the other links,
+// like the images, the scripts and the external pages, are checked by HEAD requests if UseHEAD is true,
+// and by GET requests if the servers don't support HEAD. The external links are checked only if External is true.
+// The internal domains are the Domains, or the hosts of the start urls if it's empty, the spider
+// shouldn't have AllowedDomains, otherwise the external links are dropped before being checked.
+// The broken links and their referring pages are saved to the Report as JSON when the spider closes.
+// See CrawlerBuilder.AddLinkChecker.
+type LinkChecker struct {
+	Logger   log.Logger
+	Domains  []string
+	External bool
+	UseHEAD  bool
+	Report   string
+
+	Checked int
+
+	parser    DefaultParser
+	referrers map[string]map[string]bool
+	pages     map[string]bool
+	broken    map[string]*BrokenLink
+	mutex     sync.Mutex
+}
+
+func (l *LinkChecker) Open(spider *leiogo.Spider) error {
+	l.referrers = make(map[string]map[string]bool)
+	l.pages = make(map[string]bool)
+	l.broken = make(map[string]*BrokenLink)
+	if len(l.Domains) == 0 {
+		for _, req := range spider.StartURLs {
+			l.Domains = append(l.Domains, util.Hostname(req.URL))
+		}
+	}
+	return nil
+}
+
+func (l *LinkChecker) Close(reason string, spider *leiogo.Spider) error {
+	broken := l.Broken()
+	l.Logger.Info(spider.Name, "Checked %d links, %d are broken", l.Checked, len(broken))
+	if l.Report == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(broken, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(l.Report, buf, 0644)
+}
+
+// Broken returns the broken links found so far, sorted by their urls.
+func (l *LinkChecker) Broken() []*BrokenLink {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	broken := make([]*BrokenLink, 0, len(l.broken))
+	for _, b := range l.broken {
+		copied := *b
+		copied.Referrers = l.sortedReferrers(b.URL)
+		broken = append(broken, &copied)
+	}
+	sort.Slice(broken, func(i, j int) bool { return broken[i].URL < broken[j].URL })
+	return broken
+}
+
+func (l *LinkChecker) sortedReferrers(link string) []string {
+	referrers := make([]string, 0, len(l.referrers[link]))
+	for r := range l.referrers[link] {
+		referrers = append(referrers, r)
+	}
+	sort.Strings(referrers)
+	return referrers
+}
+
+func (l *LinkChecker) internal(link string) bool {
+	host := util.Hostname(link)
+	for _, domain := range l.Domains {
+		if util.MatchDomain(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Spider returns a spider checking the site from the urls.
+func (l *LinkChecker) Spider(name string, urls ...string) *leiogo.Spider {
+	spider := &leiogo.Spider{Name: name}
+	for _, u := range urls {
+		req := leiogo.NewRequest(u)
+		req.ParserName = LinkCheckParser
+		req.ErrbackName = LinkCheckParser
+		spider.StartURLs = append(spider.StartURLs, req)
+	}
+	return spider
+}
+
+// Parse an internal page, and follow its links. A link is requested once, and the later pages
+// linking to it are only added to its referrers. But an internal page first seen as a resource,
+// like by a <link> in the head, is requested again to be crawled when a page links to it.
+// The relative links are resolved against the final url of the page, after the redirects.
+func (l *LinkChecker) parsePage(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	l.check()
+	if !strings.Contains(strings.ToLower(res.Header.Get("Content-Type")), "html") {
+		return
+	}
+	// An internal link redirected to another site is checked, but the other site isn't crawled.
+	final := res.FinalURL()
+	if !l.internal(final) {
+		return
+	}
+
+	for _, link := range extractLinks(res.Body, final) {
+		internal := l.internal(link.url)
+		crawl := internal && link.page
+
+		l.mutex.Lock()
+		refs, seen := l.referrers[link.url]
+		if !seen {
+			refs = make(map[string]bool)
+			l.referrers[link.url] = refs
+		}
+		refs[res.URL] = true
+		crawled := l.pages[link.url]
+		if crawl {
+			l.pages[link.url] = true
+		}
+		l.mutex.Unlock()
+
+		if (seen && (!crawl || crawled)) || (!internal && !l.External) {
+			continue
+		}
+
+		next := leiogo.NewRequest(link.url)
+		next.ErrbackName = LinkCheckParser
+		if crawl {
+			next.ParserName = LinkCheckParser
+			if seen {
+				next.Meta["dontfilter"] = true
+			}
+		} else {
+			next.ParserName = linkCheckHead
+			if l.UseHEAD {
+				next.Meta["method"] = "HEAD"
+			}
+		}
+		l.parser.NewRequest(next, res, spider)
+	}
+}
+
+func (l *LinkChecker) check() {
+	l.mutex.Lock()
+	l.Checked++
+	l.mutex.Unlock()
+}
+
+// The 4xx and 5xx responses are broken, except the HEAD requests refused by the servers,
+// they are checked again by GET.
+func (l *LinkChecker) parseError(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	if method, _ := req.Meta["method"].(string); method == "HEAD" && (res.StatusCode == 405 || res.StatusCode == 501) {
+		l.Logger.Debug(req.LogContext(spider), "%s doesn't support HEAD, check it by GET", req.URL)
+		next := leiogo.NewRequest(req.URL)
+		next.ParserName = linkCheckHead
+		next.ErrbackName = LinkCheckParser
+		next.Meta["dontfilter"] = true
+		l.parser.NewRequest(next, res, spider)
+		return
+	}
+	l.check()
+	l.addBroken(&BrokenLink{URL: req.URL, Status: res.StatusCode})
+}
+
+func (l *LinkChecker) errback(err error, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	l.check()
+	l.addBroken(&BrokenLink{URL: req.URL, Error: err.Error()})
+}
+
+func (l *LinkChecker) addBroken(b *BrokenLink) {
+	l.mutex.Lock()
+	l.broken[b.URL] = b
+	l.mutex.Unlock()
+}
+
+// AddLinkChecker turns the crawler into a link checker, see LinkChecker. The spider is created by its Spider method.
+func (c *CrawlerBuilder) AddLinkChecker(l *LinkChecker) *CrawlerBuilder {
+	l.parser = c.DefaultParser()
+	ok := middleware.Parser(func(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) { l.check() })
+	for _, name := range []string{LinkCheckParser, linkCheckHead} {
+		c.AddStatusParser(name, "4xx", l.parseError)
+		c.AddStatusParser(name, "5xx", l.parseError)
+	}
+	return c.AddParser(LinkCheckParser, l.parsePage).
+		AddParser(linkCheckHead, ok).
+		AddErrback(LinkCheckParser, l.errback).
+		AddOpenCloses(l)
+}
+
+// A link on a page, page is false for the resources like the images, which are never parsed.
+// The <link> elements are resources, except the ones to other pages, like rel="next", see pageRels.
+type pageLink struct {
+	url  string
+	page bool
+}
+
+// The attributes of the links, by the elements.
+var linkAttrs = map[string]string{
+	"a": "href", "area": "href", "iframe": "src", "frame": "src",
+	"img": "src", "script": "src", "link": "href", "source": "src", "video": "src", "audio": "src",
+}
+
+// The rel of the <link> elements linking to pages.
+var pageRels = map[string]bool{"canonical": true, "alternate": true, "next": true, "prev": true, "previous": true}
+
+// Extract the http links of the page, they are resolved against the base, and the fragments are removed.
+func extractLinks(body []byte, base string) []pageLink {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return nil
+	}
+
+	var links []pageLink
+	// The index of each link in links, a link found again as a page makes the first one a page.
+	seen := make(map[string]int)
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if n.Data == "base" {
+				if u, err := baseURL.Parse(nodeAttr(n, "href")); err == nil {
+					baseURL = u
+				}
+			}
+			if key, ok := linkAttrs[n.Data]; ok {
+				if href := strings.TrimSpace(nodeAttr(n, key)); href != "" {
+					if u, err := baseURL.Parse(href); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+						u.Fragment = ""
+						s, page := u.String(), isPageLink(n)
+						if i, ok := seen[s]; ok {
+							links[i].page = links[i].page || page
+						} else {
+							seen[s] = len(links)
+							links = append(links, pageLink{url: s, page: page})
+						}
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return links
+}
+
+func isPageLink(n *html.Node) bool {
+	switch n.Data {
+	case "a", "area", "iframe", "frame":
+		return true
+	case "link":
+		for _, rel := range strings.Fields(strings.ToLower(nodeAttr(n, "rel"))) {
+			if pageRels[rel] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func nodeAttr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
@@ -0,0 +1,171 @@
+package crawler
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// lookupCall is a lookup in flight or done, the callers of the same request wait for the first one.
+type lookupCall struct {
+	done chan struct{}
+	res  *leiogo.Response
+	err  error
+}
+
+// lookupCache remembers the recent lookups by the fingerprints of their requests.
+// The oldest lookups are forgotten when there are more than size of them.
+type lookupCache struct {
+	calls map[string]*lookupCall
+	keys  []string
+	mutex sync.Mutex
+}
+
+// Get the call of the key, the second result is true if the caller has to make the call.
+func (l *lookupCache) get(key string, size int) (*lookupCall, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.calls == nil {
+		l.calls = make(map[string]*lookupCall)
+	}
+	if call, ok := l.calls[key]; ok {
+		return call, false
+	}
+	call := &lookupCall{done: make(chan struct{})}
+	if size > 0 {
+		l.calls[key] = call
+		l.keys = append(l.keys, key)
+		if len(l.keys) > size {
+			delete(l.calls, l.keys[0])
+			l.keys = l.keys[1:]
+		}
+	}
+	return call, true
+}
+
+// Forget a failed lookup, so it can be tried again later.
+func (l *lookupCache) forget(key string, call *lookupCall) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.calls[key] == call {
+		delete(l.calls, key)
+	}
+}
+
+// Lookup downloads an auxiliary request in the parser and returns its response, like resolving a shortlink
+// or asking an API for the details of an item. Unlike http.Get, the request goes through the crawler:
+// the spider middlewares check it as a new request of the parent response, the download middlewares
+// delay it, set its headers, proxies and cookies, and drop it if it's offsite or disallowed, the RateLimiter
+// and the ConcurrentRequests of its host limit its download.
+//
+// The lookups are not parsed, so the ProcessResponse methods of the middlewares are skipped, and a lookup
+// is retried in place for LookupRetryTimes on the download errors and the 5xx responses instead of being
+// rescheduled. The responses are never streamed, and the latest LookupCacheSize lookups are remembered
+// by their fingerprints, so the same lookup from many pages is downloaded once. The responses are shared
+// by the callers, so they should never be modified.
+//
+// The lookup works on a copy of the request, so its meta never leaks into the request of the caller,
+// which may still be yielded as a page and checked by the dupe filter.
+//
+// The error is the error of a middleware dropping the request, or the download error.
+// The response of an error status is returned without an error.
+func (c *Crawler) Lookup(req *leiogo.Request, parRes *leiogo.Response, spider *leiogo.Spider) (*leiogo.Response, error) {
+	req = &leiogo.Request{
+		URL:         req.URL,
+		Meta:        req.Meta.Copy(),
+		ParserName:  req.ParserName,
+		Callback:    req.Callback,
+		Priority:    req.Priority,
+		ErrbackName: req.ErrbackName,
+	}
+	delete(req.Meta, "stream")
+	trace(req)
+	key := req.Fingerprint()
+	call, owner := c.lookups.get(key, c.LookupCacheSize)
+	if !owner {
+		<-call.done
+		return call.res, call.err
+	}
+
+	// The waiters are released however the lookup ends, a panic of a middleware fails them with errLookupAborted.
+	call.err = errLookupAborted
+	defer func() {
+		if call.err != nil {
+			c.lookups.forget(key, call)
+		}
+		close(call.done)
+	}()
+	call.res, call.err = c.lookup(req, parRes, spider)
+	return call.res, call.err
+}
+
+var errLookupAborted = errors.New("Lookup aborted")
+
+func (c *Crawler) lookup(req *leiogo.Request, parRes *leiogo.Response, spider *leiogo.Spider) (*leiogo.Response, error) {
+	if parRes != nil {
+		for _, m := range c.SpiderMiddlewares {
+			if err := m.ProcessNewRequest(req, parRes, spider); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// The lookup is downloaded once, the dupe filter would drop the requests of the same url, like the retries.
+	req.Meta["dontfilter"] = true
+
+	for retry := 0; ; retry++ {
+		// The parser is waiting anyway, so the lookup waits for the deferring middlewares in place.
+		for until := c.deferUntil(req, spider); !until.IsZero(); until = c.deferUntil(req, spider) {
+			time.Sleep(time.Until(until))
+		}
+		for _, m := range c.DownloadMiddlewares {
+			if err := m.ProcessRequest(req, spider); err != nil {
+				c.politeness.drop(req, err)
+				return nil, err
+			}
+		}
+
+		res := c.cachedResponse(req, spider)
+		if res == nil {
+			if c.RateLimiter != nil {
+				c.RateLimiter.Wait()
+			}
+			release := c.acquireHost(req, nil)
+			ctx, cancel := c.requestContext(req)
+			downloaded := c.politeness.download(req)
+			res = c.Downloader.Download(ctx, req, spider)
+			downloaded(res)
+			cancel()
+			release()
+		}
+		c.StatusInfo.AddHost(util.GetHost(req.URL), res.Err != nil || res.StatusCode >= 400)
+
+		if (res.Err == nil && res.StatusCode < 500) || retry >= c.LookupRetryTimes || c.StatusInfo.IsCancelled() {
+			c.Logger.Debug(req.LogContext(spider), "Lookup %s, status %d", req.URL, res.StatusCode)
+			return res, res.Err
+		}
+		c.Logger.Debug(req.LogContext(spider), "Retry lookup %s", req.URL)
+		time.Sleep(time.Duration(1<<uint(retry)) * time.Second)
+	}
+}
+
+// LookupURL looks up the url for the parser, see Crawler.Lookup.
+// The errors are logged, and the response is nil on an error.
+func (d *DefaultParser) LookupURL(url string, parRes *leiogo.Response, spider *leiogo.Spider) *leiogo.Response {
+	req := leiogo.NewRequest(url)
+	res, err := d.Lookup(req, parRes, spider)
+	if err != nil {
+		if _, ok := err.(*middleware.DropTaskError); ok {
+			d.Logger.Debug(req.LogContext(spider), "Drop lookup %s, %s", url, err)
+		} else {
+			d.Logger.Error(req.LogContext(spider), "Lookup %s failed, %s", url, err)
+		}
+		return nil
+	}
+	return res
+}
@@ -0,0 +1,27 @@
+package crawler
+
+import (
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// The requests to re-download the files of the manifest which are missing or corrupt on the disk.
+// They skip the CacheMiddleware, since their urls have been crawled.
+func (c *Crawler) verifyManifest(spider *leiogo.Spider) []*leiogo.Request {
+	bad, err := middleware.OpenManifest(c.ManifestFile).Verify()
+	if err != nil {
+		c.Logger.Error(spider.Name, "Verify manifest %s failed, %s", c.ManifestFile, err.Error())
+		return nil
+	}
+	c.Logger.Info(spider.Name, "Found %d missing or corrupt files in %s", len(bad), c.ManifestFile)
+
+	var reqs []*leiogo.Request
+	for _, entry := range bad {
+		req := leiogo.NewRequest(entry.URL)
+		req.Meta["__type__"] = "file"
+		req.Meta["__filepath__"] = entry.Path
+		req.Meta["dontfilter"] = true
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
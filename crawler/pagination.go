@@ -0,0 +1,65 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// Pagination follows the cursors of a cursor-paginated JSON API.
+// It extracts the cursor of the next page from the response by CursorPath (see util.JSONPath),
+// and creates the request of the next page by replacing "{cursor}" in URLTemplate with the escaped cursor.
+// The pagination stops when the cursor is missing, null, false or an empty string.
+type Pagination struct {
+	CursorPath  string
+	URLTemplate string
+
+	// The max number of pages to follow, 0 means no limitation.
+	MaxPages int
+}
+
+// Next returns the request of the next page, or nil if there's no more page.
+// The next request is parsed by the same parser, and carries the cursor and the page number
+// in its meta as 'cursor' and 'page'.
+func (p *Pagination) Next(res *leiogo.Response, req *leiogo.Request) (*leiogo.Request, error) {
+	var data interface{}
+	if err := json.Unmarshal(res.Body, &data); err != nil {
+		return nil, err
+	}
+
+	val, ok := util.JSONPath(data, p.CursorPath)
+	if !ok || val == nil || val == false || val == "" {
+		return nil, nil
+	}
+
+	page := 1
+	if n, ok := req.Meta["page"].(int); ok {
+		page = n
+	}
+	if p.MaxPages > 0 && page >= p.MaxPages {
+		return nil, nil
+	}
+
+	// JSON numbers are decoded as float64, %v prints the integers without the decimal point.
+	cursor := fmt.Sprintf("%v", val)
+	next := leiogo.NewRequest(strings.Replace(p.URLTemplate, "{cursor}", url.QueryEscape(cursor), -1))
+	next.ParserName = req.ParserName
+	next.Callback = req.Callback
+	next.Meta["cursor"] = cursor
+	next.Meta["page"] = page + 1
+	return next, nil
+}
+
+// FollowCursor yields the request of the next page, if there is one.
+func (d *DefaultParser) FollowCursor(p Pagination, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	if next, err := p.Next(res, req); err != nil {
+		d.Logger.Error(req.LogContext(spider), "Error at extracting cursor from %s, %s", res.URL, err)
+	} else if next != nil {
+		d.Logger.Debug(req.LogContext(spider), "Follow cursor %s of %s", next.Meta["cursor"], res.URL)
+		d.NewRequest(next, res, spider)
+	}
+}
@@ -0,0 +1,182 @@
+package crawler
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// HostPoliteness tells how the crawler behaved to a host, the evidence when the site owners ask.
+type HostPoliteness struct {
+	Host     string `json:"host"`
+	Requests int    `json:"requests"`
+
+	// The delay of the DelayMiddleware for the host, and the seconds between the starts of two downloads,
+	// which may be shorter than the delay, since the delays of the concurrent requests overlap.
+	ConfiguredDelay float64 `json:"configured_delay"`
+	AverageInterval float64 `json:"average_interval"`
+	MinInterval     float64 `json:"min_interval"`
+
+	// The max downloads from the host at the same time.
+	MaxConcurrency int `json:"max_concurrency"`
+
+	// The responses telling the crawler to slow down or go away.
+	TooManyRequests int `json:"too_many_requests"`
+	Forbidden       int `json:"forbidden"`
+
+	// The requests dropped by the download middlewares before they are sent, like the off site
+	// or the denied ones, by the reasons. The duplicated requests are not counted.
+	Dropped map[string]int `json:"dropped,omitempty"`
+}
+
+type hostActivity struct {
+	HostPoliteness
+
+	active    int
+	last      time.Time
+	intervals time.Duration
+	min       time.Duration
+}
+
+// politeness records the downloads of each host for the report.
+type politeness struct {
+	hosts map[string]*hostActivity
+	mutex sync.Mutex
+}
+
+func (p *politeness) host(url string) *hostActivity {
+	host := util.GetHost(url)
+	if p.hosts == nil {
+		p.hosts = make(map[string]*hostActivity)
+	}
+	h, ok := p.hosts[host]
+	if !ok {
+		h = &hostActivity{HostPoliteness: HostPoliteness{Host: host}}
+		p.hosts[host] = h
+	}
+	return h
+}
+
+// Record the start of a download, and return the function to record its end with the response.
+func (p *politeness) download(req *leiogo.Request) func(res *leiogo.Response) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	h := p.host(req.URL)
+	now := time.Now()
+	if !h.last.IsZero() {
+		interval := now.Sub(h.last)
+		h.intervals += interval
+		if h.min == 0 || interval < h.min {
+			h.min = interval
+		}
+	}
+	h.last = now
+	h.Requests++
+	h.active++
+	if h.active > h.MaxConcurrency {
+		h.MaxConcurrency = h.active
+	}
+
+	return func(res *leiogo.Response) {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		h.active--
+		switch res.StatusCode {
+		case 429:
+			h.TooManyRequests++
+		case 403:
+			h.Forbidden++
+		}
+	}
+}
+
+// Record a request dropped by a download middleware.
+func (p *politeness) drop(req *leiogo.Request, err error) {
+	drop, ok := err.(*middleware.DropTaskError)
+	if !ok || drop.Rescheduled || drop.Message == "URL already parsed" {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	h := p.host(req.URL)
+	if h.Dropped == nil {
+		h.Dropped = make(map[string]int)
+	}
+	h.Dropped[drop.Message]++
+}
+
+// The politeness of the hosts, the busiest hosts go first.
+func (c *Crawler) politenessReport(spider *leiogo.Spider) []*HostPoliteness {
+	var delay *middleware.DelayMiddleware
+	for _, m := range c.DownloadMiddlewares {
+		if d, ok := m.(*middleware.DelayMiddleware); ok {
+			delay = d
+		}
+	}
+
+	c.politeness.mutex.Lock()
+	defer c.politeness.mutex.Unlock()
+
+	report := make([]*HostPoliteness, 0, len(c.politeness.hosts))
+	for _, h := range c.politeness.hosts {
+		host := h.HostPoliteness
+		if h.Requests > 1 {
+			host.AverageInterval = (h.intervals / time.Duration(h.Requests-1)).Seconds()
+		}
+		host.MinInterval = h.min.Seconds()
+		if delay != nil {
+			host.ConfiguredDelay = delay.HostSettings.Float("http://"+h.Host+"/", "DownloadDelay", delay.GetDownloadDelay())
+		}
+		report = append(report, &host)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Requests != report[j].Requests {
+			return report[i].Requests > report[j].Requests
+		}
+		return report[i].Host < report[j].Host
+	})
+	return report
+}
+
+// The max hosts in the politeness logs, all of them are in the PolitenessFile.
+const maxPolitenessLogs = 20
+
+// Log the politeness of the busiest hosts, and save all of them to the PolitenessFile if it's not empty.
+func (c *Crawler) reportPoliteness(report []*HostPoliteness, spider *leiogo.Spider) {
+	for i, h := range report {
+		if i == maxPolitenessLogs {
+			c.Logger.Info(spider.Name, "Politeness of %d more hosts are not shown", len(report)-i)
+			break
+		}
+		c.Logger.Info(spider.Name, "Politeness %s - requests: %d, delay: %.2fs, interval: %.2fs (min %.2fs), concurrency: %d, 429: %d, 403: %d, dropped: %d",
+			h.Host, h.Requests, h.ConfiguredDelay, h.AverageInterval, h.MinInterval, h.MaxConcurrency,
+			h.TooManyRequests, h.Forbidden, sum(h.Dropped))
+	}
+
+	if c.PolitenessFile == "" {
+		return
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(c.PolitenessFile, buf, 0644)
+	}
+	if err != nil {
+		c.Logger.Error(spider.Name, "Save the politeness report to %s failed, %s", c.PolitenessFile, err)
+	}
+}
+
+func sum(counts map[string]int) int {
+	n := 0
+	for _, c := range counts {
+		n += c
+	}
+	return n
+}
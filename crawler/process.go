@@ -0,0 +1,244 @@
+package crawler
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// CrawlerProcess runs several spiders in one process, at the same time if Concurrent, otherwise
+// one after another. Each spider is crawled by its own crawler created by New, so the spiders have
+// their own queues, stats and results, and the results are combined into a ProcessResult.
+//
+// The components shared by the crawlers, which are the same values added to more than one of them,
+// like a pipeline writing the items of all the spiders to one file, are opened before the first spider starts,
+// and closed after the last spider stops, instead of by each crawler. The shared ones are called
+// by several spiders, so they have to be thread-safe if Concurrent. The ItemHolders can't be shared,
+// since each crawler sets its own release function, the process panics if one is.
+//
+// The settings of a run, which are JobDir, SchedulerDir, RunID, ManifestFile and PolitenessFile,
+// are derived for each spider while New is called, like JobDir/<spider> and run-<spider>, so the spiders
+// never share their states, and New sees them as if it built the crawler of a single spider.
+type CrawlerProcess struct {
+	Logger log.Logger
+
+	// New creates the crawler of the spider, like DefaultCrawlerBuilder().AddParser(...).Build().
+	New        func(spider *leiogo.Spider) *Crawler
+	Concurrent bool
+
+	// The file Run saves the ProcessResult to, see RunSummaryFile.
+	SummaryFile string
+
+	spiders []*leiogo.Spider
+}
+
+// ProcessResult is the combined result of the spiders of a CrawlerProcess. The Outcome is the worst
+// of the spiders, and the numbers are the sums of them.
+type ProcessResult struct {
+	StartDate   time.Time `json:"start_date"`
+	EndDate     time.Time `json:"end_date"`
+	Duration    float64   `json:"duration"`
+	Outcome     Outcome   `json:"outcome"`
+	Pages       int       `json:"pages"`
+	Crawled     int       `json:"crawled"`
+	Succeed     int       `json:"succeed"`
+	Items       int       `json:"items"`
+	Files       int       `json:"files"`
+	SlowParsers int       `json:"slow_parsers"`
+	Errors      int       `json:"errors"`
+	Pending     int       `json:"pending"`
+
+	// The results of the spiders, in the order they were added.
+	Spiders []*RunResult `json:"spiders"`
+}
+
+func NewCrawlerProcess(newCrawler func(spider *leiogo.Spider) *Crawler) *CrawlerProcess {
+	return &CrawlerProcess{
+		Logger:      log.New("CrawlerProcess"),
+		New:         newCrawler,
+		SummaryFile: RunSummaryFile,
+	}
+}
+
+func (p *CrawlerProcess) AddSpiders(spiders ...*leiogo.Spider) *CrawlerProcess {
+	p.spiders = append(p.spiders, spiders...)
+	return p
+}
+
+// Crawl runs all the spiders, and returns the combined result when they are closed.
+// In sequence, the spiders after an interrupted one are not started.
+func (p *CrawlerProcess) Crawl() *ProcessResult {
+	crawlers := make([]*Crawler, len(p.spiders))
+	for i, spider := range p.spiders {
+		restore := spiderSettings(spider)
+		crawlers[i] = p.New(spider)
+		restore()
+	}
+	shared := sharedComponents(crawlers)
+
+	// The shared components are opened and closed as the process, with a spider standing for all the spiders.
+	process := &leiogo.Spider{Name: "process"}
+	for _, m := range shared {
+		m.Open(process)
+	}
+
+	result := &ProcessResult{StartDate: time.Now(), Outcome: OutcomeCompleted}
+	results := make([]*RunResult, len(p.spiders))
+	if p.Concurrent {
+		var wg sync.WaitGroup
+		for i := range p.spiders {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				results[i] = crawlers[i].Crawl(p.spiders[i])
+			}(i)
+		}
+		wg.Wait()
+	} else {
+		for i, spider := range p.spiders {
+			results[i] = crawlers[i].Crawl(spider)
+			if results[i].Outcome == OutcomeInterrupted && i+1 < len(p.spiders) {
+				p.Logger.Info(spider.Name, "Interrupted, %d spiders are not started", len(p.spiders)-i-1)
+				break
+			}
+		}
+	}
+
+	for _, r := range results {
+		if r != nil {
+			result.add(r)
+		}
+	}
+
+	// The shared components are closed in the reverse order, like the pipelines before the middlewares.
+	for i := len(shared) - 1; i >= 0; i-- {
+		shared[i].Close("All spiders closed", process)
+	}
+	result.EndDate = time.Now()
+	result.Duration = result.EndDate.Sub(result.StartDate).Seconds()
+	p.Logger.Info(process.Name, "%d spiders closed, %s, pages: %d, items: %d, errors: %d",
+		len(result.Spiders), result.Outcome, result.Pages, result.Items, result.Errors)
+	return result
+}
+
+func (r *ProcessResult) add(res *RunResult) {
+	r.Spiders = append(r.Spiders, res)
+	r.Pages += res.Pages
+	r.Crawled += res.Crawled
+	r.Succeed += res.Succeed
+	r.Items += res.Items
+	r.Files += res.Files
+	r.SlowParsers += res.SlowParsers
+	r.Errors += res.Errors
+	r.Pending += res.Pending
+	if outcomeSeverity[res.Outcome] > outcomeSeverity[r.Outcome] {
+		r.Outcome = res.Outcome
+	}
+}
+
+// The worse outcome of a spider wins in the ProcessResult.
+var outcomeSeverity = map[Outcome]int{
+	OutcomeCompleted:   0,
+	OutcomeInterrupted: 1,
+	OutcomeFailed:      2,
+}
+
+func (r *ProcessResult) ExitCode() int {
+	return ExitCodes[r.Outcome]
+}
+
+// Save the result as JSON to the file.
+func (r *ProcessResult) Save(filename string) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf, 0644)
+}
+
+// Run crawls the spiders, saves the result to the SummaryFile if it's not empty,
+// and exits the process with the exit code of the outcome, see ExitCodes.
+func (p *CrawlerProcess) Run() {
+	result := p.Crawl()
+	if p.SummaryFile != "" {
+		if err := result.Save(p.SummaryFile); err != nil {
+			p.Logger.Error("process", "Save run summary to %s failed, %s", p.SummaryFile, err.Error())
+		}
+	}
+	os.Exit(result.ExitCode())
+}
+
+// Set the settings of a run to the ones of the spider, and return the function restoring them.
+// The crawlers are built one by one, so the settings are never changed by two spiders at the same time.
+func spiderSettings(spider *leiogo.Spider) (restore func()) {
+	jobDir, schedulerDir, runID, manifestFile, politenessFile := JobDir, SchedulerDir, RunID, ManifestFile, PolitenessFile
+	if JobDir != "" {
+		JobDir = filepath.Join(JobDir, spider.Name)
+	}
+	if SchedulerDir != "" {
+		SchedulerDir = filepath.Join(SchedulerDir, spider.Name)
+	}
+	if RunID != "" {
+		RunID = RunID + "-" + spider.Name
+	}
+	ManifestFile = spiderFile(ManifestFile, spider)
+	PolitenessFile = spiderFile(PolitenessFile, spider)
+	return func() {
+		JobDir, SchedulerDir, RunID, ManifestFile, PolitenessFile = jobDir, schedulerDir, runID, manifestFile, politenessFile
+	}
+}
+
+// The file of the spider, like manifest-<spider>.jsonl for manifest.jsonl.
+func spiderFile(filename string, spider *leiogo.Spider) string {
+	if filename == "" {
+		return ""
+	}
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "-" + spider.Name + ext
+}
+
+// Find the components added to more than one crawler, and mark them shared in the crawlers.
+// They are returned in the order they are opened by a crawler.
+func sharedComponents(crawlers []*Crawler) []middleware.OpenClose {
+	owners := make(map[interface{}]int)
+	var ordered []middleware.OpenClose
+	for _, c := range crawlers {
+		seen := make(map[interface{}]bool)
+		for _, m := range c.components() {
+			if reflect.ValueOf(m).Kind() != reflect.Ptr || seen[m] {
+				continue
+			}
+			seen[m] = true
+			if owners[m]++; owners[m] == 2 {
+				if _, ok := m.(middleware.ItemHolder); ok {
+					panic(fmt.Sprintf("The item pipeline %T is an ItemHolder, it can't be shared by the spiders", m))
+				}
+				ordered = append(ordered, m.(middleware.OpenClose))
+			}
+		}
+	}
+	for _, c := range crawlers {
+		c.shared = make(map[interface{}]bool)
+		for _, m := range ordered {
+			c.shared[m] = true
+		}
+	}
+	return ordered
+}
+
+func (c *Crawler) isShared(m interface{}) bool {
+	if len(c.shared) == 0 || reflect.ValueOf(m).Kind() != reflect.Ptr {
+		return false
+	}
+	return c.shared[m]
+}
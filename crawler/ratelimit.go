@@ -0,0 +1,57 @@
+package crawler
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiting the requests downloaded by the crawler, no matter which hosts
+// they go to, for the crawls whose contract is an aggregate rate like 600 requests per minute.
+// A request takes a token right before it's downloaded, so the requests dropped by the middlewares
+// or answered from the cache take none.
+// The bucket holds at most one second of tokens, so the requests are spread over the minute
+// instead of being sent in a burst. It's independent of the DownloadDelay of each host.
+type RateLimiter struct {
+	// The interval between two tokens.
+	interval time.Duration
+	burst    float64
+
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func NewRateLimiter(perMinute int) *RateLimiter {
+	burst := float64(perMinute) / 60
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		interval: time.Minute / time.Duration(perMinute),
+		burst:    burst,
+		tokens:   burst,
+		last:     time.Now(),
+	}
+}
+
+// Wait blocks until a token is available, and takes it.
+func (r *RateLimiter) Wait() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	now := time.Now()
+	r.tokens += float64(now.Sub(r.last)) / float64(r.interval)
+	if r.tokens > r.burst {
+		r.tokens = r.burst
+	}
+	r.last = now
+
+	// Waiting with the mutex held keeps the waiters in order.
+	if r.tokens < 1 {
+		wait := time.Duration((1 - r.tokens) * float64(r.interval))
+		time.Sleep(wait)
+		r.tokens = 1
+		r.last = now.Add(wait)
+	}
+	r.tokens--
+}
@@ -0,0 +1,127 @@
+package crawler
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// pageYields counts the requests and the items yielded by the parsers of the tracked responses.
+// The items are told apart by their trace IDs, since NewItem doesn't know the response.
+type pageYields struct {
+	counts map[*leiogo.Response]*yieldCount
+	traces map[string]*leiogo.Response
+	mutex  sync.Mutex
+}
+
+// The yields of a page, the items are counted in the yields too.
+type yieldCount struct {
+	yields int
+	items  int
+}
+
+func (p *pageYields) track(res *leiogo.Response) {
+	p.mutex.Lock()
+	if p.counts == nil {
+		p.counts = make(map[*leiogo.Response]*yieldCount)
+		p.traces = make(map[string]*leiogo.Response)
+	}
+	p.counts[res] = &yieldCount{}
+	if id := res.TraceID(); id != "" {
+		p.traces[id] = res
+	}
+	p.mutex.Unlock()
+}
+
+// Count a request yielded by the tracked response.
+func (p *pageYields) add(res *leiogo.Response) {
+	p.mutex.Lock()
+	if n, ok := p.counts[res]; ok {
+		n.yields++
+	}
+	p.mutex.Unlock()
+}
+
+// Count an item for the tracked response with the trace ID, and return the response,
+// or nil if there's none being parsed.
+func (p *pageYields) addItem(traceID string) *leiogo.Response {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	res, ok := p.traces[traceID]
+	if !ok {
+		return nil
+	}
+	n := p.counts[res]
+	n.yields++
+	n.items++
+	return res
+}
+
+// Stop tracking the response, and return its yields and items.
+func (p *pageYields) done(res *leiogo.Response) (int, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	n, ok := p.counts[res]
+	if !ok {
+		return 0, 0
+	}
+	delete(p.counts, res)
+	if p.traces[res.TraceID()] == res {
+		delete(p.traces, res.TraceID())
+	}
+	return n.yields, n.items
+}
+
+// Whether the request is rendered by phantomjs, by its meta or the "Render" setting of its host.
+func (c *Crawler) rendered(req *leiogo.Request) bool {
+	if enable, ok := req.Meta["phantomjs"].(bool); ok {
+		return enable
+	}
+	return c.HostSettings.Bool(req.URL, "Render", false)
+}
+
+// With RerenderEmpty, a html page which yields nothing is requested again with phantomjs, once,
+// since the content of many pages is built by the scripts. The re-rendered requests have '__rerender__'
+// in their meta, and the pages yielding something after the rendering are counted as rescued in the StatusInfo.
+func (c *Crawler) checkYields(yields int, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+	if _, ok := req.Meta["__rerender__"]; ok {
+		if yields > 0 {
+			c.StatusInfo.AddRescued()
+		}
+		return
+	}
+	if yields > 0 || c.rendered(req) || c.StatusInfo.IsInterrupt() {
+		return
+	}
+	if t := res.Header.Get("Content-Type"); t != "" && !strings.Contains(strings.ToLower(t), "html") {
+		return
+	}
+
+	next := &leiogo.Request{
+		URL:         req.URL,
+		Meta:        req.Meta.Copy(),
+		ParserName:  req.ParserName,
+		Callback:    req.Callback,
+		Priority:    req.Priority,
+		ErrbackName: req.ErrbackName,
+	}
+	delete(next.Meta, "retry")
+	delete(next.Meta, "__retryat__")
+	next.Meta["phantomjs"] = true
+	next.Meta["dontfilter"] = true
+	next.Meta["__rerender__"] = true
+
+	c.Logger.Debug(req.LogContext(spider), "Nothing yielded from %s, render it again", req.URL)
+	c.StatusInfo.AddRerendered()
+	c.NewRequest(next, nil, spider)
+}
+
+// NewPageItem yields the item extracted from the page, like NewItem, with the trace ID of the page,
+// so the item counts for the page, see NewItem.
+func (c *Crawler) NewPageItem(item *leiogo.Item, res *leiogo.Response, spider *leiogo.Spider) error {
+	if item.TraceID == "" {
+		item.TraceID = res.TraceID()
+	}
+	return c.NewItem(item, spider)
+}
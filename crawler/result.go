@@ -0,0 +1,212 @@
+package crawler
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// Outcome tells how a crawl ended, so the CI or the orchestration systems can branch on it.
+type Outcome string
+
+const (
+	// The crawl has completed, or stopped by a limit like CloseOnPageCount.
+	OutcomeCompleted Outcome = "completed"
+
+	// The crawl was stopped by the user, or the control API, before it completed.
+	OutcomeInterrupted Outcome = "interrupted"
+
+	// The crawl was stopped by too many errors, see CloseOnErrorCount.
+	OutcomeFailed Outcome = "failed"
+)
+
+// The exit codes of Crawler.Run for the outcomes.
+var ExitCodes = map[Outcome]int{
+	OutcomeCompleted:   0,
+	OutcomeFailed:      1,
+	OutcomeInterrupted: 2,
+}
+
+// The max error messages kept in the StatusInfo, the later errors are only counted.
+const maxErrorSamples = 100
+
+// RunResult is the final status of a crawl, returned by Crawler.Crawl.
+type RunResult struct {
+	Spider      string                 `json:"spider"`
+	Tenant      string                 `json:"tenant,omitempty"`
+	RunID       string                 `json:"run_id"`
+	StartDate   time.Time              `json:"start_date"`
+	EndDate     time.Time              `json:"end_date"`
+	Duration    float64                `json:"duration"`
+	Reason      string                 `json:"reason"`
+	Outcome     Outcome                `json:"outcome"`
+	Pages       int                    `json:"pages"`
+	Crawled     int                    `json:"crawled"`
+	Succeed     int                    `json:"succeed"`
+	Items       int                    `json:"items"`
+	Files       int                    `json:"files"`
+	SlowParsers int                    `json:"slow_parsers"`
+	Errors      int                    `json:"errors"`
+	Hosts       map[string]*HostStatus `json:"hosts"`
+
+	// The runs resumed from the job directory, from the first one.
+	PreviousRuns []string `json:"previous_runs,omitempty"`
+
+	// The files which are downloaded but failed to be saved.
+	StorageErrors int `json:"storage_errors"`
+
+	// The retries refused by the retry budgets of the hosts, see RetryBudget.
+	OverBudget int `json:"over_budget"`
+
+	// The first error messages, see maxErrorSamples.
+	ErrorSamples []string `json:"error_samples"`
+
+	// The pages rendered again because they yielded nothing, and the ones rescued by the rendering.
+	Rerendered int `json:"rerendered,omitempty"`
+	Rescued    int `json:"rescued,omitempty"`
+
+	// How the crawler behaved to each host, see HostPoliteness.
+	Politeness []*HostPoliteness `json:"politeness,omitempty"`
+
+	// The requests which are not crawled, they are saved if there's a JobDir.
+	Pending int `json:"pending"`
+
+	// The url traps found by the TrapDetectorMiddleware, their rules can be added to TrapDenyRules.
+	Traps []*middleware.Trap `json:"traps,omitempty"`
+
+	// Whether the crawl followed the strict compliance profile, see StrictCompliance.
+	StrictCompliance bool `json:"strict_compliance,omitempty"`
+
+	// The branches of the site pruned by the adaptive DepthMiddleware.
+	Pruned []*middleware.PrunedBranch `json:"pruned,omitempty"`
+}
+
+func (r *RunResult) ExitCode() int {
+	return ExitCodes[r.Outcome]
+}
+
+// Save the result as JSON to the file.
+func (r *RunResult) Save(filename string) error {
+	buf, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, buf, 0644)
+}
+
+// Result returns the current status of the spider.
+func (s *StatusInfo) Result(spider *leiogo.Spider) *RunResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	end := s.EndDate
+	if end.IsZero() {
+		end = time.Now()
+	}
+	outcome := s.outcome
+	if outcome == "" {
+		outcome = OutcomeCompleted
+	}
+	return &RunResult{
+		Spider:        spider.Name,
+		Tenant:        spider.Tenant,
+		RunID:         spider.RunID,
+		PreviousRuns:  append([]string{}, s.PreviousRuns...),
+		StartDate:     s.StartDate,
+		EndDate:       end,
+		Duration:      end.Sub(s.StartDate).Seconds(),
+		Reason:        s.Reason,
+		Outcome:       outcome,
+		Pages:         s.Pages,
+		Crawled:       s.Crawled,
+		Succeed:       s.Succeed,
+		Items:         s.Items,
+		Files:         s.Files,
+		SlowParsers:   s.SlowParsers,
+		Errors:        s.Errors,
+		StorageErrors: s.StorageErrors,
+		Rerendered:    s.Rerendered,
+		Rescued:       s.Rescued,
+		Hosts:         s.Hosts,
+		ErrorSamples:  append([]string{}, s.ErrorSamples...),
+	}
+}
+
+// Run crawls the spider, saves the result to the SummaryFile if it's not empty,
+// and exits the process with the exit code of the outcome, see ExitCodes.
+func (c *Crawler) Run(spider *leiogo.Spider) {
+	result := c.Crawl(spider)
+	if c.SummaryFile != "" {
+		if err := result.Save(c.SummaryFile); err != nil {
+			c.Logger.Error(spider.Name, "Save run summary to %s failed, %s", c.SummaryFile, err.Error())
+		}
+	}
+	os.Exit(result.ExitCode())
+}
+
+// The traps found by the TrapDetectorMiddleware, nil if the crawler doesn't have one.
+func (c *Crawler) traps() []*middleware.Trap {
+	for _, m := range c.SpiderMiddlewares {
+		if d, ok := m.(*middleware.TrapDetectorMiddleware); ok {
+			return d.Traps()
+		}
+	}
+	return nil
+}
+
+// The retries refused by the budgets of the RetryMiddleware, 0 if the crawler doesn't have one.
+func (c *Crawler) overBudget() int {
+	for _, m := range c.DownloadMiddlewares {
+		if r, ok := m.(*middleware.RetryMiddleware); ok {
+			return r.RefusedRetries()
+		}
+	}
+	return 0
+}
+
+// The crawl is compliant if it has the ComplianceMiddleware.
+func (c *Crawler) strictCompliance() bool {
+	for _, m := range c.DownloadMiddlewares {
+		if _, ok := m.(*middleware.ComplianceMiddleware); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// The branches pruned by the DepthMiddleware, nil if the crawler doesn't have one.
+func (c *Crawler) prunedBranches() []*middleware.PrunedBranch {
+	for _, m := range c.SpiderMiddlewares {
+		if d, ok := m.(*middleware.DepthMiddleware); ok && d.AdaptivePages > 0 {
+			return d.Pruned()
+		}
+	}
+	return nil
+}
+
+// NewRunID generates a unique ID of a run, the IDs of the runs sort by their start time.
+func NewRunID() string {
+	buf := make([]byte, 4)
+	rand.Read(buf)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(buf)
+}
+
+// Give the request a trace ID unless it has one, the logs about the request are tagged with it,
+// see leiogo.Request.LogContext.
+func trace(req *leiogo.Request) {
+	if req.TraceID() != "" {
+		return
+	}
+	if req.Meta == nil {
+		req.Meta = make(leiogo.Dict)
+	}
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	req.Meta["__trace__"] = hex.EncodeToString(buf)
+}
@@ -0,0 +1,174 @@
+package crawler
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/SteveZhangBit/leiogo/testsite"
+)
+
+// The links of the test site, it has no relative paths but the ones from the root.
+var siteLinkRe = regexp.MustCompile(`href="(/[^"]*)"`)
+
+// siteCrawl is a crawl of the default crawler on the test site, the parser follows all the links,
+// and remembers the bodies of the parsed pages by their final urls.
+type siteCrawl struct {
+	site   *testsite.Site
+	result *RunResult
+	pages  map[string]string
+	mutex  sync.Mutex
+}
+
+// Crawl the site from the paths, setup adds the components to the builder before the crawler is built.
+func crawlSite(t *testing.T, site *testsite.Site, setup func(b *CrawlerBuilder), paths ...string) *siteCrawl {
+	delay, jar := DownloadDelay, CookieJar
+	DownloadDelay, CookieJar = 0, middleware.NewCookieJar()
+	defer func() { DownloadDelay, CookieJar = delay, jar }()
+
+	s := &siteCrawl{site: site, pages: make(map[string]string)}
+	var c *Crawler
+	b := DefaultCrawlerBuilder()
+	b.AddParser("parser", func(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) {
+		s.mutex.Lock()
+		s.pages[strings.TrimPrefix(res.FinalURL(), site.URL)] = string(res.Body)
+		s.mutex.Unlock()
+		for _, match := range siteLinkRe.FindAllStringSubmatch(string(res.Body), -1) {
+			c.NewRequest(leiogo.NewRequest(site.URLOf(match[1])), res, spider)
+		}
+	})
+	if setup != nil {
+		setup(b)
+	}
+	c = b.Build()
+
+	spider := &leiogo.Spider{Name: "testsite"}
+	for _, p := range paths {
+		spider.StartURLs = append(spider.StartURLs, leiogo.NewRequest(site.URLOf(p)))
+	}
+	done := make(chan *RunResult)
+	go func() { done <- c.Crawl(spider) }()
+	select {
+	case s.result = <-done:
+	case <-time.After(30 * time.Second):
+		t.Fatal("the crawl of the test site never closes")
+	}
+	return s
+}
+
+func (s *siteCrawl) page(path string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	body, ok := s.pages[path]
+	return body, ok
+}
+
+func TestSiteLinks(t *testing.T) {
+	site := testsite.New(30, 3)
+	defer site.Close()
+
+	// The CacheMiddleware filters the urls which have been downloaded, not the ones in flight,
+	// so the pages are downloaded one by one to count the duplicates.
+	concurrent := ConcurrentRequests
+	ConcurrentRequests = 1
+	defer func() { ConcurrentRequests = concurrent }()
+
+	s := crawlSite(t, site, nil, "/page/0")
+	if s.result.Outcome != OutcomeCompleted {
+		t.Errorf("the crawl is %s, want %s", s.result.Outcome, OutcomeCompleted)
+	}
+	for i := 0; i < site.Pages; i++ {
+		path := "/page/" + strconv.Itoa(i)
+		if _, ok := s.page(path); !ok {
+			t.Errorf("%s is not parsed", path)
+		}
+		if n := site.Hits(path); n != 1 {
+			t.Errorf("%s is requested %d times, want once", path, n)
+		}
+	}
+}
+
+func TestSiteRedirectsAndGzip(t *testing.T) {
+	site := testsite.New(1, 0)
+	defer site.Close()
+
+	// The redirect loop fails at once without the retries.
+	retry := RetryEnabled
+	RetryEnabled = false
+	defer func() { RetryEnabled = retry }()
+
+	s := crawlSite(t, site, nil, "/redirect/2", "/redirect/loop", "/gzip")
+	if _, ok := s.page("/page/0"); !ok {
+		t.Error("the redirects don't end at /page/0")
+	}
+	if n := site.Hits("/redirect/loop"); n > MaxRedirects+1 {
+		t.Errorf("the redirect loop is followed %d times, want at most %d", n, MaxRedirects+1)
+	}
+	if s.result.Errors == 0 {
+		t.Error("the redirect loop is not an error")
+	}
+	if body, _ := s.page("/gzip"); !strings.Contains(body, "<h1>Gzip</h1>") {
+		t.Errorf("the gzip page is %q, want it decompressed", body)
+	}
+}
+
+func TestSiteCookies(t *testing.T) {
+	site := testsite.New(1, 0)
+	defer site.Close()
+
+	s := crawlSite(t, site, nil, "/cookie/set")
+	if body, _ := s.page("/cookie/check"); !strings.Contains(body, "Cookie checked") {
+		t.Errorf("the cookie is not sent, /cookie/check is %q", body)
+	}
+}
+
+func TestSiteLogin(t *testing.T) {
+	site := testsite.New(1, 0)
+	defer site.Close()
+
+	s := crawlSite(t, site, func(b *CrawlerBuilder) {
+		b.AddFormLogin(site.URLOf("/login"), map[string]string{"username": testsite.Username, "password": testsite.Password}, "")
+	}, "/private")
+	if body, _ := s.page("/private"); !strings.Contains(body, "<h1>Private</h1>") {
+		t.Errorf("the private page is %q, want it crawled in the session", body)
+	}
+}
+
+func TestSiteSlow(t *testing.T) {
+	site := testsite.New(1, 0)
+	defer site.Close()
+
+	timeout, retry := Timeout, RetryEnabled
+	Timeout, RetryEnabled = 1, false
+	defer func() { Timeout, RetryEnabled = timeout, retry }()
+
+	s := crawlSite(t, site, nil, "/slow/10", "/slow/3000")
+	if _, ok := s.page("/slow/10"); !ok {
+		t.Error("the fast page is not parsed")
+	}
+	if _, ok := s.page("/slow/3000"); ok {
+		t.Error("the page slower than the timeout is parsed")
+	}
+}
+
+func TestSiteCalendarTrap(t *testing.T) {
+	site := testsite.New(1, 0)
+	defer site.Close()
+
+	enabled := TrapDetectorEnabled
+	TrapDetectorEnabled = true
+	defer func() { TrapDetectorEnabled = enabled }()
+
+	s := crawlSite(t, site, nil, "/calendar/2020/01")
+	if len(s.result.Traps) == 0 || s.result.Traps[0].Reason != middleware.TrapCalendar {
+		t.Errorf("the traps are %v, want the calendar", s.result.Traps)
+	}
+	if n := len(s.pages); n > 4*TrapCalendarPages {
+		t.Errorf("crawled %d months of the calendar, want it stopped after about %d", n, TrapCalendarPages)
+	}
+}
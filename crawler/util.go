@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"path"
 	"sync"
 
 	"github.com/SteveZhangBit/leiogo/log"
@@ -14,39 +15,96 @@ import (
 	"time"
 )
 
+// ConcurrentCount is similar to sync.WaitGroup, it counts the running requests and items.
+// Unlike sync.WaitGroup, it's fine to call Add after Wait has returned, which may happen when
+// the requests are shared by several crawler processes, and Wait can be called again.
 type ConcurrentCount struct {
 	count int
-	done  chan bool
+	mutex sync.Mutex
+	cond  *sync.Cond
+}
+
+func NewConcurrentCount() *ConcurrentCount {
+	c := &ConcurrentCount{}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
 }
 
 func (c *ConcurrentCount) Add() {
-	c.done <- true
+	c.mutex.Lock()
+	c.count++
+	c.mutex.Unlock()
 }
 
 func (c *ConcurrentCount) Done() {
-	c.done <- false
+	c.mutex.Lock()
+	c.count--
+	c.mutex.Unlock()
+	c.cond.Broadcast()
 }
 
+// Wait blocks until the count drops to 0.
 func (c *ConcurrentCount) Wait() {
-	for {
-		if ok := <-c.done; ok {
-			c.count++
-		} else {
-			c.count--
-			if c.count <= 0 {
-				break
-			}
-		}
+	c.mutex.Lock()
+	for c.count > 0 {
+		c.cond.Wait()
+	}
+	c.mutex.Unlock()
+}
+
+// pauseGate blocks the callers of wait while it's closed.
+type pauseGate struct {
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func (g *pauseGate) init() {
+	if g.cond == nil {
+		g.cond = sync.NewCond(&g.mutex)
+	}
+}
+
+func (g *pauseGate) close() {
+	g.mutex.Lock()
+	g.init()
+	g.closed = true
+	g.mutex.Unlock()
+}
+
+func (g *pauseGate) open() {
+	g.mutex.Lock()
+	g.init()
+	g.closed = false
+	g.mutex.Unlock()
+	g.cond.Broadcast()
+}
+
+func (g *pauseGate) isClosed() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.closed
+}
+
+func (g *pauseGate) wait() {
+	g.mutex.Lock()
+	g.init()
+	for g.closed {
+		g.cond.Wait()
 	}
+	g.mutex.Unlock()
 }
 
 // The crawler will catch the interrupt signal from OS.
 // The process won't stop immediately when user press ctrl+c, instead,
 // it will wait for the running requests and items to complete,
 // and refuse any further product.
+// The second ctrl+c cancels the running downloads with Cancel, and the interrupted requests are kept
+// as pending, see Crawler.Cancel.
 type UserInterrupt struct {
 	StatusInfo *StatusInfo
 	Logger     log.Logger
+	Cancel     func()
 
 	interrupt chan os.Signal
 	closed    chan bool
@@ -61,8 +119,13 @@ func (u *UserInterrupt) Open(spider *leiogo.Spider) error {
 		for {
 			select {
 			case <-u.interrupt:
-				u.StatusInfo.Interrupt()
-				u.Logger.Info(spider.Name, "Get user interrupt signal, waiting the running requests to complete")
+				if !u.StatusInfo.IsInterrupt() || u.Cancel == nil {
+					u.StatusInfo.Interrupt()
+					u.Logger.Info(spider.Name, "Get user interrupt signal, waiting the running requests to complete, press ctrl+c again to cancel them")
+				} else {
+					u.Logger.Info(spider.Name, "Get second user interrupt signal, cancelling the running requests")
+					u.Cancel()
+				}
 			case <-u.closed:
 				break
 			}
@@ -106,10 +169,46 @@ type StatusInfo struct {
 	// If user enable image download feature for the crawler, this field will show how many images have downloaded.
 	Files int
 
+	// Number of parsers which are slower than the threshold or timed out.
+	SlowParsers int
+
+	// Number of the pages yielding nothing which are rendered again, and the ones yielding something
+	// after the rendering, see Crawler.RerenderEmpty.
+	Rerendered int
+	Rescued    int
+
+	// Number of the download errors and the middleware errors, not including the dropped tasks.
+	Errors int
+
+	// The messages of the first errors, see maxErrorSamples.
+	ErrorSamples []string
+
+	// The runs resumed from the job directory, the counters contain their numbers.
+	PreviousRuns []string
+
+	// Number of the files which are downloaded, but failed to be saved by the FileWriters,
+	// and the failures to save the pending requests to the job directory.
+	// They are not counted in the Errors.
+	StorageErrors int
+
+	// The downloads of each host, the hosts are usually where the problems come from.
+	Hosts map[string]*HostStatus
+
 	// This boolean indicates whether the crawler has been interrupted by user (ctrl+c).
 	// The addRequest method will check this boolean when adding a new request.
 	Interrupted bool
 
+	// The running downloads are aborted after the second interrupt.
+	Cancelled bool
+
+	// How the spider stopped, see StopWith.
+	outcome Outcome
+
+	// The crawler doesn't dispatch the queued requests while it's paused, see Crawler.Pause.
+	// Stopping the spider resumes it, so the queued requests can be dropped.
+	gate pauseGate
+
+	runID  string
 	mutex  sync.Mutex
 	closed chan bool
 }
@@ -120,6 +219,7 @@ func (s *StatusInfo) Open(spider *leiogo.Spider) error {
 
 	s.StartDate = time.Now()
 	s.Reason = "Jobs completed"
+	s.runID = spider.RunID
 
 	go func() {
 		for {
@@ -150,6 +250,12 @@ func (s *StatusInfo) Close(reason string, spider *leiogo.Spider) error {
 	s.Logger.Info(spider.Name, "%-10s - %d", "Succeed", s.Succeed)
 	s.Logger.Info(spider.Name, "%-10s - %d", "Items", s.Items)
 	s.Logger.Info(spider.Name, "%-10s - %d", "Files", s.Files)
+	s.Logger.Info(spider.Name, "%-10s - %d", "SlowParser", s.SlowParsers)
+	s.Logger.Info(spider.Name, "%-10s - %d", "Errors", s.Errors)
+	s.Logger.Info(spider.Name, "%-10s - %d", "Storage", s.StorageErrors)
+	if s.Rerendered > 0 {
+		s.Logger.Info(spider.Name, "%-10s - %d (%d rescued)", "Rerendered", s.Rerendered, s.Rescued)
+	}
 	s.Logger.Info(spider.Name, "%-10s - %s", "Reason", s.Reason)
 
 	return nil
@@ -164,12 +270,67 @@ func (s *StatusInfo) Report() []string {
 		fmt.Sprintf("%-10s - %d (%.1f per minute)", "Succeed", s.Succeed, float64(s.Succeed)/duration.Minutes()),
 		fmt.Sprintf("%-10s - %d (%.1f per minute)", "Items", s.Items, float64(s.Items)/duration.Minutes()),
 		fmt.Sprintf("%-10s - %d (%.1f per minute)", "Files", s.Files, float64(s.Files)/duration.Minutes()),
+		fmt.Sprintf("%-10s - %d", "SlowParser", s.SlowParsers),
+		fmt.Sprintf("%-10s - %d", "Errors", s.Errors),
+		fmt.Sprintf("%-10s - %d", "Storage", s.StorageErrors),
+		fmt.Sprintf("%-10s - %t", "Paused", s.IsPaused()),
 	}
 }
 
 func (s *StatusInfo) Interrupt() {
-	s.Interrupted = true
-	s.Reason = "User interrupted"
+	s.Stop("User interrupted")
+}
+
+// Stop the spider like the user interrupt, with the reason. Only the first reason is kept.
+func (s *StatusInfo) Stop(reason string) {
+	s.StopWith(reason, OutcomeInterrupted)
+}
+
+// StopWith stops the spider like Stop, and the crawl ends with the outcome.
+func (s *StatusInfo) StopWith(reason string, outcome Outcome) {
+	s.mutex.Lock()
+	if !s.Interrupted {
+		s.Interrupted = true
+		s.Reason = reason
+		s.outcome = outcome
+	}
+	s.mutex.Unlock()
+	s.gate.open()
+}
+
+// Cancel stops the spider, and marks the running requests to be cancelled.
+func (s *StatusInfo) Cancel() {
+	s.Stop("User cancelled")
+	s.mutex.Lock()
+	s.Cancelled = true
+	s.Reason = "User cancelled"
+	s.outcome = OutcomeInterrupted
+	s.mutex.Unlock()
+}
+
+func (s *StatusInfo) IsCancelled() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.Cancelled
+}
+
+func (s *StatusInfo) Pause() {
+	if !s.IsInterrupt() {
+		s.gate.close()
+	}
+}
+
+func (s *StatusInfo) Resume() {
+	s.gate.open()
+}
+
+func (s *StatusInfo) IsPaused() bool {
+	return s.gate.isClosed()
+}
+
+// WaitResumed blocks while the spider is paused.
+func (s *StatusInfo) WaitResumed() {
+	s.gate.wait()
 }
 
 func (s *StatusInfo) IsInterrupt() bool {
@@ -199,6 +360,29 @@ func (s *StatusInfo) AddCrawled() {
 	s.mutex.Unlock()
 }
 
+type HostStatus struct {
+	Crawled int `json:"crawled"`
+	Failed  int `json:"failed"`
+}
+
+// Count a download of the host, failed means a download error or a status code >= 400.
+func (s *StatusInfo) AddHost(host string, failed bool) {
+	s.mutex.Lock()
+	if s.Hosts == nil {
+		s.Hosts = make(map[string]*HostStatus)
+	}
+	h, ok := s.Hosts[host]
+	if !ok {
+		h = &HostStatus{}
+		s.Hosts[host] = h
+	}
+	h.Crawled++
+	if failed {
+		h.Failed++
+	}
+	s.mutex.Unlock()
+}
+
 func (s *StatusInfo) AddFiles() {
 	s.mutex.Lock()
 	s.Files++
@@ -217,3 +401,76 @@ func (s *StatusInfo) AddItem() {
 	s.Items++
 	s.mutex.Unlock()
 }
+
+func (s *StatusInfo) AddError(err error) {
+	s.mutex.Lock()
+	s.Errors++
+	if len(s.ErrorSamples) < maxErrorSamples {
+		s.ErrorSamples = append(s.ErrorSamples, err.Error())
+	}
+	s.mutex.Unlock()
+}
+
+func (s *StatusInfo) AddStorageError(err error) {
+	s.mutex.Lock()
+	s.StorageErrors++
+	if len(s.ErrorSamples) < maxErrorSamples {
+		s.ErrorSamples = append(s.ErrorSamples, err.Error())
+	}
+	s.mutex.Unlock()
+}
+
+func (s *StatusInfo) AddSlowParser() {
+	s.mutex.Lock()
+	s.SlowParsers++
+	s.mutex.Unlock()
+}
+
+func (s *StatusInfo) AddRerendered() {
+	s.mutex.Lock()
+	s.Rerendered++
+	s.mutex.Unlock()
+}
+
+func (s *StatusInfo) AddRescued() {
+	s.mutex.Lock()
+	s.Rescued++
+	s.mutex.Unlock()
+}
+
+// The counters of the status which are saved to the job directory.
+type statusState struct {
+	Pages, Crawled, Succeed, Items, Files, SlowParsers, Errors int
+
+	StorageErrors int
+	RunIDs        []string
+}
+
+func (s *StatusInfo) SaveState(dir string) error {
+	s.mutex.Lock()
+	state := statusState{s.Pages, s.Crawled, s.Succeed, s.Items, s.Files, s.SlowParsers, s.Errors,
+		s.StorageErrors, append(append([]string{}, s.PreviousRuns...), s.runID)}
+	s.mutex.Unlock()
+	return util.SaveGob(path.Join(dir, "status.gob"), state)
+}
+
+// Restore the counters of the previous runs, the start date is still the date of this run.
+func (s *StatusInfo) LoadState(dir string) error {
+	var state statusState
+	if err := util.LoadGob(path.Join(dir, "status.gob"), &state); err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	s.Pages += state.Pages
+	s.Crawled += state.Crawled
+	s.Succeed += state.Succeed
+	s.Items += state.Items
+	s.Files += state.Files
+	s.SlowParsers += state.SlowParsers
+	s.Errors += state.Errors
+	s.StorageErrors += state.StorageErrors
+	s.PreviousRuns = state.RunIDs
+	s.mutex.Unlock()
+	return nil
+}
@@ -0,0 +1,31 @@
+package crawler
+
+import (
+	"fmt"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// Validate checks the parsers and the errbacks referred by the start urls of the spider, so a typo
+// in a ParserName fails the crawl before anything is downloaded, instead of an error after each download.
+// A request with a Callback needs no parser, and a request with an empty ParserName needs a URLParser,
+// unless there's a FallbackParser.
+func (c *Crawler) Validate(spider *leiogo.Spider) error {
+	for _, req := range spider.StartURLs {
+		if req.Callback == nil && c.FallbackParser == nil {
+			if req.ParserName == "" {
+				if len(c.URLParsers) == 0 {
+					return fmt.Errorf("No parser for start url %s, neither ParserName nor URL parsers", req.URL)
+				}
+			} else if _, ok := c.Parsers[req.ParserName]; !ok {
+				return fmt.Errorf("No parser named %s, which is referred by start url %s", req.ParserName, req.URL)
+			}
+		}
+		if req.ErrbackName != "" {
+			if _, ok := c.Errbacks[req.ErrbackName]; !ok {
+				return fmt.Errorf("No errback named %s, which is referred by start url %s", req.ErrbackName, req.URL)
+			}
+		}
+	}
+	return nil
+}
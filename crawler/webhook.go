@@ -0,0 +1,83 @@
+package crawler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+// SummaryWebhook posts the final status of the crawl as JSON to the URL when the spider closes,
+// so the chat or workflow systems learn that a crawl has finished, and whether it met the thresholds.
+// It should be added after the StatusInfo, see CrawlerBuilder.AddSummaryWebhook.
+type SummaryWebhook struct {
+	Logger     log.Logger
+	StatusInfo *StatusInfo
+	URL        string
+
+	// The post fails if the endpoint doesn't respond in Timeout, so a hanging endpoint doesn't block
+	// the closing crawler. Zero means no timeout.
+	Timeout time.Duration
+
+	// The crawl fails if it yields less than MinItems items, or the rate of the succeed pages
+	// is lower than MinSucceedRate. Zero means no limitation.
+	MinItems       int
+	MinSucceedRate float64
+}
+
+type runSummary struct {
+	*RunResult
+	Passed   bool     `json:"passed"`
+	Failures []string `json:"failures"`
+}
+
+func (w *SummaryWebhook) Open(spider *leiogo.Spider) error {
+	return nil
+}
+
+func (w *SummaryWebhook) Close(reason string, spider *leiogo.Spider) error {
+	summary := runSummary{
+		RunResult: w.StatusInfo.Result(spider),
+		Failures:  w.check(),
+	}
+	summary.Passed = len(summary.Failures) == 0
+
+	buf, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Timeout: w.Timeout}
+	res, err := client.Post(w.URL, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		w.Logger.Error(spider.Name, "Post summary to %s fail, %s", w.URL, err)
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		err = fmt.Errorf("Post summary to %s fail with status %d", w.URL, res.StatusCode)
+		w.Logger.Error(spider.Name, "%s", err)
+		return err
+	}
+	w.Logger.Info(spider.Name, "Posted summary to %s, passed: %t", w.URL, summary.Passed)
+	return nil
+}
+
+// Return the thresholds which the crawl didn't meet.
+func (w *SummaryWebhook) check() []string {
+	s := w.StatusInfo
+	failures := []string{}
+	if w.MinItems > 0 && s.Items < w.MinItems {
+		failures = append(failures, fmt.Sprintf("%d items, expect at least %d", s.Items, w.MinItems))
+	}
+	if w.MinSucceedRate > 0 && s.Pages > 0 {
+		if rate := float64(s.Succeed) / float64(s.Pages); rate < w.MinSucceedRate {
+			failures = append(failures, fmt.Sprintf("%.2f pages succeed, expect at least %.2f", rate, w.MinSucceedRate))
+		}
+	}
+	return failures
+}
@@ -0,0 +1,108 @@
+package log
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// The levels overriding the Level of the loggers, by the logger names, like "Downloader",
+// and by the spiders, which are the contexts of the logs. The level of a spider wins over
+// the level of a logger name, so the Debug output can be targeted at a noisy component or spider,
+// and they can be changed at runtime, like by the control API of the crawler.
+type levelOverrides struct {
+	names    map[string]int
+	contexts map[string]int
+}
+
+var (
+	// The overrides are replaced as a whole when they change, so the loggers read them without a lock.
+	overrides      atomic.Value
+	overridesMutex sync.Mutex
+)
+
+func init() {
+	overrides.Store(&levelOverrides{})
+}
+
+// SetLevel overrides the level of the loggers with the name.
+func SetLevel(name string, level int) {
+	updateOverrides(func(o *levelOverrides) { o.names[name] = level })
+}
+
+// SetSpiderLevel overrides the level of the logs of the spider.
+func SetSpiderLevel(spider string, level int) {
+	updateOverrides(func(o *levelOverrides) { o.contexts[spider] = level })
+}
+
+// UnsetLevel removes the override of the logger name, its loggers go back to their own levels.
+func UnsetLevel(name string) {
+	updateOverrides(func(o *levelOverrides) { delete(o.names, name) })
+}
+
+// UnsetSpiderLevel removes the override of the spider.
+func UnsetSpiderLevel(spider string) {
+	updateOverrides(func(o *levelOverrides) { delete(o.contexts, spider) })
+}
+
+func updateOverrides(update func(o *levelOverrides)) {
+	overridesMutex.Lock()
+	defer overridesMutex.Unlock()
+	old := overrides.Load().(*levelOverrides)
+	o := &levelOverrides{names: make(map[string]int), contexts: make(map[string]int)}
+	for name, level := range old.names {
+		o.names[name] = level
+	}
+	for context, level := range old.contexts {
+		o.contexts[context] = level
+	}
+	update(o)
+	overrides.Store(o)
+}
+
+// Levels returns the overrides of the logger names and the spiders.
+func Levels() (names map[string]int, spiders map[string]int) {
+	o := overrides.Load().(*levelOverrides)
+	names, spiders = make(map[string]int), make(map[string]int)
+	for name, level := range o.names {
+		names[name] = level
+	}
+	for context, level := range o.contexts {
+		spiders[context] = level
+	}
+	return
+}
+
+// EffectiveLevel returns the level of the logs of the logger name in the context,
+// def is the level of the logger without the overrides. The Logger implementations should
+// check the levels of the logs by it.
+func EffectiveLevel(name string, context string, def int) int {
+	o := overrides.Load().(*levelOverrides)
+	context, _ = SplitTrace(context)
+	if level, ok := o.contexts[context]; ok {
+		return level
+	}
+	if level, ok := o.names[name]; ok {
+		return level
+	}
+	return def
+}
+
+// ParseLevel parses the name of a level, like "Debug", it's case-insensitive.
+func ParseLevel(s string) (int, error) {
+	for i, name := range levels {
+		if strings.EqualFold(name, s) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %s, should be one of Fatal, Error, Info, Debug, Trace", s)
+}
+
+// LevelName returns the name of the level, like "Debug".
+func LevelName(level int) string {
+	if level >= 0 && level < len(levels) {
+		return levels[level][:1] + strings.ToLower(levels[level][1:])
+	}
+	return ""
+}
@@ -1,5 +1,10 @@
 package log
 
+import (
+	"strings"
+	"sync"
+)
+
 type Logger interface {
 	Fatal(context string, content string, args ...interface{})
 	Error(context string, content string, args ...interface{})
@@ -22,3 +27,42 @@ var (
 )
 
 var New func(name string) Logger
+
+// The run IDs of the contexts, the loggers print the run ID of a context along with it.
+// The crawler sets the run ID of the spider when it starts, see crawler.Crawler.RunID.
+var runIDs sync.Map
+
+func SetRunID(context string, runID string) {
+	runIDs.Store(context, runID)
+}
+
+// RunID returns the run ID of the context, or an empty string if there isn't one.
+func RunID(context string) string {
+	context, _ = SplitTrace(context)
+	if id, ok := runIDs.Load(context); ok {
+		return id.(string)
+	}
+	return ""
+}
+
+// The trace ID of a request is appended to the context of the logs about it, so the logs of a request
+// can be grepped out by its trace ID. See leiogo.Request.LogContext. The separator is a NUL, which can't be
+// in the spider names, so a context without a trace ID is never split, the loggers print the trace ID apart.
+const traceSeparator = "\x00"
+
+// Traced returns the context with the trace ID, or the context itself if the trace ID is empty.
+func Traced(context string, traceID string) string {
+	if traceID == "" {
+		return context
+	}
+	return context + traceSeparator + traceID
+}
+
+// SplitTrace splits a context returned by Traced into the context and the trace ID.
+// RunID and EffectiveLevel look up the context without the trace ID.
+func SplitTrace(context string) (string, string) {
+	if i := strings.LastIndex(context, traceSeparator); i >= 0 {
+		return context[:i], context[i+len(traceSeparator):]
+	}
+	return context, ""
+}
@@ -0,0 +1,67 @@
+package logruslog
+
+import (
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/sirupsen/logrus"
+)
+
+// Logger is a log.Logger writing to a logrus.Logger of the application, with the fields "logger", "spider",
+// and "run" and "trace" if they are known. Fatal is written at the error level, since it doesn't exit,
+// unlike the fatal level of logrus.
+//
+// The Level passes everything by default, and the level of the logrus.Logger decides which logs are written.
+// The levels set by log.SetLevel and log.SetSpiderLevel are still checked first, so they can quiet a logger,
+// but can't make it more verbose than the logrus.Logger.
+type Logger struct {
+	Name   string
+	Level  int
+	Logger *logrus.Logger
+}
+
+// New returns the constructor of the Loggers writing to the logger, set it to log.New before
+// building the crawler:
+//
+//	log.New = logruslog.New(logger)
+func New(logger *logrus.Logger) func(name string) log.Logger {
+	return func(name string) log.Logger {
+		return &Logger{Name: name, Level: log.Trace, Logger: logger}
+	}
+}
+
+var levels = [...]logrus.Level{logrus.ErrorLevel, logrus.ErrorLevel, logrus.InfoLevel, logrus.DebugLevel, logrus.TraceLevel}
+
+func (l *Logger) logging(context string, content string, args []interface{}, level int) {
+	if level > log.EffectiveLevel(l.Name, context, l.Level) || !l.Logger.IsLevelEnabled(levels[level]) {
+		return
+	}
+
+	spider, traceID := log.SplitTrace(context)
+	fields := logrus.Fields{"logger": l.Name, "spider": spider}
+	if id := log.RunID(spider); id != "" {
+		fields["run"] = id
+	}
+	if traceID != "" {
+		fields["trace"] = traceID
+	}
+	l.Logger.WithFields(fields).Logf(levels[level], content, args...)
+}
+
+func (l *Logger) Fatal(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Fatal)
+}
+
+func (l *Logger) Error(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Error)
+}
+
+func (l *Logger) Info(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Info)
+}
+
+func (l *Logger) Debug(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Debug)
+}
+
+func (l *Logger) Trace(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Trace)
+}
@@ -16,11 +16,18 @@ type SimpleLogger struct {
 }
 
 func (l *SimpleLogger) logging(context string, content string, level int) {
-	if level <= l.Level {
+	context, traceID := SplitTrace(context)
+	if level <= EffectiveLevel(l.Name, context, l.Level) {
 		name := l.Name
 		if len(name) > 20 {
 			name = name[:17] + "..."
 		}
+		if id := RunID(context); id != "" {
+			context += " " + id
+		}
+		if traceID != "" {
+			context += " trace=" + traceID
+		}
 		log.Printf("<%s> %-7s %-20s: %s\n", context, fmt.Sprintf("[%s]", levels[level]), name, content)
 	}
 }
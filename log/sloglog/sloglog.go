@@ -0,0 +1,79 @@
+package sloglog
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+// Logger is a log.Logger writing to a slog.Logger of the application, so the crawls share its handlers,
+// like the JSON output and the level. The logs are recorded with the attributes "logger", "spider",
+// and "run" and "trace" if they are known. Fatal is recorded at the error level, since it doesn't exit.
+//
+// The Level passes everything by default, and the handler decides which logs are written. The levels set
+// by log.SetLevel and log.SetSpiderLevel are still checked first, so they can quiet a logger, but can't make
+// it more verbose than the handler.
+type Logger struct {
+	Name   string
+	Level  int
+	Logger *slog.Logger
+}
+
+// New returns the constructor of the Loggers writing to the logger, set it to log.New before
+// building the crawler:
+//
+//	log.New = sloglog.New(slog.Default())
+func New(logger *slog.Logger) func(name string) log.Logger {
+	return func(name string) log.Logger {
+		return &Logger{Name: name, Level: log.Trace, Logger: logger}
+	}
+}
+
+var (
+	// The slog levels of the leiogo levels, Trace is below the debug level.
+	levels = [...]slog.Level{slog.LevelError, slog.LevelError, slog.LevelInfo, slog.LevelDebug, slog.LevelDebug - 4}
+
+	// The logs aren't called with a context.Context, the parameters named context are the spiders.
+	background = context.Background()
+)
+
+func (l *Logger) logging(context string, content string, args []interface{}, level int) {
+	if level > log.EffectiveLevel(l.Name, context, l.Level) {
+		return
+	}
+	if !l.Logger.Enabled(background, levels[level]) {
+		return
+	}
+
+	spider, traceID := log.SplitTrace(context)
+	attrs := []slog.Attr{slog.String("logger", l.Name), slog.String("spider", spider)}
+	if id := log.RunID(spider); id != "" {
+		attrs = append(attrs, slog.String("run", id))
+	}
+	if traceID != "" {
+		attrs = append(attrs, slog.String("trace", traceID))
+	}
+	l.Logger.LogAttrs(background, levels[level], fmt.Sprintf(content, args...), attrs...)
+}
+
+func (l *Logger) Fatal(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Fatal)
+}
+
+func (l *Logger) Error(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Error)
+}
+
+func (l *Logger) Info(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Info)
+}
+
+func (l *Logger) Debug(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Debug)
+}
+
+func (l *Logger) Trace(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Trace)
+}
@@ -0,0 +1,72 @@
+package zaplog
+
+import (
+	"fmt"
+
+	"github.com/SteveZhangBit/leiogo/log"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Logger is a log.Logger writing to a zap.Logger of the application, named after the leiogo logger,
+// like "Downloader". The logs are written with the fields "spider", and "run" and "trace" if they are known.
+// Fatal is written at the error level, since it doesn't exit, and Trace at the debug level.
+//
+// The Level passes everything by default, and the core of the zap.Logger decides which logs are written.
+// The levels set by log.SetLevel and log.SetSpiderLevel are still checked first, so they can quiet a logger,
+// but can't make it more verbose than the core.
+type Logger struct {
+	Name   string
+	Level  int
+	Logger *zap.Logger
+}
+
+// New returns the constructor of the Loggers writing to the logger, set it to log.New before
+// building the crawler:
+//
+//	log.New = zaplog.New(logger)
+func New(logger *zap.Logger) func(name string) log.Logger {
+	return func(name string) log.Logger {
+		return &Logger{Name: name, Level: log.Trace, Logger: logger.Named(name)}
+	}
+}
+
+var levels = [...]zapcore.Level{zapcore.ErrorLevel, zapcore.ErrorLevel, zapcore.InfoLevel, zapcore.DebugLevel, zapcore.DebugLevel}
+
+func (l *Logger) logging(context string, content string, args []interface{}, level int) {
+	if level > log.EffectiveLevel(l.Name, context, l.Level) || !l.Logger.Core().Enabled(levels[level]) {
+		return
+	}
+
+	spider, traceID := log.SplitTrace(context)
+	fields := []zap.Field{zap.String("spider", spider)}
+	if id := log.RunID(spider); id != "" {
+		fields = append(fields, zap.String("run", id))
+	}
+	if traceID != "" {
+		fields = append(fields, zap.String("trace", traceID))
+	}
+	if entry := l.Logger.Check(levels[level], fmt.Sprintf(content, args...)); entry != nil {
+		entry.Write(fields...)
+	}
+}
+
+func (l *Logger) Fatal(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Fatal)
+}
+
+func (l *Logger) Error(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Error)
+}
+
+func (l *Logger) Info(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Info)
+}
+
+func (l *Logger) Debug(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Debug)
+}
+
+func (l *Logger) Trace(context string, content string, args ...interface{}) {
+	l.logging(context, content, args, log.Trace)
+}
@@ -0,0 +1,144 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// UnlockStrategy decides what to do with a request whose response is gated by a paywall or a login wall.
+// It returns a new request to try again, or nil if the page should be skipped.
+type UnlockStrategy interface {
+	Unlock(req *leiogo.Request, res *leiogo.Response, spider *leiogo.Spider) (*leiogo.Request, error)
+}
+
+// Skip the gated pages.
+type SkipStrategy struct{}
+
+func (s *SkipStrategy) Unlock(req *leiogo.Request, res *leiogo.Response, spider *leiogo.Spider) (*leiogo.Request, error) {
+	return nil, nil
+}
+
+// Try the same page again after refreshing the session, for example logging in again.
+type SessionRefreshStrategy struct {
+	Refresh func(spider *leiogo.Spider) error
+}
+
+func (s *SessionRefreshStrategy) Unlock(req *leiogo.Request, res *leiogo.Response, spider *leiogo.Spider) (*leiogo.Request, error) {
+	if err := s.Refresh(spider); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// Try the same path on an alternate host, like a mirror or an AMP site.
+type AlternateHostStrategy struct {
+	Host string
+}
+
+func (s *AlternateHostStrategy) Unlock(req *leiogo.Request, res *leiogo.Response, spider *leiogo.Spider) (*leiogo.Request, error) {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	u.Host = s.Host
+	req.URL = u.String()
+	return req, nil
+}
+
+// Some walls are only rendered by javascript for the plain http clients,
+// so we try the page again with phantomjs.
+type RenderStrategy struct{}
+
+func (s *RenderStrategy) Unlock(req *leiogo.Request, res *leiogo.Response, spider *leiogo.Spider) (*leiogo.Request, error) {
+	if enable, ok := req.Meta["phantomjs"].(bool); ok && enable {
+		return nil, errors.New("Page is still gated after rendering")
+	}
+	req.Meta["phantomjs"] = true
+	return req, nil
+}
+
+// AccessGateMiddleware is a spider middleware.
+// It inspects the responses for paywall or login wall markers, and routes the gated requests
+// through the configured unlock strategy. The gated pages themselves are always dropped.
+type AccessGateMiddleware struct {
+	BaseMiddleware
+
+	// A response is gated if its body contains any of the markers,
+	// or if the Detect function returns true.
+	Markers [][]byte
+	Detect  func(res *leiogo.Response) bool
+
+	Strategy UnlockStrategy
+
+	// The max times a single request can be unlocked, this avoids endless loops
+	// when the strategy can't unlock the page at all.
+	MaxUnlocks int
+
+	Yielder
+
+	// Metrics on the gated pages, they will be reported when the spider closes.
+	Gated    int
+	Unlocked int
+	Skipped  int
+	mutex    sync.Mutex
+}
+
+func (m *AccessGateMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	m.Logger.Info(spider.Name, "Gated pages: %d, unlock tries: %d, skipped: %d", m.Gated, m.Unlocked, m.Skipped)
+	return nil
+}
+
+func (m *AccessGateMiddleware) isGated(res *leiogo.Response) bool {
+	for _, marker := range m.Markers {
+		if bytes.Contains(res.Body, marker) {
+			return true
+		}
+	}
+	return m.Detect != nil && m.Detect(res)
+}
+
+func (m *AccessGateMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if !m.isGated(res) {
+		return nil
+	}
+	m.count(&m.Gated)
+	m.Logger.Debug(req.LogContext(spider), "Response of %s is gated", req.URL)
+
+	// We store the unlock times in the request's meta, just like what the retry middleware does.
+	// It may be an int64 or a float64 after the meta is saved and loaded, like by the JobDir.
+	n, _ := req.Meta.Float("__unlocks__")
+	unlocks := int(n)
+	if unlocks >= m.MaxUnlocks {
+		m.count(&m.Skipped)
+		return &DropTaskError{Message: fmt.Sprintf("Still gated after %d unlocks", unlocks)}
+	}
+
+	newReq, err := m.Strategy.Unlock(req, res, spider)
+	if err != nil {
+		m.count(&m.Skipped)
+		return err
+	}
+	if newReq == nil {
+		m.count(&m.Skipped)
+		return &DropTaskError{Message: "Skip gated page"}
+	}
+
+	newReq.Meta["__unlocks__"] = unlocks + 1
+	newReq.Meta["dontfilter"] = true
+	m.count(&m.Unlocked)
+	if err := m.NewRequest(newReq, nil, spider); err != nil {
+		m.Logger.Error(req.LogContext(spider), "Add unlock request error, %s", err.Error())
+	}
+	return &DropTaskError{Message: "Gated page", Rescheduled: true}
+}
+
+func (m *AccessGateMiddleware) count(n *int) {
+	m.mutex.Lock()
+	*n++
+	m.mutex.Unlock()
+}
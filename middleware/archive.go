@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// ArchiveMiddleware is a spider middleware, it submits the crawled pages to an archive service,
+// like the Wayback Machine, so a research crawl can be reproduced from the snapshots later.
+// The pages are submitted by a background goroutine, one every Interval, so the crawl is never
+// slowed down by the archive service. When the spider closes, the remaining pages are submitted one after another
+// without the Interval, and it waits for them.
+type ArchiveMiddleware struct {
+	BaseMiddleware
+
+	// The URL of the page is appended to the Endpoint, and the archive service is asked with a GET request.
+	// For the Wayback Machine, it's https://web.archive.org/save/
+	Endpoint string
+
+	// The minimum interval between two submissions, the archive services usually have strict rate limits.
+	// A non-positive Interval falls back to defaultArchiveInterval.
+	Interval time.Duration
+
+	// The times to submit a page again when the service is busy (429) or fails (5xx).
+	MaxRetries int
+
+	// The counters are updated atomically, so they can be read while the crawler is running.
+	Submitted int64
+	Failed    int64
+
+	client  *http.Client
+	queue   []*leiogo.Request
+	retries map[string]int
+	seen    map[string]bool
+	closed  bool
+	closing chan bool
+	done    chan bool
+	mutex   sync.Mutex
+}
+
+// The interval of the submissions if the Interval is not set.
+const defaultArchiveInterval = 5 * time.Second
+
+func (m *ArchiveMiddleware) Open(spider *leiogo.Spider) error {
+	if m.Interval <= 0 {
+		m.Logger.Error(spider.Name, "Invalid interval %s, submit pages every %s", m.Interval, defaultArchiveInterval)
+		m.Interval = defaultArchiveInterval
+	}
+	m.client = &http.Client{Timeout: 120 * time.Second}
+	m.retries = make(map[string]int)
+	m.seen = make(map[string]bool)
+	m.closing = make(chan bool)
+	m.done = make(chan bool)
+	go m.submitLoop(spider)
+
+	m.Logger.Info(spider.Name, "Submit pages to %s every %s", m.Endpoint, m.Interval)
+	return nil
+}
+
+func (m *ArchiveMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	m.mutex.Lock()
+	m.closed = true
+	remaining := len(m.queue)
+	m.mutex.Unlock()
+	close(m.closing)
+
+	if remaining > 0 {
+		m.Logger.Info(spider.Name, "Waiting for %d pages to be archived", remaining)
+	}
+	<-m.done
+	m.Logger.Info(spider.Name, "Archived pages: %d, failed: %d",
+		atomic.LoadInt64(&m.Submitted), atomic.LoadInt64(&m.Failed))
+	return nil
+}
+
+// Only the pages downloaded successfully are archived, and each url is submitted once.
+func (m *ArchiveMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if res.Err != nil || res.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if !m.seen[req.URL] {
+		m.seen[req.URL] = true
+		m.queue = append(m.queue, req)
+	}
+	return nil
+}
+
+func (m *ArchiveMiddleware) pop() (*leiogo.Request, bool, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.queue) == 0 {
+		return nil, false, m.closed
+	}
+	req := m.queue[0]
+	m.queue = m.queue[1:]
+	return req, true, false
+}
+
+func (m *ArchiveMiddleware) submitLoop(spider *leiogo.Spider) {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.Interval)
+	defer ticker.Stop()
+
+	for {
+		// The rest of the queue doesn't wait for the ticker after the spider closes.
+		select {
+		case <-ticker.C:
+		case <-m.closing:
+		}
+
+		req, ok, closed := m.pop()
+		if closed {
+			return
+		} else if ok {
+			m.submit(req, spider)
+		}
+	}
+}
+
+func (m *ArchiveMiddleware) submit(req *leiogo.Request, spider *leiogo.Spider) {
+	url := req.URL
+	res, err := m.client.Get(m.Endpoint + url)
+	if err == nil {
+		res.Body.Close()
+		if res.StatusCode < 400 {
+			atomic.AddInt64(&m.Submitted, 1)
+			m.Logger.Debug(req.LogContext(spider), "Archived %s", url)
+			return
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// A busy or failing service may accept the page later, so put it back to the end of the queue.
+	if err == nil && (res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500) &&
+		m.retries[url] < m.MaxRetries {
+		m.retries[url]++
+		m.queue = append(m.queue, req)
+		return
+	}
+
+	atomic.AddInt64(&m.Failed, 1)
+	if err != nil {
+		m.Logger.Error(req.LogContext(spider), "Archive %s fail, %s", url, err)
+	} else {
+		m.Logger.Error(req.LogContext(spider), "Archive %s fail with status %d", url, res.StatusCode)
+	}
+}
@@ -0,0 +1,98 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// AutoThrottleMiddleware is a download middleware, it's an alternative of DelayMiddleware.
+// Instead of a static delay, it measures the download latency and the server errors of each host,
+// and adjusts the delay of the host dynamically, just like Scrapy's AutoThrottle extension.
+// The idea is that a server is busy when the latency is high, so we should request it less often.
+type AutoThrottleMiddleware struct {
+	BaseMiddleware
+
+	// The delay seconds for a host we haven't requested yet.
+	StartDelay float64
+
+	// The delay of a host is always between MinDelay and MaxDelay.
+	MinDelay float64
+	MaxDelay float64
+
+	// The average number of requests we want to send to a host in parallel.
+	// With a latency of 2s and TargetConcurrency of 1.0, the target delay is 2s.
+	TargetConcurrency float64
+
+	hosts map[string]*throttleHost
+	mutex sync.Mutex
+}
+
+type throttleHost struct {
+	delay    float64
+	requests int
+	errors   int
+}
+
+func (m *AutoThrottleMiddleware) Open(spider *leiogo.Spider) error {
+	m.hosts = make(map[string]*throttleHost)
+	m.Logger.Debug(spider.Name, "Init success with startDelay: %.1f, maxDelay: %.1f, targetConcurrency: %.1f",
+		m.StartDelay, m.MaxDelay, m.TargetConcurrency)
+	return nil
+}
+
+func (m *AutoThrottleMiddleware) host(req *leiogo.Request) *throttleHost {
+	name := util.GetHost(req.URL)
+	h, ok := m.hosts[name]
+	if !ok {
+		h = &throttleHost{delay: m.StartDelay}
+		m.hosts[name] = h
+	}
+	return h
+}
+
+func (m *AutoThrottleMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	m.mutex.Lock()
+	delay := m.host(req).delay
+	m.mutex.Unlock()
+
+	m.Logger.Debug(req.LogContext(spider), "Delay request %s for %.3f", req.URL, delay)
+	time.Sleep(time.Duration(delay*1000) * time.Millisecond)
+	return nil
+}
+
+// The new delay is the average of the previous delay and the target delay,
+// which is the latency divided by the target concurrency. This makes the delay change smoothly.
+// Errors and server errors (5xx) are usually faster than the normal responses, so they are not allowed
+// to decrease the delay. Instead, we double the delay to back off from a failing server.
+func (m *AutoThrottleMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h := m.host(req)
+	h.requests++
+	oldDelay := h.delay
+
+	if res.Err != nil || res.StatusCode >= 500 {
+		// A finished file download also comes with a DropTaskError, it's not a server error.
+		if _, ok := res.Err.(*DropTaskError); !ok {
+			h.errors++
+			h.delay *= 2
+		}
+	} else {
+		target := res.Latency.Seconds() / m.TargetConcurrency
+		h.delay = (h.delay + target) / 2
+	}
+
+	if h.delay < m.MinDelay {
+		h.delay = m.MinDelay
+	} else if h.delay > m.MaxDelay {
+		h.delay = m.MaxDelay
+	}
+
+	m.Logger.Debug(req.LogContext(spider), "Latency of %s: %.3f, delay: %.3f -> %.3f, errors: %d/%d",
+		req.URL, res.Latency.Seconds(), oldDelay, h.delay, h.errors, h.requests)
+	return nil
+}
@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"sync"
+
+	"github.com/blevesearch/bleve/v2"
+)
+
+// BleveSearchIndex indexes the documents into a local Bleve index at Path, it's created with the default
+// mapping if it doesn't exist, so the site can be searched without a search server.
+type BleveSearchIndex struct {
+	Path string
+
+	index bleve.Index
+	mutex sync.Mutex
+}
+
+func (b *BleveSearchIndex) open() (err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.index != nil {
+		return nil
+	}
+	if b.index, err = bleve.Open(b.Path); err == bleve.ErrorIndexPathDoesNotExist {
+		b.index, err = bleve.New(b.Path, bleve.NewIndexMapping())
+	}
+	return err
+}
+
+func (b *BleveSearchIndex) Index(docs []*SearchDocument) error {
+	if err := b.open(); err != nil {
+		return err
+	}
+	batch := b.index.NewBatch()
+	for _, doc := range docs {
+		if err := batch.Index(doc.ID, doc); err != nil {
+			return err
+		}
+	}
+	return b.index.Batch(batch)
+}
+
+func (b *BleveSearchIndex) Close() error {
+	if b.index == nil {
+		return nil
+	}
+	return b.index.Close()
+}
@@ -0,0 +1,235 @@
+package middleware
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// The steps of the mitigation ladder, a blocked host climbs one step at a time.
+const (
+	BlockNormal = iota
+	BlockSlowDown
+	BlockRotate
+	BlockRender
+	BlockPause
+)
+
+var blockLevelNames = [...]string{"normal", "slow down", "rotate", "render", "pause"}
+
+// BlockState is the state of a host in the BlockDetectorMiddleware.
+type BlockState struct {
+	Level       int       `json:"level"`
+	Step        string    `json:"step"`
+	Blocked     int       `json:"blocked"`
+	Responses   int       `json:"responses"`
+	PausedUntil time.Time `json:"paused_until,omitempty"`
+
+	// The responses and the signs of blocking in the current window, and the clean responses in a row.
+	window, signs, clean int
+	rotation             int
+
+	// The time the next request to a slowed down host may be sent.
+	next time.Time
+}
+
+// BlockDetectorMiddleware is a download middleware, it detects the signs of being blocked by a host:
+// the statuses like 403 and 429, the captcha pages, and the redirects to a challenge page.
+// When the signs are more than Threshold of the last Window responses of a host, the host climbs
+// the mitigation ladder by one step:
+//
+//	slow down - the requests to the host are sent SlowDelay apart
+//	rotate    - and sent with the UserAgents and the Proxies in turn
+//	render    - and rendered by phantomjs
+//	pause     - and the host is paused for PauseDuration, then it starts over from slow down
+//
+// After CalmResponses clean responses in a row, the host steps down. The state of the hosts
+// is in the status of the control API. The delayed and the paused requests go back to the scheduler
+// until their time, see Deferrer, so they don't hold the tokens of the other hosts.
+// Add it before the RetryMiddleware, otherwise the retried responses never reach it.
+type BlockDetectorMiddleware struct {
+	BaseMiddleware
+
+	Window    int
+	Threshold float64
+
+	BlockStatuses  []int
+	CaptchaMarkers []string
+
+	// The redirects to a url containing any of these words are signs, like /captcha or /blocked.
+	RedirectMarkers []string
+
+	SlowDelay     time.Duration
+	UserAgents    []string
+	Proxies       []string
+	PauseDuration time.Duration
+	CalmResponses int
+
+	hosts map[string]*BlockState
+	mutex sync.Mutex
+}
+
+func (m *BlockDetectorMiddleware) Open(spider *leiogo.Spider) error {
+	m.hosts = make(map[string]*BlockState)
+	return m.BaseMiddleware.Open(spider)
+}
+
+// The rotation step of the ladder disguises the crawler, see StealthComponent.
+func (m *BlockDetectorMiddleware) StealthFeatures() []string {
+	var features []string
+	if len(m.UserAgents) != 0 {
+		features = append(features, "user agent rotation")
+	}
+	if len(m.Proxies) != 0 {
+		features = append(features, "proxy rotation")
+	}
+	return features
+}
+
+func (m *BlockDetectorMiddleware) host(name string) *BlockState {
+	h, ok := m.hosts[name]
+	if !ok {
+		h = &BlockState{Step: blockLevelNames[BlockNormal]}
+		m.hosts[name] = h
+	}
+	return h
+}
+
+// Apply the mitigations of the step of the host to the request.
+func (m *BlockDetectorMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	m.mutex.Lock()
+	h := m.host(util.GetHost(req.URL))
+	level := h.Level
+	rotation := h.rotation
+	if level >= BlockRotate {
+		h.rotation++
+	}
+	m.mutex.Unlock()
+
+	if level >= BlockRender {
+		req.Meta["phantomjs"] = true
+	}
+	if level >= BlockRotate {
+		if len(m.UserAgents) != 0 {
+			req.Meta["useragent"] = m.UserAgents[rotation%len(m.UserAgents)]
+		}
+		if len(m.Proxies) != 0 {
+			req.Meta["proxy"] = m.Proxies[rotation%len(m.Proxies)]
+		}
+	}
+	return nil
+}
+
+// Put the requests to a paused host off until the pause ends, and the requests to a slowed down host
+// until its next request may be sent. A request let through takes the next slot of the host.
+func (m *BlockDetectorMiddleware) DeferUntil(req *leiogo.Request, spider *leiogo.Spider) time.Time {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h := m.host(util.GetHost(req.URL))
+	now := time.Now()
+	if h.Level >= BlockPause && now.Before(h.PausedUntil) {
+		return h.PausedUntil
+	}
+	if h.Level >= BlockSlowDown {
+		if now.Before(h.next) {
+			return h.next
+		}
+		h.next = now.Add(m.SlowDelay)
+	}
+	return time.Time{}
+}
+
+func (m *BlockDetectorMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	// The files and the connection errors tell nothing about blocking.
+	if res.Err != nil {
+		return nil
+	}
+	blocked := m.isBlocked(res)
+	name := util.GetHost(req.URL)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	h := m.host(name)
+	h.Responses++
+	h.window++
+	if blocked {
+		h.Blocked++
+		h.signs++
+		h.clean = 0
+	} else {
+		h.clean++
+	}
+
+	if h.window >= m.Window {
+		if float64(h.signs) >= m.Threshold*float64(h.window) {
+			m.setLevel(h, name, h.Level%BlockPause+1, spider)
+		}
+		h.window, h.signs = 0, 0
+	}
+	if h.Level > BlockNormal && h.clean >= m.CalmResponses {
+		m.setLevel(h, name, h.Level-1, spider)
+		h.clean = 0
+	}
+	return nil
+}
+
+func (m *BlockDetectorMiddleware) setLevel(h *BlockState, name string, level int, spider *leiogo.Spider) {
+	if level > h.Level || (h.Level == BlockPause && level == BlockSlowDown) {
+		m.Logger.Error(spider.Name, "Host %s seems to block us, %d of %d responses are blocked, step up to %s",
+			name, h.signs, h.window, blockLevelNames[level])
+	} else {
+		m.Logger.Info(spider.Name, "Host %s seems fine, step down to %s", name, blockLevelNames[level])
+	}
+	h.Level = level
+	h.Step = blockLevelNames[level]
+	if level == BlockPause {
+		h.PausedUntil = time.Now().Add(m.PauseDuration)
+	}
+}
+
+func (m *BlockDetectorMiddleware) isBlocked(res *leiogo.Response) bool {
+	for _, s := range m.BlockStatuses {
+		if res.StatusCode == s {
+			return true
+		}
+	}
+	for _, r := range res.Redirects {
+		location := strings.ToLower(r.Location)
+		for _, marker := range m.RedirectMarkers {
+			if strings.Contains(location, strings.ToLower(marker)) {
+				return true
+			}
+		}
+	}
+	if len(m.CaptchaMarkers) != 0 {
+		// The markers are usually in the head, and the blocking pages are small.
+		body := res.Body
+		if len(body) > 64*1024 {
+			body = body[:64*1024]
+		}
+		lower := strings.ToLower(string(body))
+		for _, marker := range m.CaptchaMarkers {
+			if strings.Contains(lower, strings.ToLower(marker)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// States returns a copy of the states of the hosts.
+func (m *BlockDetectorMiddleware) States() map[string]*BlockState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	states := make(map[string]*BlockState, len(m.hosts))
+	for name, h := range m.hosts {
+		copied := *h
+		states[name] = &copied
+	}
+	return states
+}
@@ -0,0 +1,147 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// BodyStore keeps the bodies by their contents, a body is stored once under its hash, see BodyHash,
+// however many urls serve it, and the store remembers the hash of the latest body of every url.
+// The archive scale crawls see the same bodies again and again, like the error pages and the scripts,
+// so the HTTP cache and the WARC records keep the hashes instead, see DedupCacheStorage and WARCWriter.
+type BodyStore interface {
+	// Put stores the body if it's not stored yet, maps the url to it, and returns its hash.
+	Put(url string, body []byte) (string, error)
+
+	// Get returns the body of the hash, or nil if it's not stored.
+	Get(hash string) ([]byte, error)
+
+	// Exists tells whether the body of the hash is stored.
+	Exists(hash string) bool
+
+	// Hash returns the hash of the latest body of the url, or empty if there's none.
+	Hash(url string) (string, error)
+}
+
+// BodyHash returns the hex SHA-256 of the body, the address of the body in a BodyStore.
+func BodyHash(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// FSBodyStore keeps the bodies in Dir/blobs/hash[:2]/hash, and the hashes of the urls
+// in Dir/urls/h[:2]/h, h is the hash of the url, see util.Hash.
+type FSBodyStore struct {
+	Dir string
+}
+
+func (s *FSBodyStore) blob(hash string) string {
+	return path.Join(s.Dir, "blobs", hash[:2], hash)
+}
+
+func (s *FSBodyStore) url(url string) string {
+	h := util.Hash(url)
+	return path.Join(s.Dir, "urls", h[:2], h)
+}
+
+func (s *FSBodyStore) Put(url string, body []byte) (string, error) {
+	hash := BodyHash(body)
+	if !s.Exists(hash) {
+		if err := writeAtomic(s.blob(hash), body); err != nil {
+			return "", err
+		}
+	}
+	if err := writeAtomic(s.url(url), []byte(hash)); err != nil {
+		return "", err
+	}
+	return hash, nil
+}
+
+func (s *FSBodyStore) Get(hash string) ([]byte, error) {
+	if len(hash) < 2 {
+		return nil, nil
+	}
+	body, err := ioutil.ReadFile(s.blob(hash))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return body, err
+}
+
+func (s *FSBodyStore) Exists(hash string) bool {
+	if len(hash) < 2 {
+		return false
+	}
+	_, err := os.Stat(s.blob(hash))
+	return err == nil
+}
+
+func (s *FSBodyStore) Hash(url string) (string, error) {
+	hash, err := ioutil.ReadFile(s.url(url))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	return string(hash), err
+}
+
+// Write the file by a rename, so the readers never see a partial file.
+func writeAtomic(filepath string, data []byte) error {
+	if err := os.MkdirAll(path.Dir(filepath), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(filepath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// DedupCacheStorage is a HttpCacheStorage keeping the bodies of the responses in the Bodies, and the rest
+// of the responses with the hashes of the bodies in the wrapped storage. So a body is stored once,
+// no matter how many urls or versions have it.
+type DedupCacheStorage struct {
+	HttpCacheStorage
+	Bodies BodyStore
+}
+
+func (s *DedupCacheStorage) Store(key string, res *CachedResponse) error {
+	hash, err := s.Bodies.Put(res.URL, res.Body)
+	if err != nil {
+		return err
+	}
+	stored := *res
+	stored.Body = nil
+	stored.BodyHash = hash
+	return s.HttpCacheStorage.Store(key, &stored)
+}
+
+func (s *DedupCacheStorage) Retrieve(key string, asOf time.Time) (*CachedResponse, error) {
+	res, err := s.HttpCacheStorage.Retrieve(key, asOf)
+	if err != nil || res == nil || res.BodyHash == "" {
+		return res, err
+	}
+	if res.Body, err = s.Bodies.Get(res.BodyHash); err != nil {
+		return nil, err
+	}
+	// The body is lost, so is the response.
+	if res.Body == nil {
+		return nil, nil
+	}
+	return res, nil
+}
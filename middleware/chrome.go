@@ -0,0 +1,600 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"golang.org/x/net/websocket"
+)
+
+// ChromeDownloader renders the pages with headless Chrome through the DevTools protocol, instead of
+// the abandoned phantomjs. The requests with 'render' = true in the meta are rendered, the others are
+// downloaded by the wrapped Downloader. A page is opened in a new tab, and its DOM is returned when the network
+// has been idle for IdleTime after the page is loaded, or when an element matches the CSS selector 'waitfor'
+// in the meta, until the Timeout. The status and the headers are the ones of the document of the page.
+// The other options of the page, like the viewport and the script, are in the meta too, see renderOptions.
+//
+// The browsers are started when they are needed, and shared by the requests: there are up to Browsers of them,
+// each rendering up to Tabs pages at the same time, and the other requests wait. A browser which has crashed
+// is started again by the next request. The browsers are killed when the spider closes.
+type ChromeDownloader struct {
+	Downloader
+
+	Logger log.Logger
+
+	// The Chrome executable, and the extra flags of its command line.
+	Exec  string
+	Flags []string
+
+	Browsers int
+	Tabs     int
+	IdleTime time.Duration
+	Timeout  time.Duration
+
+	// The max bytes of a message from the DevTools, like the DOM or the screenshot of a page,
+	// 0 means websocket.DefaultMaxPayloadBytes. See ErrMessageTooLarge.
+	MaxMessageSize int
+
+	// If Tenants is not nil, the bodies of the rendered pages are counted into the usages of the tenants
+	// of the spiders, see DefaultDownloader.Tenants.
+	Tenants *Tenants
+
+	browsers []*chromeBrowser
+	tokens   chan int
+	once     sync.Once
+	mutex    sync.Mutex
+}
+
+func (d *ChromeDownloader) Open(spider *leiogo.Spider) error {
+	return nil
+}
+
+func (d *ChromeDownloader) Close(reason string, spider *leiogo.Spider) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i, b := range d.browsers {
+		if b != nil {
+			b.close()
+			d.browsers[i] = nil
+		}
+	}
+	return nil
+}
+
+func (d *ChromeDownloader) init() {
+	if d.Browsers < 1 {
+		d.Browsers = 1
+	}
+	if d.Tabs < 1 {
+		d.Tabs = 1
+	}
+	d.browsers = make([]*chromeBrowser, d.Browsers)
+	// Every browser has Tabs tokens, the token t is a tab of the browser t % Browsers.
+	d.tokens = make(chan int, d.Browsers*d.Tabs)
+	for t := 0; t < d.Browsers*d.Tabs; t++ {
+		d.tokens <- t
+	}
+}
+
+func (d *ChromeDownloader) Download(ctx context.Context, req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response {
+	if render, _ := req.Meta["render"].(bool); !render {
+		return d.Downloader.Download(ctx, req, spider)
+	}
+
+	res := leiogo.NewResponse(req)
+	d.once.Do(d.init)
+	var token int
+	select {
+	case token = <-d.tokens:
+	case <-ctx.Done():
+		res.Err = ctx.Err()
+		return res
+	}
+	defer func() { d.tokens <- token }()
+
+	b, err := d.browser(token%d.Browsers, spider)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	d.Logger.Info(req.LogContext(spider), "Rendering %s with Chrome", req.URL)
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	res.Err = b.render(ctx, req, res, d.IdleTime)
+	if d.Tenants != nil && spider.Tenant != "" {
+		d.Tenants.AddBytes(spider.Tenant, int64(len(res.Body)))
+	}
+	return res
+}
+
+// The i-th browser, it's started if it's not running.
+func (d *ChromeDownloader) browser(i int, spider *leiogo.Spider) (*chromeBrowser, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if b := d.browsers[i]; b != nil {
+		err := b.broken()
+		if err == nil {
+			return b, nil
+		}
+		d.Logger.Error(spider.Name, "Restart Chrome, %s", err)
+		b.close()
+		d.browsers[i] = nil
+	}
+	b, err := startChrome(d.Exec, d.Flags, d.MaxMessageSize)
+	if err != nil {
+		return nil, fmt.Errorf("Start Chrome failed, %s", err)
+	}
+	d.browsers[i] = b
+	return b, nil
+}
+
+// A request or a response of the DevTools protocol, or an event if ID is 0.
+type cdpRequest struct {
+	ID        int64       `json:"id"`
+	SessionID string      `json:"sessionId,omitempty"`
+	Method    string      `json:"method"`
+	Params    interface{} `json:"params,omitempty"`
+}
+
+type cdpMessage struct {
+	ID        int64           `json:"id"`
+	SessionID string          `json:"sessionId"`
+	Method    string          `json:"method"`
+	Params    json.RawMessage `json:"params"`
+	Result    json.RawMessage `json:"result"`
+	Error     *struct {
+		Message string `json:"message"`
+	} `json:"error"`
+
+	// The error of the call which is not from the browser, like ErrMessageTooLarge.
+	err error
+}
+
+// ErrMessageTooLarge fails the calls waiting when the browser sends a message larger than the MaxMessageSize.
+// The message is discarded without being read, so it can't be told which call it answers, and all of them fail,
+// but the connection is still fine.
+var ErrMessageTooLarge = errors.New("DevTools message is larger than the max message size")
+
+// The events of a tab, they are queued until the tab reads them.
+type cdpSession struct {
+	events []*cdpMessage
+	signal chan struct{}
+}
+
+// chromeBrowser is a Chrome process, and the connection to its DevTools.
+type chromeBrowser struct {
+	cmd  *exec.Cmd
+	dir  string
+	conn *websocket.Conn
+
+	id       int64
+	calls    map[int64]chan *cdpMessage
+	sessions map[string]*cdpSession
+	err      error
+	mutex    sync.Mutex
+}
+
+const devToolsPrefix = "DevTools listening on "
+
+func startChrome(exe string, flags []string, maxMessageSize int) (*chromeBrowser, error) {
+	dir, err := ioutil.TempDir("", "leiogo-chrome")
+	if err != nil {
+		return nil, err
+	}
+	args := append([]string{
+		"--headless=new", "--disable-gpu", "--no-first-run", "--no-default-browser-check",
+		"--remote-debugging-port=0", "--remote-allow-origins=*", "--user-data-dir=" + dir,
+	}, flags...)
+	cmd := exec.Command(exe, append(args, "about:blank")...)
+	stderr, err := cmd.StderrPipe()
+	if err == nil {
+		err = cmd.Start()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	// Chrome prints the url of the DevTools when it's ready. The rest of the stderr is discarded,
+	// but it has to be read, or Chrome blocks on a full pipe.
+	found := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, devToolsPrefix) {
+				select {
+				case found <- strings.TrimSpace(strings.TrimPrefix(line, devToolsPrefix)):
+				default:
+				}
+			}
+		}
+		close(found)
+	}()
+
+	var url string
+	select {
+	case url = <-found:
+	case <-time.After(30 * time.Second):
+	}
+	var conn *websocket.Conn
+	if url == "" {
+		err = errors.New("no DevTools url from Chrome")
+	} else {
+		conn, err = websocket.Dial(url, "", "http://localhost/")
+	}
+	if err == nil {
+		conn.MaxPayloadBytes = maxMessageSize
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+
+	b := &chromeBrowser{
+		cmd:      cmd,
+		dir:      dir,
+		conn:     conn,
+		calls:    make(map[int64]chan *cdpMessage),
+		sessions: make(map[string]*cdpSession),
+	}
+	go b.read()
+	return b, nil
+}
+
+func (b *chromeBrowser) close() {
+	b.conn.Close()
+	b.cmd.Process.Kill()
+	b.cmd.Wait()
+	os.RemoveAll(b.dir)
+}
+
+// The error if the connection to the browser is broken, like a crash.
+func (b *chromeBrowser) broken() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.err
+}
+
+// Read the messages from the browser, the responses go to their calls, and the events to their tabs.
+func (b *chromeBrowser) read() {
+	for {
+		msg := &cdpMessage{}
+		err := websocket.JSON.Receive(b.conn, msg)
+		if err == websocket.ErrFrameTooLarge {
+			b.mutex.Lock()
+			for id, call := range b.calls {
+				call <- &cdpMessage{ID: id, err: ErrMessageTooLarge}
+				delete(b.calls, id)
+			}
+			b.mutex.Unlock()
+			continue
+		}
+		if err != nil {
+			b.mutex.Lock()
+			b.err = fmt.Errorf("Chrome connection broken, %s", err)
+			for id, call := range b.calls {
+				close(call)
+				delete(b.calls, id)
+			}
+			for _, s := range b.sessions {
+				close(s.signal)
+			}
+			b.sessions = make(map[string]*cdpSession)
+			b.mutex.Unlock()
+			return
+		}
+
+		b.mutex.Lock()
+		if msg.ID != 0 {
+			if call, ok := b.calls[msg.ID]; ok {
+				delete(b.calls, msg.ID)
+				call <- msg
+			}
+		} else if s, ok := b.sessions[msg.SessionID]; ok {
+			s.events = append(s.events, msg)
+			select {
+			case s.signal <- struct{}{}:
+			default:
+			}
+		}
+		b.mutex.Unlock()
+	}
+}
+
+// Call a method of the browser, or of the tab if sessionID isn't empty, and decode the result into result.
+func (b *chromeBrowser) call(ctx context.Context, sessionID string, method string, params interface{}, result interface{}) error {
+	call := make(chan *cdpMessage, 1)
+	b.mutex.Lock()
+	if b.err != nil {
+		b.mutex.Unlock()
+		return b.err
+	}
+	b.id++
+	id := b.id
+	b.calls[id] = call
+	b.mutex.Unlock()
+
+	err := websocket.JSON.Send(b.conn, cdpRequest{ID: id, SessionID: sessionID, Method: method, Params: params})
+	if err == nil {
+		select {
+		case msg, ok := <-call:
+			if !ok {
+				return b.broken()
+			}
+			if msg.err != nil {
+				return fmt.Errorf("%s failed, %w", method, msg.err)
+			}
+			if msg.Error != nil {
+				return fmt.Errorf("%s failed, %s", method, msg.Error.Message)
+			}
+			if result != nil {
+				return json.Unmarshal(msg.Result, result)
+			}
+			return nil
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	b.mutex.Lock()
+	delete(b.calls, id)
+	b.mutex.Unlock()
+	return err
+}
+
+// The next event of the tab, it's nil if there's none in the timeout.
+func (b *chromeBrowser) next(ctx context.Context, s *cdpSession, timeout time.Duration) (*cdpMessage, error) {
+	b.mutex.Lock()
+	if len(s.events) != 0 {
+		msg := s.events[0]
+		s.events = s.events[1:]
+		b.mutex.Unlock()
+		return msg, nil
+	}
+	b.mutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case _, ok := <-s.signal:
+		if !ok {
+			return nil, b.broken()
+		}
+		return b.next(ctx, s, 0)
+	case <-timer.C:
+		return nil, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Render the page of the request in a new tab, and set the DOM to the body of the response.
+func (b *chromeBrowser) render(ctx context.Context, req *leiogo.Request, res *leiogo.Response, idle time.Duration) error {
+	opts, err := newRenderOptions(req)
+	if err != nil {
+		return err
+	}
+
+	var target struct {
+		TargetID string `json:"targetId"`
+	}
+	if err := b.call(ctx, "", "Target.createTarget", leiogo.Dict{"url": "about:blank"}, &target); err != nil {
+		return err
+	}
+	defer func() {
+		// The tab is closed even if the request is cancelled.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		b.call(ctx, "", "Target.closeTarget", leiogo.Dict{"targetId": target.TargetID}, nil)
+		cancel()
+	}()
+
+	var attached struct {
+		SessionID string `json:"sessionId"`
+	}
+	if err := b.call(ctx, "", "Target.attachToTarget", leiogo.Dict{"targetId": target.TargetID, "flatten": true}, &attached); err != nil {
+		return err
+	}
+	session := attached.SessionID
+	s := &cdpSession{signal: make(chan struct{}, 1)}
+	b.mutex.Lock()
+	b.sessions[session] = s
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		delete(b.sessions, session)
+		b.mutex.Unlock()
+	}()
+
+	for _, method := range []string{"Page.enable", "Network.enable"} {
+		if err := b.call(ctx, session, method, nil, nil); err != nil {
+			return err
+		}
+	}
+	if opts.Width > 0 {
+		metrics := leiogo.Dict{"width": opts.Width, "height": opts.Height, "deviceScaleFactor": 1, "mobile": false}
+		if err := b.call(ctx, session, "Emulation.setDeviceMetricsOverride", metrics, nil); err != nil {
+			return err
+		}
+	}
+	var nav struct {
+		LoaderID  string `json:"loaderId"`
+		ErrorText string `json:"errorText"`
+	}
+	if err := b.call(ctx, session, "Page.navigate", leiogo.Dict{"url": req.URL}, &nav); err != nil {
+		return err
+	}
+	if nav.ErrorText != "" {
+		return fmt.Errorf("Navigate to %s failed, %s", req.URL, nav.ErrorText)
+	}
+
+	waitCtx := ctx
+	if opts.WaitTimeout > 0 {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, opts.waitTimeout())
+		defer cancel()
+	}
+	if err := b.wait(waitCtx, s, session, nav.LoaderID, opts.WaitFor, idle, res); err != nil {
+		// The page is captured as it is after the waittimeout.
+		if waitCtx.Err() == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	if opts.Script != "" {
+		if err := b.evaluate(ctx, session, opts.Script, &res.ScriptResult); err != nil {
+			return err
+		}
+	}
+	var html string
+	if err := b.evaluate(ctx, session, "document.documentElement.outerHTML", &html); err != nil {
+		return err
+	}
+	res.Body = []byte(html)
+	if opts.Screenshot {
+		if res.Screenshot, err = b.screenshot(ctx, session); err != nil {
+			return err
+		}
+	}
+	// The document may come from the cache of the browser without a response event, it's fine like phantomjs.
+	if res.StatusCode == 0 {
+		res.StatusCode = 200
+	}
+	return nil
+}
+
+// Wait until the page is loaded and the network is idle, or until an element matches the selector
+// if it's not empty. The status and the headers of the document are set to the response on the way.
+func (b *chromeBrowser) wait(ctx context.Context, s *cdpSession, session string, loaderID string,
+	selector string, idle time.Duration, res *leiogo.Response) error {
+
+	const tick = 100 * time.Millisecond
+	loaded := false
+	inflight := make(map[string]bool)
+	active := time.Now()
+	checked := time.Now()
+
+	for {
+		msg, err := b.next(ctx, s, tick)
+		if err != nil {
+			return err
+		}
+		if msg != nil {
+			var params struct {
+				RequestID string `json:"requestId"`
+				LoaderID  string `json:"loaderId"`
+				Type      string `json:"type"`
+				Response  struct {
+					Status  int               `json:"status"`
+					Headers map[string]string `json:"headers"`
+				} `json:"response"`
+			}
+			json.Unmarshal(msg.Params, &params)
+
+			switch msg.Method {
+			case "Network.requestWillBeSent":
+				inflight[params.RequestID] = true
+				active = time.Now()
+			case "Network.loadingFinished", "Network.loadingFailed":
+				delete(inflight, params.RequestID)
+				active = time.Now()
+			case "Network.responseReceived":
+				if params.Type == "Document" && params.LoaderID == loaderID {
+					res.StatusCode = params.Response.Status
+					res.Header = make(http.Header)
+					for k, v := range params.Response.Headers {
+						// The headers of the same name are joined by new lines.
+						for _, value := range strings.Split(v, "\n") {
+							res.Header.Add(k, value)
+						}
+					}
+				}
+			case "Page.loadEventFired":
+				loaded = true
+				active = time.Now()
+			}
+		}
+
+		if selector != "" {
+			if time.Since(checked) < tick {
+				continue
+			}
+			checked = time.Now()
+			quoted, _ := json.Marshal(selector)
+			var found bool
+			if err := b.evaluate(ctx, session, "document.querySelector("+string(quoted)+") !== null", &found); err != nil {
+				return err
+			}
+			if found {
+				return nil
+			}
+		} else if loaded && len(inflight) == 0 && time.Since(active) >= idle {
+			return nil
+		}
+	}
+}
+
+// Capture a PNG of the whole page, beyond the viewport.
+func (b *chromeBrowser) screenshot(ctx context.Context, session string) ([]byte, error) {
+	var metrics struct {
+		ContentSize struct {
+			Width  float64 `json:"width"`
+			Height float64 `json:"height"`
+		} `json:"cssContentSize"`
+	}
+	if err := b.call(ctx, session, "Page.getLayoutMetrics", nil, &metrics); err != nil {
+		return nil, err
+	}
+	params := leiogo.Dict{"format": "png", "captureBeyondViewport": true}
+	if size := metrics.ContentSize; size.Width > 0 && size.Height > 0 {
+		params["clip"] = leiogo.Dict{"x": 0, "y": 0, "width": size.Width, "height": size.Height, "scale": 1}
+	}
+	var shot struct {
+		Data []byte `json:"data"`
+	}
+	if err := b.call(ctx, session, "Page.captureScreenshot", params, &shot); err != nil {
+		return nil, err
+	}
+	return shot.Data, nil
+}
+
+// Evaluate the expression in the tab, and decode its value into value, the promises are awaited.
+// The value is untouched if it's undefined.
+func (b *chromeBrowser) evaluate(ctx context.Context, session string, expression string, value interface{}) error {
+	var result struct {
+		Result struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"result"`
+		ExceptionDetails *struct {
+			Text string `json:"text"`
+		} `json:"exceptionDetails"`
+	}
+	params := leiogo.Dict{"expression": expression, "returnByValue": true, "awaitPromise": true}
+	if err := b.call(ctx, session, "Runtime.evaluate", params, &result); err != nil {
+		return err
+	}
+	if result.ExceptionDetails != nil {
+		return fmt.Errorf("Evaluate failed, %s", result.ExceptionDetails.Text)
+	}
+	if len(result.Result.Value) == 0 {
+		return nil
+	}
+	return json.Unmarshal(result.Result.Value, value)
+}
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// The traffic classes of the requests, a request is in the class of its 'class' meta,
+// or in ClassFile if it's a file download, otherwise in ClassDefault.
+const (
+	ClassDefault   = "default"
+	ClassDiscovery = "discovery"
+	ClassDetail    = "detail"
+	ClassFile      = "file"
+
+	// The virtual time of a dispatch, it's divisible by the weights up to 16, so their shares are exact.
+	classStride = 720720
+)
+
+// ClassScheduler shares the crawl among the traffic classes of the requests by their Weights,
+// so the file downloads and the discovery pages advance in proportion instead of one starving the other.
+// With the weights {"discovery": 1, "file": 3}, three files are dispatched for each discovery page
+// while both of them have requests waiting. The classes not in the Weights have the weight 1.
+//
+// Each class has its own queue created by New with its name, so the requests in a class
+// are still popped in the order of that scheduler. A class which has been empty doesn't save up
+// its share, it starts from the progress of the waiting classes when it has requests again.
+// The queues are only popped when they have requests, so they should be local ones, not shared
+// by several processes like the redis one. The requests lost by the queues, like the DiskSchedulers,
+// are reported to the function set by SetOnLost, see LossyScheduler.
+type ClassScheduler struct {
+	Weights map[string]int
+	New     func(class string) Scheduler
+
+	classes map[string]*schedulerClass
+	order   []string
+	count   int
+	closed  bool
+	onLost  func(n int)
+	mutex   sync.Mutex
+	cond    *sync.Cond
+}
+
+type schedulerClass struct {
+	queue Scheduler
+	// The virtual time of the class, it advances by classStride / weight for each dispatched request,
+	// and the waiting class with the smallest one is popped next.
+	pass int64
+}
+
+func NewClassScheduler(weights map[string]int, newQueue func(class string) Scheduler) *ClassScheduler {
+	s := &ClassScheduler{Weights: weights, New: newQueue, classes: make(map[string]*schedulerClass)}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// RequestClass returns the traffic class of the request.
+func RequestClass(req *leiogo.Request) string {
+	if class, ok := req.Meta["class"].(string); ok && class != "" {
+		return class
+	}
+	if typename, _ := req.Meta["__type__"].(string); typename == "file" {
+		return ClassFile
+	}
+	return ClassDefault
+}
+
+func (s *ClassScheduler) Push(req *leiogo.Request) {
+	name := RequestClass(req)
+
+	s.mutex.Lock()
+	class, ok := s.classes[name]
+	if !ok {
+		class = &schedulerClass{queue: s.New(name)}
+		if q, ok := class.queue.(LossyScheduler); ok {
+			q.SetOnLost(s.lost)
+		}
+		s.classes[name] = class
+		s.order = append(s.order, name)
+	}
+	if class.queue.Len() == 0 {
+		// Don't let an idle class catch up by the dispatches it has missed.
+		if pass, ok := s.minPass(); ok && pass > class.pass {
+			class.pass = pass
+		}
+	}
+	class.queue.Push(req)
+	s.count++
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
+
+// The smallest virtual time of the classes with requests waiting.
+func (s *ClassScheduler) minPass() (int64, bool) {
+	var min int64
+	found := false
+	for _, name := range s.order {
+		class := s.classes[name]
+		if class.queue.Len() != 0 && (!found || class.pass < min) {
+			min, found = class.pass, true
+		}
+	}
+	return min, found
+}
+
+func (s *ClassScheduler) Pop() (*leiogo.Request, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		for s.count == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.count == 0 {
+			return nil, false
+		}
+
+		var next *schedulerClass
+		var nextName string
+		for _, name := range s.order {
+			class := s.classes[name]
+			if class.queue.Len() != 0 && (next == nil || class.pass < next.pass) {
+				next, nextName = class, name
+			}
+		}
+		if next == nil {
+			// None of the queues has a request, the counted ones are lost without being reported.
+			s.lost(s.count)
+			continue
+		}
+		req, ok := tryPop(next.queue)
+		if !ok {
+			// The rest of the queue is lost, it has been reported by s.lost.
+			continue
+		}
+		weight := s.Weights[nextName]
+		if weight <= 0 {
+			weight = 1
+		}
+		next.pass += classStride / int64(weight)
+		s.count--
+		return req, true
+	}
+}
+
+// The queues are popped with the mutex held, so a queue which may lose its requests is popped without waiting,
+// otherwise it would wait for its lost requests forever.
+func tryPop(queue Scheduler) (*leiogo.Request, bool) {
+	if q, ok := queue.(interface {
+		TryPop() (*leiogo.Request, bool)
+	}); ok {
+		return q.TryPop()
+	}
+	return queue.Pop()
+}
+
+func (s *ClassScheduler) SetOnLost(onLost func(n int)) {
+	s.mutex.Lock()
+	s.onLost = onLost
+	s.mutex.Unlock()
+}
+
+// The requests lost by a queue, it's called by the queue while it's popped, with the mutex held.
+func (s *ClassScheduler) lost(n int) {
+	s.count -= n
+	if s.onLost != nil {
+		s.onLost(n)
+	}
+}
+
+func (s *ClassScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+func (s *ClassScheduler) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	for _, class := range s.classes {
+		class.queue.Close()
+	}
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// ComplianceMiddleware is a download middleware of the strict compliance profile, so a crawl can prove
+// it conforms to the policies of the sites and the organization:
+//
+//	robots.txt - the requests disallowed by the robots.txt of their hosts are dropped,
+//	             and the requests to a host are apart by its Crawl-delay at least, see DeferUntil
+//	identity   - the requests are sent with the UserAgent and the From header, the contact of the operator,
+//	             the 'useragent' in the meta and the User-Agent in the 'headers' are removed
+//
+// The robots.txt of a host is fetched by Client when the host is requested first. It allows everything
+// if it's not found, and disallows everything if it can't be fetched for the other reasons, like
+// the server errors. The stealth components are refused by the crawler, see StealthComponent.
+type ComplianceMiddleware struct {
+	BaseMiddleware
+
+	UserAgent string
+	From      string
+	Client    *http.Client
+
+	hosts map[string]*complianceHost
+	mutex sync.Mutex
+
+	Yielder
+}
+
+type complianceHost struct {
+	robots *RobotsTxt
+	once   sync.Once
+
+	// The time the next request to the host may be sent by the Crawl-delay.
+	next  time.Time
+	mutex sync.Mutex
+}
+
+// Take the slot of the host if it's free, the next slot is after the delay.
+func (h *complianceHost) take(delay time.Duration) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	now := time.Now()
+	if h.next.After(now) {
+		return false
+	}
+	h.next = now.Add(delay)
+	return true
+}
+
+func (m *ComplianceMiddleware) Open(spider *leiogo.Spider) error {
+	m.hosts = make(map[string]*complianceHost)
+	return nil
+}
+
+func (m *ComplianceMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	if _, ok := req.Meta["useragent"]; ok {
+		m.Logger.Debug(req.LogContext(spider), "Remove the user agent of %s", req.URL)
+		delete(req.Meta, "useragent")
+	}
+	headers := map[string]string{"From": m.From}
+	if old, ok := req.Meta["headers"].(map[string]string); ok {
+		for k, v := range old {
+			if http.CanonicalHeaderKey(k) != "User-Agent" {
+				headers[k] = v
+			}
+		}
+	}
+	req.Meta["headers"] = headers
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return &DropTaskError{Message: err.Error()}
+	}
+	host := m.host(u.Scheme+"://"+u.Host, spider)
+	if !host.robots.Allowed(req.URL) {
+		return &DropTaskError{Message: "Disallowed by robots.txt"}
+	}
+
+	// Another request may have taken the slot since the crawler checked it, then the request is put off again.
+	if delay := host.robots.CrawlDelay; delay > 0 && !host.take(delay) {
+		m.Logger.Debug(req.LogContext(spider), "Delay request %s for the crawl delay %s", req.URL, delay)
+		if err := m.NewRequest(req, nil, spider); err != nil {
+			m.Logger.Error(req.LogContext(spider), "Add new request error, %s", err.Error())
+		}
+		return &DropTaskError{Message: "Delayed by the crawl delay", Rescheduled: true}
+	}
+	return nil
+}
+
+// The requests to a host wait outside of the scheduler until the next slot of the host by its Crawl-delay,
+// without holding the tokens of the crawler, see Deferrer. The hosts whose robots.txt is not fetched yet
+// are not deferred.
+func (m *ComplianceMiddleware) DeferUntil(req *leiogo.Request, spider *leiogo.Spider) time.Time {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return time.Time{}
+	}
+	m.mutex.Lock()
+	host, ok := m.hosts[u.Scheme+"://"+u.Host]
+	m.mutex.Unlock()
+	if !ok {
+		return time.Time{}
+	}
+
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+	return host.next
+}
+
+// The host of the origin, its robots.txt is fetched by the first request to it,
+// and the other requests wait for it.
+func (m *ComplianceMiddleware) host(origin string, spider *leiogo.Spider) *complianceHost {
+	m.mutex.Lock()
+	host, ok := m.hosts[origin]
+	if !ok {
+		host = &complianceHost{}
+		m.hosts[origin] = host
+	}
+	m.mutex.Unlock()
+
+	host.once.Do(func() { host.robots = m.fetchRobots(origin, spider) })
+	return host
+}
+
+func (m *ComplianceMiddleware) fetchRobots(origin string, spider *leiogo.Spider) *RobotsTxt {
+	req, err := http.NewRequest("GET", origin+"/robots.txt", nil)
+	if err != nil {
+		return DisallowAllRobotsTxt
+	}
+	req.Header.Set("User-Agent", m.UserAgent)
+	req.Header.Set("From", m.From)
+
+	res, err := m.Client.Do(req)
+	if err != nil {
+		m.Logger.Error(spider.Name, "Fetch robots.txt of %s fail, disallow the host, %s", origin, err)
+		return DisallowAllRobotsTxt
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		// The robots.txt larger than 500 KiB is cut by RFC 9309.
+		body, err := ioutil.ReadAll(io.LimitReader(res.Body, 500<<10))
+		if err != nil {
+			m.Logger.Error(spider.Name, "Read robots.txt of %s fail, disallow the host, %s", origin, err)
+			return DisallowAllRobotsTxt
+		}
+		m.Logger.Info(spider.Name, "Follow robots.txt of %s", origin)
+		return ParseRobotsTxt(body, m.UserAgent)
+	case res.StatusCode >= 400 && res.StatusCode < 500:
+		m.Logger.Info(spider.Name, "No robots.txt of %s, status %d", origin, res.StatusCode)
+		return &RobotsTxt{}
+	default:
+		m.Logger.Error(spider.Name, "Fetch robots.txt of %s fail, disallow the host, status %d", origin, res.StatusCode)
+		return DisallowAllRobotsTxt
+	}
+}
@@ -0,0 +1,143 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+// CompositeWriter is a FileWriter made of a chain of writers, like a redis cache first and the file system
+// as the fallback, or the file system with an asynchronous backup to S3.
+// A file exists if any writer of the chain has it. A file is written to the Writers in order,
+// until one of them saves it, and then to all the Backups in background. Since the body can only be read once,
+// it's copied into a temporary file while the first writer reads it, see WriteFile.
+// CompositeWriter is also an OpenClose, the builder adds it when it's the DownloaderFileWriter,
+// so the crawler waits for the backups before closing.
+type CompositeWriter struct {
+	Base
+
+	Writers []FileWriter
+	Backups []FileWriter
+
+	spiderName string
+	backups    sync.WaitGroup
+}
+
+func NewCompositeWriter(writers ...FileWriter) *CompositeWriter {
+	return &CompositeWriter{
+		Base:    NewBasePipeline("CompositeWriter"),
+		Writers: writers,
+	}
+}
+
+func (w *CompositeWriter) Open(spider *leiogo.Spider) error {
+	w.spiderName = spider.Name
+	return w.Base.Open(spider)
+}
+
+// Wait for the running backups.
+func (w *CompositeWriter) Close(reason string, spider *leiogo.Spider) error {
+	w.backups.Wait()
+	return w.Base.Close(reason, spider)
+}
+
+func (w *CompositeWriter) NotExists(filepath string) bool {
+	for _, writer := range w.Writers {
+		if !writer.NotExists(filepath) {
+			return false
+		}
+	}
+	return true
+}
+
+func (w *CompositeWriter) WriteFile(req *leiogo.Request, res *http.Response) (info string, writerErr error) {
+	temp, err := ioutil.TempFile("", "leiogo-composite-")
+	if err != nil {
+		return "", &StorageError{Err: err}
+	}
+	saved := false
+	defer func() {
+		temp.Close()
+		if !saved {
+			os.Remove(temp.Name())
+		}
+	}()
+
+	var errs []string
+	for i, writer := range w.Writers {
+		if i == 0 {
+			// The first writer reads the body from the network, and it's copied into the temporary file by the way,
+			// then the rest the writer hasn't read, so the other writers and the backups read the whole file from it.
+			copied := *res
+			copied.Body = ioutil.NopCloser(io.TeeReader(res.Body, temp))
+			info, writerErr = writer.WriteFile(req, &copied)
+			size, err := io.Copy(temp, res.Body)
+			if err != nil {
+				return info, err
+			}
+			if size, err = temp.Seek(0, io.SeekCurrent); err != nil {
+				return info, &StorageError{Err: err}
+			}
+			if res.ContentLength >= 0 && size != res.ContentLength {
+				return info, fmt.Errorf("Content length doesn't match, need %d, get %d", res.ContentLength, size)
+			}
+		} else {
+			info, writerErr = writeFrom(writer, req, res, temp.Name())
+		}
+
+		// The writers drop the task when the file is saved.
+		if _, ok := writerErr.(*DropTaskError); ok || writerErr == nil {
+			saved = true
+			w.backup(req, res, temp.Name())
+			return info, writerErr
+		}
+		errs = append(errs, fmt.Sprintf("%T: %s", writer, writerErr.Error()))
+	}
+	return info, &StorageError{Err: fmt.Errorf("All writers failed, %s", strings.Join(errs, "; "))}
+}
+
+// Write the file to the backups in background, the errors are only logged.
+// The temporary file is removed after all the backups.
+func (w *CompositeWriter) backup(req *leiogo.Request, res *http.Response, filename string) {
+	var backups sync.WaitGroup
+	for _, writer := range w.Backups {
+		w.backups.Add(1)
+		backups.Add(1)
+		go func(writer FileWriter) {
+			defer w.backups.Done()
+			defer backups.Done()
+			info, err := writeFrom(writer, req, res, filename)
+			if _, ok := err.(*DropTaskError); !ok && err != nil {
+				w.Logger.Error(log.Traced(w.spiderName, req.TraceID()), "Backup %s with %T failed, %s", req.URL, writer, err.Error())
+			} else if info != "" {
+				w.Logger.Debug(log.Traced(w.spiderName, req.TraceID()), "Backup, %s", info)
+			}
+		}(writer)
+	}
+	w.backups.Add(1)
+	go func() {
+		defer w.backups.Done()
+		backups.Wait()
+		os.Remove(filename)
+	}()
+}
+
+// Write the file with the writer, the body of the response is read from the file.
+func writeFrom(writer FileWriter, req *leiogo.Request, res *http.Response, filename string) (string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return "", &StorageError{Err: err}
+	}
+	defer file.Close()
+
+	copied := *res
+	copied.Body = file
+	return writer.WriteFile(req, &copied)
+}
@@ -0,0 +1,185 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// CookieJar is a cookie jar which remembers the cookies set to it, so it can be exported to the disk
+// and imported by the next run. The standard cookiejar can't list its cookies.
+// The cookies are remembered with their absolute expiry times, so an imported cookie expires when it would
+// have without the restart, and the expired and the removed cookies are forgotten.
+type CookieJar struct {
+	jar     *cookiejar.Jar
+	cookies map[string]*savedCookie
+	mutex   sync.Mutex
+}
+
+// A cookie and the url it's set by, which decides its domain and path when it's imported.
+type savedCookie struct {
+	URL    string
+	Cookie *http.Cookie
+}
+
+// The copy of the cookie with its Max-Age turned into the Expires, so it expires at the same time after it's saved.
+func absoluteCookie(c *http.Cookie, now time.Time) *http.Cookie {
+	copied := *c
+	if c.MaxAge > 0 {
+		copied.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		copied.MaxAge = 0
+	}
+	return &copied
+}
+
+// Whether the cookie has expired, or it's removed by a negative Max-Age.
+func cookieExpired(c *http.Cookie, now time.Time) bool {
+	return c.MaxAge < 0 || (!c.Expires.IsZero() && !c.Expires.After(now))
+}
+
+func NewCookieJar() *CookieJar {
+	jar, _ := cookiejar.New(nil)
+	return &CookieJar{jar: jar, cookies: make(map[string]*savedCookie)}
+}
+
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+
+	now := time.Now()
+	j.mutex.Lock()
+	for _, c := range cookies {
+		// The same cookie of a site replaces the previous one, and an expired one removes it, like in the jar.
+		key := u.Host + "|" + c.Domain + "|" + c.Path + "|" + c.Name
+		if cookieExpired(c, now) {
+			delete(j.cookies, key)
+		} else {
+			j.cookies[key] = &savedCookie{URL: u.String(), Cookie: absoluteCookie(c, now)}
+		}
+	}
+	j.mutex.Unlock()
+}
+
+// Export saves the cookies to the file, the session cookies are included, and the expired ones are pruned.
+// Only the owner may read the file, since the cookies may log in as the user.
+func (j *CookieJar) Export(filename string) error {
+	now := time.Now()
+	j.mutex.Lock()
+	cookies := make([]*savedCookie, 0, len(j.cookies))
+	for key, c := range j.cookies {
+		if cookieExpired(c.Cookie, now) {
+			delete(j.cookies, key)
+			continue
+		}
+		cookies = append(cookies, c)
+	}
+	j.mutex.Unlock()
+	return util.SaveGobPerm(filename, cookies, 0600)
+}
+
+// Import sets the cookies exported to the file, it's not an error if the file doesn't exist.
+// The cookies keep the expiry times they were exported with, the expired ones are skipped.
+func (j *CookieJar) Import(filename string) error {
+	var cookies []*savedCookie
+	if err := util.LoadGob(filename, &cookies); err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, c := range cookies {
+		// The files of the older versions may have the relative Max-Age, which can't be trusted any more.
+		if c.Cookie.MaxAge > 0 || cookieExpired(c.Cookie, now) {
+			continue
+		}
+		if u, err := url.Parse(c.URL); err == nil {
+			j.SetCookies(u, []*http.Cookie{c.Cookie})
+		}
+	}
+	return nil
+}
+
+// CookiesMiddleware manages the cookie jar shared by the downloader.
+// The Seeds are set to the jar when the spider opens, by the urls of the sites, like the cookies copied from a browser.
+// A request can carry its own cookies with 'cookies' = map[string]string in its meta, they are merged into the jar.
+// With 'dontmergecookies' = true, the request is sent with only its own cookies, and the cookies
+// of its response are not stored, see DefaultDownloader.
+// The jar is exported to the File when the spider closes, and imported when it opens,
+// it's also saved to the job directory if the crawler has one.
+type CookiesMiddleware struct {
+	BaseMiddleware
+
+	Jar   *CookieJar
+	Seeds map[string][]*http.Cookie
+	File  string
+}
+
+func (m *CookiesMiddleware) Open(spider *leiogo.Spider) error {
+	if m.File != "" {
+		if err := m.Jar.Import(m.File); err != nil {
+			m.Logger.Error(spider.Name, "Import cookies from %s failed, %s", m.File, err.Error())
+		}
+	}
+	m.seed()
+	return m.BaseMiddleware.Open(spider)
+}
+
+func (m *CookiesMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	if m.File != "" {
+		if err := m.Jar.Export(m.File); err != nil {
+			m.Logger.Error(spider.Name, "Export cookies to %s failed, %s", m.File, err.Error())
+		}
+	}
+	return m.BaseMiddleware.Close(reason, spider)
+}
+
+// The seeds always override the imported cookies, since they are the configuration of this run.
+func (m *CookiesMiddleware) seed() {
+	for raw, cookies := range m.Seeds {
+		if u, err := url.Parse(raw); err == nil {
+			m.Jar.SetCookies(u, cookies)
+		}
+	}
+}
+
+func (m *CookiesMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	if dont, ok := req.Meta["dontmergecookies"].(bool); ok && dont {
+		return nil
+	}
+	if cookies, ok := req.Meta["cookies"].(map[string]string); ok && len(cookies) != 0 {
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return err
+		}
+		m.Jar.SetCookies(u, MetaCookies(cookies))
+	}
+	return nil
+}
+
+func (m *CookiesMiddleware) SaveState(dir string) error {
+	return m.Jar.Export(path.Join(dir, "cookies.gob"))
+}
+
+func (m *CookiesMiddleware) LoadState(dir string) error {
+	if err := m.Jar.Import(path.Join(dir, "cookies.gob")); err != nil {
+		return err
+	}
+	m.seed()
+	return nil
+}
+
+// MetaCookies turns the 'cookies' in the meta into the cookies.
+func MetaCookies(cookies map[string]string) []*http.Cookie {
+	cs := make([]*http.Cookie, 0, len(cookies))
+	for name, value := range cookies {
+		cs = append(cs, &http.Cookie{Name: name, Value: value})
+	}
+	return cs
+}
@@ -0,0 +1,105 @@
+package middleware
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/transform"
+)
+
+// The encodings we accept, the downloader decompresses the body by itself,
+// since Go's transport only handles gzip, and only when we don't set Accept-Encoding.
+const acceptEncoding = "gzip, deflate, br"
+
+// decodedBody reads the decoded body, and closes the original one.
+type decodedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// Decompress the body by its Content-Encoding, the unknown encodings are left as they are.
+func decompress(res *http.Response) (io.ReadCloser, error) {
+	var r io.Reader
+	var err error
+
+	switch strings.ToLower(strings.TrimSpace(res.Header.Get("Content-Encoding"))) {
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(res.Body)
+	case "deflate":
+		r, err = inflate(res.Body)
+	case "br":
+		r = brotli.NewReader(res.Body)
+	default:
+		return res.Body, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return &decodedBody{Reader: r, Closer: res.Body}, nil
+}
+
+// The deflate of HTTP is the zlib format, but some servers send the raw deflate data without the zlib header,
+// so the header is checked first, see RFC 1950.
+func inflate(body io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(body)
+	header, _ := br.Peek(2)
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+// Only the text pages are decoded, the other types, like images, are binary.
+// A body without a Content-Type is unknown, so it's left as it is.
+func isText(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "html") || strings.Contains(contentType, "xml")
+}
+
+// The charsets declared in the first 1024 bytes, by the meta tags of the HTML,
+// or by the XML declaration, like the feeds and the sitemaps.
+var (
+	metaCharsetRe = regexp.MustCompile(`(?i)<meta[^>]+charset\s*=\s*["']?\s*([-\w.:]+)`)
+	xmlCharsetRe  = regexp.MustCompile(`(?i)^\s*<\?xml[^>]*encoding\s*=\s*["']([-\w.:]+)["']`)
+)
+
+func declaredCharset(peek []byte) string {
+	for _, re := range []*regexp.Regexp{xmlCharsetRe, metaCharsetRe} {
+		if m := re.FindSubmatch(peek); m != nil {
+			return string(m[1])
+		}
+	}
+	return ""
+}
+
+// Decode the text body to UTF-8. The body is transcoded only if its charset is declared, by the Content-Type,
+// the BOM, or the meta tags or the XML declaration in the first 1024 bytes. Otherwise it's passed through
+// as UTF-8, since guessing from the first 1024 bytes garbles the UTF-8 pages whose text isn't ASCII after them.
+// It returns the name of the encoding.
+func decodeCharset(body io.ReadCloser, contentType string) (io.ReadCloser, string) {
+	br := bufio.NewReaderSize(body, 1024)
+	peek, _ := br.Peek(1024)
+
+	enc, name, certain := charset.DetermineEncoding(peek, contentType)
+	if !certain {
+		enc, name = nil, "utf-8"
+		if declared := declaredCharset(peek); declared != "" {
+			if e, n := charset.Lookup(declared); e != nil {
+				enc, name = e, n
+			}
+		}
+	}
+	if enc == nil || name == "utf-8" {
+		return &decodedBody{Reader: br, Closer: body}, "utf-8"
+	}
+	return &decodedBody{Reader: transform.NewReader(br, enc.NewDecoder()), Closer: body}, name
+}
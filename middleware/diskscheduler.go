@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// DiskScheduler spills the queue to the segment files in Dir, so the number of the waiting requests
+// is bounded by the disk instead of the memory, for the crawls discovering millions of links.
+// Like the PriorityScheduler, the requests with higher Priority are popped first, and the requests
+// with the same priority are popped in the order they were pushed, unless IgnorePriority, then all
+// of them are popped in FIFO order.
+//
+// Each priority keeps at most SegmentSize requests in the memory at both ends of its queue, the ones
+// in between are written to the segment files, SegmentSize requests in each. The requests are encoded
+// with encoding/gob, so the Callback is lost when a request goes to the disk, and it falls back to ParserName.
+// The stale segments of a previous process are removed when the scheduler is created.
+//
+// The scheduler never crashes the crawler on the disk errors: a tail which can't be written stays in the memory,
+// and the requests of a segment which can't be read are lost, both are logged, and the lost requests
+// are reported, see LossyScheduler. A SegmentSize less than 1 means DefaultSegmentSize.
+type DiskScheduler struct {
+	Logger log.Logger
+
+	Dir            string
+	SegmentSize    int
+	IgnorePriority bool
+
+	queues     map[int]*diskQueue
+	priorities []int
+	count      int
+	segments   int
+	closed     bool
+	onLost     func(n int)
+	mutex      sync.Mutex
+	cond       *sync.Cond
+}
+
+// diskQueue is the FIFO queue of a priority, the requests are popped from head, pushed to tail,
+// and the full tails are written to the segments in between.
+type diskQueue struct {
+	head     []*leiogo.Request
+	segments []diskSegment
+	tail     []*leiogo.Request
+}
+
+type diskSegment struct {
+	name  string
+	count int
+}
+
+const DefaultSegmentSize = 1000
+
+// NewDiskScheduler creates the Dir, and removes the stale segments in it.
+func NewDiskScheduler(dir string, segmentSize int) (*DiskScheduler, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	stale, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	for _, name := range stale {
+		os.Remove(name)
+	}
+
+	s := &DiskScheduler{Logger: log.New("DiskScheduler"), Dir: dir, SegmentSize: segmentSize, queues: make(map[int]*diskQueue)}
+	s.cond = sync.NewCond(&s.mutex)
+	return s, nil
+}
+
+func (s *DiskScheduler) SetOnLost(onLost func(n int)) {
+	s.mutex.Lock()
+	s.onLost = onLost
+	s.mutex.Unlock()
+}
+
+func (s *DiskScheduler) Push(req *leiogo.Request) {
+	priority := req.Priority
+	if s.IgnorePriority {
+		priority = 0
+	}
+
+	s.mutex.Lock()
+	q, ok := s.queues[priority]
+	if !ok {
+		q = &diskQueue{}
+		s.queues[priority] = q
+		s.priorities = append(s.priorities, priority)
+		sort.Sort(sort.Reverse(sort.IntSlice(s.priorities)))
+	}
+	q.tail = append(q.tail, req)
+	// A tail failed to be written is tried again when it grows by another segment.
+	if size := s.segmentSize(); len(q.tail)%size == 0 {
+		s.spill(priority, q)
+	}
+	s.count++
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
+
+// Write the tail to a new segment, or move it to the head if there's nothing in between.
+func (s *DiskScheduler) spill(priority int, q *diskQueue) {
+	if len(q.head) == 0 && len(q.segments) == 0 {
+		q.head, q.tail = q.tail, nil
+		return
+	}
+	s.segments++
+	name := filepath.Join(s.Dir, fmt.Sprintf("%d-%08d.seg", priority, s.segments))
+	if err := util.SaveGob(name, q.tail); err != nil {
+		s.Logger.Error("scheduler", "Write segment %s failed, keep %d requests in memory, %s", name, len(q.tail), err)
+		return
+	}
+	q.segments = append(q.segments, diskSegment{name: name, count: len(q.tail)})
+	q.tail = nil
+}
+
+func (s *DiskScheduler) segmentSize() int {
+	if s.SegmentSize < 1 {
+		return DefaultSegmentSize
+	}
+	return s.SegmentSize
+}
+
+func (s *DiskScheduler) Pop() (*leiogo.Request, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for {
+		for s.count == 0 && !s.closed {
+			s.cond.Wait()
+		}
+		if s.count == 0 {
+			return nil, false
+		}
+		if req := s.next(); req != nil {
+			return req, true
+		}
+		// The rest of the requests were in the lost segments, which are not counted any more.
+	}
+}
+
+// TryPop pops a request without waiting, it returns false if there's none, including when the rest
+// of the requests are lost, so the schedulers wrapping it never wait for the lost ones, see ClassScheduler.
+func (s *DiskScheduler) TryPop() (*leiogo.Request, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	req := s.next()
+	return req, req != nil
+}
+
+func (s *DiskScheduler) next() *leiogo.Request {
+	for _, priority := range s.priorities {
+		if req := s.pop(s.queues[priority]); req != nil {
+			s.count--
+			return req
+		}
+	}
+	return nil
+}
+
+func (s *DiskScheduler) pop(q *diskQueue) *leiogo.Request {
+	for len(q.head) == 0 && len(q.segments) != 0 {
+		seg := q.segments[0]
+		q.segments = q.segments[1:]
+		var reqs []*leiogo.Request
+		if err := util.LoadGob(seg.name, &reqs); err != nil {
+			s.Logger.Error("scheduler", "Read segment %s failed, %d requests are lost, %s", seg.name, seg.count, err)
+			s.lost(seg.count)
+			continue
+		} else if reqs == nil {
+			s.Logger.Error("scheduler", "Segment %s is missing, %d requests are lost", seg.name, seg.count)
+			s.lost(seg.count)
+			continue
+		}
+		os.Remove(seg.name)
+		q.head = reqs
+	}
+	if len(q.head) == 0 {
+		q.head, q.tail = q.tail, nil
+	}
+	if len(q.head) == 0 {
+		return nil
+	}
+	req := q.head[0]
+	q.head[0] = nil
+	q.head = q.head[1:]
+	return req
+}
+
+func (s *DiskScheduler) lost(n int) {
+	s.count -= n
+	if s.onLost != nil {
+		s.onLost(n)
+	}
+}
+
+func (s *DiskScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.count
+}
+
+func (s *DiskScheduler) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
@@ -1,8 +1,14 @@
 package middleware
 
 import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net"
@@ -11,14 +17,20 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/util"
 )
 
+// The downloaders should stop when the ctx is done, which happens when the request times out,
+// or the crawler is cancelled. See Crawler.Cancel and the 'timeout' in the meta of the request.
 type Downloader interface {
-	Download(req *leiogo.Request, spider *leiogo.Spider) (leioRes *leiogo.Response)
+	Download(ctx context.Context, req *leiogo.Request, spider *leiogo.Spider) (leioRes *leiogo.Response)
 }
 
 type ClientConfig interface {
@@ -35,18 +47,146 @@ type FileWriter interface {
 	WriteFile(req *leiogo.Request, res *http.Response) (info string, writerErr error)
 }
 
-type FSWriter struct{}
+// StorageError is returned by the FileWriters when the file is downloaded, but can't be saved,
+// like a full disk or a broken connection to redis. They are counted apart from the download errors.
+type StorageError struct {
+	Err error
+}
+
+func (err *StorageError) Error() string {
+	return "Storage error, " + err.Err.Error()
+}
+
+// RangeWriter is a FileWriter which keeps the partial files of the failed downloads, so the downloader
+// asks for the rest of a partial file with a Range request, and the writer appends the 206 response to it.
+// A ManifestWriter never resumes the files, since the checksum needs the whole file.
+type RangeWriter interface {
+	FileWriter
+
+	// The size of the partial file of the request, and the ETag or the Last-Modified of the response
+	// it's from, which is sent in the If-Range, so a changed file is downloaded again from the start.
+	// The files without a validator can't be resumed, their size is 0.
+	Partial(req *leiogo.Request) (size int64, validator string)
+
+	// Remove the partial file, so the file is downloaded again from the start.
+	DiscardPartial(req *leiogo.Request)
+}
+
+// FSWriter saves the files to the file system at the '__filepath__' in the meta of the requests.
+// With Resume, a file is written to filepath.part until it completes, and the part is kept when
+// the download fails, so the retry resumes it, see RangeWriter.
+type FSWriter struct {
+	Resume bool
+}
 
 func (f *FSWriter) NotExists(filepath string) bool {
 	info, err := os.Stat(filepath)
 	return os.IsNotExist(err) || info.Size() < 512
 }
 
+// The validator of the partial file is saved beside it.
+func partPaths(req *leiogo.Request) (part string, validator string) {
+	part = req.Meta["__filepath__"].(string) + ".part"
+	return part, part + ".validator"
+}
+
+func (f *FSWriter) Partial(req *leiogo.Request) (int64, string) {
+	if !f.Resume {
+		return 0, ""
+	}
+	part, validatorPath := partPaths(req)
+	validator, err := ioutil.ReadFile(validatorPath)
+	if err != nil || len(validator) == 0 {
+		return 0, ""
+	}
+	info, err := os.Stat(part)
+	if err != nil {
+		return 0, ""
+	}
+	return info.Size(), string(validator)
+}
+
+func (f *FSWriter) DiscardPartial(req *leiogo.Request) {
+	part, validatorPath := partPaths(req)
+	os.Remove(part)
+	os.Remove(validatorPath)
+}
+
+// The strong ETag of the response, or its Last-Modified, the weak ETags can't be used in the If-Range.
+func rangeValidator(res *http.Response) string {
+	if etag := res.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return res.Header.Get("Last-Modified")
+}
+
+func storageFile(file *os.File, err error) (*os.File, error) {
+	if err != nil {
+		return nil, &StorageError{Err: err}
+	}
+	return file, nil
+}
+
+// The file the response is written to, before it's completed.
+func (f *FSWriter) writing(req *leiogo.Request) string {
+	if f.Resume {
+		part, _ := partPaths(req)
+		return part
+	}
+	return req.Meta["__filepath__"].(string)
+}
+
+// Open the file to write the response to, a 206 response is appended to the partial file
+// if it starts at the end of the partial file, and is from the same version of the file.
+// The SHA-256 of the file is computed while it's written, so it starts with the partial file.
+func (f *FSWriter) open(req *leiogo.Request, res *http.Response) (*os.File, hash.Hash, error) {
+	h := sha256.New()
+	if !f.Resume {
+		file, err := storageFile(os.Create(f.writing(req)))
+		return file, h, err
+	}
+
+	part, validatorPath := partPaths(req)
+	if res.StatusCode != http.StatusPartialContent {
+		f.DiscardPartial(req)
+		if err := ioutil.WriteFile(validatorPath, []byte(rangeValidator(res)), 0644); err != nil {
+			return nil, nil, &StorageError{Err: err}
+		}
+		file, err := storageFile(os.Create(part))
+		return file, h, err
+	}
+
+	size, validator := f.Partial(req)
+	var start int64 = -1
+	fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-", &start)
+	if start != size {
+		f.DiscardPartial(req)
+		return nil, nil, fmt.Errorf("Content range %s doesn't match the partial file of %d bytes", res.Header.Get("Content-Range"), size)
+	}
+	if etag := res.Header.Get("ETag"); strings.HasPrefix(validator, `"`) && etag != "" && etag != validator {
+		f.DiscardPartial(req)
+		return nil, nil, fmt.Errorf("ETag %s doesn't match the partial file, %s", etag, validator)
+	}
+
+	file, err := storageFile(os.OpenFile(part, os.O_RDWR|os.O_APPEND, 0644))
+	if err == nil {
+		if _, err = io.Copy(h, io.NewSectionReader(file, 0, size)); err != nil {
+			file.Close()
+			return nil, nil, &StorageError{Err: err}
+		}
+	}
+	return file, h, err
+}
+
+// WriteFile writes the file, and the SHA-256 and the size of the saved file are added to the meta
+// as '__sha256__' and '__size__'. If the request has the expected 'sha256' in its meta,
+// the file is removed when the checksum doesn't match. With '__contentname__' in the meta,
+// the file is named by its SHA-256 in the directory of the filepath, and '__filepath__' is changed to it.
 func (f *FSWriter) WriteFile(req *leiogo.Request, res *http.Response) (info string, writerErr error) {
 	// Create a file from its filepath. We've already verified the request to be a file request
 	// with type = file and filepath = 'path' in its meta
 	filepath := req.Meta["__filepath__"].(string)
-	if file, err := os.Create(filepath); err != nil {
+	if file, h, err := f.open(req, res); err != nil {
 		writerErr = err
 	} else {
 		// Create a counter to calculate the read content length.
@@ -63,9 +203,10 @@ func (f *FSWriter) WriteFile(req *leiogo.Request, res *http.Response) (info stri
 			// return a EOF error. So it's possible that the n > 0 and an EOF error.
 			if n > 0 {
 				if _, err := file.Write(buf[:n]); err != nil {
-					writerErr = err
+					writerErr = &StorageError{Err: err}
 					break
 				}
+				h.Write(buf[:n])
 				readLength += int64(n)
 			}
 
@@ -83,17 +224,72 @@ func (f *FSWriter) WriteFile(req *leiogo.Request, res *http.Response) (info stri
 		}
 		file.Close()
 
-		if readLength == res.ContentLength {
-			info = fmt.Sprintf("Saved %s to %s", req.URL, filepath)
-		} else {
+		sum := hex.EncodeToString(h.Sum(nil))
+		expected, _ := req.Meta["sha256"].(string)
+
+		if _, ok := writerErr.(*StorageError); ok {
+			f.remove(req)
+		} else if _, ok := writerErr.(*DropTaskError); !ok {
+			// The connection is broken, the partial file is kept to be resumed.
+			if !f.Resume {
+				os.Remove(filepath)
+			}
+		} else if readLength != res.ContentLength {
 			writerErr = errors.New(fmt.Sprintf("Content length doesn't match, need %d, get %d", res.ContentLength, readLength))
 			// Remove the imcompleted file
-			os.Remove(filepath)
+			f.remove(req)
+		} else if expected != "" && !strings.EqualFold(expected, sum) {
+			writerErr = fmt.Errorf("Checksum doesn't match, need %s, get %s", expected, sum)
+			f.remove(req)
+		} else if err := f.complete(req, sum); err != nil {
+			writerErr = &StorageError{Err: err}
+		} else if res.StatusCode == http.StatusPartialContent {
+			info = fmt.Sprintf("Saved %s to %s, resumed at %s", req.URL, req.Meta["__filepath__"], res.Header.Get("Content-Range"))
+		} else {
+			info = fmt.Sprintf("Saved %s to %s", req.URL, req.Meta["__filepath__"])
 		}
 	}
 	return
 }
 
+func (f *FSWriter) remove(req *leiogo.Request) {
+	if f.Resume {
+		f.DiscardPartial(req)
+	} else {
+		os.Remove(req.Meta["__filepath__"].(string))
+	}
+}
+
+// Move the completed file to the filepath, or to the name of its content. A file of the same content
+// is only saved once.
+func (f *FSWriter) complete(req *leiogo.Request, sum string) error {
+	if f.Resume {
+		_, validatorPath := partPaths(req)
+		os.Remove(validatorPath)
+	}
+
+	src, dst := f.writing(req), req.Meta["__filepath__"].(string)
+	content, _ := req.Meta["__contentname__"].(bool)
+	if content {
+		dst = path.Join(path.Dir(dst), sum+path.Ext(dst))
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	req.Meta["__sha256__"] = sum
+	req.Meta["__size__"] = info.Size()
+	req.Meta["__filepath__"] = dst
+
+	if src == dst {
+		return nil
+	} else if _, err := os.Stat(dst); err == nil && content {
+		return os.Remove(src)
+	}
+	return os.Rename(src, dst)
+}
+
 // Downloader is where the requests truly be processed. It will execute the requests and produce
 // the corresponding response.
 type DefaultDownloader struct {
@@ -113,60 +309,295 @@ type DefaultDownloader struct {
 	// the Client's Transport typically has internal state (cached TCP connections),
 	// so Clients should be reused instead of created as needed.
 	// Clients are safe for concurrent use by multiple goroutines.
-	client *http.Client
+	// The client is created by the first download, the mutex guards the creation.
+	client      *http.Client
+	clientMutex sync.Mutex
 
 	// See the definition of FileWriter interface.
 	FileWriter
+
+	// The hosts may override the UserAgent, and enable phantomjs with the "Render" setting.
+	// See HostSettings.
+	HostSettings HostSettings
+
+	// The max redirects to follow for a request, see redirectPolicy.
+	MaxRedirects int
+
+	// The downloader stops reading a page larger than MaxResponseSize bytes, and drops the task.
+	// 0 means no limitation. The files are not limited, since they are written to the FileWriter.
+	MaxResponseSize int64
+
+	// If the FileWriter fails to save a file, the downloader retries the write for WriteRetries times,
+	// and then writes it with the FallbackWriter if it's not nil, instead of downloading the file again.
+	// To retry the writes, the file is downloaded into a temporary file first, see retryWrite.
+	WriteRetries   int
+	FallbackWriter FileWriter
+
+	// The files waiting for their writes to be retried, by the fingerprints of the requests.
+	downloaded      map[string]*downloadedFile
+	downloadedMutex sync.Mutex
+
+	// If WARC is not nil, the http exchanges are recorded by it, see WARCWriter.
+	WARC *WARCWriter
+
+	// If Phantom is not nil, the pages are rendered by its workers, instead of a new phantomjs for every page.
+	Phantom *PhantomPool
+
+	// If Tenants is not nil, the bytes read from the network are counted into the usages of the tenants of the spiders,
+	// as they are read, so the streams and the files are counted too. A rendered page counts its body.
+	// See TenantQuotaMiddleware.
+	Tenants *Tenants
+}
+
+// The error of a response which is larger than the MaxResponseSize.
+func tooLargeError(size int64) error {
+	return &DropTaskError{Message: fmt.Sprintf("Response is larger than the max size %d bytes", size)}
 }
 
-func (d *DefaultDownloader) Download(req *leiogo.Request, spider *leiogo.Spider) (leioRes *leiogo.Response) {
+// countedBody counts the bytes read from it into the usage of the tenant.
+type countedBody struct {
+	io.ReadCloser
+	tenants *Tenants
+	tenant  string
+}
+
+func (b *countedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.tenants.AddBytes(b.tenant, int64(n))
+	}
+	return n, err
+}
+
+// limitedBody returns an error instead of EOF after reading more than max bytes.
+type limitedBody struct {
+	io.ReadCloser
+	max  int64
+	read int64
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.read += int64(n); b.read > b.max {
+		return n, tooLargeError(b.max)
+	}
+	return n, err
+}
+
+func (d *DefaultDownloader) Download(ctx context.Context, req *leiogo.Request, spider *leiogo.Spider) (leioRes *leiogo.Response) {
 	leioRes = leiogo.NewResponse(req)
 
 	if retry, ok := req.Meta["retry"].(int); ok {
-		d.Logger.Info(spider.Name, "Retrying %s for %d times", req.URL, retry)
+		d.Logger.Info(req.LogContext(spider), "Retrying %s for %d times", req.URL, retry)
 	} else {
-		d.Logger.Info(spider.Name, "Requesting %s", req.URL)
+		d.Logger.Info(req.LogContext(spider), "Requesting %s", req.URL)
 	}
 
-	if enable, ok := req.Meta["phantomjs"]; ok && enable.(bool) {
-		d.phantomjs(req, leioRes, spider)
+	start := time.Now()
+	defer func() { leioRes.Latency = time.Since(start) }()
+
+	if enable, ok := req.Meta["phantomjs"]; (ok && enable.(bool)) || (!ok && d.HostSettings.Bool(req.URL, "Render", false)) {
+		d.phantomjs(ctx, req, leioRes, spider)
+		if d.Tenants != nil && spider.Tenant != "" {
+			d.Tenants.AddBytes(spider.Tenant, int64(len(leioRes.Body)))
+		}
 	} else if typename, ok := req.Meta["__type__"].(string); ok && typename == "file" {
-		d.fileDownload(req, leioRes, spider)
+		d.fileDownload(ctx, req, leioRes, spider)
 	} else {
-		d.httpDownload(req, leioRes, spider)
+		d.httpDownload(ctx, req, leioRes, spider)
 	}
 
 	return
 }
 
-func (d *DefaultDownloader) getResponse(req *leiogo.Request) (*http.Response, error) {
+// The redirect policy of a request, it's passed to checkRedirect with the context of the http request,
+// since the client is shared by all the requests.
+type redirectPolicy struct {
+	follow bool
+	max    int
+	chain  []leiogo.Redirect
+}
+
+type redirectPolicyKey struct{}
+
+// By default, the redirects are followed up to MaxRedirects times. A request can forbid the redirects
+// with 'dontredirect' = true in its meta, then the redirect response itself is returned,
+// or change the limitation with 'maxredirects' = n.
+func (d *DefaultDownloader) redirectPolicy(req *leiogo.Request) *redirectPolicy {
+	policy := &redirectPolicy{follow: true, max: d.MaxRedirects}
+	if dont, ok := req.Meta["dontredirect"].(bool); ok && dont {
+		policy.follow = false
+	}
+	if max, ok := req.Meta["maxredirects"].(int); ok {
+		policy.max = max
+	}
+	return policy
+}
+
+// Stop at the forbidden redirects, the loops, or too many redirects, and record the hops which are followed,
+// so the last one is where the response came from.
+func checkRedirect(req *http.Request, via []*http.Request) error {
+	policy, ok := req.Context().Value(redirectPolicyKey{}).(*redirectPolicy)
+	if !ok {
+		return nil
+	}
+
+	if !policy.follow {
+		return http.ErrUseLastResponse
+	}
+	for _, prev := range via {
+		if prev.URL.String() == req.URL.String() {
+			return fmt.Errorf("Redirect loop at %s", req.URL)
+		}
+	}
+	if len(via) > policy.max {
+		return fmt.Errorf("Stopped after %d redirects", policy.max)
+	}
+
+	policy.chain = append(policy.chain, leiogo.Redirect{
+		URL:        via[len(via)-1].URL.String(),
+		StatusCode: req.Response.StatusCode,
+		Location:   req.URL.String(),
+	})
+	return nil
+}
+
+// Create the client by the first download, the concurrent downloads wait for it.
+func (d *DefaultDownloader) httpClient() (*http.Client, error) {
+	d.clientMutex.Lock()
+	defer d.clientMutex.Unlock()
 	if d.client == nil {
-		var err error
-		d.client, err = d.ConfigClient()
+		client, err := d.ConfigClient()
 		if err != nil {
 			return nil, err
 		}
+		client.CheckRedirect = checkRedirect
+		if d.WARC != nil {
+			client.Transport = d.WARC.Transport(client.Transport)
+		}
+		d.client = client
+	}
+	return d.client, nil
+}
+
+// The header is added to the request, like the Range of a resumed file.
+// The body of the response is counted into the usage of the tenant of the spider, see Tenants.
+func (d *DefaultDownloader) getResponse(ctx context.Context, req *leiogo.Request, leioRes *leiogo.Response, header http.Header, spider *leiogo.Spider) (res *http.Response, err error) {
+	client, err := d.httpClient()
+	if err != nil {
+		return nil, err
 	}
 
-	if getReq, err := http.NewRequest("GET", req.URL, nil); err != nil {
+	policy := d.redirectPolicy(req)
+	defer func() { leioRes.Redirects = policy.chain }()
+	defer func() {
+		if err == nil && d.Tenants != nil && spider.Tenant != "" {
+			res.Body = &countedBody{ReadCloser: res.Body, tenants: d.Tenants, tenant: spider.Tenant}
+		}
+	}()
+
+	ctx = context.WithValue(ctx, redirectPolicyKey{}, policy)
+	if proxy, ok := req.Meta["proxy"].(string); ok && proxy != "" {
+		ctx = context.WithValue(ctx, proxyKey{}, proxy)
+	}
+	// A request may be sent with another method by 'method' in its meta, like HEAD to check a link.
+	method := "GET"
+	if m, ok := req.Meta["method"].(string); ok && m != "" {
+		method = m
+	}
+	if getReq, err := http.NewRequestWithContext(ctx, method, req.URL, nil); err != nil {
 		return nil, err
 	} else {
-		if d.UserAgent != "" {
-			getReq.Header.Set("User-Agent", d.UserAgent)
+		for k := range header {
+			getReq.Header.Set(k, header.Get(k))
+		}
+
+		// The 'useragent' in the meta overrides the user agents of the settings.
+		ua, ok := req.Meta["useragent"].(string)
+		if !ok {
+			ua = d.HostSettings.String(req.URL, "UserAgent", d.UserAgent)
+		}
+		if ua != "" {
+			getReq.Header.Set("User-Agent", ua)
+		}
+		// The files are saved as they are, so we only ask the pages to be compressed.
+		if typename, ok := req.Meta["__type__"].(string); !ok || typename != "file" {
+			getReq.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+
+		// The extra headers of the request, like the validators of a cached response.
+		if headers, ok := req.Meta["headers"].(map[string]string); ok {
+			for k, v := range headers {
+				getReq.Header.Set(k, v)
+			}
+		}
+
+		// The request with 'dontmergecookies' is sent without the jar, only with the cookies in its meta.
+		// Otherwise the cookies in the meta have been merged into the jar by the CookiesMiddleware.
+		if dont, ok := req.Meta["dontmergecookies"].(bool); ok && dont {
+			if cookies, ok := req.Meta["cookies"].(map[string]string); ok {
+				for _, c := range MetaCookies(cookies) {
+					getReq.AddCookie(c)
+				}
+			}
+			noJar := *client
+			noJar.Jar = nil
+			return noJar.Do(getReq)
 		}
-		return d.client.Do(getReq)
+		return client.Do(getReq)
 	}
 }
 
 // The traditional way the handle http requests in golang.
-func (d *DefaultDownloader) httpDownload(req *leiogo.Request, leioRes *leiogo.Response, spider *leiogo.Spider) {
-	if res, err := d.getResponse(req); err != nil {
+func (d *DefaultDownloader) httpDownload(ctx context.Context, req *leiogo.Request, leioRes *leiogo.Response, spider *leiogo.Spider) {
+	if res, err := d.getResponse(ctx, req, leioRes, nil, spider); err != nil {
 		leioRes.Err = err
 	} else {
-		// With the help of golang's defer feature, remember to close the response body.
-		defer res.Body.Close()
 		leioRes.StatusCode = res.StatusCode
-		leioRes.Body, leioRes.Err = ioutil.ReadAll(res.Body)
+		leioRes.Header = res.Header
+
+		// A HEAD response has no body, even if it has the Content-Encoding.
+		if res.Request.Method == "HEAD" {
+			res.Body.Close()
+			return
+		}
+
+		// Don't even start reading if the server tells us the body is too large.
+		if d.MaxResponseSize > 0 && res.ContentLength > d.MaxResponseSize {
+			res.Body.Close()
+			leioRes.Err = tooLargeError(d.MaxResponseSize)
+			return
+		}
+
+		body, err := decompress(res)
+		if err != nil {
+			res.Body.Close()
+			leioRes.Err = err
+			return
+		}
+
+		// The Content-Length may be absent or wrong, and the body may be compressed,
+		// so we still count the decompressed bytes we read.
+		if d.MaxResponseSize > 0 {
+			body = &limitedBody{ReadCloser: body, max: d.MaxResponseSize}
+		}
+
+		// The parsers always get UTF-8 text, the original encoding is saved in the meta.
+		if contentType := res.Header.Get("Content-Type"); isText(contentType) {
+			var name string
+			body, name = decodeCharset(body, contentType)
+			leioRes.Meta["encoding"] = name
+		}
+
+		if stream, ok := req.Meta["stream"].(bool); ok && stream {
+			leioRes.Stream = body
+			return
+		}
+
+		// With the help of golang's defer feature, remember to close the response body.
+		// The body is read into a pooled buffer, the Content-Length is only a hint, since it may be compressed.
+		defer body.Close()
+		leioRes.Body, leioRes.Err = util.ReadAll(body, res.ContentLength)
 	}
 }
 
@@ -176,71 +607,346 @@ func (d *DefaultDownloader) httpDownload(req *leiogo.Request, leioRes *leiogo.Re
 // another byte array, we need a lot of memory which is not a godd idea.
 // The second problem is that there's no need for the file to pass through the following middlewares,
 // we want them to be writen into the target files as soon as possible.
-func (d *DefaultDownloader) fileDownload(req *leiogo.Request, leioRes *leiogo.Response, spider *leiogo.Spider) {
-	if res, err := d.getResponse(req); err != nil {
+// A partial file of a RangeWriter is resumed by a Range request, unless the file is downloaded into a temporary file
+// for the WriteRetries or the FallbackWriter, which write the whole file.
+func (d *DefaultDownloader) fileDownload(ctx context.Context, req *leiogo.Request, leioRes *leiogo.Response, spider *leiogo.Spider) {
+	// The file has been downloaded, only its write is retried.
+	if f := d.takeDownloaded(req); f != nil {
+		leioRes.StatusCode = f.res.StatusCode
+		leioRes.Header = f.res.Header
+		leioRes.Err = d.retryWrite(req, f, spider)
+		return
+	}
+
+	var header http.Header
+	rw, resumable := d.FileWriter.(RangeWriter)
+	if resumable && d.WriteRetries == 0 && d.FallbackWriter == nil {
+		if size, validator := rw.Partial(req); size > 0 {
+			d.Logger.Info(req.LogContext(spider), "Resuming %s from %d bytes", req.URL, size)
+			header = http.Header{}
+			header.Set("Range", fmt.Sprintf("bytes=%d-", size))
+			header.Set("If-Range", validator)
+		}
+	}
+
+	if res, err := d.getResponse(ctx, req, leioRes, header, spider); err != nil {
 		leioRes.Err = err
 	} else {
 		// With the help of golang's defer feature, remember to close the response body.
 		defer res.Body.Close()
 		leioRes.StatusCode = res.StatusCode
+		leioRes.Header = res.Header
+
+		// The partial file is larger than the file now, start it over.
+		if header != nil && res.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			rw.DiscardPartial(req)
+			leioRes.Err = fmt.Errorf("Range of the partial file of %s is not satisfiable", req.URL)
+			return
+		}
+
+		if d.WriteRetries > 0 || d.FallbackWriter != nil {
+			f, err := downloadTemp(res)
+			if err != nil {
+				leioRes.Err = err
+				return
+			}
+			leioRes.Err = d.retryWrite(req, f, spider)
+			return
+		}
 
 		var info string
 		info, leioRes.Err = d.WriteFile(req, res)
 		if info != "" {
-			d.Logger.Info(spider.Name, info)
+			d.Logger.Info(req.LogContext(spider), info)
 		}
 	}
 }
 
+// A file downloaded into a temporary file, which waits for its write to be retried, see retryWrite.
+// The response has no body, the body is in the file.
+type downloadedFile struct {
+	path   string
+	res    *http.Response
+	writes int
+}
+
+// Copy the body into a temporary file, so the writes can be retried without the file in the memory.
+func downloadTemp(res *http.Response) (*downloadedFile, error) {
+	file, err := ioutil.TempFile("", "leiogo-download-")
+	if err != nil {
+		return nil, &StorageError{Err: err}
+	}
+	n, err := io.Copy(file, res.Body)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = &StorageError{Err: closeErr}
+	}
+	if err == nil && res.ContentLength >= 0 && n != res.ContentLength {
+		err = fmt.Errorf("Content length doesn't match, need %d, get %d", res.ContentLength, n)
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	copied := *res
+	copied.Body = nil
+	return &downloadedFile{path: file.Name(), res: &copied}, nil
+}
+
+func (d *DefaultDownloader) Open(spider *leiogo.Spider) error {
+	return nil
+}
+
+// Close removes the temporary files of the writes which are never retried, like the requests out of retries.
+func (d *DefaultDownloader) Close(reason string, spider *leiogo.Spider) error {
+	d.downloadedMutex.Lock()
+	defer d.downloadedMutex.Unlock()
+
+	for key, f := range d.downloaded {
+		os.Remove(f.path)
+		delete(d.downloaded, key)
+	}
+	return nil
+}
+
+// Take the downloaded file of the request, nil if it's not downloaded yet, or the temporary file is gone.
+func (d *DefaultDownloader) takeDownloaded(req *leiogo.Request) *downloadedFile {
+	d.downloadedMutex.Lock()
+	defer d.downloadedMutex.Unlock()
+
+	key := req.Fingerprint()
+	f, ok := d.downloaded[key]
+	if !ok {
+		return nil
+	}
+	delete(d.downloaded, key)
+	if _, err := os.Stat(f.path); err != nil {
+		return nil
+	}
+	return f
+}
+
+func (d *DefaultDownloader) putDownloaded(req *leiogo.Request, f *downloadedFile) {
+	d.downloadedMutex.Lock()
+	defer d.downloadedMutex.Unlock()
+
+	if d.downloaded == nil {
+		d.downloaded = make(map[string]*downloadedFile)
+	}
+	d.downloaded[req.Fingerprint()] = f
+}
+
+// Write the downloaded file with the FileWriter. If it fails, the file is kept, and the request fails with
+// a StorageError, so the RetryMiddleware reschedules it after its backoff, and the write is retried from
+// the file instead of downloading it again, for WriteRetries times. Then the file is written with the
+// FallbackWriter at once. Any error of the writers is a StorageError, since the file has been downloaded.
+func (d *DefaultDownloader) retryWrite(req *leiogo.Request, f *downloadedFile, spider *leiogo.Spider) error {
+	var writerErr error
+	for {
+		var w FileWriter
+		if f.writes <= d.WriteRetries {
+			w = d.FileWriter
+		} else if f.writes == d.WriteRetries+1 && d.FallbackWriter != nil {
+			w = d.FallbackWriter
+		} else {
+			break
+		}
+		if f.writes > 0 && w == d.FileWriter {
+			d.Logger.Debug(req.LogContext(spider), "Retry writing %s for %d times, %s", req.URL, f.writes, writerErr)
+		}
+
+		var info string
+		info, writerErr = writeDownloaded(w, req, f)
+		f.writes++
+
+		// The writers drop the task when the file is saved.
+		if _, ok := writerErr.(*DropTaskError); ok || writerErr == nil {
+			os.Remove(f.path)
+			if info != "" {
+				d.Logger.Info(req.LogContext(spider), info)
+			}
+			return writerErr
+		}
+		if f.writes <= d.WriteRetries {
+			d.putDownloaded(req, f)
+			return &StorageError{Err: fmt.Errorf("Write %s with %T failed, retry later, %s", req.URL, w, writerErr)}
+		}
+		d.Logger.Error(req.LogContext(spider), "Write %s with %T failed, %s", req.URL, w, writerErr.Error())
+	}
+
+	os.Remove(f.path)
+	if _, ok := writerErr.(*StorageError); !ok {
+		writerErr = &StorageError{Err: writerErr}
+	}
+	return writerErr
+}
+
+// Write the downloaded file with the writer, the body of the response is read from the temporary file.
+func writeDownloaded(w FileWriter, req *leiogo.Request, f *downloadedFile) (string, error) {
+	file, err := os.Open(f.path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	res := *f.res
+	res.Body = file
+	return w.WriteFile(req, &res)
+}
+
 // Add support for phantomjs. If user add 'phantomjs' = true to the requests' meta,
-// such requests will be processed by phantomjs in a subprocess.
+// such requests will be processed by phantomjs in a subprocess, or by a worker of the Phantom pool.
+// The options like 'waitfor' and 'script' in the meta are passed to download.js, see renderOptions.
 // Phantomjs is a headless webkit with javascript API, with its help,
 // it's much more easy to handle the AJAX web pages.
 // We are able to directly capture what we see on the browser, without site api digging.
-func (d *DefaultDownloader) phantomjs(req *leiogo.Request, leioRes *leiogo.Response, spider *leiogo.Spider) {
-	d.Logger.Info(spider.Name, "Using phantomjs for request %s", req.URL)
+func (d *DefaultDownloader) phantomjs(ctx context.Context, req *leiogo.Request, leioRes *leiogo.Response, spider *leiogo.Spider) {
+	d.Logger.Info(req.LogContext(spider), "Using phantomjs for request %s", req.URL)
+
+	opts, err := newRenderOptions(req)
+	if err != nil {
+		leioRes.Err = err
+		return
+	}
+
+	if d.Phantom != nil {
+		page, err := d.Phantom.Render(ctx, req.URL, opts, spider)
+		if err != nil {
+			d.Logger.Error(req.LogContext(spider), "Render %s failed, %s", req.URL, err.Error())
+			leioRes.Err = err
+		} else {
+			page.setTo(leioRes)
+		}
+		return
+	}
+
+	args, _ := json.Marshal(opts)
 
 	// Using golang's exec package to run command, by default it will search the current directory,
 	// so make sure to put phantomjs and download.js to the running directory.
-	if out, err := exec.Command("phantomjs", "download.js", req.URL).Output(); err != nil {
-		d.Logger.Error(spider.Name, "Exec error: %s", err.Error())
+	if out, err := exec.CommandContext(ctx, "phantomjs", "download.js", req.URL, string(args)).Output(); err != nil {
+		d.Logger.Error(req.LogContext(spider), "Exec error: %s", err.Error())
 		leioRes.Err = err
 	} else {
 		if len(out) == 0 {
 			leioRes.Err = errors.New("Phantomjs Error")
 		} else {
-			leioRes.Body = out
-
-			// A request of a web page usually contains a bunch of related requests,
-			// so it's not easy to define the status code of this request,
-			// so we mistakely set it to 200.
-			leioRes.StatusCode = 200
+			// download.js writes the page, the result of the script and the base64 screenshot in JSON,
+			// the older versions write the page only.
+			page := &phantomPage{}
+			if err := json.Unmarshal(out, page); err != nil {
+				page = &phantomPage{Body: string(out)}
+			}
+			page.setTo(leioRes)
 		}
 	}
 }
 
-// We only config the timeout for the default config.
+// We only config the timeout and the transport for the default config.
+// The cookies are stored in the Jar, it may be shared with others, like the FormLogin.
+// A new jar is created if it's nil.
 type DefaultConfig struct {
-	Timeout int
+	Timeout   int
+	Jar       http.CookieJar
+	Transport TransportConfig
+}
+
+// The HTTP versions of the TransportConfig.
+const (
+	HTTP1 = "1.1"
+	HTTP2 = "2"
+)
+
+// TransportConfig tunes the connection pool and the protocol of the http transport of a ClientConfig.
+// The zero values keep the defaults of net/http, except MaxIdleConns which defaults to 100.
+// A high-concurrency crawl usually needs a larger MaxIdleConnsPerHost, since net/http only keeps 2 idle
+// connections to each host, and the others are closed and dialed again for every request.
+type TransportConfig struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+
+	// The max connections to each host, including the active ones. 0 means no limitation.
+	MaxConnsPerHost int
+
+	// Close the connection after each request.
+	DisableKeepAlives bool
+
+	// HTTP1 never uses HTTP/2, and HTTP2 tries HTTP/2 on every https host, falling back to HTTP/1.1
+	// if the host doesn't support it. Empty means the default of the config.
+	HTTPVersion string
+}
+
+// Apply the config to the transport, forceHTTP2 is the default when the HTTPVersion is empty.
+func (c TransportConfig) apply(t *http.Transport, forceHTTP2 bool) error {
+	if c.MaxIdleConns > 0 {
+		t.MaxIdleConns = c.MaxIdleConns
+	}
+	t.MaxIdleConnsPerHost = c.MaxIdleConnsPerHost
+	t.MaxConnsPerHost = c.MaxConnsPerHost
+	t.DisableKeepAlives = c.DisableKeepAlives
+
+	switch c.HTTPVersion {
+	case HTTP1:
+		// A non-nil empty map disables HTTP/2.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	case HTTP2:
+		t.ForceAttemptHTTP2 = true
+	case "":
+		t.ForceAttemptHTTP2 = forceHTTP2
+	default:
+		return fmt.Errorf("Unknown HTTP version %s", c.HTTPVersion)
+	}
+	return nil
+}
+
+func newJar(jar http.CookieJar) (http.CookieJar, error) {
+	if jar != nil {
+		return jar, nil
+	}
+	return cookiejar.New(nil)
 }
 
 func (c *DefaultConfig) ConfigClient() (*http.Client, error) {
-	jar, err := cookiejar.New(nil)
+	jar, err := newJar(c.Jar)
 	if err != nil {
 		return nil, err
 	}
 
+	// Same as http.DefaultTransport, except the proxies in the meta.
+	transport := defaultTransport()
+	transport.Proxy = metaProxy(http.ProxyFromEnvironment)
+	if err := c.Transport.apply(transport, true); err != nil {
+		return nil, err
+	}
+
 	client := &http.Client{
-		Timeout: time.Duration(c.Timeout) * time.Second,
-		Jar:     jar,
+		Transport: transport,
+		Timeout:   time.Duration(c.Timeout) * time.Second,
+		Jar:       jar,
 	}
 	return client, nil
 }
 
+type proxyKey struct{}
+
+// A request may be sent by its own proxy with 'proxy' = url in its meta, like the proxies rotated
+// by the BlockDetectorMiddleware. The other requests use the proxy of the config.
+func metaProxy(def func(*http.Request) (*url.URL, error)) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		if proxy, ok := req.Context().Value(proxyKey{}).(string); ok {
+			return url.Parse(proxy)
+		}
+		return def(req)
+	}
+}
+
 // Add proxy support to the downloader.
 type ProxyConfig struct {
-	Timeout  int
-	ProxyURL string
+	Timeout   int
+	ProxyURL  string
+	Jar       http.CookieJar
+	Transport TransportConfig
 }
 
 func defaultTransport() *http.Transport {
@@ -259,10 +965,10 @@ func defaultTransport() *http.Transport {
 
 func (c *ProxyConfig) ConfigClient() (*http.Client, error) {
 	var proxyURL *url.URL
-	var jar *cookiejar.Jar
+	var jar http.CookieJar
 	var err error
 
-	jar, err = cookiejar.New(nil)
+	jar, err = newJar(c.Jar)
 	if err != nil {
 		return nil, err
 	}
@@ -273,7 +979,10 @@ func (c *ProxyConfig) ConfigClient() (*http.Client, error) {
 	}
 
 	transport := defaultTransport()
-	transport.Proxy = http.ProxyURL(proxyURL)
+	transport.Proxy = metaProxy(http.ProxyURL(proxyURL))
+	if err := c.Transport.apply(transport, false); err != nil {
+		return nil, err
+	}
 
 	client := &http.Client{
 		Transport: transport,
@@ -0,0 +1,136 @@
+package middleware
+
+import (
+	"hash/fnv"
+	"math"
+	"path"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// DupeFilter is the backend of CacheMiddleware to remember the crawled urls.
+// It should be thread-safe, since it's called from different goroutines.
+// A DupeFilter may also implement the Persistent interface, so the crawled urls
+// can be saved to the job directory.
+type DupeFilter interface {
+	Seen(key string) bool
+	Add(key string)
+}
+
+// MapDupeFilter stores every key in a map. It's exact, but the memory grows with the number of keys.
+type MapDupeFilter struct {
+	// Considering the memory usage, we make the value to be struct{},
+	// in golang it will use 0 space.
+	keys  map[string]struct{}
+	mutex sync.RWMutex
+}
+
+func NewMapDupeFilter() *MapDupeFilter {
+	return &MapDupeFilter{keys: make(map[string]struct{})}
+}
+
+func (f *MapDupeFilter) Seen(key string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	_, ok := f.keys[key]
+	return ok
+}
+
+func (f *MapDupeFilter) Add(key string) {
+	f.mutex.Lock()
+	f.keys[key] = struct{}{}
+	f.mutex.Unlock()
+}
+
+func (f *MapDupeFilter) SaveState(dir string) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	// gob is not able to encode struct{}, so we save the keys as a slice.
+	keys := make([]string, 0, len(f.keys))
+	for key := range f.keys {
+		keys = append(keys, key)
+	}
+	return util.SaveGob(path.Join(dir, "cache.gob"), keys)
+}
+
+func (f *MapDupeFilter) LoadState(dir string) error {
+	var keys []string
+	if err := util.LoadGob(path.Join(dir, "cache.gob"), &keys); err != nil {
+		return err
+	}
+
+	f.mutex.Lock()
+	for _, key := range keys {
+		f.keys[key] = struct{}{}
+	}
+	f.mutex.Unlock()
+	return nil
+}
+
+// BloomDupeFilter stores the keys in a bloom filter, which uses a fixed size of memory,
+// about 1.2MB for a million keys with 1% false positive rate. The cost is that a small part
+// of the new urls will be treated as crawled, never a crawled url as new.
+type BloomDupeFilter struct {
+	// The number of bits and the number of hash functions, they are calculated from
+	// the expected capacity and false positive rate, see NewBloomDupeFilter.
+	M, K uint64
+	Bits []uint64
+
+	mutex sync.RWMutex
+}
+
+func NewBloomDupeFilter(capacity int, fpRate float64) *BloomDupeFilter {
+	n := float64(capacity)
+	m := math.Ceil(-n * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+	return &BloomDupeFilter{M: uint64(m), K: uint64(k), Bits: make([]uint64, (uint64(m)+63)/64)}
+}
+
+// We use the double hashing technique to generate K hash values from a single 64-bit hash.
+func (f *BloomDupeFilter) locations(key string) []uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32
+
+	locs := make([]uint64, f.K)
+	for i := uint64(0); i < f.K; i++ {
+		locs[i] = (h1 + i*h2) % f.M
+	}
+	return locs
+}
+
+func (f *BloomDupeFilter) Seen(key string) bool {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+
+	for _, loc := range f.locations(key) {
+		if f.Bits[loc/64]&(1<<(loc%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *BloomDupeFilter) Add(key string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, loc := range f.locations(key) {
+		f.Bits[loc/64] |= 1 << (loc % 64)
+	}
+}
+
+func (f *BloomDupeFilter) SaveState(dir string) error {
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return util.SaveGob(path.Join(dir, "bloom.gob"), f)
+}
+
+func (f *BloomDupeFilter) LoadState(dir string) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return util.LoadGob(path.Join(dir, "bloom.gob"), f)
+}
@@ -0,0 +1,213 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// ESPipeline indexes the items into Elasticsearch with the bulk API.
+// The items are buffered, and sent when the buffer is full, every FlushInterval, and when the spider closes.
+type ESPipeline struct {
+	Base
+
+	// The address of the cluster, like http://localhost:9200
+	URL string
+
+	// The index name, it's formatted with the time when the item is indexed by Go's time layout
+	// inside braces, so "items-{2006.01.02}" creates a new index every day.
+	Index string
+
+	// If KeyFields is not empty, the idempotency keys of the items are used as the document ids,
+	// so re-indexing the same item overwrites the document instead of duplicating it. See Item.Key.
+	KeyFields []string
+
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// The times to retry a bulk request which is rejected with 429 Too Many Requests.
+	// A document failing to index for more than MaxRetries times is dropped and logged.
+	MaxRetries int
+
+	// The number of the dropped documents.
+	Dropped int
+
+	client   *http.Client
+	docs     []*esDoc
+	mutex    sync.Mutex
+	flushing bool
+	flushed  *sync.Cond
+	closed   chan bool
+}
+
+type esDoc struct {
+	// The action line followed by the document, the bulk API takes newline delimited JSON.
+	lines []byte
+	fails int
+}
+
+func (p *ESPipeline) Open(spider *leiogo.Spider) error {
+	p.client = &http.Client{Timeout: 60 * time.Second}
+	p.flushed = sync.NewCond(&p.mutex)
+	p.closed = make(chan bool)
+
+	if p.FlushInterval > 0 {
+		ticker := time.NewTicker(p.FlushInterval)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.mutex.Lock()
+					if err := p.flush(spider); err != nil {
+						p.Logger.Error(spider.Name, "Flush %d items fail, %s", len(p.docs), err)
+					}
+					p.mutex.Unlock()
+				case <-p.closed:
+					return
+				}
+			}
+		}()
+	}
+	p.Logger.Info(spider.Name, "Indexing items to %s/%s", p.URL, p.Index)
+	return nil
+}
+
+func (p *ESPipeline) Close(reason string, spider *leiogo.Spider) error {
+	close(p.closed)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Wait for the flush backing off, then the failed documents are tried once more.
+	for p.flushing {
+		p.flushed.Wait()
+	}
+	err := p.flush(spider)
+	if err != nil {
+		p.Logger.Error(spider.Name, "Flush %d items fail, %s", len(p.docs), err)
+	}
+	return err
+}
+
+// Replace the time layouts in braces with the current time.
+func (p *ESPipeline) indexName(now time.Time) string {
+	name := p.Index
+	for {
+		start := strings.Index(name, "{")
+		end := strings.Index(name, "}")
+		if start < 0 || end < start {
+			return name
+		}
+		name = name[:start] + now.Format(name[start+1:end]) + name[end+1:]
+	}
+}
+
+func (p *ESPipeline) Buffered() bool {
+	return true
+}
+
+func (p *ESPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	meta := map[string]interface{}{"_index": p.indexName(time.Now())}
+	if len(p.KeyFields) != 0 {
+		meta["_id"] = item.Key(p.KeyFields...)
+	}
+	action, _ := json.Marshal(map[string]interface{}{"index": meta})
+	lines := append(action, "\n"+item.String()+"\n"...)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.docs = append(p.docs, &esDoc{lines: lines})
+	if len(p.docs) >= p.BatchSize {
+		return p.flush(spider)
+	}
+	return nil
+}
+
+// Send the buffered documents in a bulk request. The documents are kept if the request fails, so they will be
+// tried again with the next batch. Of a bulk request with errors, only the failed documents are kept, except the
+// ones failing for more than MaxRetries times, and the ones the cluster will never take, like mapping errors.
+// The mutex is released while backing off, the documents coming meanwhile are sent with the next request,
+// and the other flushes return at once.
+func (p *ESPipeline) flush(spider *leiogo.Spider) error {
+	if len(p.docs) == 0 || p.flushing {
+		return nil
+	}
+	p.flushing = true
+	defer func() {
+		p.flushing = false
+		p.flushed.Broadcast()
+	}()
+
+	for retry := 0; ; retry++ {
+		docs := p.docs
+		var buf bytes.Buffer
+		for _, doc := range docs {
+			buf.Write(doc.lines)
+		}
+		res, err := p.client.Post(p.URL+"/_bulk", "application/x-ndjson", &buf)
+		if err != nil {
+			return err
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+
+		// The cluster is busy, back off and try again.
+		if res.StatusCode == http.StatusTooManyRequests && retry < p.MaxRetries {
+			p.mutex.Unlock()
+			time.Sleep(time.Duration(1<<uint(retry)) * time.Second)
+			p.mutex.Lock()
+			continue
+		}
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("Bulk request fail with status %d, %s", res.StatusCode, body)
+		}
+
+		// A successful bulk request may still contain failed items, the results are in the order of the documents.
+		var result struct {
+			Errors bool `json:"errors"`
+			Items  []map[string]struct {
+				Status int             `json:"status"`
+				Error  json.RawMessage `json:"error"`
+			} `json:"items"`
+		}
+		if err = json.Unmarshal(body, &result); err != nil {
+			return fmt.Errorf("Parse bulk response fail, %s", err)
+		}
+		var failed []*esDoc
+		fails := 0
+		if result.Errors {
+			if len(result.Items) != len(docs) {
+				return fmt.Errorf("Bulk response has %d items of %d documents", len(result.Items), len(docs))
+			}
+			for i, item := range result.Items {
+				for _, r := range item {
+					if r.Status < 300 {
+						continue
+					}
+					fails++
+					doc := docs[i]
+					// Only the rejected and the server errors may succeed later.
+					retryable := r.Status == http.StatusTooManyRequests || r.Status >= 500
+					if doc.fails++; !retryable || doc.fails > p.MaxRetries {
+						p.Logger.Error(spider.Name, "Drop the document failed for %d times, status %d, %s", doc.fails, r.Status, r.Error)
+						p.Dropped++
+					} else {
+						failed = append(failed, doc)
+					}
+				}
+			}
+			err = fmt.Errorf("%d of the %d items fail to index", fails, len(docs))
+		}
+		p.docs = append(failed, p.docs[len(docs):]...)
+		return err
+	}
+}
@@ -0,0 +1,106 @@
+package middleware
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+// The modes of the FixtureDownloader.
+const (
+	// The responses are downloaded and recorded as the fixtures.
+	FixtureRecord = "record"
+
+	// The responses are only answered from the fixtures, the network is never used.
+	FixtureReplay = "replay"
+)
+
+// FixtureMissError is the error of a request which isn't recorded in the fixtures in the replay mode,
+// including the files and the streams, which are never recorded. It's never retried, and it's counted
+// as an error of the crawl, so a spider tested against out-of-date fixtures fails instead of passing
+// with fewer pages. Unlike a DropTaskError, the file requests are failed, since nothing is saved.
+type FixtureMissError struct {
+	URL     string
+	Message string
+}
+
+func (err *FixtureMissError) Error() string {
+	if err.Message != "" {
+		return err.Message + ", " + err.URL
+	}
+	return "No fixture for " + err.URL
+}
+
+// FixtureDownloader records the responses of a crawl, and replays them later, so the spiders can be tested
+// against the captured pages deterministically, without the network. The fixtures are stored by
+// the same keys as the HTTP cache, see CacheKey, the latest recorded version is replayed.
+// A request missing in the fixtures fails with a FixtureMissError, and so do the files and the streams,
+// which are never recorded.
+type FixtureDownloader struct {
+	Downloader
+
+	Logger  log.Logger
+	Storage HttpCacheStorage
+	Mode    string
+
+	Recorded int64
+	Replayed int64
+
+	missed []string
+	mutex  sync.Mutex
+}
+
+func (d *FixtureDownloader) Download(ctx context.Context, req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response {
+	if d.Mode == FixtureReplay {
+		return d.replay(req, spider)
+	}
+
+	res := d.Downloader.Download(ctx, req, spider)
+	if d.Mode == FixtureRecord && res.Err == nil && cacheable(req) {
+		err := d.Storage.Store(CacheKey(req), newCachedResponse(req, res))
+		if err != nil {
+			d.Logger.Error(req.LogContext(spider), "Record %s failed, %s", req.URL, err.Error())
+		} else {
+			atomic.AddInt64(&d.Recorded, 1)
+		}
+	}
+	return res
+}
+
+func (d *FixtureDownloader) replay(req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response {
+	res := leiogo.NewResponse(req)
+	if !cacheable(req) {
+		res.Err = &FixtureMissError{URL: req.URL, Message: "Files and streams are not recorded"}
+		return res
+	}
+
+	cached, err := d.Storage.Retrieve(CacheKey(req), time.Time{})
+	if err != nil {
+		d.Logger.Error(req.LogContext(spider), "Retrieve %s from fixtures failed, %s", req.URL, err.Error())
+	}
+	if cached == nil {
+		d.Logger.Error(req.LogContext(spider), "%s is not in the fixtures", req.URL)
+		d.mutex.Lock()
+		d.missed = append(d.missed, req.URL)
+		d.mutex.Unlock()
+		res.Err = &FixtureMissError{URL: req.URL}
+		return res
+	}
+
+	atomic.AddInt64(&d.Replayed, 1)
+	return cached.response(req)
+}
+
+// Missed returns the sorted urls missing in the fixtures in the replay mode.
+func (d *FixtureDownloader) Missed() []string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	missed := append([]string{}, d.missed...)
+	sort.Strings(missed)
+	return missed
+}
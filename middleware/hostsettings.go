@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// HostSettings overrides the settings for the hosts matching the patterns, so a broad spider
+// can treat different sites with different policies. A pattern is either a host name like
+// "www.example.com", or a wildcard like "*.example.com", which matches example.com and all its subdomains.
+// The keys of the settings are:
+//
+//	"DownloadDelay"      float64, used by DelayMiddleware
+//	"ConcurrentRequests" int, the max concurrent requests to the host, used by the crawler
+//	"UserAgent"          string, used by DefaultDownloader
+//	"Render"             bool, render the pages with phantomjs, used by DefaultDownloader
+//	"RetryTimes"         int, used by RetryMiddleware
+//	"RetryBudget"        float64, the max ratio of the retries to the requests, used by RetryMiddleware
+//	"AllowedStatuses"    []int, the status codes passing HttpErrorMiddleware
+type HostSettings map[string]leiogo.Dict
+
+// Lookup returns the setting of the key for the host of the url.
+// An exact host pattern wins over the wildcards, and a longer wildcard wins over a shorter one.
+func (h HostSettings) Lookup(rawurl string, key string) (interface{}, bool) {
+	if len(h) == 0 {
+		return nil, false
+	}
+
+	host := util.GetHost(rawurl)
+	if settings, ok := h[host]; ok {
+		if val, ok := settings[key]; ok {
+			return val, true
+		}
+	}
+
+	var found interface{}
+	matched := ""
+	for pattern, settings := range h {
+		if !strings.HasPrefix(pattern, "*.") || len(pattern) <= len(matched) {
+			continue
+		}
+		domain := pattern[2:]
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			if val, ok := settings[key]; ok {
+				found, matched = val, pattern
+			}
+		}
+	}
+	return found, matched != ""
+}
+
+// The settings may be written in Go code or decoded from JSON,
+// so the numbers may be either int or float64.
+func (h HostSettings) Float(rawurl string, key string, def float64) float64 {
+	val, _ := h.Lookup(rawurl, key)
+	switch x := val.(type) {
+	case float64:
+		return x
+	case int:
+		return float64(x)
+	default:
+		return def
+	}
+}
+
+func (h HostSettings) Int(rawurl string, key string, def int) int {
+	val, _ := h.Lookup(rawurl, key)
+	switch x := val.(type) {
+	case int:
+		return x
+	case float64:
+		return int(x)
+	default:
+		return def
+	}
+}
+
+func (h HostSettings) String(rawurl string, key string, def string) string {
+	if val, ok := h.Lookup(rawurl, key); ok {
+		if x, ok := val.(string); ok {
+			return x
+		}
+	}
+	return def
+}
+
+func (h HostSettings) Bool(rawurl string, key string, def bool) bool {
+	if val, ok := h.Lookup(rawurl, key); ok {
+		if x, ok := val.(bool); ok {
+			return x
+		}
+	}
+	return def
+}
+
+func (h HostSettings) Ints(rawurl string, key string, def []int) []int {
+	val, _ := h.Lookup(rawurl, key)
+	switch x := val.(type) {
+	case []int:
+		return x
+	case []interface{}:
+		ints := make([]int, 0, len(x))
+		for _, i := range x {
+			if f, ok := i.(float64); ok {
+				ints = append(ints, int(f))
+			} else if n, ok := i.(int); ok {
+				ints = append(ints, n)
+			}
+		}
+		return ints
+	default:
+		return def
+	}
+}
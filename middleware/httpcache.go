@@ -0,0 +1,391 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// CacheKey returns the key which a response cache should store the response of the request under,
+// it's based on the fingerprint of the request, see leiogo.Request.Fingerprint.
+// The same url may produce different bodies, a raw page from the http client and a rendered DOM from phantomjs or Chrome,
+// and rendered pages also depend on the options of the rendering, see renderOptions. So the key contains the render flag
+// and the options changing the page, the waitfor, the viewport, the hash of the interaction script and the screenshot,
+// switching render settings will never serve a raw body to the parsers expecting the rendered one. The method is a part of the fingerprint, so the empty body of a HEAD
+// is never served to a GET.
+func CacheKey(req *leiogo.Request) string {
+	key := req.Fingerprint()
+	phantomjs, _ := req.Meta["phantomjs"].(bool)
+	chrome, _ := req.Meta["render"].(bool)
+	if phantomjs || chrome {
+		key += "|rendered"
+		if waitfor, ok := req.Meta["waitfor"].(string); ok && waitfor != "" {
+			key += "|waitfor=" + waitfor
+		}
+		if viewport, ok := req.Meta["viewport"].(string); ok && viewport != "" {
+			key += "|viewport=" + viewport
+		}
+		if script, ok := req.Meta["script"].(string); ok && script != "" {
+			key += "|" + util.Hash(script)
+		}
+		if screenshot, _ := req.Meta["screenshot"].(bool); screenshot {
+			key += "|screenshot"
+		}
+	} else {
+		key += "|raw"
+	}
+	return util.Hash(key)
+}
+
+// The key of the request in the cache of the tenant of the spider, tenant/CacheKey, so the tenants
+// never share their pages. The spiders without a Tenant use the CacheKey.
+func tenantCacheKey(req *leiogo.Request, spider *leiogo.Spider) string {
+	if spider.Tenant == "" {
+		return CacheKey(req)
+	}
+	return spider.Tenant + "/" + CacheKey(req)
+}
+
+// CachedResponse is a version of a response in the HTTP cache, Time is when it was downloaded.
+// The BodyHash is set instead of the Body if the body is kept in a BodyStore, see DedupCacheStorage.
+// The ScriptResult and the Screenshot of a rendered page are kept too.
+type CachedResponse struct {
+	URL          string
+	StatusCode   int
+	Header       http.Header
+	Body         []byte
+	BodyHash     string
+	Time         time.Time
+	ScriptResult json.RawMessage
+	Screenshot   []byte
+}
+
+// Keep the downloaded response of the request.
+func newCachedResponse(req *leiogo.Request, res *leiogo.Response) *CachedResponse {
+	return &CachedResponse{
+		URL:          req.URL,
+		StatusCode:   res.StatusCode,
+		Header:       res.Header,
+		Body:         res.Body,
+		Time:         time.Now(),
+		ScriptResult: res.ScriptResult,
+		Screenshot:   res.Screenshot,
+	}
+}
+
+// Answer the request with the cached response.
+func (c *CachedResponse) response(req *leiogo.Request) *leiogo.Response {
+	res := leiogo.NewResponse(req)
+	res.StatusCode = c.StatusCode
+	res.Header = c.Header
+	res.Body = c.Body
+	res.ScriptResult = c.ScriptResult
+	res.Screenshot = c.Screenshot
+	return res
+}
+
+// HttpCacheStorage keeps all the versions of the cached responses, so the crawl can be
+// replayed as of any time in the past.
+type HttpCacheStorage interface {
+	Store(key string, res *CachedResponse) error
+
+	// Retrieve returns the latest version downloaded not after asOf, or nil if there's none.
+	// Zero asOf means the latest version.
+	Retrieve(key string, asOf time.Time) (*CachedResponse, error)
+}
+
+// FSCacheStorage saves a version of a response to Dir/key[:2]/key/time.gob, time is in unix nanoseconds.
+// The key of a tenant, tenant/key, is saved in the directory of the tenant, Dir/tenant/key[:2]/key.
+type FSCacheStorage struct {
+	Dir string
+}
+
+func (s *FSCacheStorage) dir(key string) string {
+	dir := s.Dir
+	if i := strings.LastIndex(key, "/"); i >= 0 {
+		dir, key = path.Join(dir, key[:i]), key[i+1:]
+	}
+	return path.Join(dir, key[:2], key)
+}
+
+func (s *FSCacheStorage) Store(key string, res *CachedResponse) error {
+	dir := s.dir(key)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return util.SaveGob(path.Join(dir, strconv.FormatInt(res.Time.UnixNano(), 10)+".gob"), res)
+}
+
+func (s *FSCacheStorage) Retrieve(key string, asOf time.Time) (*CachedResponse, error) {
+	files, err := ioutil.ReadDir(s.dir(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var latest int64 = -1
+	for _, f := range files {
+		t, err := strconv.ParseInt(strings.TrimSuffix(f.Name(), ".gob"), 10, 64)
+		if err != nil || !strings.HasSuffix(f.Name(), ".gob") {
+			continue
+		}
+		if (asOf.IsZero() || t <= asOf.UnixNano()) && t > latest {
+			latest = t
+		}
+	}
+	if latest < 0 {
+		return nil, nil
+	}
+
+	res := &CachedResponse{}
+	if err := util.LoadGob(path.Join(s.dir(key), strconv.FormatInt(latest, 10)+".gob"), res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// CacheMissError is the error of a request refused by the CacheDownloader in the time travel, because
+// it wasn't cached as of the Snapshot, or it's a file or a stream, which are never cached. Unlike a DropTaskError,
+// it means nothing is downloaded, so the file requests are failed, and it's never retried.
+type CacheMissError struct {
+	URL     string
+	Message string
+}
+
+func (err *CacheMissError) Error() string {
+	return err.Message + ", " + err.URL
+}
+
+// CacheDownloader answers the requests from the HTTP cache, and caches the pages it downloads.
+// It shares the storage with the HttpCacheMiddleware.
+// With a Snapshot, it's a time travel: every request is answered by the version cached as of the Snapshot,
+// and the requests which weren't cached by then are refused instead of being downloaded,
+// so the parsers can be run again against a consistent view of a past crawl.
+// The files and the streams are never cached, they are refused in the time travel.
+type CacheDownloader struct {
+	Downloader
+
+	Logger   log.Logger
+	Storage  HttpCacheStorage
+	Snapshot time.Time
+
+	Hits   int64
+	Misses int64
+}
+
+func (d *CacheDownloader) Download(ctx context.Context, req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response {
+	if !cacheable(req) {
+		if d.Snapshot.IsZero() {
+			return d.Downloader.Download(ctx, req, spider)
+		}
+		res := leiogo.NewResponse(req)
+		res.Err = &CacheMissError{URL: req.URL, Message: "Files and streams are not cached"}
+		return res
+	}
+
+	key := tenantCacheKey(req, spider)
+	cached, err := d.Storage.Retrieve(key, d.Snapshot)
+	if err != nil {
+		d.Logger.Error(req.LogContext(spider), "Retrieve %s from cache failed, %s", req.URL, err.Error())
+	}
+	if cached != nil {
+		atomic.AddInt64(&d.Hits, 1)
+		return cached.response(req)
+	}
+
+	atomic.AddInt64(&d.Misses, 1)
+	if !d.Snapshot.IsZero() {
+		d.Logger.Debug(req.LogContext(spider), "%s is not cached as of %s", req.URL, d.Snapshot.Format(time.RFC3339))
+		res := leiogo.NewResponse(req)
+		res.Err = &CacheMissError{URL: req.URL, Message: "Not cached as of " + d.Snapshot.Format(time.RFC3339)}
+		return res
+	}
+
+	res := d.Downloader.Download(ctx, req, spider)
+	if res.Err == nil {
+		err := d.Storage.Store(key, newCachedResponse(req, res))
+		if err != nil {
+			d.Logger.Error(req.LogContext(spider), "Cache %s failed, %s", req.URL, err.Error())
+		}
+	}
+	return res
+}
+
+func cacheable(req *leiogo.Request) bool {
+	if typeName, ok := req.Meta["__type__"].(string); ok && typeName == "file" {
+		return false
+	}
+	stream, _ := req.Meta["stream"].(bool)
+	return !stream
+}
+
+// The policies of the HttpCacheMiddleware.
+const (
+	// The cached responses are fresh until they are older than the TTL.
+	CachePolicyTTL = "ttl"
+
+	// The freshness follows RFC 7234, by the Cache-Control and Expires headers. The stale responses
+	// are validated by the ETag and Last-Modified headers, and reused if the server responds 304.
+	// The TTL still limits the freshness if it's not 0.
+	CachePolicyRFC7234 = "rfc7234"
+)
+
+// HttpCacheMiddleware is a download middleware for the development of the parsers, it stores the responses
+// in the Storage and answers the following runs from it, so the sites are not hit again and again.
+// The TTL of 0 means the responses never expire with the ttl policy. The 5xx and the 304 responses,
+// the files and the streams are never cached. Unlike the CacheDownloader, it's a middleware, so the responses
+// from the cache still go through the other download middlewares.
+type HttpCacheMiddleware struct {
+	BaseMiddleware
+
+	Storage HttpCacheStorage
+	Policy  string
+	TTL     time.Duration
+
+	Hits        int64
+	Misses      int64
+	Revalidated int64
+}
+
+func (m *HttpCacheMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	m.Logger.Info(spider.Name, "HTTP cache hits: %d, misses: %d, revalidated: %d",
+		atomic.LoadInt64(&m.Hits), atomic.LoadInt64(&m.Misses), atomic.LoadInt64(&m.Revalidated))
+	return m.BaseMiddleware.Close(reason, spider)
+}
+
+func (m *HttpCacheMiddleware) CachedResponse(req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response {
+	if !cacheable(req) {
+		return nil
+	}
+
+	cached, err := m.Storage.Retrieve(tenantCacheKey(req, spider), time.Time{})
+	if err != nil {
+		m.Logger.Error(req.LogContext(spider), "Retrieve %s from cache failed, %s", req.URL, err.Error())
+	}
+	if cached == nil {
+		atomic.AddInt64(&m.Misses, 1)
+		return nil
+	}
+
+	if m.fresh(cached) {
+		atomic.AddInt64(&m.Hits, 1)
+		m.Logger.Debug(req.LogContext(spider), "Found %s in cache", req.URL)
+		// The responses from the cache are not stored again.
+		res := cached.response(req)
+		res.Meta["__cached__"] = true
+		return res
+	}
+
+	// A stale response with validators is validated by a conditional request.
+	atomic.AddInt64(&m.Misses, 1)
+	if m.Policy == CachePolicyRFC7234 {
+		headers := make(map[string]string)
+		if etag := cached.Header.Get("ETag"); etag != "" {
+			headers["If-None-Match"] = etag
+		}
+		if modified := cached.Header.Get("Last-Modified"); modified != "" {
+			headers["If-Modified-Since"] = modified
+		}
+		if len(headers) != 0 {
+			if old, ok := req.Meta["headers"].(map[string]string); ok {
+				for k, v := range old {
+					if _, ok := headers[k]; !ok {
+						headers[k] = v
+					}
+				}
+			}
+			req.Meta["headers"] = headers
+		}
+	}
+	return nil
+}
+
+func (m *HttpCacheMiddleware) fresh(cached *CachedResponse) bool {
+	age := time.Since(cached.Time)
+	if m.TTL > 0 && age > m.TTL {
+		return false
+	}
+	if m.Policy != CachePolicyRFC7234 {
+		return true
+	}
+	return age < freshnessLifetime(cached)
+}
+
+// The freshness lifetime of a response by RFC 7234, 0 if the response must be validated.
+func freshnessLifetime(cached *CachedResponse) time.Duration {
+	for _, directive := range strings.Split(cached.Header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		if directive == "no-cache" || directive == "no-store" {
+			return 0
+		}
+		if strings.HasPrefix(directive, "max-age=") {
+			if seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				return time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	if expires, err := http.ParseTime(cached.Header.Get("Expires")); err == nil {
+		date, err := http.ParseTime(cached.Header.Get("Date"))
+		if err != nil {
+			date = cached.Time
+		}
+		return expires.Sub(date)
+	}
+	return 0
+}
+
+func (m *HttpCacheMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if cached, _ := res.Meta["__cached__"].(bool); cached {
+		delete(res.Meta, "__cached__")
+		return nil
+	}
+
+	if res.Err != nil || !cacheable(req) || res.StatusCode >= 500 {
+		return nil
+	}
+	if m.Policy == CachePolicyRFC7234 && strings.Contains(strings.ToLower(res.Header.Get("Cache-Control")), "no-store") {
+		return nil
+	}
+
+	// The stale response is still valid, use it with the new headers. It's retrieved again instead of being
+	// kept for the request, so nothing is left behind when the response never gets here, like a lookup.
+	if res.StatusCode == http.StatusNotModified {
+		stale, err := m.Storage.Retrieve(tenantCacheKey(req, spider), time.Time{})
+		if err != nil {
+			m.Logger.Error(req.LogContext(spider), "Retrieve %s from cache failed, %s", req.URL, err.Error())
+		}
+		// A 304 has no body, it's never stored.
+		if stale == nil {
+			return nil
+		}
+		atomic.AddInt64(&m.Revalidated, 1)
+		m.Logger.Debug(req.LogContext(spider), "Revalidated %s in cache", req.URL)
+		header := stale.Header
+		for k, v := range res.Header {
+			header[k] = v
+		}
+		res.StatusCode = stale.StatusCode
+		res.Header = header
+		res.Body = stale.Body
+		res.ScriptResult = stale.ScriptResult
+		res.Screenshot = stale.Screenshot
+	}
+
+	err := m.Storage.Store(tenantCacheKey(req, spider), newCachedResponse(req, res))
+	if err != nil {
+		m.Logger.Error(req.LogContext(spider), "Cache %s failed, %s", req.URL, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"bufio"
+	"os"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// KeyStore remembers the idempotency keys of the items which have already been exported.
+// See Item.Key for how the keys are generated.
+type KeyStore interface {
+	OpenClose
+	Exists(key string) bool
+	Add(key string) error
+}
+
+// FileKeyStore keeps the keys in memory and appends every new key to a file,
+// one key per line. When the spider is opened again, all the keys in the file are loaded,
+// so a resumed crawl knows which items have been exported by the previous runs.
+type FileKeyStore struct {
+	FileName string
+
+	keys  map[string]struct{}
+	file  *os.File
+	mutex sync.RWMutex
+}
+
+func (s *FileKeyStore) Open(spider *leiogo.Spider) error {
+	s.keys = make(map[string]struct{})
+
+	// It's fine that the file doesn't exist, this is the first run.
+	if file, err := os.Open(s.FileName); err == nil {
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			s.keys[scanner.Text()] = struct{}{}
+		}
+		file.Close()
+	}
+
+	var err error
+	s.file, err = os.OpenFile(s.FileName, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	return err
+}
+
+func (s *FileKeyStore) Close(reason string, spider *leiogo.Spider) error {
+	return s.file.Close()
+}
+
+func (s *FileKeyStore) Exists(key string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	_, ok := s.keys[key]
+	return ok
+}
+
+func (s *FileKeyStore) Add(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.keys[key] = struct{}{}
+	_, err := s.file.WriteString(key + "\n")
+	return err
+}
+
+// ExactlyOncePipeline wraps an exporting pipeline (JSON, SQL, ...) and makes sure that
+// each item is exported only once, even if a resumed or distributed crawl yields it again.
+// An item is skipped if its key is already in the store, and its key is added to the store
+// only after the wrapped pipeline processes it successfully, so a failed export will be tried again.
+//
+// If the wrapped pipeline buffers the items, see Buffered, the keys are added to the store only after
+// the pipeline is closed without an error, since an item buffered may still be lost. So a crawl stopped
+// before that exports its buffered items again, which the batching pipelines upsert by the same keys.
+type ExactlyOncePipeline struct {
+	Base
+
+	Pipeline ItemPipeline
+
+	// KeyFields defines which fields of the item make up its key.
+	// If it's empty, the whole item is used. See Item.Key.
+	KeyFields []string
+
+	Store KeyStore
+
+	// Items with the same key may be processed by different goroutines at the same time,
+	// so we have to remember the keys which are being processed, and the keys of the items
+	// buffered by the wrapped pipeline.
+	running  map[string]struct{}
+	pending  map[string]struct{}
+	buffered bool
+	mutex    sync.Mutex
+}
+
+func (p *ExactlyOncePipeline) Open(spider *leiogo.Spider) error {
+	p.running = make(map[string]struct{})
+	p.pending = make(map[string]struct{})
+	if b, ok := p.Pipeline.(Buffered); ok {
+		p.buffered = b.Buffered()
+	}
+	if err := p.Store.Open(spider); err != nil {
+		p.Logger.Error(spider.Name, "Open key store fail, %s", err)
+		return err
+	}
+	return p.Pipeline.Open(spider)
+}
+
+func (p *ExactlyOncePipeline) Close(reason string, spider *leiogo.Spider) error {
+	err := p.Pipeline.Close(reason, spider)
+	if err != nil && len(p.pending) != 0 {
+		p.Logger.Error(spider.Name, "The keys of %d buffered items are not stored, they will be exported again", len(p.pending))
+	} else {
+		for key := range p.pending {
+			if addErr := p.Store.Add(key); addErr != nil {
+				p.Logger.Error(spider.Name, "Add key to store fail, %s", addErr)
+				break
+			}
+		}
+	}
+	if storeErr := p.Store.Close(reason, spider); storeErr != nil {
+		p.Logger.Error(spider.Name, "Close key store fail, %s", storeErr)
+	}
+	return err
+}
+
+func (p *ExactlyOncePipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	key := item.Key(p.KeyFields...)
+
+	p.mutex.Lock()
+	_, running := p.running[key]
+	_, pending := p.pending[key]
+	if running || pending || p.Store.Exists(key) {
+		p.mutex.Unlock()
+		return &DropItemError{Message: "Item already exported"}
+	}
+	p.running[key] = struct{}{}
+	p.mutex.Unlock()
+
+	err := p.Pipeline.Process(item, spider)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.running, key)
+	if err != nil {
+		return err
+	}
+	if p.buffered {
+		p.pending[key] = struct{}{}
+		return nil
+	}
+	return p.Store.Add(key)
+}
+
+func (p *ExactlyOncePipeline) HandleErr(err error, spider *leiogo.Spider) {
+	p.Pipeline.HandleErr(err, spider)
+}
@@ -0,0 +1,290 @@
+package middleware
+
+import (
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// ThumbSize is the box of a thumbnail, the thumbnails keep the aspect ratio of the images.
+// A zero Width or Height doesn't limit that side.
+type ThumbSize struct {
+	Width  int
+	Height int
+}
+
+// ImagesPipeline downloads the images of the items like the FilePipeline, from the imageurls of the items
+// instead of the fileurls. The other attributes, like filepath, baseurl and checksums, work the same.
+// The images narrower than MinWidth or lower than MinHeight are removed, and a JPEG thumbnail is saved
+// for each of the Thumbs, as thumbs/<name>/<file name>.jpg next to the image.
+//
+// An item is held until its images are saved or failed, then the images are attached to it as images,
+// in the order of the imageurls, each with its url, path, width, height and the paths of the thumbnails
+// by their names. The removed and the failed images are left out. The images are read from the local files,
+// so the pipeline doesn't work with the ObjectWriter.
+type ImagesPipeline struct {
+	FilePipeline
+
+	MinWidth  int
+	MinHeight int
+
+	Thumbs map[string]ThumbSize
+
+	// The JPEG quality of the thumbnails, from 1 to 100.
+	ThumbQuality int
+
+	release func(item *leiogo.Item, spider *leiogo.Spider)
+
+	// The held items waiting for the image requests by their urls, and the latest imagesDoneSize images
+	// which are done, the older ones are requested again, or read from their files if they're saved.
+	// A done image is nil if it's removed or failed.
+	waiting  map[string][]imageWaiter
+	done     map[string]leiogo.Dict
+	doneURLs []string
+	held     map[*heldImages]bool
+	mutex    sync.Mutex
+}
+
+// The number of the done images remembered by the ImagesPipeline.
+const imagesDoneSize = 10000
+
+type heldImages struct {
+	item   *leiogo.Item
+	images []leiogo.Dict
+	left   int
+}
+
+type imageWaiter struct {
+	held  *heldImages
+	index int
+}
+
+func (p *ImagesPipeline) SetRelease(release func(item *leiogo.Item, spider *leiogo.Spider)) {
+	p.release = release
+}
+
+func (p *ImagesPipeline) Open(spider *leiogo.Spider) error {
+	if isRemote(p.FileWriter) {
+		p.Logger.Error(spider.Name, "Images can't be read from the object store, no image will be attached")
+	}
+	p.waiting = make(map[string][]imageWaiter)
+	p.done = make(map[string]leiogo.Dict)
+	p.doneURLs = nil
+	p.held = make(map[*heldImages]bool)
+	return p.FilePipeline.Open(spider)
+}
+
+func (p *ImagesPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	urls, ok := item.Data["imageurls"].([]string)
+	if !ok {
+		return nil
+	}
+	files := p.saveFiles(urls, item, spider)
+
+	// Process itself counts as one left, so the item isn't released by the others before the local images are done.
+	held := &heldImages{item: item, images: make([]leiogo.Dict, len(files)), left: 1}
+	var local []int
+	var requests []*leiogo.Request
+
+	p.mutex.Lock()
+	for i, f := range files {
+		if f.Request == nil {
+			local = append(local, i)
+			held.left++
+		} else if info, ok := p.done[f.URL]; ok {
+			held.images[i] = info
+		} else {
+			// The same image of many items is requested once.
+			if len(p.waiting[f.URL]) == 0 {
+				requests = append(requests, f.Request)
+			}
+			p.waiting[f.URL] = append(p.waiting[f.URL], imageWaiter{held: held, index: i})
+			held.left++
+		}
+	}
+	p.held[held] = true
+	p.mutex.Unlock()
+
+	for _, req := range requests {
+		p.requestFile(req, spider)
+	}
+	for _, i := range local {
+		p.finish(held, i, p.image(files[i].URL, files[i].Path, spider))
+	}
+
+	if p.finish(held, -1, nil) {
+		held.attach()
+		return nil
+	}
+	return &HoldItemError{Message: "Waiting for the images"}
+}
+
+// Set the i-th image of the held item, and return true if it's the last one, then the item should be released.
+func (p *ImagesPipeline) finish(held *heldImages, i int, info leiogo.Dict) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// The item has been released by Flush.
+	if held.left <= 0 {
+		return false
+	}
+	if i >= 0 {
+		held.images[i] = info
+	}
+	held.left--
+	if held.left > 0 {
+		return false
+	}
+	delete(p.held, held)
+	return true
+}
+
+func (held *heldImages) attach() {
+	images := make([]leiogo.Dict, 0, len(held.images))
+	for _, info := range held.images {
+		if info != nil {
+			images = append(images, info)
+		}
+	}
+	held.item.Data["images"] = images
+}
+
+func (p *ImagesPipeline) FileDone(req *leiogo.Request, err error, spider *leiogo.Spider) {
+	p.mutex.Lock()
+	_, ok := p.waiting[req.URL]
+	p.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	// A request dropped by the dupe filter was downloaded before, like by a previous run,
+	// so the image is read from its file if it's still there.
+	var info leiogo.Dict
+	filepath, _ := req.Meta["__filepath__"].(string)
+	if drop, ok := err.(*DropTaskError); ok && drop.Message == "URL already parsed" && filepath != "" && !p.NotExists(filepath) {
+		info = p.image(req.URL, filepath, spider)
+	} else if err != nil {
+		p.Logger.Debug(req.LogContext(spider), "Image %s failed, %s", req.URL, err)
+	} else if filepath != "" {
+		info = p.image(req.URL, filepath, spider)
+	}
+
+	p.mutex.Lock()
+	waiters := p.waiting[req.URL]
+	delete(p.waiting, req.URL)
+	if _, ok := p.done[req.URL]; !ok {
+		p.doneURLs = append(p.doneURLs, req.URL)
+		if len(p.doneURLs) > imagesDoneSize {
+			delete(p.done, p.doneURLs[0])
+			p.doneURLs = p.doneURLs[1:]
+		}
+	}
+	p.done[req.URL] = info
+	p.mutex.Unlock()
+
+	for _, w := range waiters {
+		if p.finish(w.held, w.index, info) {
+			w.held.attach()
+			p.release(w.held.item, spider)
+		}
+	}
+}
+
+// Release the items still waiting for their images, like the ones whose requests are never done
+// because the spider is interrupted.
+func (p *ImagesPipeline) Flush(spider *leiogo.Spider) {
+	p.mutex.Lock()
+	held := p.held
+	p.held = make(map[*heldImages]bool)
+	p.waiting = make(map[string][]imageWaiter)
+	for h := range held {
+		h.left = 0
+	}
+	p.mutex.Unlock()
+
+	for h := range held {
+		h.attach()
+		p.Logger.Debug(h.item.LogContext(spider), "Release item %s with the images done", h.item.String())
+		p.release(h.item, spider)
+	}
+}
+
+// Check the size of the saved image, and save its thumbnails. It returns nil if the image is removed or broken.
+func (p *ImagesPipeline) image(url string, filepath string, spider *leiogo.Spider) leiogo.Dict {
+	file, err := os.Open(filepath)
+	if err != nil {
+		p.Logger.Error(spider.Name, "Open image %s fail, %s", filepath, err)
+		return nil
+	}
+	defer file.Close()
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		p.Logger.Error(spider.Name, "Decode image %s fail, %s", filepath, err)
+		return nil
+	}
+	if config.Width < p.MinWidth || config.Height < p.MinHeight {
+		p.Logger.Debug(spider.Name, "Remove image %s, %dx%d is smaller than %dx%d",
+			filepath, config.Width, config.Height, p.MinWidth, p.MinHeight)
+		if err := os.Remove(filepath); err != nil {
+			p.Logger.Error(spider.Name, "Remove image %s fail, %s", filepath, err)
+		}
+		return nil
+	}
+
+	info := leiogo.Dict{"url": url, "path": filepath, "width": config.Width, "height": config.Height}
+	if len(p.Thumbs) == 0 {
+		return info
+	}
+
+	// The image is decoded only if some thumbnails don't exist.
+	var img image.Image
+	thumbs := make(leiogo.Dict)
+	name := strings.TrimSuffix(path.Base(filepath), path.Ext(filepath)) + ".jpg"
+	for thumb, size := range p.Thumbs {
+		thumbpath := path.Join(path.Dir(filepath), "thumbs", thumb, name)
+		if _, err := os.Stat(thumbpath); err == nil {
+			thumbs[thumb] = thumbpath
+			continue
+		}
+		if img == nil {
+			if _, err = file.Seek(0, 0); err == nil {
+				img, _, err = image.Decode(file)
+			}
+			if err != nil {
+				p.Logger.Error(spider.Name, "Decode image %s fail, %s", filepath, err)
+				break
+			}
+		}
+		if err := p.saveThumb(util.Thumbnail(img, size.Width, size.Height), thumbpath); err != nil {
+			p.Logger.Error(spider.Name, "Save thumbnail %s fail, %s", thumbpath, err)
+			continue
+		}
+		thumbs[thumb] = thumbpath
+	}
+	info["thumbs"] = thumbs
+	return info
+}
+
+func (p *ImagesPipeline) saveThumb(img image.Image, thumbpath string) error {
+	if err := os.MkdirAll(path.Dir(thumbpath), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.Create(thumbpath)
+	if err != nil {
+		return err
+	}
+	if err = jpeg.Encode(file, util.Flatten(img), &jpeg.Options{Quality: p.ThumbQuality}); err != nil {
+		file.Close()
+		os.Remove(thumbpath)
+		return err
+	}
+	return file.Close()
+}
@@ -1,9 +1,16 @@
 package middleware
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"strings"
+	"sync"
 
 	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo/util"
@@ -25,6 +32,16 @@ func (err *DropItemError) Error() string {
 	return err.Message
 }
 
+// Return this type of error when the pipeline holds the item for a while, like the ImagesPipeline
+// waiting for the downloads of the images. The pipeline passes the item on by itself, see ItemHolder.
+type HoldItemError struct {
+	Message string
+}
+
+func (err *HoldItemError) Error() string {
+	return err.Message
+}
+
 // FilePipeline is simple pipeline to download static files, usually images.
 // Since it is divided into two part, a pipeline and spider middleware,
 // so we have to add these two parts to the crawler to make it available,
@@ -37,6 +54,11 @@ type FilePipeline struct {
 	// And there's no need to create the directory first, the pipeline will create the path if needed.
 	DirPath string
 
+	// With ContentNames, the files are named by the SHA-256 of their contents instead of the hashes
+	// of their urls, so the same file from many urls is saved once. The names are unknown before the downloads,
+	// so the files are always downloaded. It needs a FileWriter supporting it, like the FSWriter.
+	ContentNames bool
+
 	Yielder
 
 	// See the definition of this interface in downloader.go .
@@ -51,12 +73,54 @@ func (p *FilePipeline) Open(spider *leiogo.Spider) error {
 // Because file pipeline is an item pipeline, so we can just yield a special item with the target file information.
 // Add fileurls (required) and filepath (optional) to the items, and the pipeline will catch such items,
 // create new download requests for those urls.
+// The images of the modern pages are often in the srcset attributes, add them to srcsets,
+// and the largest candidate of each srcset is downloaded. If the urls are relative, add baseurl to the item.
+// The data: URIs hold the files themselves, so they are written directly without any request.
+// The expected SHA-256 of the files can be added to checksums in the order of the fileurls,
+// the downloads which don't match are removed and retried.
 func (p *FilePipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
-	// We have to first make sure that the item has fileurls attribute,
+	// We have to first make sure that the item has fileurls or srcsets attribute,
 	// only such type of item will be treated as a file download item.
-	if _, ok := item.Data["fileurls"]; !ok {
+	fileurls, hasURLs := item.Data["fileurls"].([]string)
+	srcsets, hasSrcsets := item.Data["srcsets"].([]string)
+	if !hasURLs && !hasSrcsets {
 		return nil
 	}
+	urls := append([]string{}, fileurls...)
+	for _, srcset := range srcsets {
+		if u := util.LargestSrcset(srcset); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	for _, f := range p.saveFiles(urls, item, spider) {
+		if f.Request != nil {
+			p.requestFile(f.Request, spider)
+		}
+	}
+	return nil
+}
+
+// itemFile is a file of an item.
+type itemFile struct {
+	URL  string
+	Path string
+
+	// The request to download the file, it's nil if the file exists, or it's written from a data URI.
+	Request *leiogo.Request
+}
+
+func (p *FilePipeline) requestFile(req *leiogo.Request, spider *leiogo.Spider) {
+	if err := p.NewRequest(req, nil, spider); err != nil {
+		p.Logger.Error(req.LogContext(spider), "Add file request error %s", err.Error())
+	}
+}
+
+// Save the files of the urls with the fileurls options of the item, and return the files. The data URIs are
+// written at once, and the requests of the files to download are returned for the caller to yield.
+func (p *FilePipeline) saveFiles(urls []string, item *leiogo.Item, spider *leiogo.Spider) []itemFile {
+	var files []itemFile
+	base, _ := item.Data["baseurl"].(string)
+	checksums, _ := item.Data["checksums"].([]string)
 
 	subpath := p.DirPath
 
@@ -69,31 +133,58 @@ func (p *FilePipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
 	}
 
 	// Create the sub directory, in the same time we will also create the parent directory if needed.
-	if err := os.MkdirAll(subpath, os.ModeDir); err != nil {
-		p.Logger.Error(spider.Name, "Create directory failed, %s", err.Error())
+	// The files written to an object store don't need any local directory.
+	if !isRemote(p.FileWriter) {
+		if err := os.MkdirAll(subpath, os.ModeDir); err != nil {
+			p.Logger.Error(item.LogContext(spider), "Create directory failed, %s", err.Error())
+		}
 	}
 
-	// Traverse all the urls in the fileurls.
-	for i, url := range item.Data["fileurls"].([]string) {
+	// Traverse all the urls in the fileurls, and the ones from the srcsets.
+	for i, url := range urls {
+		var data []byte
+		var mediaType string
+		if util.IsDataURI(url) {
+			var err error
+			if mediaType, data, err = util.ParseDataURI(url); err != nil {
+				p.Logger.Error(item.LogContext(spider), "Decode data URI failed, %s", err.Error())
+				continue
+			}
+		} else if base != "" {
+			if u, err := util.JoinURL(base, url); err == nil {
+				url = u
+			}
+		}
 
 		// First to get the extension of the file to keep the filetype.
 		// We offer two ways:
-		// the first is using the extension in the url string, usually the last few words.
+		// the first is using the extension in the url string, usually the last few words,
+		// or the media type of a data URI.
 		// the second way is to add exts attribute to the item.
 		var ext string
-		if exts, ok := item.Data["exts"].([]string); !ok {
-			ext = url[strings.LastIndex(url, "."):]
-		} else {
+		if exts, ok := item.Data["exts"].([]string); ok && i < len(exts) {
 			ext = exts[i]
+		} else if data != nil {
+			ext = util.DataURIExt(mediaType)
+		} else if dot := strings.LastIndex(url, "."); dot >= 0 {
+			ext = url[dot:]
 		}
 
 		// We won't use the original file name, instead we create a hashed name from its url.
-		// We are using MD5 here.
-		filepath := path.Join(subpath, util.MD5Hash(url)+ext)
+		// The hash function is util.DefaultHasher, which is MD5 by default.
+		filepath := path.Join(subpath, util.Hash(url)+ext)
 
 		// Somtimes we will run the spider for several times, and there's no need to download
 		// the files which are already exists, therefore we will first check the existance of the file.
-		if p.NotExists(filepath) {
+		if !p.ContentNames && !p.NotExists(filepath) {
+			files = append(files, itemFile{URL: url, Path: filepath})
+		} else {
+			if data != nil {
+				if filepath, ok := p.writeData(data, mediaType, url, filepath, spider); ok {
+					files = append(files, itemFile{URL: url, Path: filepath})
+				}
+				continue
+			}
 
 			// We might directely download the file here, but that's not a good idea.
 			// We still want to take advantage of our previous work, like delay, offsite,
@@ -103,13 +194,54 @@ func (p *FilePipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
 			fileRequest := leiogo.NewRequest(url)
 			fileRequest.Meta["__type__"] = "file"
 			fileRequest.Meta["__filepath__"] = filepath
-
-			if err := p.NewRequest(fileRequest, nil, spider); err != nil {
-				p.Logger.Error(spider.Name, "Add file request error %s", err.Error())
+			if p.ContentNames {
+				fileRequest.Meta["__contentname__"] = true
+			}
+			if i < len(checksums) && checksums[i] != "" {
+				fileRequest.Meta["sha256"] = checksums[i]
 			}
+
+			files = append(files, itemFile{URL: url, Path: filepath, Request: fileRequest})
 		}
 	}
-	return nil
+	return files
+}
+
+// Write the content of a data URI with the FileWriter, as if it were downloaded.
+// They are not counted in the Files of the crawler, since they are never requested.
+// It returns the path of the saved file, which is renamed with ContentNames.
+func (p *FilePipeline) writeData(data []byte, mediaType string, url string, filepath string, spider *leiogo.Spider) (string, bool) {
+	saved, info, err := writeFileData(p.FileWriter, data, mediaType, url, filepath)
+	if err != nil {
+		p.Logger.Error(spider.Name, "Save data URI to %s failed, %s", filepath, err.Error())
+		return "", false
+	}
+	p.Logger.Debug(spider.Name, "Saved data URI to %s, %s", filepath, info)
+	return saved, true
+}
+
+// Write the data of the url with the writer as if it were downloaded, and return the path of the saved file
+// and the info of the writer.
+func writeFileData(w FileWriter, data []byte, mediaType string, url string, filepath string) (string, string, error) {
+	req := leiogo.NewRequest(url)
+	req.Meta["__type__"] = "file"
+	req.Meta["__filepath__"] = filepath
+
+	res := &http.Response{
+		StatusCode:    200,
+		Header:        http.Header{"Content-Type": []string{mediaType}},
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: int64(len(data)),
+	}
+	info, err := w.WriteFile(req, res)
+	// The writers return a DropTaskError when the file is saved, see FSWriter.
+	if _, ok := err.(*DropTaskError); ok || err == nil {
+		if saved, ok := req.Meta["__filepath__"].(string); ok {
+			filepath = saved
+		}
+		return filepath, info, nil
+	}
+	return "", info, err
 }
 
 // JSON pipeline will write all the items into a file.
@@ -126,7 +258,7 @@ type JSONPipeline struct {
 
 func (j *JSONPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
 	if j.FileName == "" {
-		j.Logger.Info(spider.Name, item.String())
+		j.Logger.Info(item.LogContext(spider), item.String())
 		return nil
 	} else {
 		_, err := j.file.WriteString(item.String() + "\n")
@@ -160,3 +292,121 @@ func (j *JSONPipeline) Close(reason string, spider *leiogo.Spider) error {
 	}
 	return err
 }
+
+// CSV pipeline writes the items into a csv file, one item per row.
+type CSVPipeline struct {
+	Base
+
+	FileName string
+
+	// Columns defines the fields to write and their order. If it's empty, the sorted keys of the first item
+	// will be used, so the fields which the first item doesn't have are never written. A field out of
+	// the columns is warned once when it's dropped, set the Columns to keep it.
+	Columns []string
+
+	// Whether to write the column names as the first row.
+	Header bool
+
+	// The field delimiter, the default value is ','.
+	Delimiter rune
+
+	// Nested items are flattened with this separator, like "offers.0.price".
+	// See Item.Flatten. The default value is '.'.
+	Separator string
+
+	file    *os.File
+	writer  *csv.Writer
+	columns map[string]bool
+	dropped map[string]bool
+	mutex   sync.Mutex
+}
+
+func (c *CSVPipeline) Open(spider *leiogo.Spider) error {
+	var err error
+	if c.file, err = os.Create(c.FileName); err != nil {
+		c.Logger.Error(spider.Name, "Create file %s fail, %s", c.FileName, err)
+		return err
+	}
+	c.Logger.Info(spider.Name, "Create file %s", c.FileName)
+
+	c.writer = csv.NewWriter(c.file)
+	c.dropped = make(map[string]bool)
+	if len(c.Columns) != 0 {
+		c.setColumns(c.Columns)
+	}
+	if c.Delimiter != 0 {
+		c.writer.Comma = c.Delimiter
+	}
+	if c.Header && len(c.Columns) != 0 {
+		err = c.writer.Write(c.Columns)
+	}
+	return err
+}
+
+func (c *CSVPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	sep := c.Separator
+	if sep == "" {
+		sep = "."
+	}
+	data := item.Flatten(sep)
+
+	if len(c.Columns) == 0 {
+		c.setColumns(sortedKeys(data))
+		if c.Header {
+			if err := c.writer.Write(c.Columns); err != nil {
+				return err
+			}
+		}
+	}
+
+	for key := range data {
+		if !c.columns[key] && !c.dropped[key] {
+			c.dropped[key] = true
+			c.Logger.Error(item.LogContext(spider), "Field %s is not in the columns, it's dropped from the rows", key)
+		}
+	}
+
+	row := make([]string, len(c.Columns))
+	for i, col := range c.Columns {
+		row[i] = csvValue(data[col])
+	}
+	return c.writer.Write(row)
+}
+
+func (c *CSVPipeline) setColumns(columns []string) {
+	c.Columns = columns
+	c.columns = make(map[string]bool, len(columns))
+	for _, col := range columns {
+		c.columns[col] = true
+	}
+}
+
+// Strings and numbers are written as they are, and the other values are written in JSON.
+func csvValue(val interface{}) string {
+	switch x := val.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case int, int64, float64, bool:
+		return fmt.Sprintf("%v", x)
+	default:
+		data, _ := json.Marshal(x)
+		return string(data)
+	}
+}
+
+func (c *CSVPipeline) Close(reason string, spider *leiogo.Spider) error {
+	c.writer.Flush()
+	err := c.writer.Error()
+	if closeErr := c.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		c.Logger.Error(spider.Name, "Close file %s fail, %s", c.FileName, err)
+	}
+	return err
+}
@@ -0,0 +1,168 @@
+package middleware
+
+import (
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// NewPartItem creates a part of a logical item, which will be merged by the JoinPipeline.
+// The parts of the same item share the join key, and each part has a distinct name.
+// Usually, the listing parser creates the key, and passes it to the detail requests in their meta,
+// so the detail parsers are able to create their parts with the same key.
+func NewPartItem(key string, part string, data leiogo.Dict) *leiogo.Item {
+	data["__join__"] = key
+	data["__part__"] = part
+	return leiogo.NewItem(data)
+}
+
+// JoinPipeline accumulates the parts of a logical item across multiple requests
+// (like a listing page, a detail page and a reviews endpoint), and yields the merged item
+// when all the parts have arrived. The parts themselves are dropped, and so are the parts
+// without a name, or with a name not in the Parts, since they can't complete an item.
+// If some parts never arrive, for example the request failed, the item is yielded with
+// the arrived parts after Timeout, or when the crawl completes.
+// Put this pipeline first, so the following pipelines only see the merged items.
+type JoinPipeline struct {
+	Base
+
+	// The names of all the parts of an item.
+	Parts []string
+
+	Timeout time.Duration
+
+	Yielder
+
+	entries map[string]*joinEntry
+	mutex   sync.Mutex
+	closed  chan bool
+}
+
+type joinEntry struct {
+	data    leiogo.Dict
+	parts   map[string]struct{}
+	created time.Time
+}
+
+func (p *JoinPipeline) Open(spider *leiogo.Spider) error {
+	p.entries = make(map[string]*joinEntry)
+	p.closed = make(chan bool)
+
+	if p.Timeout > 0 {
+		ticker := time.NewTicker(time.Second)
+		go func() {
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.expire(spider)
+				case <-p.closed:
+					return
+				}
+			}
+		}()
+	}
+	p.Logger.Debug(spider.Name, "Init success with parts: %v", p.Parts)
+	return nil
+}
+
+func (p *JoinPipeline) Close(reason string, spider *leiogo.Spider) error {
+	close(p.closed)
+	return nil
+}
+
+func (p *JoinPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	key, ok := item.Data["__join__"].(string)
+	if !ok {
+		return nil
+	}
+	part, _ := item.Data["__part__"].(string)
+	if !p.isPart(part) {
+		return &DropItemError{Message: "Unknown part \"" + part + "\" of item " + key}
+	}
+
+	p.mutex.Lock()
+	e, ok := p.entries[key]
+	if !ok {
+		e = &joinEntry{data: make(leiogo.Dict), parts: make(map[string]struct{}), created: time.Now()}
+		p.entries[key] = e
+	}
+	for k, v := range item.Data {
+		if k != "__join__" && k != "__part__" {
+			e.data[k] = v
+		}
+	}
+	e.parts[part] = struct{}{}
+
+	complete := len(p.missing(e)) == 0
+	if complete {
+		delete(p.entries, key)
+	}
+	p.mutex.Unlock()
+
+	if complete {
+		p.yield(key, e, spider)
+	}
+	return &DropItemError{Message: "Part " + part + " joined"}
+}
+
+// Yield the items waiting longer than the timeout.
+func (p *JoinPipeline) expire(spider *leiogo.Spider) {
+	expired := make(map[string]*joinEntry)
+
+	p.mutex.Lock()
+	for key, e := range p.entries {
+		if time.Since(e.created) > p.Timeout {
+			expired[key] = e
+			delete(p.entries, key)
+		}
+	}
+	p.mutex.Unlock()
+
+	for key, e := range expired {
+		p.yield(key, e, spider)
+	}
+}
+
+// Yield all the incomplete items when the crawl completes.
+func (p *JoinPipeline) Flush(spider *leiogo.Spider) {
+	p.mutex.Lock()
+	entries := p.entries
+	p.entries = make(map[string]*joinEntry)
+	p.mutex.Unlock()
+
+	for key, e := range entries {
+		p.yield(key, e, spider)
+	}
+}
+
+func (p *JoinPipeline) isPart(part string) bool {
+	for _, name := range p.Parts {
+		if name == part {
+			return part != ""
+		}
+	}
+	return false
+}
+
+// The names of the parts which haven't arrived.
+func (p *JoinPipeline) missing(e *joinEntry) []string {
+	var missing []string
+	for _, part := range p.Parts {
+		if _, ok := e.parts[part]; !ok {
+			missing = append(missing, part)
+		}
+	}
+	return missing
+}
+
+func (p *JoinPipeline) yield(key string, e *joinEntry, spider *leiogo.Spider) {
+	if missing := p.missing(e); len(missing) != 0 {
+		p.Logger.Info(spider.Name, "Item %s is incomplete, missing parts: %v", key, missing)
+	}
+
+	if err := p.NewItem(leiogo.NewItem(e.data), spider); err != nil {
+		p.Logger.Error(spider.Name, "Add joined item error, %s", err.Error())
+	}
+}
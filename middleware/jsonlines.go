@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// JSONLinesPipeline appends the items to a JSON Lines file, one item per line,
+// so the items are streamed to the disk instead of being buffered.
+// The file can be compressed with gzip, and rotated when it's larger than MaxSize.
+type JSONLinesPipeline struct {
+	Base
+
+	// The file to write the items. When the file is rotated, a sequence number is added before
+	// the extension, like items-0001.jsonl, items-0002.jsonl. When Gzip is true, ".gz" is appended.
+	FileName string
+
+	Gzip bool
+
+	// The max size in bytes of a file, 0 means no rotation. For gzip files, the size is
+	// the compressed size written to the disk, which is a little behind since gzip buffers the data.
+	MaxSize int64
+
+	seq    int
+	file   *os.File
+	gz     *gzip.Writer
+	writer io.Writer
+	size   int64
+	mutex  sync.Mutex
+}
+
+func (j *JSONLinesPipeline) Open(spider *leiogo.Spider) error {
+	return j.open(spider)
+}
+
+func (j *JSONLinesPipeline) filename() string {
+	name := j.FileName
+	if j.MaxSize > 0 {
+		ext := filepath.Ext(name)
+		name = fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(name, ext), j.seq, ext)
+	}
+	if j.Gzip {
+		name += ".gz"
+	}
+	return name
+}
+
+func (j *JSONLinesPipeline) open(spider *leiogo.Spider) error {
+	j.seq++
+	j.size = 0
+
+	name := j.filename()
+	var err error
+	if j.file, err = os.Create(name); err != nil {
+		j.Logger.Error(spider.Name, "Create file %s fail, %s", name, err)
+		return err
+	}
+	j.Logger.Info(spider.Name, "Create file %s", name)
+
+	j.writer = &countWriter{Writer: j.file, count: &j.size}
+	if j.Gzip {
+		j.gz = gzip.NewWriter(j.writer)
+		j.writer = j.gz
+	}
+	return nil
+}
+
+func (j *JSONLinesPipeline) close() error {
+	if j.gz != nil {
+		if err := j.gz.Close(); err != nil {
+			j.file.Close()
+			return err
+		}
+	}
+	return j.file.Close()
+}
+
+func (j *JSONLinesPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.MaxSize > 0 && j.size >= j.MaxSize {
+		if err := j.close(); err != nil {
+			return err
+		}
+		if err := j.open(spider); err != nil {
+			return err
+		}
+	}
+
+	_, err := io.WriteString(j.writer, item.String()+"\n")
+	return err
+}
+
+func (j *JSONLinesPipeline) Close(reason string, spider *leiogo.Spider) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	err := j.close()
+	if err != nil {
+		j.Logger.Error(spider.Name, "Close file %s fail, %s", j.filename(), err)
+	}
+	return err
+}
+
+// countWriter counts the bytes written to the underlying writer.
+type countWriter struct {
+	io.Writer
+	count *int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	*w.count += int64(n)
+	return n, err
+}
@@ -0,0 +1,102 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/segmentio/kafka-go"
+)
+
+// KafkaPipeline publishes the items as JSON messages to a Kafka topic.
+// A single producer is shared by the whole crawl. The messages are buffered and written in batches,
+// the buffer is flushed when it's full and when the spider closes.
+type KafkaPipeline struct {
+	Base
+
+	Brokers []string
+	Topic   string
+
+	// The value of KeyField in the item is used as the message key, so the items with the same key
+	// always go to the same partition. The items without the field are keyed by their idempotency keys,
+	// see Item.Key, so every message of a keyed topic has a key. If KeyField is empty, the messages
+	// are balanced among the partitions.
+	KeyField string
+
+	// The number of messages in a batch, the default value is 1.
+	BatchSize int
+
+	writer   *kafka.Writer
+	messages []kafka.Message
+	mutex    sync.Mutex
+}
+
+func (p *KafkaPipeline) Open(spider *leiogo.Spider) error {
+	p.writer = &kafka.Writer{
+		Addr:      kafka.TCP(p.Brokers...),
+		Topic:     p.Topic,
+		Balancer:  &kafka.Hash{},
+		BatchSize: p.BatchSize,
+		// The messages are already batched here, but the writer splits them by partitions and waits
+		// BatchTimeout for each partial batch to fill, with the mutex held.
+		BatchTimeout: 10 * time.Millisecond,
+	}
+	p.Logger.Info(spider.Name, "Publishing items to %s on %v", p.Topic, p.Brokers)
+	return nil
+}
+
+func (p *KafkaPipeline) Close(reason string, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	err := p.flush()
+	if err != nil {
+		p.Logger.Error(spider.Name, "Flush %d items fail, %s", len(p.messages), err)
+	}
+	if closeErr := p.writer.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (p *KafkaPipeline) Buffered() bool {
+	return true
+}
+
+func (p *KafkaPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	value, err := item.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	msg := kafka.Message{Value: value}
+	if p.KeyField != "" {
+		if key, ok := item.Data[p.KeyField]; ok && key != nil {
+			msg.Key = []byte(fmt.Sprint(key))
+		} else {
+			p.Logger.Debug(item.LogContext(spider), "No %s in the item, key it by the whole item", p.KeyField)
+			msg.Key = []byte(item.Key())
+		}
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.messages = append(p.messages, msg)
+	if len(p.messages) >= p.BatchSize {
+		return p.flush()
+	}
+	return nil
+}
+
+func (p *KafkaPipeline) flush() error {
+	if len(p.messages) == 0 {
+		return nil
+	}
+	if err := p.writer.WriteMessages(context.Background(), p.messages...); err != nil {
+		return err
+	}
+	p.messages = p.messages[:0]
+	return nil
+}
@@ -0,0 +1,353 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+	"golang.org/x/net/html"
+)
+
+// FormLogin is a download middleware, it logs in with a form when the spider opens, and the session cookies
+// are stored in the Jar, which is shared with the downloader, so the pages are crawled in the session.
+// It fetches the LoginURL, finds the login form (the first form with a password input),
+// and posts all its inputs, including the hidden CSRF token, with the Fields filled in.
+// The session can be saved to the SessionFile, with the domains, the paths and the expiry times of the cookies,
+// then the next run reuses it instead of logging in again, unless it has expired. Delete the file to log in again.
+//
+// It logs in again when a cookie of the session expires, and when a response looks like the session is lost,
+// a 401 or a redirect to the login page, then the request is tried again once in the new session.
+type FormLogin struct {
+	BaseMiddleware
+
+	LoginURL string
+	Fields   map[string]string
+
+	// The login fails if the response contains FailureMarker, like "Invalid password".
+	FailureMarker string
+
+	Jar         http.CookieJar
+	UserAgent   string
+	Timeout     time.Duration
+	SessionFile string
+
+	Yielder
+
+	// The time of the last login, and the earliest expiry time of the session cookies, zero if they never expire.
+	loggedIn time.Time
+	expires  time.Time
+	mutex    sync.Mutex
+}
+
+func (l *FormLogin) Open(spider *leiogo.Spider) error {
+	if _, err := url.Parse(l.LoginURL); err != nil {
+		return l.fail(spider, err)
+	}
+
+	if l.SessionFile != "" {
+		var cookies []*savedCookie
+		if err := util.LoadGob(l.SessionFile, &cookies); err != nil {
+			l.Logger.Error(spider.Name, "Load session from %s failed, %s", l.SessionFile, err.Error())
+		} else if l.restore(cookies) {
+			l.Logger.Info(spider.Name, "Reuse the session in %s", l.SessionFile)
+			return nil
+		} else if len(cookies) != 0 {
+			l.Logger.Info(spider.Name, "The session in %s has expired, log in again", l.SessionFile)
+		}
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.login(spider)
+}
+
+// Set the saved cookies to the Jar, it returns false if there's no cookie, or any of them has expired.
+func (l *FormLogin) restore(cookies []*savedCookie) bool {
+	now := time.Now()
+	if len(cookies) == 0 {
+		return false
+	}
+	for _, c := range cookies {
+		if cookieExpired(c.Cookie, now) {
+			return false
+		}
+	}
+	for _, c := range cookies {
+		if u, err := url.Parse(c.URL); err == nil {
+			l.Jar.SetCookies(u, []*http.Cookie{c.Cookie})
+		}
+	}
+	l.loggedIn, l.expires = now, sessionExpires(cookies)
+	return true
+}
+
+// Log in again if the session has expired, the requests sent after that are in the new session.
+func (l *FormLogin) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	l.mutex.Lock()
+	expired := !l.expires.IsZero() && time.Now().After(l.expires)
+	l.mutex.Unlock()
+	if expired {
+		l.Logger.Info(spider.Name, "The session has expired, log in again")
+		if err := l.refresh(time.Now(), spider); err != nil {
+			// The failure is logged, and it's not tried again by every request,
+			// the lost session is still caught by the responses.
+			l.mutex.Lock()
+			l.expires = time.Time{}
+			l.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// A response of the lost session logs in again, and the request is tried again once.
+func (l *FormLogin) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if !l.unauthorized(res, req) {
+		return nil
+	}
+	relogins, _ := req.Meta["__relogins__"].(int)
+	if relogins >= 1 {
+		return &DropTaskError{Message: "Still unauthorized after logging in again"}
+	}
+
+	l.Logger.Info(req.LogContext(spider), "The session seems lost at %s, log in again", req.URL)
+	if err := l.refresh(time.Now().Add(-res.Latency), spider); err != nil {
+		return err
+	}
+	next := &leiogo.Request{
+		URL:         req.URL,
+		Meta:        req.Meta.Copy(),
+		ParserName:  req.ParserName,
+		Callback:    req.Callback,
+		Priority:    req.Priority,
+		ErrbackName: req.ErrbackName,
+	}
+	next.Meta["__relogins__"] = relogins + 1
+	next.Meta["dontfilter"] = true
+	if err := l.NewRequest(next, nil, spider); err != nil {
+		l.Logger.Error(req.LogContext(spider), "Add relogin request error, %s", err.Error())
+	}
+	return &DropTaskError{Message: "Logged in again", Rescheduled: true}
+}
+
+// The session is lost if the response is a 401, or it's redirected to the login page.
+func (l *FormLogin) unauthorized(res *leiogo.Response, req *leiogo.Request) bool {
+	if res.Err != nil || sameLoginPage(req.URL, l.LoginURL) {
+		return false
+	}
+	return res.StatusCode == http.StatusUnauthorized || (len(res.Redirects) != 0 && sameLoginPage(res.FinalURL(), l.LoginURL))
+}
+
+func sameLoginPage(raw string, login string) bool {
+	u, err1 := url.Parse(raw)
+	l, err2 := url.Parse(login)
+	return err1 == nil && err2 == nil && u.Host == l.Host && u.Path == l.Path
+}
+
+// Log in again, unless another login has happened since the time, then the session is already new.
+func (l *FormLogin) refresh(since time.Time, spider *leiogo.Spider) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.loggedIn.After(since) {
+		return nil
+	}
+	return l.login(spider)
+}
+
+// Log in with the form, it's called with the mutex held, so there's one login at a time.
+func (l *FormLogin) login(spider *leiogo.Spider) error {
+	loginURL, err := url.Parse(l.LoginURL)
+	if err != nil {
+		return l.fail(spider, err)
+	}
+	jar := &sessionJar{CookieJar: l.Jar}
+	client := &http.Client{Jar: jar, Timeout: l.Timeout}
+	body, err := l.get(client, loginURL)
+	if err != nil {
+		return l.fail(spider, err)
+	}
+	action, values, err := findLoginForm(body, loginURL)
+	if err != nil {
+		return l.fail(spider, err)
+	}
+	for k, v := range l.Fields {
+		values.Set(k, v)
+	}
+
+	req, err := http.NewRequest("POST", action.String(), strings.NewReader(values.Encode()))
+	if err != nil {
+		return l.fail(spider, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", loginURL.String())
+	if l.UserAgent != "" {
+		req.Header.Set("User-Agent", l.UserAgent)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return l.fail(spider, err)
+	}
+	defer res.Body.Close()
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		return l.fail(spider, err)
+	}
+	if res.StatusCode >= 400 {
+		return l.fail(spider, fmt.Errorf("Login form responded %d", res.StatusCode))
+	}
+	if l.FailureMarker != "" && bytes.Contains(body, []byte(l.FailureMarker)) {
+		return l.fail(spider, fmt.Errorf("Found failure marker %q", l.FailureMarker))
+	}
+
+	l.Logger.Info(spider.Name, "Logged in at %s", action)
+	cookies := jar.session()
+	l.loggedIn, l.expires = time.Now(), sessionExpires(cookies)
+	if l.SessionFile != "" {
+		// The session cookies are the credentials of the account, only the owner may read them.
+		if err := util.SaveGobPerm(l.SessionFile, cookies, 0600); err != nil {
+			l.Logger.Error(spider.Name, "Save session to %s failed, %s", l.SessionFile, err.Error())
+		}
+	}
+	return nil
+}
+
+func (l *FormLogin) fail(spider *leiogo.Spider, err error) error {
+	l.Logger.Error(spider.Name, "Login at %s failed, %s", l.LoginURL, err.Error())
+	return err
+}
+
+// sessionJar passes the cookies to the Jar, and remembers the ones set during a login with their urls,
+// so the session is saved with the domains, the paths and the expiry times of the cookies.
+type sessionJar struct {
+	http.CookieJar
+	cookies map[string]*savedCookie
+	mutex   sync.Mutex
+}
+
+func (j *sessionJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.CookieJar.SetCookies(u, cookies)
+	now := time.Now()
+	j.mutex.Lock()
+	if j.cookies == nil {
+		j.cookies = make(map[string]*savedCookie)
+	}
+	for _, c := range cookies {
+		j.cookies[u.Host+"|"+c.Domain+"|"+c.Path+"|"+c.Name] = &savedCookie{URL: u.String(), Cookie: absoluteCookie(c, now)}
+	}
+	j.mutex.Unlock()
+}
+
+// The cookies of the session, the ones removed by the server are left out.
+func (j *sessionJar) session() []*savedCookie {
+	now := time.Now()
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	cookies := make([]*savedCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if !cookieExpired(c.Cookie, now) {
+			cookies = append(cookies, c)
+		}
+	}
+	return cookies
+}
+
+// The earliest expiry time of the cookies, zero if they are all session cookies.
+func sessionExpires(cookies []*savedCookie) time.Time {
+	var expires time.Time
+	for _, c := range cookies {
+		if !c.Cookie.Expires.IsZero() && (expires.IsZero() || c.Cookie.Expires.Before(expires)) {
+			expires = c.Cookie.Expires
+		}
+	}
+	return expires
+}
+
+func (l *FormLogin) get(client *http.Client, u *url.URL) ([]byte, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.UserAgent != "" {
+		req.Header.Set("User-Agent", l.UserAgent)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// Find the first form with a password input, and return its action and the values of its inputs.
+func findLoginForm(body []byte, base *url.URL) (*url.URL, url.Values, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var forms []*html.Node
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "form" {
+			forms = append(forms, n)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	for _, form := range forms {
+		values := url.Values{}
+		hasPassword := false
+		var inputs func(n *html.Node)
+		inputs = func(n *html.Node) {
+			if n.Type == html.ElementNode && n.Data == "input" {
+				name, typ := attr(n, "name"), strings.ToLower(attr(n, "type"))
+				if typ == "password" {
+					hasPassword = true
+				}
+				if name != "" && typ != "submit" && typ != "button" && typ != "image" &&
+					((typ != "checkbox" && typ != "radio") || hasAttr(n, "checked")) {
+					values.Set(name, attr(n, "value"))
+				}
+			}
+			for c := n.FirstChild; c != nil; c = c.NextSibling {
+				inputs(c)
+			}
+		}
+		inputs(form)
+
+		if hasPassword {
+			action, err := base.Parse(attr(form, "action"))
+			if err != nil {
+				return nil, nil, err
+			}
+			return action, values, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("No login form found")
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
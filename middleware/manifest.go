@@ -0,0 +1,195 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// ManifestEntry records a saved file, the checksum is the hex digest of the file by util.DefaultHasher.
+type ManifestEntry struct {
+	URL      string    `json:"url"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Checksum string    `json:"checksum"`
+	Time     time.Time `json:"time"`
+	RunID    string    `json:"run_id,omitempty"`
+}
+
+// Manifest is a JSON lines file of the saved files of a mirroring spider, an entry per line.
+// The entries are only appended, so a file downloaded again has several entries, and the last one is used.
+// With the manifest, Verify finds the files which are missing or corrupt on the disk.
+type Manifest struct {
+	Filename string
+
+	// The ID of the current run, it's added to the new entries.
+	RunID string
+
+	mutex sync.Mutex
+}
+
+var (
+	manifests     = make(map[string]*Manifest)
+	manifestMutex sync.Mutex
+)
+
+// OpenManifest returns the manifest of the file, the writers of the same file share a manifest,
+// so the entries are never interleaved.
+func OpenManifest(filename string) *Manifest {
+	manifestMutex.Lock()
+	defer manifestMutex.Unlock()
+	if m, ok := manifests[filename]; ok {
+		return m
+	}
+	m := &Manifest{Filename: filename}
+	manifests[filename] = m
+	return m
+}
+
+func (m *Manifest) Add(entry *ManifestEntry) error {
+	buf, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	file, err := os.OpenFile(m.Filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(buf, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Load the entries of the manifest in order, and keep the last entry of each path.
+func (m *Manifest) Load() ([]*ManifestEntry, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	file, err := os.Open(m.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []*ManifestEntry
+	index := make(map[string]int)
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			entry := &ManifestEntry{}
+			// A line broken by a crash is skipped, the file will be verified as missing.
+			if json.Unmarshal(line, entry) == nil {
+				if i, ok := index[entry.Path]; ok {
+					entries[i] = entry
+				} else {
+					index[entry.Path] = len(entries)
+					entries = append(entries, entry)
+				}
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return entries, err
+		}
+	}
+}
+
+// Verify re-checks the files on the disk, and returns the entries whose files are missing,
+// or don't match the size or the checksum.
+func (m *Manifest) Verify() ([]*ManifestEntry, error) {
+	entries, err := m.Load()
+	if err != nil {
+		return nil, err
+	}
+
+	var bad []*ManifestEntry
+	for _, entry := range entries {
+		if size, checksum, err := checksumFile(entry.Path); err != nil || size != entry.Size || checksum != entry.Checksum {
+			bad = append(bad, entry)
+		}
+	}
+	return bad, nil
+}
+
+func checksumFile(filepath string) (int64, string, error) {
+	file, err := os.Open(filepath)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	h := util.DefaultHasher()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return 0, "", err
+	}
+	return size, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ManifestWriter records the files saved by its FileWriter in the manifest.
+// The body is hashed while the FileWriter reads it, so the file isn't read twice.
+type ManifestWriter struct {
+	FileWriter
+	Manifest *Manifest
+}
+
+func NewManifestWriter(w FileWriter, filename string) *ManifestWriter {
+	return &ManifestWriter{FileWriter: w, Manifest: OpenManifest(filename)}
+}
+
+// The ManifestWriter saves the files by its FileWriter, so it's remote if the FileWriter is.
+func (w *ManifestWriter) Remote() bool {
+	return isRemote(w.FileWriter)
+}
+
+func (w *ManifestWriter) WriteFile(req *leiogo.Request, res *http.Response) (info string, writerErr error) {
+	h := util.DefaultHasher()
+	counter := &countingWriter{}
+	copied := *res
+	copied.Body = readCloser{io.TeeReader(res.Body, io.MultiWriter(h, counter)), res.Body}
+
+	info, writerErr = w.FileWriter.WriteFile(req, &copied)
+	// The writers drop the task when the file is saved.
+	if _, ok := writerErr.(*DropTaskError); ok || writerErr == nil {
+		err := w.Manifest.Add(&ManifestEntry{
+			URL:      req.URL,
+			Path:     req.Meta["__filepath__"].(string),
+			Size:     counter.n,
+			Checksum: hex.EncodeToString(h.Sum(nil)),
+			Time:     time.Now(),
+			RunID:    w.Manifest.RunID,
+		})
+		if err != nil {
+			info += ", but failed to add it to the manifest, " + err.Error()
+		}
+	}
+	return
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
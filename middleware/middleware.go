@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"time"
+
 	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo/log"
 )
@@ -28,6 +30,56 @@ type SpiderMiddleware interface {
 	HandleErr
 }
 
+// Components implementing Persistent are able to save their state to the job directory when
+// the spider closes, and load it back when the spider opens again, so a long crawl can be resumed.
+// See JobDir in crawler package for more information.
+type Persistent interface {
+	SaveState(dir string) error
+	LoadState(dir string) error
+}
+
+// Flusher is implemented by the pipelines which buffer the items and yield them later.
+// The crawler calls Flush after all the requests have completed, and before any component is closed,
+// so the flushed items will still be processed by all the pipelines. The pipelines are flushed in order,
+// and the crawler waits for the items released by a Flush before it flushes the next pipelines.
+type Flusher interface {
+	Flush(spider *leiogo.Spider)
+}
+
+// Buffered is implemented by the item pipelines which buffer the items and write them in batches,
+// like the SQL and the Mongo ones. Their Process returning nil only means the item is buffered,
+// it's written at the latest when the pipeline is closed, see ExactlyOncePipeline.
+type Buffered interface {
+	Buffered() bool
+}
+
+// ItemHolder is an item pipeline which may hold the items, see HoldItemError. The crawler sets the function
+// to pass a held item to the next pipelines before the spider opens. The held items have to be released,
+// at the latest when the pipeline is flushed, see Flusher.
+type ItemHolder interface {
+	SetRelease(release func(item *leiogo.Item, spider *leiogo.Spider))
+}
+
+// FileListener is an item pipeline told by the crawler when a file request is done,
+// err is nil if the file is saved, and the path of the saved file is the '__filepath__' in the meta.
+// A file request dropped by the dupe filter is told too, with its DropTaskError.
+type FileListener interface {
+	FileDone(req *leiogo.Request, err error, spider *leiogo.Spider)
+}
+
+// PageListener is a spider middleware told by the crawler when the parser of a page returns,
+// with the number of the items yielded from the page, the items with the trace ID of the page, see NewItem of the crawler.
+type PageListener interface {
+	PageParsed(res *leiogo.Response, req *leiogo.Request, items int, spider *leiogo.Spider)
+}
+
+// StealthComponent is a component with the features disguising the crawler, like rotating the user agents
+// or spoofing the browser fingerprints. The crawler refuses to start with any of the features
+// in the strict compliance profile, see ComplianceMiddleware.
+type StealthComponent interface {
+	StealthFeatures() []string
+}
+
 type Yielder interface {
 	NewRequest(req *leiogo.Request, parRes *leiogo.Response, spider *leiogo.Spider) error
 	NewItem(item *leiogo.Item, spider *leiogo.Spider) error
@@ -74,3 +126,25 @@ func NewBasePipeline(name string) Base {
 func NewBaseMiddleware(name string) BaseMiddleware {
 	return BaseMiddleware{Base: NewBasePipeline(name)}
 }
+
+// ResponseCache is implemented by the download middlewares which answer the requests from a cache.
+// The crawler asks them after the requests are processed by all the download middlewares,
+// and a non-nil response skips the downloader, but it still goes through the ProcessResponse methods.
+type ResponseCache interface {
+	CachedResponse(req *leiogo.Request, spider *leiogo.Spider) *leiogo.Response
+}
+
+// Deferrer is a download middleware which may put the requests off, like the retries waiting for their backoff.
+// The crawler asks it before a request takes the tokens, and if the returned time is after now, the request
+// goes back to the scheduler at that time, so the waiting requests never hold the tokens of the others.
+type Deferrer interface {
+	DeferUntil(req *leiogo.Request, spider *leiogo.Spider) time.Time
+}
+
+// ResponseConsumer gets the responses along with the parsers, like an archiver, a classifier or a search indexer.
+// The consumers run in their own goroutines, so they should never modify the response, which is shared
+// with the parser and other consumers. A consumer reading a stream gets a copy of the stream,
+// and it slows the parser down if it reads slower. See AddResponseConsumers in crawler package.
+type ResponseConsumer interface {
+	Consume(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error
+}
@@ -3,18 +3,26 @@ package middleware
 import (
 	"fmt"
 	"math/rand"
+	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
 )
 
 // When a middleware wants to drop the current task, return this type of error.
 // We are able to add drop details to the Message field.
 type DropTaskError struct {
 	Message string
+
+	// The request is dropped because it has been scheduled again, like a retry,
+	// so this is not the final failure of the request and the errback is not called.
+	Rescheduled bool
 }
 
 func (err *DropTaskError) Error() string {
@@ -23,42 +31,51 @@ func (err *DropTaskError) Error() string {
 
 // CacheMiddleware is a download middleware.
 // Using CacheMiddleware to store the crawled urls and avoid duplicated urls.
-// Cause each middleware will be called in different goroutines, so Locking is necessary.
+// The urls are compared by their fingerprints, so http://a.com/?b=1&a=2 and http://a.com?a=2&b=1#top
+// are the same url. See Request.Fingerprint.
+// The urls are stored in a DupeFilter, which is thread-safe, since each middleware
+// will be called in different goroutines. See dupefilter.go for the available filters.
 type CacheMiddleware struct {
 	BaseMiddleware
 
-	// We simply use a dictionary to store the requested urls,
-	// considering the memory usage, we make the value to be struct{},
-	// in golang it will use 0 space.
-	Cache map[string]struct{}
-
-	// We use a RWMutex here, instead of the Mutex struct.
-	mutex sync.RWMutex
+	DupeFilter DupeFilter
 }
 
-// First lock the mutex, then test whether the url has cached, if it is, then drop it.
-// Pay attention that because we only need to read from the cache, so we should call
-// RWMutex's RLock method.
+// Test whether the url has cached, if it is, then drop it.
+// Requests with 'dontfilter' = true in the meta will never be dropped, this is useful
+// when a middleware wants to request the same page again.
 func (m *CacheMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
-	m.mutex.RLock()
-	defer m.mutex.RUnlock()
+	if dontfilter, ok := req.Meta["dontfilter"].(bool); ok && dontfilter {
+		return nil
+	}
 
-	m.Logger.Debug(spider.Name, "Test whether %s is cached", req.URL)
-	if _, ok := m.Cache[req.URL]; ok {
+	m.Logger.Debug(req.LogContext(spider), "Test whether %s is cached", req.URL)
+	if m.DupeFilter.Seen(req.Fingerprint()) {
 		return &DropTaskError{Message: "URL already parsed"}
 	}
 	return nil
 }
 
-// First lock the mutex, then add the url into the cache,
-// pay attention that we need to call the RWMutex's Lock method,
-// because we have to write the cache.
+// Add the url into the cache after it has been downloaded.
 func (m *CacheMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
-	m.mutex.Lock()
-	defer m.mutex.Unlock()
+	m.Logger.Debug(req.LogContext(spider), "Add %s to cache", req.URL)
+	m.DupeFilter.Add(req.Fingerprint())
+	return nil
+}
+
+// Save the cached urls to the job directory, so the resumed crawl won't request them again.
+// This only works when the DupeFilter implements the Persistent interface.
+func (m *CacheMiddleware) SaveState(dir string) error {
+	if p, ok := m.DupeFilter.(Persistent); ok {
+		return p.SaveState(dir)
+	}
+	return nil
+}
 
-	m.Logger.Debug(spider.Name, "Add %s to cache", req.URL)
-	m.Cache[req.URL] = struct{}{}
+func (m *CacheMiddleware) LoadState(dir string) error {
+	if p, ok := m.DupeFilter.(Persistent); ok {
+		return p.LoadState(dir)
+	}
 	return nil
 }
 
@@ -74,14 +91,40 @@ type DelayMiddleware struct {
 
 	// Randomize the delay seconds, the default range is from 0.5 times to 1.5 times.
 	RandomizeDelay bool
+
+	// The random generator of the delays, a seeded one makes the delays reproducible.
+	// If Rand is nil, the global one is used.
+	Rand *rand.Rand
+
+	// The hosts may override the DownloadDelay, see HostSettings.
+	HostSettings HostSettings
+
+	mutex sync.Mutex
+}
+
+// Change the delay of a running crawler, for example, by the control API.
+func (m *DelayMiddleware) SetDownloadDelay(delay float64) {
+	m.mutex.Lock()
+	m.DownloadDelay = delay
+	m.mutex.Unlock()
+}
+
+func (m *DelayMiddleware) GetDownloadDelay() float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.DownloadDelay
 }
 
 func (m *DelayMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
-	delay := m.DownloadDelay
+	delay := m.HostSettings.Float(req.URL, "DownloadDelay", m.GetDownloadDelay())
 	if m.RandomizeDelay {
-		delay *= rand.Float64() + 0.5
+		if m.Rand != nil {
+			delay *= m.Rand.Float64() + 0.5
+		} else {
+			delay *= rand.Float64() + 0.5
+		}
 	}
-	m.Logger.Debug(spider.Name, "Delay request %s for %.3f", req.URL, delay)
+	m.Logger.Debug(req.LogContext(spider), "Delay request %s for %.3f", req.URL, delay)
 
 	// We simply use time.Sleep to make the goroutine to wait for the demanding seconds.
 	// Since each request is processed in a seperate goroutine, so don't worry it will block the main thread.
@@ -95,13 +138,132 @@ func (m *DelayMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spi
 type DepthMiddleware struct {
 	BaseMiddleware
 	DepthLimit int
+
+	// The priority of a new request will be adjusted by depth * DepthPriority.
+	// A negative value makes the crawler prefer the shallow pages (breadth-first),
+	// and a positive value prefers the deep ones (depth-first). 0 means no adjustment.
+	DepthPriority int
+
+	// With AdaptivePages, the branches of the site stop deepening when they stop yielding items, even before
+	// the DepthLimit. A branch is the host and the first BranchSegments segments of the path, like "example.com/blog",
+	// and the items per page are counted for each depth of each branch. When the pages at a depth and the
+	// Patience - 1 depths above it all yield at most AdaptiveYield items per page, after at least AdaptivePages pages
+	// at each of them, the new requests of the branch deeper than that depth are dropped. The pruned branches
+	// are logged when the spider closes, and reported in the run result.
+	// The items are counted if they have the trace IDs of the pages, like the items of the default parser,
+	// see NewItem of the crawler.
+	AdaptivePages  int
+	AdaptiveYield  float64
+	Patience       int
+	BranchSegments int
+
+	branches map[string]map[int]*branchDepth
+	pruned   map[string]*PrunedBranch
+	mutex    sync.Mutex
+}
+
+// PrunedBranch is a branch of the site which the DepthMiddleware stopped deepening after Depth,
+// the Pages at the depths which proved it barren yielded Items, and Dropped requests were dropped.
+type PrunedBranch struct {
+	Branch  string `json:"branch"`
+	Depth   int    `json:"depth"`
+	Pages   int    `json:"pages"`
+	Items   int    `json:"items"`
+	Dropped int    `json:"dropped"`
+}
+
+// The pages and the items at a depth of a branch.
+type branchDepth struct {
+	pages int
+	items int
 }
 
 func (m *DepthMiddleware) Open(spider *leiogo.Spider) error {
 	m.Logger.Debug(spider.Name, "Init success with depthLimit: %d", m.DepthLimit)
+	m.branches = make(map[string]map[int]*branchDepth)
+	m.pruned = make(map[string]*PrunedBranch)
+	return nil
+}
+
+func (m *DepthMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	for _, b := range m.Pruned() {
+		m.Logger.Info(spider.Name, "Pruned branch %s after depth %d, %d pages yielded %d items, dropped %d requests",
+			b.Branch, b.Depth, b.Pages, b.Items, b.Dropped)
+	}
 	return nil
 }
 
+// Pruned returns the pruned branches, sorted by their names.
+func (m *DepthMiddleware) Pruned() []*PrunedBranch {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	pruned := make([]*PrunedBranch, 0, len(m.pruned))
+	for _, b := range m.pruned {
+		copied := *b
+		pruned = append(pruned, &copied)
+	}
+	sort.Slice(pruned, func(i, j int) bool { return pruned[i].Branch < pruned[j].Branch })
+	return pruned
+}
+
+// The branch of the url, the host and the first BranchSegments segments of its path.
+func (m *DepthMiddleware) branch(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return ""
+	}
+	branch := u.Host
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i < m.BranchSegments && i < len(segments) && segments[i] != ""; i++ {
+		branch += "/" + segments[i]
+	}
+	return branch
+}
+
+// Count the items of the page for its depth of its branch, and prune the branch if it's barren.
+func (m *DepthMiddleware) PageParsed(res *leiogo.Response, req *leiogo.Request, items int, spider *leiogo.Spider) {
+	depth, ok := res.Meta["depth"].(int)
+	if m.AdaptivePages <= 0 || !ok {
+		return
+	}
+	branch := m.branch(req.URL)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	depths, ok := m.branches[branch]
+	if !ok {
+		depths = make(map[int]*branchDepth)
+		m.branches[branch] = depths
+	}
+	d, ok := depths[depth]
+	if !ok {
+		d = &branchDepth{}
+		depths[depth] = d
+	}
+	d.pages++
+	d.items += items
+
+	if _, ok := m.pruned[branch]; ok {
+		return
+	}
+	patience := m.Patience
+	if patience < 1 {
+		patience = 1
+	}
+	pruned := &PrunedBranch{Branch: branch, Depth: depth}
+	for i := depth - patience + 1; i <= depth; i++ {
+		d, ok := depths[i]
+		if !ok || d.pages < m.AdaptivePages || float64(d.items)/float64(d.pages) > m.AdaptiveYield {
+			return
+		}
+		pruned.Pages += d.pages
+		pruned.Items += d.items
+	}
+	m.pruned[branch] = pruned
+	m.Logger.Info(req.LogContext(spider), "Stop deepening branch %s after depth %d, %d pages yielded %d items",
+		branch, depth, pruned.Pages, pruned.Items)
+}
+
 // We simply store the depth information in the request's and response's meta,
 // and since that we will copy the meta information of a request to its corresponding response,
 // therefore all the requests and the response must carry the depth information.
@@ -109,7 +271,7 @@ func (m *DepthMiddleware) Open(spider *leiogo.Spider) error {
 // depth information to it, so we have to set the depth to 1 for those responses without depth information.
 // In general, this would only happen to start requests.
 func (m *DepthMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
-	m.Logger.Debug(spider.Name, "Add depth meta to request %s", req.URL)
+	m.Logger.Debug(req.LogContext(spider), "Add depth meta to request %s", req.URL)
 
 	if _, ok := res.Meta["depth"]; !ok {
 		res.Meta["depth"] = 1
@@ -124,59 +286,101 @@ func (m *DepthMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Requ
 func (m *DepthMiddleware) ProcessNewRequest(req *leiogo.Request, parentRes *leiogo.Response, spider *leiogo.Spider) error {
 	depth := parentRes.Meta["depth"].(int) + 1
 	req.Meta["depth"] = depth
-	m.Logger.Debug(spider.Name, "Depth of %s is %d", req.URL, depth)
+	req.Priority += depth * m.DepthPriority
+	m.Logger.Debug(req.LogContext(spider), "Depth of %s is %d", req.URL, depth)
 	if m.DepthLimit != 0 && depth > m.DepthLimit {
 		return &DropTaskError{Message: fmt.Sprintf("Depth beyond the max depth %d", m.DepthLimit)}
 	}
+	if m.AdaptivePages > 0 {
+		branch := m.branch(req.URL)
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if b, ok := m.pruned[branch]; ok && depth > b.Depth {
+			b.Dropped++
+			return &DropTaskError{Message: "Depth beyond a pruned branch"}
+		}
+	}
 	return nil
 }
 
 // HttpErrorMiddleware is a spider middleware (well, in fact we only define its ProcessResponse method,
 // we say it a spider middleware only because we want to make it happen after all those download middlwares).
-// HttpErrorMiddleware will drop all the responses with status code not 200.
+// HttpErrorMiddleware will drop all the responses with status code not 200,
+// unless the host allows more status codes with the "AllowedStatuses" setting, see HostSettings,
+// or the response is Handled, like by a status parser of the crawler.
 type HttpErrorMiddleware struct {
 	BaseMiddleware
+
+	HostSettings HostSettings
+	Handled      func(res *leiogo.Response, req *leiogo.Request) bool
 }
 
 func (m *HttpErrorMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
-	m.Logger.Debug(spider.Name, "Status code of %s: %d", req.URL, res.StatusCode)
-	if res.StatusCode != 200 {
-		return &DropTaskError{Message: fmt.Sprintf("[HTTP ERROR] %d", res.StatusCode)}
+	m.Logger.Debug(req.LogContext(spider), "Status code of %s: %d", req.URL, res.StatusCode)
+	if m.Handled != nil && m.Handled(res, req) {
+		return nil
 	}
-	return nil
+	for _, status := range m.HostSettings.Ints(req.URL, "AllowedStatuses", []int{200}) {
+		if res.StatusCode == status {
+			return nil
+		}
+	}
+	return &DropTaskError{Message: fmt.Sprintf("[HTTP ERROR] %d", res.StatusCode)}
 }
 
 // OffSiteMiddleware is a download middleware.
 // OffSiteMiddleware will drop all the requests failing to match any AllowedDomain.
+// The domains are matched by whole labels, so "example.com" matches "www.example.com",
+// but never "notexample.com".
 type OffSiteMiddleware struct {
 	BaseMiddleware
+
+	// If Subdomains is false, the host must be exactly one of the AllowedDomains.
+	Subdomains bool
+
+	// If RegistrableDomain is true, the hosts sharing the registrable domain (eTLD+1) with an allowed domain
+	// are also allowed, so allowing "www.example.co.uk" allows "shop.example.co.uk". See util.RegistrableDomain.
+	RegistrableDomain bool
+
+	// The hosts matching DeniedDomains are dropped even if they match the AllowedDomains,
+	// like "ads.example.com" in a crawl of "example.com".
+	DeniedDomains []string
+}
+
+// The hosts are compared without the ports, so a domain like "localhost:8080" matches the urls of localhost.
+func (m *OffSiteMiddleware) match(host string, domain string) bool {
+	domain = util.StripPort(domain)
+	if m.RegistrableDomain {
+		return util.RegistrableDomain(host) == util.RegistrableDomain(domain)
+	} else if m.Subdomains {
+		return util.MatchDomain(host, domain)
+	}
+	return host == strings.ToLower(domain)
 }
 
 func (m *OffSiteMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
-	m.Logger.Debug(spider.Name, "Testing whether request %s off site", req.URL)
-	if u, err := url.Parse(req.URL); err == nil {
-
-		// Create an url object from the url string in order to get the host name.
-		host := u.Host
-
-		// If spider's AllowedDomains field is empty, it should always pass this middleware.
-		offsite := len(spider.AllowedDomains) != 0
-
-		// Traverse all the domains, if there's one that can match the request url,
-		// then set offsite to false.
-		for _, domain := range spider.AllowedDomains {
-			if strings.HasSuffix(host, domain) {
-				m.Logger.Debug(spider.Name, "%s match domain: %s", req.URL, domain)
-				offsite = false
-				break
-			}
+	m.Logger.Debug(req.LogContext(spider), "Testing whether request %s off site", req.URL)
+	host := util.Hostname(req.URL)
+
+	for _, domain := range m.DeniedDomains {
+		if util.MatchDomain(host, util.StripPort(domain)) {
+			return &DropTaskError{Message: "Filtered denied domain request"}
 		}
+	}
+
+	// If spider's AllowedDomains field is empty, it should always pass this middleware.
+	if len(spider.AllowedDomains) == 0 {
+		return nil
+	}
 
-		if offsite {
-			return &DropTaskError{Message: "Filtered off site request"}
+	// Traverse all the domains, if there's one that can match the request url, it's not off site.
+	for _, domain := range spider.AllowedDomains {
+		if m.match(host, domain) {
+			m.Logger.Debug(req.LogContext(spider), "%s match domain: %s", req.URL, domain)
+			return nil
 		}
 	}
-	return nil
+	return &DropTaskError{Message: "Filtered off site request"}
 }
 
 // RetryMiddleware is a download middlware.
@@ -193,34 +397,205 @@ type RetryMiddleware struct {
 	// The default value is set to 3, see the definition in crawler package.
 	RetryTimes int
 
+	// The responses with these status codes are retried, as well as the download errors.
+	RetryStatuses []int
+
+	// The retried requests wait for an exponential backoff starting from BackoffBase seconds,
+	// or the Retry-After of the response, but never more than BackoffMax seconds.
+	BackoffBase float64
+	BackoffMax  float64
+
+	// The random generator of the backoff jitters, if Rand is nil, the global one is used.
+	Rand *rand.Rand
+
+	// The retried requests will have their priority adjusted by this value,
+	// a positive value makes them crawled before the newly discovered links.
+	PriorityAdjust int
+
+	// The hosts may override the RetryTimes and the RetryBudget, see HostSettings.
+	HostSettings HostSettings
+
+	// If RetryBudget is not 0, the retries to a host are limited to RetryBudget of the requests to the host,
+	// plus RetryBudgetMin, so a dying site doesn't get its traffic multiplied by the retries.
+	// For example, with 0.1 and 10, a host with 200 requests may have at most 30 retries.
+	RetryBudget    float64
+	RetryBudgetMin int
+
+	// The number of the retries refused by the budgets, see RefusedRetries.
+	OverBudget int
+
+	budgets map[string]*retryBudget
+	mutex   sync.Mutex
+
 	Yielder
 }
 
+type retryBudget struct {
+	requests int
+	retries  int
+}
+
 func (m *RetryMiddleware) Open(spider *leiogo.Spider) error {
-	m.Logger.Debug(spider.Name, "Init success with retryEnanled: %v, retryTimes: %d", m.RetryEnabled, m.RetryTimes)
+	m.budgets = make(map[string]*retryBudget)
+	m.Logger.Debug(spider.Name, "Init success with retryEnanled: %v, retryTimes: %d, retryBudget: %.2f",
+		m.RetryEnabled, m.RetryTimes, m.RetryBudget)
 	return nil
 }
 
+func (m *RetryMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	if m.OverBudget > 0 {
+		m.Logger.Info(spider.Name, "%d retries refused by the retry budgets", m.OverBudget)
+	}
+	return m.BaseMiddleware.Close(reason, spider)
+}
+
+// RefusedRetries returns the OverBudget, it's safe to call while the crawler is running.
+func (m *RetryMiddleware) RefusedRetries() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.OverBudget
+}
+
+func (m *RetryMiddleware) budget(req *leiogo.Request) *retryBudget {
+	host := util.GetHost(req.URL)
+	b, ok := m.budgets[host]
+	if !ok {
+		b = &retryBudget{}
+		m.budgets[host] = b
+	}
+	return b
+}
+
+// Count the first requests to each host, the retries are counted when they are allowed.
+func (m *RetryMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	if _, ok := req.Meta["retry"]; !ok {
+		m.mutex.Lock()
+		m.budget(req).requests++
+		m.mutex.Unlock()
+	}
+	return nil
+}
+
+// The retried requests are put off until their backoff has passed, see Deferrer.
+func (m *RetryMiddleware) DeferUntil(req *leiogo.Request, spider *leiogo.Spider) time.Time {
+	if at, ok := req.Meta["__retryat__"].(int64); ok {
+		return time.Unix(0, at)
+	}
+	return time.Time{}
+}
+
+// Take a retry from the budget of the host, it returns false if the budget runs out.
+func (m *RetryMiddleware) takeBudget(req *leiogo.Request, spider *leiogo.Spider) bool {
+	ratio := m.HostSettings.Float(req.URL, "RetryBudget", m.RetryBudget)
+	if ratio <= 0 {
+		return true
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	b := m.budget(req)
+	if float64(b.retries) >= ratio*float64(b.requests)+float64(m.RetryBudgetMin) {
+		m.OverBudget++
+		m.Logger.Debug(req.LogContext(spider), "Retry budget of %s runs out, drop %s", util.GetHost(req.URL), req.URL)
+		return false
+	}
+	b.retries++
+	return true
+}
+
 func (m *RetryMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
 	// Retry will occur only if the Err field of the response is not nil.
 	// And it usually should be a connection error.
 	// Pay attention to an exception, we add file download feature to our downloader, and in order to
 	// stop its spread to the following middlewares, we set a DropTaskError to the Err field.
 	// In this situation, we don't need to retry.
+	// The responses with the RetryStatuses are also retried, like 503 Service Unavailable.
 	switch res.Err.(type) {
 	case nil:
-		return nil
+		if !m.isRetryStatus(res.StatusCode) {
+			return nil
+		}
+		// If the request can't be retried any more, let the HttpErrorMiddleware handle the status.
+		if !m.retry(res, req, spider) {
+			return nil
+		}
+		return &DropTaskError{Message: fmt.Sprintf("Retry status %d", res.StatusCode), Rescheduled: true}
 	case *DropTaskError:
 		return res.Err
+	case *FixtureMissError, *CacheMissError:
+		// The fixtures and the cache snapshot never change during the replay.
+		return &DropTaskError{Message: res.Err.Error()}
 	default:
-		// Test whether this request is retriable, see the function below.
-		if m.isRetriable(req) {
-			if err := m.NewRequest(req, nil, spider); err != nil {
-				m.Logger.Error(spider.Name, "Add new request error, %s", err.Error())
-			}
+		return &DropTaskError{Message: res.Err.Error(), Rescheduled: m.retry(res, req, spider)}
+	}
+}
+
+func (m *RetryMiddleware) isRetryStatus(status int) bool {
+	for _, s := range m.RetryStatuses {
+		if s == status {
+			return true
 		}
-		return &DropTaskError{Message: res.Err.Error()}
 	}
+	return false
+}
+
+// Test whether this request is retriable, see the function below.
+// And the retry also needs the budget of the host.
+// The retried request will wait for the backoff before it's downloaded again, see DeferUntil.
+func (m *RetryMiddleware) retry(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) bool {
+	if !m.isRetriable(req) || !m.takeBudget(req, spider) {
+		return false
+	}
+
+	backoff := m.backoff(res, req.Meta["retry"].(int))
+	req.Meta["__retryat__"] = time.Now().Add(backoff).UnixNano()
+	m.Logger.Debug(req.LogContext(spider), "Retry %s after %s", req.URL, util.FormatDuration(backoff))
+
+	req.Priority += m.PriorityAdjust
+	if err := m.NewRequest(req, nil, spider); err != nil {
+		m.Logger.Error(req.LogContext(spider), "Add new request error, %s", err.Error())
+	}
+	return true
+}
+
+// The backoff is the Retry-After header of the response if it has one, otherwise it grows exponentially
+// with the retry times, BackoffBase * 2^(retry-1), and we add a jitter of [0.5, 1.5) times,
+// so the retries of the requests failing at the same time won't come back at the same time.
+// The backoff never exceeds BackoffMax.
+func (m *RetryMiddleware) backoff(res *leiogo.Response, retry int) time.Duration {
+	max := time.Duration(m.BackoffMax*1000) * time.Millisecond
+	backoff, ok := retryAfter(res)
+	if !ok {
+		backoff = time.Duration(m.BackoffBase*1000) * time.Millisecond << uint(retry-1)
+		if backoff <= 0 || backoff > max {
+			backoff = max
+		}
+		if m.Rand != nil {
+			backoff = time.Duration(float64(backoff) * (m.Rand.Float64() + 0.5))
+		} else {
+			backoff = time.Duration(float64(backoff) * (rand.Float64() + 0.5))
+		}
+	}
+	if backoff > max {
+		backoff = max
+	}
+	return backoff
+}
+
+// Retry-After is either the seconds to wait, or a http date.
+func retryAfter(res *leiogo.Response) (time.Duration, bool) {
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return time.Until(date), true
+	}
+	return 0, false
 }
 
 // A request is retriable when RetryEnabled is set to true and the retry times of this request
@@ -228,7 +603,8 @@ func (m *RetryMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Requ
 // And we simply store the retry information in the request's meta.
 func (m *RetryMiddleware) isRetriable(req *leiogo.Request) bool {
 	if m.RetryEnabled {
-		if retry, ok := req.Meta["retry"]; ok && retry.(int) < m.RetryTimes {
+		retryTimes := m.HostSettings.Int(req.URL, "RetryTimes", m.RetryTimes)
+		if retry, ok := req.Meta["retry"]; ok && retry.(int) < retryTimes {
 			req.Meta["retry"] = retry.(int) + 1
 			return true
 		} else if !ok {
@@ -249,13 +625,13 @@ type ReferenceURLMiddleware struct {
 
 func (r *ReferenceURLMiddleware) ProcessNewRequest(req *leiogo.Request, parentRes *leiogo.Response, spider *leiogo.Spider) error {
 	// We first check that if the request url is a relative url.
+	// The links like "javascript:" can't be crawled, so they are dropped.
 	if !strings.HasPrefix(req.URL, "http") {
-		base, _ := url.Parse(parentRes.URL)
-		if ref, err := url.Parse(req.URL); err != nil {
-			return err
+		if u, err := util.JoinURL(parentRes.URL, req.URL); err != nil {
+			return &DropTaskError{Message: err.Error()}
 		} else {
-			req.URL = base.ResolveReference(ref).String()
-			r.Logger.Debug(spider.Name, "Resolve reference from %s to %s", ref.String(), req.URL)
+			r.Logger.Debug(req.LogContext(spider), "Resolve reference from %s to %s", req.URL, u)
+			req.URL = u
 		}
 	}
 	return nil
@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MongoPipeline inserts the items as documents into a MongoDB collection.
+// Nested items are stored as nested documents. The items are buffered and written with
+// a bulk write for throughput, the buffer is flushed when it's full and when the spider closes.
+type MongoPipeline struct {
+	Base
+
+	URI        string
+	Database   string
+	Collection string
+
+	// If KeyFields is not empty, the items are upserted by their idempotency keys, which are
+	// stored in the _id field, so the same item is never stored twice. See Item.Key.
+	KeyFields []string
+
+	// The number of items in a bulk write, NewMongoPipeline sets it to MongoBatchSize.
+	// The items are written one by one if it's not positive.
+	BatchSize int
+
+	client *mongo.Client
+	coll   *mongo.Collection
+	models []mongo.WriteModel
+	mutex  sync.Mutex
+}
+
+func (p *MongoPipeline) Open(spider *leiogo.Spider) error {
+	var err error
+	if p.client, err = mongo.Connect(context.Background(), options.Client().ApplyURI(p.URI)); err == nil {
+		err = p.client.Ping(context.Background(), nil)
+	}
+	if err != nil {
+		p.Logger.Error(spider.Name, "Connect to %s fail, %s", p.URI, err)
+		if p.client != nil {
+			p.client.Disconnect(context.Background())
+			p.client = nil
+		}
+		return err
+	}
+	p.coll = p.client.Database(p.Database).Collection(p.Collection)
+	p.Logger.Info(spider.Name, "Connected to %s, writing to %s.%s", p.URI, p.Database, p.Collection)
+	return nil
+}
+
+func (p *MongoPipeline) Close(reason string, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// Nothing to flush or disconnect if the pipeline failed to open.
+	if p.client == nil {
+		return nil
+	}
+	err := p.flush()
+	if err != nil {
+		p.Logger.Error(spider.Name, "Flush %d items fail, %s", len(p.models), err)
+	}
+	if disErr := p.client.Disconnect(context.Background()); err == nil {
+		err = disErr
+	}
+	return err
+}
+
+func (p *MongoPipeline) Buffered() bool {
+	return true
+}
+
+func (p *MongoPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	// Item implements json.Marshaler for the nested items, but bson doesn't know it,
+	// so we convert the item to a bson document by ourselves.
+	doc := bsonValue(item.Data).(bson.M)
+
+	var model mongo.WriteModel
+	if len(p.KeyFields) != 0 {
+		key := item.Key(p.KeyFields...)
+		doc["_id"] = key
+		model = mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": key}).SetReplacement(doc).SetUpsert(true)
+	} else {
+		model = mongo.NewInsertOneModel().SetDocument(doc)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.models = append(p.models, model)
+	if len(p.models) >= p.BatchSize {
+		return p.flush()
+	}
+	return nil
+}
+
+// The models are kept if the bulk write fails, so they will be tried again with the next batch.
+// With an unordered bulk write, a failed document won't stop the others, so only the failed ones are kept,
+// and the others are never inserted twice. The inserts failing with duplicate keys are already stored.
+func (p *MongoPipeline) flush() error {
+	if len(p.models) == 0 {
+		return nil
+	}
+	if p.client == nil {
+		return fmt.Errorf("not connected to %s", p.URI)
+	}
+	_, err := p.coll.BulkWrite(context.Background(), p.models, options.BulkWrite().SetOrdered(false))
+	if err == nil {
+		p.models = p.models[:0]
+		return nil
+	}
+
+	// Without a write concern error, the documents without the write errors are written.
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) && bulkErr.WriteConcernError == nil {
+		failed := make([]mongo.WriteModel, 0, len(bulkErr.WriteErrors))
+		for _, writeErr := range bulkErr.WriteErrors {
+			if !mongo.IsDuplicateKeyError(writeErr.WriteError) {
+				failed = append(failed, p.models[writeErr.Index])
+			}
+		}
+		p.models = failed
+	}
+	return err
+}
+
+func bsonValue(val interface{}) interface{} {
+	switch x := val.(type) {
+	case *leiogo.Item:
+		return bsonValue(x.Data)
+	case leiogo.Dict:
+		doc := make(bson.M, len(x))
+		for k, v := range x {
+			doc[k] = bsonValue(v)
+		}
+		return doc
+	case map[string]interface{}:
+		return bsonValue(leiogo.Dict(x))
+	case []*leiogo.Item:
+		a := make(bson.A, len(x))
+		for i, v := range x {
+			a[i] = bsonValue(v)
+		}
+		return a
+	case []leiogo.Dict:
+		a := make(bson.A, len(x))
+		for i, v := range x {
+			a[i] = bsonValue(v)
+		}
+		return a
+	case []interface{}:
+		a := make(bson.A, len(x))
+		for i, v := range x {
+			a[i] = bsonValue(v)
+		}
+		return a
+	default:
+		return val
+	}
+}
@@ -0,0 +1,66 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// ObjectStore is a bucket of an object storage service, like S3, GCS or MinIO.
+// Exists should be cheap, usually a HEAD request of the object.
+// Put streams the body to the object, size is -1 if it's unknown.
+type ObjectStore interface {
+	Exists(key string) (bool, error)
+	Put(key string, body io.Reader, size int64, contentType string) error
+}
+
+// RemoteWriter is a FileWriter which saves the files out of the local disk, like ObjectWriter,
+// so no local directory is created for the files, and the saved files can't be read back.
+// The writers wrapping another FileWriter should report whether the wrapped one is remote.
+type RemoteWriter interface {
+	FileWriter
+	Remote() bool
+}
+
+func isRemote(w FileWriter) bool {
+	r, ok := w.(RemoteWriter)
+	return ok && r.Remote()
+}
+
+// ObjectWriter is a FileWriter which streams the downloaded files to an object store,
+// so the file crawls can skip the local disk. The key of a file is its file path, which is the
+// hashed url under the file directory, see FilePipeline, and Prefix is prepended to the keys.
+type ObjectWriter struct {
+	Store  ObjectStore
+	Prefix string
+}
+
+// The files are uploaded to the store, they're not on the local disk.
+func (w *ObjectWriter) Remote() bool {
+	return true
+}
+
+func (w *ObjectWriter) key(filepath string) string {
+	return w.Prefix + strings.TrimPrefix(path.Clean(filepath), "/")
+}
+
+// If we fail to check the object, it's treated as not existing, and the file will be downloaded again.
+func (w *ObjectWriter) NotExists(filepath string) bool {
+	exists, err := w.Store.Exists(w.key(filepath))
+	return err != nil || !exists
+}
+
+func (w *ObjectWriter) WriteFile(req *leiogo.Request, res *http.Response) (info string, writerErr error) {
+	key := w.key(req.Meta["__filepath__"].(string))
+	if err := w.Store.Put(key, res.Body, res.ContentLength, res.Header.Get("Content-Type")); err != nil {
+		writerErr = &StorageError{Err: err}
+	} else {
+		// Same as FSWriter, drop the request after the file is saved.
+		writerErr = &DropTaskError{Message: "File upload completed"}
+	}
+	return fmt.Sprintf("Uploaded %s to %s", req.URL, key), writerErr
+}
@@ -5,3 +5,7 @@ import (
 )
 
 type Parser func(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider)
+
+// Errback is called when a request fails, with the error of the download or the middleware,
+// and res is the failed response. See Request.ErrbackName.
+type Errback func(err error, res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider)
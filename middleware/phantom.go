@@ -0,0 +1,314 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+)
+
+// PhantomPool renders the pages with up to Size long-lived phantomjs workers, instead of a new process
+// for every page. The workers run Script in the worker mode, see download.js, and they are started
+// when they are needed first. The requests wait in a queue when all the workers are busy.
+//
+// A worker taking longer than Timeout for a page is killed, so is a worker whose page is cancelled,
+// and a worker which has crashed, or doesn't answer the health check every HealthInterval when it's idle.
+// The killed workers are started again by the next requests. It's an OpenClose, the workers are killed
+// when the spider closes.
+type PhantomPool struct {
+	Logger log.Logger
+
+	Exec   string
+	Script string
+	Size   int
+
+	Timeout        time.Duration
+	HealthInterval time.Duration
+
+	// The workers killed for the failures, they are started again when they are needed.
+	Restarts int64
+
+	// The idle workers, a nil one is not started yet or has been killed.
+	idle    chan *phantomWorker
+	workers map[*phantomWorker]bool
+	closed  bool
+	done    chan struct{}
+	once    sync.Once
+	mutex   sync.Mutex
+}
+
+// phantomPage is what download.js writes for a page.
+type phantomPage struct {
+	Err        string
+	Body       string
+	Result     json.RawMessage
+	Screenshot []byte
+	Pong       bool
+}
+
+func (page *phantomPage) setTo(res *leiogo.Response) {
+	if page.Err != "" {
+		res.Err = errors.New(page.Err)
+		return
+	}
+	res.Body = []byte(page.Body)
+	res.ScriptResult = page.Result
+	res.Screenshot = page.Screenshot
+
+	// A request of a web page usually contains a bunch of related requests,
+	// so it's not easy to define the status code of this request,
+	// so we mistakely set it to 200.
+	res.StatusCode = 200
+}
+
+type phantomWorker struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	lines  chan []byte
+	exited chan struct{}
+	killed chan struct{}
+	once   sync.Once
+}
+
+type phantomTask struct {
+	URL     string        `json:"url,omitempty"`
+	Options renderOptions `json:"options"`
+	Ping    bool          `json:"ping,omitempty"`
+}
+
+func (p *PhantomPool) init() {
+	p.idle = make(chan *phantomWorker, p.Size)
+	for i := 0; i < p.Size; i++ {
+		p.idle <- nil
+	}
+	p.workers = make(map[*phantomWorker]bool)
+	p.done = make(chan struct{})
+}
+
+func (p *PhantomPool) Open(spider *leiogo.Spider) error {
+	p.once.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	// The pool is opened again by the next crawl.
+	if p.closed {
+		p.closed = false
+		p.workers = make(map[*phantomWorker]bool)
+		p.done = make(chan struct{})
+	}
+	if p.HealthInterval > 0 {
+		go p.checkHealth(spider, p.done)
+	}
+	return nil
+}
+
+func (p *PhantomPool) Close(reason string, spider *leiogo.Spider) error {
+	p.once.Do(p.init)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+	close(p.done)
+	for w := range p.workers {
+		w.kill()
+	}
+	p.workers = nil
+	return nil
+}
+
+// Render the url with an idle worker, or wait for one until the ctx is done.
+func (p *PhantomPool) Render(ctx context.Context, url string, opts renderOptions, spider *leiogo.Spider) (*phantomPage, error) {
+	p.once.Do(p.init)
+
+	var w *phantomWorker
+	select {
+	case w = <-p.idle:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if w == nil || w.broken() {
+		var err error
+		if w, err = p.start(w, spider); err != nil {
+			p.idle <- nil
+			return nil, err
+		}
+	}
+	page, err := p.ask(ctx, w, phantomTask{URL: url, Options: opts}, p.Timeout)
+	if err != nil {
+		// The answer may come later, so the worker can't be used again.
+		p.kill(w)
+		w = nil
+	}
+	p.idle <- w
+	return page, err
+}
+
+// Start a worker in place of the broken one, if it's not nil.
+func (p *PhantomPool) start(broken *phantomWorker, spider *leiogo.Spider) (*phantomWorker, error) {
+	if broken != nil {
+		p.kill(broken)
+		p.Logger.Info(spider.Name, "Restarting a broken phantomjs worker")
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return nil, errors.New("Phantomjs pool is closed")
+	}
+
+	cmd := exec.Command(p.Exec, p.Script, "--worker")
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	w := &phantomWorker{
+		cmd:    cmd,
+		stdin:  stdin,
+		lines:  make(chan []byte),
+		exited: make(chan struct{}),
+		killed: make(chan struct{}),
+	}
+	go w.read(stdout)
+	p.workers[w] = true
+	return w, nil
+}
+
+// Kill a failed worker.
+func (p *PhantomPool) kill(w *phantomWorker) {
+	p.mutex.Lock()
+	if p.workers[w] {
+		delete(p.workers, w)
+		atomic.AddInt64(&p.Restarts, 1)
+	}
+	p.mutex.Unlock()
+	w.kill()
+}
+
+// Send the task to the worker, and wait for the answer.
+func (p *PhantomPool) ask(ctx context.Context, w *phantomWorker, task phantomTask, timeout time.Duration) (*phantomPage, error) {
+	buf, err := json.Marshal(task)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.stdin.Write(append(buf, '\n')); err != nil {
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case line := <-w.lines:
+		page := &phantomPage{}
+		if err := json.Unmarshal(line, page); err != nil {
+			return nil, err
+		}
+		return page, nil
+	case <-w.exited:
+		return nil, errors.New("Phantomjs worker exited")
+	case <-expired:
+		return nil, fmt.Errorf("Phantomjs worker timed out after %s", timeout)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping the idle workers every HealthInterval, the ones not answering in time are killed.
+func (p *PhantomPool) checkHealth(spider *leiogo.Spider, done chan struct{}) {
+	ticker := time.NewTicker(p.HealthInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		for i := 0; i < p.Size; i++ {
+			if !p.checkIdle(spider) {
+				break
+			}
+		}
+	}
+}
+
+// Check an idle worker, it returns false if all the workers are busy.
+func (p *PhantomPool) checkIdle(spider *leiogo.Spider) bool {
+	var w *phantomWorker
+	select {
+	case w = <-p.idle:
+	default:
+		return false
+	}
+	if w != nil {
+		if w.broken() {
+			p.kill(w)
+			w = nil
+		} else if _, err := p.ask(context.Background(), w, phantomTask{Ping: true}, 5*time.Second); err != nil {
+			p.Logger.Error(spider.Name, "Phantomjs worker failed the health check, %s", err.Error())
+			p.kill(w)
+			w = nil
+		}
+	}
+	p.idle <- w
+	return true
+}
+
+// Read the JSON lines of the worker, the other outputs, like the logs of phantomjs, are skipped.
+func (w *phantomWorker) read(stdout io.Reader) {
+	defer close(w.exited)
+	reader := bufio.NewReader(stdout)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[0] == '{' {
+			select {
+			case w.lines <- line:
+			case <-w.killed:
+			}
+		}
+		if err != nil {
+			w.cmd.Wait()
+			return
+		}
+	}
+}
+
+func (w *phantomWorker) broken() bool {
+	select {
+	case <-w.exited:
+		return true
+	case <-w.killed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *phantomWorker) kill() {
+	w.once.Do(func() {
+		close(w.killed)
+		w.stdin.Close()
+		w.cmd.Process.Kill()
+	})
+}
@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// renderOptions are the options of a rendered page in the meta of its request, for both phantomjs and Chrome:
+//
+//	"waitfor"     string, the CSS selector of an element to wait for, instead of the load of the page
+//	"waittimeout" float64 or int, the max seconds to wait, then the page is captured as it is
+//	"viewport"    string, the size of the window, like "1280x800"
+//	"script"      string, the JavaScript expression evaluated in the page before it's captured,
+//	              its JSON value is the ScriptResult of the response
+//	"screenshot"  bool, capture a PNG of the whole page as the Screenshot of the response
+type renderOptions struct {
+	WaitFor     string  `json:"waitfor,omitempty"`
+	WaitTimeout float64 `json:"waittimeout,omitempty"`
+	Width       int     `json:"width,omitempty"`
+	Height      int     `json:"height,omitempty"`
+	Script      string  `json:"script,omitempty"`
+	Screenshot  bool    `json:"screenshot,omitempty"`
+}
+
+func newRenderOptions(req *leiogo.Request) (renderOptions, error) {
+	var opts renderOptions
+	opts.WaitFor, _ = req.Meta["waitfor"].(string)
+	opts.WaitTimeout, _ = req.Meta.Float("waittimeout")
+	opts.Script, _ = req.Meta["script"].(string)
+	opts.Screenshot, _ = req.Meta["screenshot"].(bool)
+	if viewport, ok := req.Meta["viewport"].(string); ok && viewport != "" {
+		if _, err := fmt.Sscanf(viewport, "%dx%d", &opts.Width, &opts.Height); err != nil || opts.Width <= 0 || opts.Height <= 0 {
+			return opts, fmt.Errorf("Invalid viewport %q, it should be like 1280x800", viewport)
+		}
+	}
+	return opts, nil
+}
+
+func (opts renderOptions) waitTimeout() time.Duration {
+	return time.Duration(opts.WaitTimeout*1000) * time.Millisecond
+}
@@ -0,0 +1,77 @@
+package middleware
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// RewriteRule replaces the matches of the regular expression Pattern in a url with the Replacement,
+// where $1 or ${name} is the text of the submatch, see regexp.Regexp.ReplaceAllString.
+type RewriteRule struct {
+	Pattern     string
+	Replacement string
+}
+
+// SessionIDRewriteRules remove the session ids in the paths of the urls, like "/page;jsessionid=ABC"
+// of the Java servers and "/(S(abc))/page" of the cookieless ASP.NET sessions.
+var SessionIDRewriteRules = []RewriteRule{
+	{Pattern: `(?i);(jsessionid|phpsessid|sessionid|sid)=[^/?#;]*`, Replacement: ""},
+	{Pattern: `(?i)/\(S\([0-9a-z]+\)\)`, Replacement: ""},
+}
+
+// URLRewriteMiddleware is a spider middleware, it rewrites the urls of the new requests by the Rules in order,
+// so the urls differing only in the session ids or the tracking segments are scheduled and deduplicated as one.
+// Use util.RemoveQuery in the parsers for the query parameters, the rules are for the rest of the url.
+// Add it before the other spider middlewares, so they see the rewritten urls. The start urls are rewritten
+// when the spider opens.
+type URLRewriteMiddleware struct {
+	BaseMiddleware
+
+	Rules []RewriteRule
+
+	rules []*regexp.Regexp
+}
+
+// CompileRewriteRules compiles the patterns of the rules, the error tells the first invalid one.
+func CompileRewriteRules(rules []RewriteRule) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid url rewrite rule %s, %s", rule.Pattern, err.Error())
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+func (m *URLRewriteMiddleware) Open(spider *leiogo.Spider) error {
+	rules, err := CompileRewriteRules(m.Rules)
+	if err != nil {
+		m.Logger.Error(spider.Name, "Open URLRewriteMiddleware fail, %s", err.Error())
+		return err
+	}
+	m.rules = rules
+	for _, req := range spider.StartURLs {
+		m.rewrite(req, spider)
+	}
+	return nil
+}
+
+func (m *URLRewriteMiddleware) ProcessNewRequest(req *leiogo.Request, parentRes *leiogo.Response, spider *leiogo.Spider) error {
+	m.rewrite(req, spider)
+	return nil
+}
+
+func (m *URLRewriteMiddleware) rewrite(req *leiogo.Request, spider *leiogo.Spider) {
+	url := req.URL
+	for i, re := range m.rules {
+		url = re.ReplaceAllString(url, m.Rules[i].Replacement)
+	}
+	if url != req.URL {
+		m.Logger.Debug(req.LogContext(spider), "Rewrite %s to %s", req.URL, url)
+		req.URL = url
+	}
+}
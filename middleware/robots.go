@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"golang.org/x/net/html"
+)
+
+// RobotsTxt is the group of a robots.txt for a user agent, see ParseRobotsTxt.
+type RobotsTxt struct {
+	// The Crawl-delay of the group, 0 if there's none.
+	CrawlDelay time.Duration
+
+	rules       []robotsRule
+	disallowAll bool
+}
+
+type robotsRule struct {
+	allow   bool
+	pattern string
+	re      *regexp.Regexp
+}
+
+// DisallowAllRobotsTxt disallows every url, the robots.txt of a host is treated so
+// when it can't be fetched because of the server errors.
+var DisallowAllRobotsTxt = &RobotsTxt{disallowAll: true}
+
+// RobotsAgent returns the product token of the user agent, like "leiobot" of "LeioBot/1.0 (+http://a.com)",
+// which is matched with the User-agent lines of robots.txt.
+func RobotsAgent(userAgent string) string {
+	agent := strings.ToLower(strings.TrimSpace(userAgent))
+	if i := strings.IndexAny(agent, "/ "); i >= 0 {
+		agent = agent[:i]
+	}
+	return agent
+}
+
+// ParseRobotsTxt parses the rules of the group for the agent, by RFC 9309. The group of the longest
+// User-agent contained in the product token of the agent is used, or the "*" group if none matches,
+// and the groups of the same User-agent are merged.
+func ParseRobotsTxt(body []byte, userAgent string) *RobotsTxt {
+	type group struct {
+		names []string
+		rules []robotsRule
+		delay time.Duration
+	}
+	var groups []*group
+	var current *group
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(kv[0]))
+		value := strings.TrimSpace(kv[1])
+
+		switch key {
+		case "user-agent":
+			// The User-agent lines in a row start a group, which lasts until the next User-agent after its rules.
+			if current == nil || len(current.rules) != 0 || current.delay != 0 {
+				current = &group{}
+				groups = append(groups, current)
+			}
+			current.names = append(current.names, strings.ToLower(value))
+		case "allow", "disallow":
+			// An empty Disallow allows everything, it's the same as no rule.
+			if current != nil && value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value, re: robotsPattern(value)})
+			}
+		case "crawl-delay":
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && current != nil {
+				current.delay = time.Duration(seconds*1000) * time.Millisecond
+			}
+		}
+	}
+
+	agent := RobotsAgent(userAgent)
+	matched := "*"
+	for _, g := range groups {
+		for _, name := range g.names {
+			if name != "*" && name != "" && strings.Contains(agent, name) && (matched == "*" || len(name) > len(matched)) {
+				matched = name
+			}
+		}
+	}
+	robots := &RobotsTxt{}
+	for _, g := range groups {
+		for _, name := range g.names {
+			if name == matched {
+				robots.rules = append(robots.rules, g.rules...)
+				if g.delay != 0 {
+					robots.CrawlDelay = g.delay
+				}
+				break
+			}
+		}
+	}
+	return robots
+}
+
+// The * in a pattern matches any characters, and a $ at the end anchors the end of the url.
+func robotsPattern(pattern string) *regexp.Regexp {
+	anchored := strings.HasSuffix(pattern, "$")
+	pattern = strings.TrimSuffix(pattern, "$")
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	expr := "^" + strings.Join(parts, ".*")
+	if anchored {
+		expr += "$"
+	}
+	return regexp.MustCompile(expr)
+}
+
+// Allowed reports whether the url may be crawled. The longest matching rule wins,
+// and an Allow wins over a Disallow of the same length. The robots.txt itself is always allowed.
+func (r *RobotsTxt) Allowed(rawurl string) bool {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return false
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if path == "/robots.txt" {
+		return true
+	}
+	if r.disallowAll {
+		return false
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	allowed, longest := true, -1
+	for _, rule := range r.rules {
+		if !rule.re.MatchString(path) {
+			continue
+		}
+		if n := len(rule.pattern); n > longest || (n == longest && rule.allow) {
+			allowed, longest = rule.allow, n
+		}
+	}
+	return allowed
+}
+
+// RobotsMetaMiddleware is a spider middleware, it follows the noindex and the nofollow directives
+// of the robots meta tags and the X-Robots-Tag headers of the pages, for the user agent or all the robots.
+// The new requests from a nofollow page are dropped, and the pages are marked with '__noindex__'
+// and '__nofollow__' in their meta, so the crawler drops the items yielded from a noindex page
+// with its trace ID. The links with rel="nofollow" are not told apart, since the requests don't know them.
+type RobotsMetaMiddleware struct {
+	BaseMiddleware
+
+	UserAgent string
+}
+
+func (m *RobotsMetaMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if typename, _ := req.Meta["__type__"].(string); typename == "file" || res.Err != nil {
+		return nil
+	}
+
+	var directives []string
+	agent := RobotsAgent(m.UserAgent)
+	for _, value := range res.Header.Values("X-Robots-Tag") {
+		// The header may be prefixed with the user agent it's for, like "googlebot: noindex".
+		if kv := strings.SplitN(value, ":", 2); len(kv) == 2 && !strings.ContainsAny(kv[0], ",") {
+			if name := strings.ToLower(strings.TrimSpace(kv[0])); name != agent {
+				continue
+			}
+			value = kv[1]
+		}
+		directives = append(directives, value)
+	}
+	if isHTML(res) {
+		directives = append(directives, m.metaDirectives(res, agent)...)
+	}
+
+	for _, value := range directives {
+		for _, directive := range strings.Split(strings.ToLower(value), ",") {
+			switch strings.TrimSpace(directive) {
+			case "noindex":
+				res.Meta["__noindex__"] = true
+			case "nofollow":
+				res.Meta["__nofollow__"] = true
+			case "none":
+				res.Meta["__noindex__"] = true
+				res.Meta["__nofollow__"] = true
+			}
+		}
+	}
+	return nil
+}
+
+// The contents of the robots meta tags, and the ones named after the agent.
+func (m *RobotsMetaMiddleware) metaDirectives(res *leiogo.Response, agent string) []string {
+	doc, err := html.Parse(bytes.NewReader(res.Body))
+	if err != nil {
+		return nil
+	}
+	var directives []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && n.Data == "meta" {
+			if name := strings.ToLower(attr(n, "name")); name == "robots" || (agent != "" && name == agent) {
+				directives = append(directives, attr(n, "content"))
+			}
+		}
+		// The meta tags are in the head, the body can be skipped.
+		if n.Type == html.ElementNode && n.Data == "body" {
+			return
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+	return directives
+}
+
+func (m *RobotsMetaMiddleware) ProcessNewRequest(req *leiogo.Request, parentRes *leiogo.Response, spider *leiogo.Spider) error {
+	if parentRes == nil {
+		return nil
+	}
+	if nofollow, _ := parentRes.Meta["__nofollow__"].(bool); nofollow {
+		return &DropTaskError{Message: "Nofollow page"}
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// SamplePipeline keeps a random sample of Size items, and writes them pretty-printed to the FileName
+// when the spider closes, or to the log if the FileName is empty, so the operators can eyeball the data
+// without opening the exports. Every item has the same chance to be in the sample, no matter how many
+// items the spider yields (reservoir sampling). Put it after the other pipelines to sample the items
+// which are kept by them.
+type SamplePipeline struct {
+	Base
+
+	Size     int
+	FileName string
+
+	// The random generator of the sample, a seeded one makes the sample reproducible.
+	// If Rand is nil, the global one is used.
+	Rand *rand.Rand
+
+	seen   int
+	sample []*leiogo.Item
+	mutex  sync.Mutex
+}
+
+func (p *SamplePipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.seen++
+	if len(p.sample) < p.Size {
+		p.sample = append(p.sample, item)
+	} else if i := p.intn(p.seen); i < p.Size {
+		p.sample[i] = item
+	}
+	return nil
+}
+
+func (p *SamplePipeline) intn(n int) int {
+	if p.Rand != nil {
+		return p.Rand.Intn(n)
+	}
+	return rand.Intn(n)
+}
+
+func (p *SamplePipeline) Close(reason string, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	buf, err := json.MarshalIndent(p.sample, "", "  ")
+	if err != nil {
+		p.Logger.Error(spider.Name, "Encode the sample fail, %s", err)
+		return err
+	}
+
+	if p.FileName == "" {
+		p.Logger.Info(spider.Name, "Sample of %d items out of %d:\n%s", len(p.sample), p.seen, buf)
+		return nil
+	}
+	if err = ioutil.WriteFile(p.FileName, buf, 0644); err != nil {
+		p.Logger.Error(spider.Name, "Write the sample to %s fail, %s", p.FileName, err)
+		return err
+	}
+	p.Logger.Info(spider.Name, "Saved a sample of %d items out of %d to %s", len(p.sample), p.seen, p.FileName)
+	return nil
+}
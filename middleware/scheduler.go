@@ -0,0 +1,191 @@
+package middleware
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// Scheduler is the queue of the requests waiting to be crawled.
+// Push should never block, and Pop blocks until there's a request to return.
+// After Close is called, Pop returns the remaining requests, then returns false.
+// Len is the number of the requests waiting, for the status of the crawler.
+type Scheduler interface {
+	Push(req *leiogo.Request)
+	Pop() (*leiogo.Request, bool)
+	Len() int
+	Close()
+}
+
+// LossyScheduler is a Scheduler which may lose the requests pushed to it, like the DiskScheduler
+// failing to read a segment. The numbers of the lost requests are reported to the function set by SetOnLost,
+// so the crawler stops waiting for them. It's called with the lock of the scheduler held, so it
+// must not call the scheduler.
+type LossyScheduler interface {
+	Scheduler
+	SetOnLost(onLost func(n int))
+}
+
+// The orders of the schedulers, see NewScheduler in crawler package.
+const (
+	SchedulePriority = "priority"
+	ScheduleFIFO     = "fifo"
+	ScheduleLIFO     = "lifo"
+)
+
+// PriorityScheduler is the default scheduler. The requests with higher Priority are popped first,
+// and the requests with the same priority are popped in the order they were pushed.
+type PriorityScheduler struct {
+	queue  priorityQueue
+	count  int
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func NewPriorityScheduler() *PriorityScheduler {
+	s := &PriorityScheduler{}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (s *PriorityScheduler) Push(req *leiogo.Request) {
+	s.mutex.Lock()
+	// The counter keeps the FIFO order among the requests with the same priority.
+	s.count++
+	heap.Push(&s.queue, &queuedRequest{req: req, seq: s.count})
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
+
+func (s *PriorityScheduler) Pop() (*leiogo.Request, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.queue.Len() == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.queue.Len() == 0 {
+		return nil, false
+	}
+	return heap.Pop(&s.queue).(*queuedRequest).req, true
+}
+
+func (s *PriorityScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queue.Len()
+}
+
+func (s *PriorityScheduler) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+// FIFOScheduler pops the requests in the order they were pushed, ignoring their priorities,
+// so the site is crawled breadth-first.
+type FIFOScheduler struct {
+	listScheduler
+}
+
+func NewFIFOScheduler() *FIFOScheduler {
+	s := &FIFOScheduler{}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+// LIFOScheduler pops the latest pushed request first, ignoring their priorities, so the site is crawled
+// depth-first, and the queue stays small on the deep sites.
+type LIFOScheduler struct {
+	listScheduler
+}
+
+func NewLIFOScheduler() *LIFOScheduler {
+	s := &LIFOScheduler{listScheduler{lifo: true}}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+type listScheduler struct {
+	lifo   bool
+	queue  []*leiogo.Request
+	closed bool
+	mutex  sync.Mutex
+	cond   *sync.Cond
+}
+
+func (s *listScheduler) Push(req *leiogo.Request) {
+	s.mutex.Lock()
+	s.queue = append(s.queue, req)
+	s.mutex.Unlock()
+	s.cond.Signal()
+}
+
+func (s *listScheduler) Pop() (*leiogo.Request, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for len(s.queue) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return nil, false
+	}
+	var req *leiogo.Request
+	if s.lifo {
+		req = s.queue[len(s.queue)-1]
+		s.queue[len(s.queue)-1] = nil
+		s.queue = s.queue[:len(s.queue)-1]
+	} else {
+		req = s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+	}
+	return req, true
+}
+
+func (s *listScheduler) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.queue)
+}
+
+func (s *listScheduler) Close() {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
+
+type queuedRequest struct {
+	req *leiogo.Request
+	seq int
+}
+
+// priorityQueue implements heap.Interface.
+type priorityQueue []*queuedRequest
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].req.Priority != q[j].req.Priority {
+		return q[i].req.Priority > q[j].req.Priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *priorityQueue) Push(x interface{}) { *q = append(*q, x.(*queuedRequest)) }
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	x := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return x
+}
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"fmt"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// Field describes a field of the items.
+// Type is one of "string", "number", "bool", "item" and "list", an empty Type accepts any value.
+// For "item" fields and the elements of "list" fields, the nested values are validated by Schema.
+type Field struct {
+	Type     string
+	Required bool
+	Schema   Schema
+}
+
+// Schema describes the fields of the items, the fields which are not in the schema are always valid.
+type Schema map[string]Field
+
+// Validate returns an error describing the first invalid field of the data.
+func (s Schema) Validate(data leiogo.Dict) error {
+	for name, field := range s {
+		val, ok := data[name]
+		if !ok || val == nil {
+			if field.Required {
+				return fmt.Errorf("Field %s is required", name)
+			}
+			continue
+		}
+		if err := field.validate(val); err != nil {
+			return fmt.Errorf("Field %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+func (f Field) validate(val interface{}) error {
+	switch f.Type {
+	case "":
+		return nil
+	case "string":
+		if _, ok := val.(string); !ok {
+			return fmt.Errorf("expect string, get %T", val)
+		}
+	case "number":
+		switch val.(type) {
+		case int, int32, int64, float32, float64:
+		default:
+			return fmt.Errorf("expect number, get %T", val)
+		}
+	case "bool":
+		if _, ok := val.(bool); !ok {
+			return fmt.Errorf("expect bool, get %T", val)
+		}
+	case "item":
+		data, ok := dictOf(val)
+		if !ok {
+			return fmt.Errorf("expect item, get %T", val)
+		}
+		return f.Schema.Validate(data)
+	case "list":
+		var elems []interface{}
+		switch x := val.(type) {
+		case []interface{}:
+			elems = x
+		case []*leiogo.Item:
+			for _, e := range x {
+				elems = append(elems, e)
+			}
+		case []leiogo.Dict:
+			for _, e := range x {
+				elems = append(elems, e)
+			}
+		case []string:
+			for _, e := range x {
+				elems = append(elems, e)
+			}
+		default:
+			return fmt.Errorf("expect list, get %T", val)
+		}
+		// The elements are validated only if they are items.
+		for n, e := range elems {
+			if data, ok := dictOf(e); ok && f.Schema != nil {
+				if err := f.Schema.Validate(data); err != nil {
+					return fmt.Errorf("element %d: %s", n, err.Error())
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("unknown type %s", f.Type)
+	}
+	return nil
+}
+
+func dictOf(val interface{}) (leiogo.Dict, bool) {
+	switch x := val.(type) {
+	case *leiogo.Item:
+		return x.Data, true
+	case leiogo.Dict:
+		return x, true
+	case map[string]interface{}:
+		return leiogo.Dict(x), true
+	default:
+		return nil, false
+	}
+}
+
+// SchemaPipeline drops the items which don't match the schema.
+// Put it before the exporting pipelines.
+type SchemaPipeline struct {
+	Base
+	Schema Schema
+}
+
+func (p *SchemaPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	if err := p.Schema.Validate(item.Data); err != nil {
+		return &DropItemError{Message: "Invalid item, " + err.Error()}
+	}
+	return nil
+}
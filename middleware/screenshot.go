@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"os"
+	"path"
+	"sync/atomic"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// ScreenshotMiddleware is a spider middleware, it saves the screenshots of the rendered pages with 'screenshot' = true
+// in the meta, by the FileWriter like the files of the FilePipeline, so the visual audits keep the images
+// along with the pages. A screenshot is saved as DirPath/<hash of the url>.png, and the path is set
+// to '__screenshot__' in the meta of the response before it's parsed, so the parser can add it to the items.
+// The screenshot of a page is saved every time the page is rendered, so an existing one is replaced
+// by the latest.
+type ScreenshotMiddleware struct {
+	BaseMiddleware
+
+	DirPath string
+
+	FileWriter
+
+	Saved int64
+}
+
+func (m *ScreenshotMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	m.Logger.Info(spider.Name, "Saved screenshots: %d", atomic.LoadInt64(&m.Saved))
+	return nil
+}
+
+func (m *ScreenshotMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if len(res.Screenshot) == 0 {
+		return nil
+	}
+
+	filepath := path.Join(m.DirPath, util.Hash(req.URL)+".png")
+	if !isRemote(m.FileWriter) {
+		if err := os.MkdirAll(m.DirPath, os.ModePerm); err != nil {
+			m.Logger.Error(req.LogContext(spider), "Create directory failed, %s", err.Error())
+		}
+	}
+	saved, info, err := writeFileData(m.FileWriter, res.Screenshot, "image/png", req.URL, filepath)
+	if err != nil {
+		m.Logger.Error(req.LogContext(spider), "Save screenshot of %s failed, %s", req.URL, err.Error())
+		return nil
+	}
+	m.Logger.Debug(req.LogContext(spider), "Saved screenshot of %s to %s, %s", req.URL, saved, info)
+	res.Meta["__screenshot__"] = saved
+	atomic.AddInt64(&m.Saved, 1)
+	return nil
+}
@@ -0,0 +1,241 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+)
+
+// SearchDocument is a page in the search index, the Tokens are the normalized words of the title and the text.
+type SearchDocument struct {
+	ID     string    `json:"-"`
+	URL    string    `json:"url"`
+	Title  string    `json:"title"`
+	Text   string    `json:"text"`
+	Tokens []string  `json:"tokens"`
+	Time   time.Time `json:"time"`
+
+	// The times the document failed to index.
+	fails int
+}
+
+// SearchIndex is the backend of the SearchIndexPipeline, like a local Bleve index or a remote Elasticsearch.
+// The documents are indexed by their IDs, so indexing a page again replaces it.
+// Index may be called by several goroutines at the same time.
+type SearchIndex interface {
+	Index(docs []*SearchDocument) error
+	Close() error
+}
+
+// Tokenizer splits the text into the tokens.
+type Tokenizer func(text string) []string
+
+// TokenFilter normalizes a token, like lowercasing or stemming, an empty result drops the token.
+type TokenFilter func(token string) string
+
+// SplitWords is the default tokenizer, it splits the text at the characters which are neither letters nor digits.
+func SplitWords(text string) []string {
+	return strings.FieldsFunc(text, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+}
+
+// LowerCase is a TokenFilter lowercasing the tokens.
+func LowerCase(token string) string {
+	return strings.ToLower(token)
+}
+
+// StopWords returns a TokenFilter dropping the words, they are compared case insensitively.
+func StopWords(words ...string) TokenFilter {
+	stop := make(map[string]bool, len(words))
+	for _, w := range words {
+		stop[strings.ToLower(w)] = true
+	}
+	return func(token string) string {
+		if stop[strings.ToLower(token)] {
+			return ""
+		}
+		return token
+	}
+}
+
+// SearchIndexPipeline is a response consumer building a site search, it extracts the title and the main text
+// of the html pages by util.Readable, splits them into tokens by the Tokenizer, normalizes the tokens
+// by the Filters in order, and indexes the documents into the Index in batches of BatchSize.
+// The documents of a failed batch are tried again with the next batch, and dropped after MaxRetries retries.
+// The Index is closed with the pipeline. Add it by AddResponseConsumers of the crawler builder.
+type SearchIndexPipeline struct {
+	Base
+
+	Index      SearchIndex
+	Tokenizer  Tokenizer
+	Filters    []TokenFilter
+	BatchSize  int
+	MaxRetries int
+
+	Indexed int
+	Dropped int
+
+	docs  []*SearchDocument
+	mutex sync.Mutex
+}
+
+func (p *SearchIndexPipeline) Close(reason string, spider *leiogo.Spider) error {
+	// The failed documents are tried once more, the rest are dropped.
+	for len(p.docs) != 0 {
+		docs := p.docs
+		p.docs = nil
+		if err := p.flush(docs, spider); err != nil {
+			p.Logger.Error(spider.Name, "Index %d pages fail, %s", len(docs), err)
+		}
+	}
+	p.Logger.Info(spider.Name, "Indexed %d pages, dropped %d pages", p.Indexed, p.Dropped)
+	if err := p.Index.Close(); err != nil {
+		return err
+	}
+	return p.Base.Close(reason, spider)
+}
+
+func (p *SearchIndexPipeline) Consume(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if res.Err != nil || res.StatusCode != http.StatusOK ||
+		!strings.Contains(strings.ToLower(res.Header.Get("Content-Type")), "html") {
+		return nil
+	}
+
+	body := res.Body
+	if res.Stream != nil {
+		var err error
+		if body, err = ioutil.ReadAll(res.Stream); err != nil {
+			return err
+		}
+	}
+	title, text, err := util.Readable(body)
+	if err != nil {
+		return err
+	}
+
+	doc := &SearchDocument{
+		ID:     util.Hash(util.CanonicalURL(res.URL)),
+		URL:    res.URL,
+		Title:  title,
+		Text:   text,
+		Tokens: p.tokenize(title + "\n" + text),
+		Time:   time.Now(),
+	}
+
+	// The batch is taken under the lock, and indexed outside it, so the other pages aren't blocked.
+	p.mutex.Lock()
+	p.docs = append(p.docs, doc)
+	if len(p.docs) < p.BatchSize {
+		p.mutex.Unlock()
+		return nil
+	}
+	docs := p.docs
+	p.docs = nil
+	p.mutex.Unlock()
+	return p.flush(docs, spider)
+}
+
+func (p *SearchIndexPipeline) tokenize(text string) []string {
+	tokenizer := p.Tokenizer
+	if tokenizer == nil {
+		tokenizer = SplitWords
+	}
+	var tokens []string
+	for _, token := range tokenizer(text) {
+		for _, f := range p.Filters {
+			if token = f(token); token == "" {
+				break
+			}
+		}
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// The documents are put back if the index fails, so they will be tried again with the next batch,
+// unless they have failed for more than MaxRetries times.
+func (p *SearchIndexPipeline) flush(docs []*SearchDocument, spider *leiogo.Spider) error {
+	if len(docs) == 0 {
+		return nil
+	}
+	err := p.Index.Index(docs)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err == nil {
+		p.Indexed += len(docs)
+		return nil
+	}
+	dropped := 0
+	for _, doc := range docs {
+		if doc.fails++; doc.fails > p.MaxRetries {
+			dropped++
+			continue
+		}
+		p.docs = append(p.docs, doc)
+	}
+	if dropped != 0 {
+		p.Dropped += dropped
+		p.Logger.Error(spider.Name, "Drop %d pages failed for %d times", dropped, p.MaxRetries+1)
+	}
+	return err
+}
+
+// ESSearchIndex indexes the documents into the IndexName of an Elasticsearch cluster at URL, like http://localhost:9200.
+type ESSearchIndex struct {
+	URL       string
+	IndexName string
+
+	client *http.Client
+	once   sync.Once
+}
+
+func (e *ESSearchIndex) Index(docs []*SearchDocument) error {
+	e.once.Do(func() { e.client = &http.Client{Timeout: 60 * time.Second} })
+
+	var buf bytes.Buffer
+	for _, doc := range docs {
+		action, _ := json.Marshal(map[string]interface{}{"index": map[string]string{"_index": e.IndexName, "_id": doc.ID}})
+		source, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		buf.Write(action)
+		buf.WriteString("\n")
+		buf.Write(source)
+		buf.WriteString("\n")
+	}
+
+	res, err := e.client.Post(e.URL+"/_bulk", "application/x-ndjson", &buf)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Bulk request fail with status %d, %s", res.StatusCode, body)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+	}
+	json.Unmarshal(body, &result)
+	if result.Errors {
+		return fmt.Errorf("Some of the %d pages fail to index", len(docs))
+	}
+	return nil
+}
+
+func (e *ESSearchIndex) Close() error {
+	return nil
+}
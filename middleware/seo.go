@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/util"
+	"golang.org/x/net/html"
+)
+
+// The issues of the pages in the SEO report.
+const (
+	SEOMissingTitle         = "missing_title"
+	SEOShortTitle           = "short_title"
+	SEOLongTitle            = "long_title"
+	SEODuplicateTitle       = "duplicate_title"
+	SEOMissingDescription   = "missing_description"
+	SEOShortDescription     = "short_description"
+	SEOLongDescription      = "long_description"
+	SEODuplicateDescription = "duplicate_description"
+	SEOMissingH1            = "missing_h1"
+	SEOMultipleH1           = "multiple_h1"
+	SEONoindex              = "noindex"
+	SEOCanonicalized        = "canonicalized"
+	SEORedirectChain        = "redirect_chain"
+	SEOHttpError            = "http_error"
+)
+
+// SEOPage is what the SEOAuditMiddleware finds on a page. The lengths are in characters, and Robots
+// has the robots meta tag and the X-Robots-Tag header. Only the html pages answered 200 are analyzed,
+// the others only have their status and redirects.
+type SEOPage struct {
+	URL       string        `json:"url"`
+	Status    int           `json:"status"`
+	Redirects []SEORedirect `json:"redirects,omitempty"`
+
+	Title             string `json:"title,omitempty"`
+	TitleLength       int    `json:"title_length"`
+	Description       string `json:"description,omitempty"`
+	DescriptionLength int    `json:"description_length"`
+	H1Count           int    `json:"h1_count"`
+	Canonical         string `json:"canonical,omitempty"`
+	Robots            string `json:"robots,omitempty"`
+
+	Issues []string `json:"issues,omitempty"`
+}
+
+// SEORedirect is a hop of the redirect chain of a page.
+type SEORedirect struct {
+	URL    string `json:"url"`
+	Status int    `json:"status"`
+}
+
+// SEOReport aggregates the pages of a crawl, the numbers of the pages by their statuses and by their issues,
+// and the urls sharing the same titles or descriptions. The pages are sorted by their urls.
+type SEOReport struct {
+	Pages                 int                 `json:"pages"`
+	Statuses              map[int]int         `json:"statuses"`
+	Issues                map[string]int      `json:"issues"`
+	DuplicateTitles       map[string][]string `json:"duplicate_titles,omitempty"`
+	DuplicateDescriptions map[string][]string `json:"duplicate_descriptions,omitempty"`
+	Details               []*SEOPage          `json:"details"`
+}
+
+// SEOAuditMiddleware is a spider middleware, it records the title and the meta description lengths, the h1 counts,
+// the canonical and robots directives, the status and the redirect chain of every crawled page,
+// and saves the SEOReport to the Report as JSON when the spider closes. A title or a description
+// out of its min and max length is an issue, 0 means no limitation.
+// Add it before the HttpErrorMiddleware, otherwise the error pages are dropped before they are recorded.
+type SEOAuditMiddleware struct {
+	BaseMiddleware
+
+	Report string
+
+	TitleMinLength       int
+	TitleMaxLength       int
+	DescriptionMinLength int
+	DescriptionMaxLength int
+
+	pages map[string]*SEOPage
+	mutex sync.Mutex
+}
+
+func (m *SEOAuditMiddleware) Open(spider *leiogo.Spider) error {
+	m.pages = make(map[string]*SEOPage)
+	return nil
+}
+
+func (m *SEOAuditMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if typename, _ := req.Meta["__type__"].(string); typename == "file" || res.Err != nil {
+		return nil
+	}
+
+	page := &SEOPage{URL: req.URL, Status: res.StatusCode}
+	final := req.URL
+	for _, r := range res.Redirects {
+		page.Redirects = append(page.Redirects, SEORedirect{URL: r.URL, Status: r.StatusCode})
+		final = r.Location
+	}
+	if len(res.Redirects) > 1 {
+		page.Issues = append(page.Issues, SEORedirectChain)
+	}
+	if res.StatusCode >= 400 {
+		page.Issues = append(page.Issues, SEOHttpError)
+	}
+	if res.StatusCode == 200 && isHTML(res) {
+		m.analyze(page, res, final)
+	}
+
+	m.mutex.Lock()
+	m.pages[req.URL] = page
+	m.mutex.Unlock()
+	return nil
+}
+
+func isHTML(res *leiogo.Response) bool {
+	if contentType := res.Header.Get("Content-Type"); contentType != "" {
+		return strings.Contains(strings.ToLower(contentType), "html")
+	}
+	return bytes.HasPrefix(bytes.TrimSpace(res.Body), []byte("<"))
+}
+
+func (m *SEOAuditMiddleware) analyze(page *SEOPage, res *leiogo.Response, final string) {
+	doc, err := html.Parse(bytes.NewReader(res.Body))
+	if err != nil {
+		return
+	}
+
+	var robots []string
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "title":
+				// The titles of the inline svg images are not the title of the page.
+				if page.Title == "" && n.Namespace == "" {
+					page.Title = strings.TrimSpace(nodeText(n))
+				}
+			case "h1":
+				page.H1Count++
+			case "meta":
+				name := strings.ToLower(attr(n, "name"))
+				if name == "description" && page.Description == "" {
+					page.Description = strings.TrimSpace(attr(n, "content"))
+				} else if name == "robots" {
+					robots = append(robots, attr(n, "content"))
+				}
+			case "link":
+				if page.Canonical == "" && strings.EqualFold(attr(n, "rel"), "canonical") {
+					page.Canonical = attr(n, "href")
+					if u, err := util.JoinURL(final, page.Canonical); err == nil {
+						page.Canonical = u
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	robots = append(robots, res.Header.Values("X-Robots-Tag")...)
+	page.Robots = strings.Join(robots, ", ")
+	page.TitleLength = utf8.RuneCountInString(page.Title)
+	page.DescriptionLength = utf8.RuneCountInString(page.Description)
+
+	page.Issues = append(page.Issues, lengthIssues(page.TitleLength, m.TitleMinLength, m.TitleMaxLength,
+		SEOMissingTitle, SEOShortTitle, SEOLongTitle)...)
+	page.Issues = append(page.Issues, lengthIssues(page.DescriptionLength, m.DescriptionMinLength, m.DescriptionMaxLength,
+		SEOMissingDescription, SEOShortDescription, SEOLongDescription)...)
+	switch {
+	case page.H1Count == 0:
+		page.Issues = append(page.Issues, SEOMissingH1)
+	case page.H1Count > 1:
+		page.Issues = append(page.Issues, SEOMultipleH1)
+	}
+	if strings.Contains(strings.ToLower(page.Robots), "noindex") {
+		page.Issues = append(page.Issues, SEONoindex)
+	}
+	if page.Canonical != "" && page.Canonical != final {
+		page.Issues = append(page.Issues, SEOCanonicalized)
+	}
+}
+
+func lengthIssues(length, min, max int, missing, short, long string) []string {
+	switch {
+	case length == 0:
+		return []string{missing}
+	case min > 0 && length < min:
+		return []string{short}
+	case max > 0 && length > max:
+		return []string{long}
+	}
+	return nil
+}
+
+func nodeText(n *html.Node) string {
+	var buf bytes.Buffer
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.TextNode {
+			buf.WriteString(c.Data)
+		}
+	}
+	return buf.String()
+}
+
+// Result returns the report of the pages recorded so far. The duplicate titles and descriptions
+// are issues of all the pages sharing them.
+func (m *SEOAuditMiddleware) Result() *SEOReport {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	report := &SEOReport{
+		Pages:                 len(m.pages),
+		Statuses:              make(map[int]int),
+		Issues:                make(map[string]int),
+		DuplicateTitles:       make(map[string][]string),
+		DuplicateDescriptions: make(map[string][]string),
+	}
+	titles := make(map[string][]*SEOPage)
+	descriptions := make(map[string][]*SEOPage)
+	for _, page := range m.pages {
+		copied := *page
+		copied.Issues = append([]string{}, page.Issues...)
+		report.Details = append(report.Details, &copied)
+		if page.Title != "" {
+			titles[page.Title] = append(titles[page.Title], &copied)
+		}
+		if page.Description != "" {
+			descriptions[page.Description] = append(descriptions[page.Description], &copied)
+		}
+	}
+	duplicates(titles, report.DuplicateTitles, SEODuplicateTitle)
+	duplicates(descriptions, report.DuplicateDescriptions, SEODuplicateDescription)
+
+	sort.Slice(report.Details, func(i, j int) bool { return report.Details[i].URL < report.Details[j].URL })
+	for _, page := range report.Details {
+		report.Statuses[page.Status]++
+		for _, issue := range page.Issues {
+			report.Issues[issue]++
+		}
+	}
+	return report
+}
+
+// Add the issue to the pages sharing a text, and the sorted urls of them to the duplicates.
+func duplicates(pages map[string][]*SEOPage, urls map[string][]string, issue string) {
+	for text, ps := range pages {
+		if len(ps) < 2 {
+			continue
+		}
+		for _, page := range ps {
+			page.Issues = append(page.Issues, issue)
+			urls[text] = append(urls[text], page.URL)
+		}
+		sort.Strings(urls[text])
+	}
+}
+
+func (m *SEOAuditMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	report := m.Result()
+	m.Logger.Info(spider.Name, "Audited %d pages, issues: %v", report.Pages, report.Issues)
+	if m.Report == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(m.Report, buf, 0644)
+	}
+	if err != nil {
+		m.Logger.Error(spider.Name, "Save the SEO report to %s fail, %s", m.Report, err)
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package middleware
+
+import (
+	"bufio"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+const (
+	SitemapXML  = "xml"
+	SitemapText = "txt"
+
+	// The limit of the urls in a sitemap file by the sitemap protocol.
+	sitemapMaxURLs = 50000
+)
+
+// SitemapMiddleware is a spider middleware, it writes the pages crawled successfully into a sitemap
+// when the spider closes, for the site audits and the migration plans. The lastmod of a page is
+// its Last-Modified header, and it's left out if the header is missing. A redirected page is listed
+// by the url it's redirected to.
+//
+// The Format is either "xml", a sitemap of sitemaps.org, or "txt", a line for each page with the url
+// and the lastmod separated by a tab. An xml sitemap of more than 50,000 pages is split into
+// FileName-0001.xml, FileName-0002.xml and so on, and FileName is the sitemap index of them,
+// where the locations are the file names after BaseURL, which is the url the sitemaps are served at.
+type SitemapMiddleware struct {
+	BaseMiddleware
+
+	FileName string
+	Format   string
+	BaseURL  string
+
+	pages map[string]time.Time
+	mutex sync.Mutex
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+func (m *SitemapMiddleware) Open(spider *leiogo.Spider) error {
+	m.pages = make(map[string]time.Time)
+	return nil
+}
+
+func (m *SitemapMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	if res.Err != nil || res.StatusCode != http.StatusOK {
+		return nil
+	}
+	url := req.URL
+	if n := len(res.Redirects); n > 0 {
+		url = res.Redirects[n-1].Location
+	}
+	lastmod, _ := http.ParseTime(res.Header.Get("Last-Modified"))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if t, ok := m.pages[url]; !ok || lastmod.After(t) {
+		m.pages[url] = lastmod
+	}
+	return nil
+}
+
+func (m *SitemapMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	urls := make([]sitemapURL, 0, len(m.pages))
+	for url, lastmod := range m.pages {
+		u := sitemapURL{Loc: url}
+		if !lastmod.IsZero() {
+			u.LastMod = lastmod.UTC().Format(time.RFC3339)
+		}
+		urls = append(urls, u)
+	}
+	sort.Slice(urls, func(i, j int) bool { return urls[i].Loc < urls[j].Loc })
+
+	var err error
+	switch {
+	case m.Format == SitemapText:
+		err = m.writeText(urls)
+	case len(urls) <= sitemapMaxURLs:
+		err = writeXML(m.FileName, &sitemapURLSet{URLs: urls})
+	default:
+		err = m.writeIndex(urls)
+	}
+	if err != nil {
+		m.Logger.Error(spider.Name, "Write sitemap %s fail, %s", m.FileName, err)
+		return err
+	}
+	m.Logger.Info(spider.Name, "Saved the sitemap of %d pages to %s", len(urls), m.FileName)
+	return nil
+}
+
+func (m *SitemapMiddleware) writeText(urls []sitemapURL) error {
+	file, err := os.Create(m.FileName)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	for _, u := range urls {
+		fmt.Fprintf(w, "%s\t%s\n", u.Loc, u.LastMod)
+	}
+	if err = w.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Split the urls into the sitemaps, and write the index of them to the FileName.
+func (m *SitemapMiddleware) writeIndex(urls []sitemapURL) error {
+	ext := filepath.Ext(m.FileName)
+	index := &sitemapIndex{}
+	for i := 0; i*sitemapMaxURLs < len(urls); i++ {
+		end := (i + 1) * sitemapMaxURLs
+		if end > len(urls) {
+			end = len(urls)
+		}
+		name := fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(m.FileName, ext), i+1, ext)
+		if err := writeXML(name, &sitemapURLSet{URLs: urls[i*sitemapMaxURLs : end]}); err != nil {
+			return err
+		}
+		index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: m.BaseURL + filepath.Base(name)})
+	}
+	return writeXML(m.FileName, index)
+}
+
+func writeXML(filename string, v interface{}) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	w.WriteString(xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err = enc.Encode(v); err == nil {
+		w.WriteString("\n")
+		err = w.Flush()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,253 @@
+package middleware
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// SQLPipeline writes the items into a table through database/sql, so it works with
+// Postgres, MySQL, SQLite and so on. Remember to import the driver in your spider, like:
+//
+//	import _ "github.com/lib/pq"
+//
+// The items are buffered and written in batches, each batch in a transaction with a prepared statement.
+// Nested items are flattened with "_" as the separator, see Item.Flatten.
+type SQLPipeline struct {
+	Base
+
+	DriverName string
+	DSN        string
+	Table      string
+
+	// Columns defines the fields to write. If it's empty, the sorted keys of the first item will be used.
+	Columns []string
+
+	// Mapping maps the field names to the column names, the fields not in the mapping use their own names.
+	Mapping map[string]string
+
+	// If KeyColumn is not empty, the idempotency key of each item is written into this column,
+	// and the items with the same key are upserted instead of inserted, so re-processing items
+	// after failures won't double count them. The column should have a unique index.
+	// KeyFields defines which fields make up the key, see Item.Key.
+	KeyColumn string
+	KeyFields []string
+
+	// The number of items in a batch, the default value is 1.
+	BatchSize int
+
+	// A row failing to write for more than MaxRetries times is dropped and logged, so a row the table
+	// rejects doesn't block the others, 0 means defaultSQLMaxRetries. While the database is down,
+	// at most MaxBuffered rows are kept for the next batches, the oldest ones are dropped. 0 means no limit.
+	MaxRetries  int
+	MaxBuffered int
+
+	// The number of the dropped rows.
+	Dropped int
+
+	db    *sql.DB
+	rows  []*sqlRow
+	mutex sync.Mutex
+}
+
+// The retries of a row if the MaxRetries is not set, a row is never dropped by its first failure.
+const defaultSQLMaxRetries = 3
+
+type sqlRow struct {
+	values []interface{}
+	fails  int
+}
+
+func (p *SQLPipeline) Open(spider *leiogo.Spider) error {
+	if p.MaxRetries <= 0 {
+		p.MaxRetries = defaultSQLMaxRetries
+	}
+	var err error
+	if p.db, err = sql.Open(p.DriverName, p.DSN); err == nil {
+		err = p.db.Ping()
+	}
+	if err != nil {
+		p.Logger.Error(spider.Name, "Connect to %s fail, %s", p.DriverName, err)
+		return err
+	}
+	p.Logger.Info(spider.Name, "Connected to %s, writing to table %s", p.DriverName, p.Table)
+	return nil
+}
+
+func (p *SQLPipeline) Close(reason string, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	// The rows after a failed row are written once it's dropped.
+	rowFailed, err := p.flush(spider)
+	for err != nil && rowFailed {
+		rowFailed, err = p.flush(spider)
+	}
+	if err != nil {
+		p.Logger.Error(spider.Name, "Flush %d items fail, %s", len(p.rows), err)
+	}
+	if closeErr := p.db.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (p *SQLPipeline) Buffered() bool {
+	return true
+}
+
+func (p *SQLPipeline) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	data := item.Flatten("_")
+	if len(p.Columns) == 0 {
+		p.Columns = sortedKeys(data)
+	}
+
+	row := make([]interface{}, 0, len(p.Columns)+1)
+	for _, col := range p.Columns {
+		row = append(row, sqlValue(data[col]))
+	}
+	if p.KeyColumn != "" {
+		row = append(row, item.Key(p.KeyFields...))
+	}
+	p.rows = append(p.rows, &sqlRow{values: row})
+
+	if len(p.rows) >= p.BatchSize {
+		_, err := p.flush(spider)
+		if err != nil {
+			p.limit(spider)
+		}
+		return err
+	}
+	return nil
+}
+
+// Write all the buffered rows in a transaction. The rows are kept if the transaction fails,
+// so they will be tried again with the next batch, except the row failing for more than MaxRetries times.
+// rowFailed tells the error is of a row, not of the database.
+func (p *SQLPipeline) flush(spider *leiogo.Spider) (rowFailed bool, err error) {
+	if len(p.rows) == 0 {
+		return false, nil
+	}
+
+	tx, err := p.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	stmt, err := tx.Prepare(p.statement())
+	if err != nil {
+		tx.Rollback()
+		return false, err
+	}
+	for i, row := range p.rows {
+		if _, err = stmt.Exec(row.values...); err != nil {
+			stmt.Close()
+			tx.Rollback()
+			if row.fails++; row.fails > p.MaxRetries {
+				p.Logger.Error(spider.Name, "Drop the row %v failed for %d times, %s", row.values, row.fails, err)
+				p.rows = append(p.rows[:i], p.rows[i+1:]...)
+				p.Dropped++
+			}
+			return true, err
+		}
+	}
+	stmt.Close()
+	if err = tx.Commit(); err != nil {
+		return false, err
+	}
+
+	p.rows = p.rows[:0]
+	return false, nil
+}
+
+// Drop the oldest rows beyond MaxBuffered.
+func (p *SQLPipeline) limit(spider *leiogo.Spider) {
+	if n := len(p.rows) - p.MaxBuffered; p.MaxBuffered > 0 && n > 0 {
+		p.Logger.Error(spider.Name, "Drop the %d oldest rows, more than %d rows are not written", n, p.MaxBuffered)
+		p.rows = append(p.rows[:0], p.rows[n:]...)
+		p.Dropped += n
+	}
+}
+
+// Build the insert or upsert statement, the syntax depends on the driver.
+func (p *SQLPipeline) statement() string {
+	var cols []string
+	for _, field := range p.Columns {
+		if col, ok := p.Mapping[field]; ok {
+			cols = append(cols, p.quote(col))
+		} else {
+			cols = append(cols, p.quote(field))
+		}
+	}
+	if p.KeyColumn != "" {
+		cols = append(cols, p.quote(p.KeyColumn))
+	}
+
+	postgres := p.DriverName == "postgres" || p.DriverName == "pgx"
+	holders := make([]string, len(cols))
+	for i := range cols {
+		if postgres {
+			holders[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			holders[i] = "?"
+		}
+	}
+
+	// The table may be qualified by its schema, like public.items.
+	table := strings.Split(p.Table, ".")
+	for i, name := range table {
+		table[i] = p.quote(name)
+	}
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", strings.Join(table, "."), strings.Join(cols, ", "), strings.Join(holders, ", "))
+	if p.KeyColumn == "" {
+		return stmt
+	}
+
+	var updates []string
+	for _, col := range cols[:len(cols)-1] {
+		if p.DriverName == "mysql" {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", col, col))
+		} else {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", col, col))
+		}
+	}
+	if p.DriverName == "mysql" {
+		return stmt + " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	}
+	return stmt + fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", p.quote(p.KeyColumn), strings.Join(updates, ", "))
+}
+
+// Quote the name by the dialect of the driver, so the field names of the items, like the reserved words
+// or the names with spaces, never break or inject into the statement. The quotes in the name are doubled.
+func (p *SQLPipeline) quote(name string) string {
+	q := `"`
+	if p.DriverName == "mysql" {
+		q = "`"
+	}
+	return q + strings.Replace(name, q, q+q, -1) + q
+}
+
+// The drivers only accept the basic types, the other values are written in JSON.
+func sqlValue(val interface{}) interface{} {
+	switch val.(type) {
+	case nil, string, int, int64, float64, bool, []byte:
+		return val
+	default:
+		return csvValue(val)
+	}
+}
+
+func sortedKeys(data leiogo.Dict) []string {
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,133 @@
+package middleware
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// Quota limits the resources a tenant may use, 0 means no limitation.
+type Quota struct {
+	// The number of the requests to download.
+	Pages int
+
+	// The bytes read from the network, of the pages, the streams and the files, and the bodies of the rendered pages.
+	// The downloaders count them, see DefaultDownloader.Tenants.
+	Bytes int64
+
+	// The number of the pages rendered by phantomjs or Chrome, which are much more expensive than the others.
+	Rendered int
+}
+
+// TenantUsage is the resources a tenant has used.
+type TenantUsage struct {
+	Pages    int
+	Bytes    int64
+	Rendered int
+	Refused  int
+}
+
+// Tenants keeps the quotas and the usages of the tenants, a tenant is the Tenant of the spiders.
+// When a service runs the spiders of many users in one process, the crawlers share the same Tenants,
+// so the quota of a tenant applies to all its spiders.
+type Tenants struct {
+	Quotas map[string]Quota
+
+	usages map[string]*TenantUsage
+	mutex  sync.Mutex
+}
+
+func NewTenants(quotas map[string]Quota) *Tenants {
+	return &Tenants{Quotas: quotas, usages: make(map[string]*TenantUsage)}
+}
+
+func (t *Tenants) usage(tenant string) *TenantUsage {
+	u, ok := t.usages[tenant]
+	if !ok {
+		u = &TenantUsage{}
+		t.usages[tenant] = u
+	}
+	return u
+}
+
+// Usage returns a copy of the usage of the tenant.
+func (t *Tenants) Usage(tenant string) TenantUsage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return *t.usage(tenant)
+}
+
+// Take a page from the quota of the tenant, it returns an error if the quota runs out.
+func (t *Tenants) take(tenant string, rendered bool) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	u, q := t.usage(tenant), t.Quotas[tenant]
+	var err error
+	if q.Pages > 0 && u.Pages >= q.Pages {
+		err = fmt.Errorf("pages %d", q.Pages)
+	} else if q.Bytes > 0 && u.Bytes >= q.Bytes {
+		err = fmt.Errorf("bytes %d", q.Bytes)
+	} else if rendered && q.Rendered > 0 && u.Rendered >= q.Rendered {
+		err = fmt.Errorf("rendered pages %d", q.Rendered)
+	}
+	if err != nil {
+		u.Refused++
+		return err
+	}
+
+	u.Pages++
+	if rendered {
+		u.Rendered++
+	}
+	return nil
+}
+
+// AddBytes counts the bytes into the usage of the tenant.
+func (t *Tenants) AddBytes(tenant string, n int64) {
+	t.mutex.Lock()
+	t.usage(tenant).Bytes += n
+	t.mutex.Unlock()
+}
+
+// TenantQuotaMiddleware is a download middleware, it drops the requests of the spiders whose tenants
+// have run out of their quotas. The spiders without a Tenant are not limited.
+// The bytes are counted by the downloaders sharing the Tenants, since only they know the bytes read from the network.
+type TenantQuotaMiddleware struct {
+	BaseMiddleware
+
+	Tenants *Tenants
+
+	// The hosts rendering their pages with the "Render" setting, see HostSettings.
+	HostSettings HostSettings
+}
+
+// A request is rendered by phantomjs with 'phantomjs' in its meta or the "Render" setting of its host,
+// or by Chrome with 'render' in its meta.
+func (m *TenantQuotaMiddleware) rendered(req *leiogo.Request) bool {
+	if enable, ok := req.Meta["phantomjs"].(bool); (ok && enable) || (!ok && m.HostSettings.Bool(req.URL, "Render", false)) {
+		return true
+	}
+	render, _ := req.Meta["render"].(bool)
+	return render
+}
+
+func (m *TenantQuotaMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	if spider.Tenant != "" {
+		u, q := m.Tenants.Usage(spider.Tenant), m.Tenants.Quotas[spider.Tenant]
+		m.Logger.Info(spider.Name, "Tenant %s used pages: %d/%d, bytes: %d/%d, rendered: %d/%d, refused: %d",
+			spider.Tenant, u.Pages, q.Pages, u.Bytes, q.Bytes, u.Rendered, q.Rendered, u.Refused)
+	}
+	return nil
+}
+
+func (m *TenantQuotaMiddleware) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
+	if spider.Tenant == "" {
+		return nil
+	}
+	if err := m.Tenants.take(spider.Tenant, m.rendered(req)); err != nil {
+		return &DropTaskError{Message: fmt.Sprintf("Tenant %s exceeds the quota of %s", spider.Tenant, err)}
+	}
+	return nil
+}
@@ -0,0 +1,297 @@
+package middleware
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// The reasons of the traps.
+const (
+	TrapLowYield   = "low yield"
+	TrapCalendar   = "calendar"
+	TrapQueryKeys  = "query permutations"
+	TrapSessionIDs = "session ids"
+)
+
+// Trap is a url family found to be a trap by the TrapDetectorMiddleware. Rule is a regular expression
+// matching the urls of the family, it can be added to the DenyRules to skip the family from the start.
+type Trap struct {
+	Family  string  `json:"family"`
+	Rule    string  `json:"rule"`
+	Reason  string  `json:"reason"`
+	Pages   int     `json:"pages"`
+	Yield   float64 `json:"yield"`
+	Example string  `json:"example"`
+}
+
+// The statistics of a url family.
+type urlFamily struct {
+	rule     string
+	calendar bool
+	pages    int
+	yield    int
+	keySets  map[string]bool
+	sessions map[string]bool
+	example  string
+	trap     *Trap
+}
+
+// TrapDetectorMiddleware is a spider middleware, it detects the crawl traps, like the infinite calendars,
+// the faceted navigation producing ever-growing query permutations, and the session ids in the paths,
+// and stops following them.
+// The urls are grouped into families by their hosts and paths, with the numbers replaced by {n},
+// the long tokens by {id}, and the session ids by {session}, like "example.com/calendar/{n}/{n}".
+// The yield of a family is the number of the new urls out of the family found on its pages per page.
+// A family is a trap when:
+//
+//	low yield          - its yield is lower than MinYield after MinPages pages
+//	calendar           - the same, but after CalendarPages pages, if its urls look like dates
+//	query permutations - its urls have more than MaxQueryKeySets different sets of query keys
+//	session ids        - its urls have more than MaxSessionIDs different session ids
+//
+// The families linking only to themselves, like the detail pages of a site whose items are the only output,
+// also have a low yield, so MinPages should be larger than such a family.
+// The new requests of a trap are dropped, and the traps are logged when the spider closes,
+// and reported in the run result, so the users can add their rules to DenyRules.
+type TrapDetectorMiddleware struct {
+	BaseMiddleware
+
+	MinPages        int
+	MinYield        float64
+	CalendarPages   int
+	MaxQueryKeySets int
+	MaxSessionIDs   int
+
+	// The urls matching any of the rules are always dropped.
+	DenyRules []string
+
+	deny     []*regexp.Regexp
+	families map[string]*urlFamily
+	seen     *BloomDupeFilter
+	mutex    sync.Mutex
+}
+
+// The urls seen by the TrapDetectorMiddleware are kept in a bloom filter of the size, a false positive
+// only misses a new url in the yield of its family.
+const (
+	trapSeenSize   = 1000000
+	trapSeenFPRate = 0.001
+)
+
+var (
+	trapDigitsRe   = regexp.MustCompile(`[0-9]+`)
+	trapIDRe       = regexp.MustCompile(`^[0-9a-zA-Z_-]{16,}$`)
+	trapSessionRe  = regexp.MustCompile(`(?i)((jsessionid|phpsessid|aspsessionid\w*|sessionid|session_id|sessid|sid)=)([0-9a-z_-]+)|\(S\(([0-9a-z]+)\)\)`)
+	trapDateRe     = regexp.MustCompile(`(^|/)(19|20)[0-9]{2}([/-][0-9]{1,2})`)
+	trapDateKeysRe = regexp.MustCompile(`(?i)(^|&)(date|year|month|day|week|from|to|start|end)(&|$)`)
+)
+
+func (m *TrapDetectorMiddleware) Open(spider *leiogo.Spider) error {
+	deny, err := CompileDenyRules(m.DenyRules)
+	if err != nil {
+		m.Logger.Error(spider.Name, "Open TrapDetectorMiddleware fail, %s", err.Error())
+		return err
+	}
+	m.deny = deny
+	m.families = make(map[string]*urlFamily)
+	m.seen = NewBloomDupeFilter(trapSeenSize, trapSeenFPRate)
+	return m.BaseMiddleware.Open(spider)
+}
+
+// CompileDenyRules compiles the DenyRules, the error tells the first invalid one.
+func CompileDenyRules(rules []string) ([]*regexp.Regexp, error) {
+	res := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid deny rule %s, %s", rule, err.Error())
+		}
+		res[i] = re
+	}
+	return res, nil
+}
+
+func (m *TrapDetectorMiddleware) Close(reason string, spider *leiogo.Spider) error {
+	for _, trap := range m.Traps() {
+		m.Logger.Info(spider.Name, "Found trap %s (%s) after %d pages, like %s, add the rule %s to skip it",
+			trap.Family, trap.Reason, trap.Pages, trap.Example, trap.Rule)
+	}
+	return m.BaseMiddleware.Close(reason, spider)
+}
+
+// Split the url into its family, the session id if it has one, and the sorted keys of its query.
+// The rule of the family is a regular expression matching the urls of the family.
+func parseFamily(u *url.URL) (family string, rule string, session string, keys string) {
+	p := u.EscapedPath()
+	if match := trapSessionRe.FindStringSubmatch(p); match != nil {
+		session = match[3] + match[4]
+		p = trapSessionRe.ReplaceAllString(p, "${1}{session}")
+	}
+
+	segments := strings.Split(p, "/")
+	rules := make([]string, len(segments))
+	for i, seg := range segments {
+		switch {
+		case strings.Contains(seg, "{session}"):
+			parts := strings.Split(seg, "{session}")
+			quoted := make([]string, len(parts))
+			for j, part := range parts {
+				parts[j] = trapDigitsRe.ReplaceAllString(part, "{n}")
+				quoted[j] = trapDigitsRe.ReplaceAllString(regexp.QuoteMeta(part), "[0-9]+")
+			}
+			segments[i], rules[i] = strings.Join(parts, "{session}"), strings.Join(quoted, `[^/;?]+`)
+		case trapIDRe.MatchString(seg) && trapDigitsRe.MatchString(seg):
+			segments[i], rules[i] = "{id}", `[^/]+`
+		default:
+			segments[i] = trapDigitsRe.ReplaceAllString(seg, "{n}")
+			rules[i] = trapDigitsRe.ReplaceAllString(regexp.QuoteMeta(seg), "[0-9]+")
+		}
+	}
+
+	query := u.Query()
+	names := make([]string, 0, len(query))
+	for k := range query {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	keys = strings.Join(names, "&")
+
+	host := strings.ToLower(u.Host)
+	family = host + strings.Join(segments, "/")
+	rule = `^https?://` + regexp.QuoteMeta(host) + strings.Join(rules, "/")
+	return
+}
+
+func (m *TrapDetectorMiddleware) family(u *url.URL) (*urlFamily, string, string) {
+	name, rule, session, keys := parseFamily(u)
+	f, ok := m.families[name]
+	if !ok {
+		f = &urlFamily{
+			rule:     rule,
+			calendar: trapDateRe.MatchString(u.Path) || trapDateKeysRe.MatchString(keys),
+			keySets:  make(map[string]bool),
+			sessions: make(map[string]bool),
+			example:  u.String(),
+		}
+		m.families[name] = f
+	}
+	return f, session, keys
+}
+
+// A family without any placeholder or query is a single page, it can't be a trap.
+func isPattern(name string, keys string) bool {
+	return keys != "" || strings.Contains(name, "{")
+}
+
+func (m *TrapDetectorMiddleware) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.seen.Add(req.URL)
+	f, _, _ := m.family(u)
+	f.pages++
+	if f.trap != nil {
+		f.trap.Pages = f.pages
+	}
+	return nil
+}
+
+func (m *TrapDetectorMiddleware) ProcessNewRequest(req *leiogo.Request, parentRes *leiogo.Response, spider *leiogo.Spider) error {
+	for _, rule := range m.deny {
+		if rule.MatchString(req.URL) {
+			return &DropTaskError{Message: "URL denied by rule " + rule.String()}
+		}
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil {
+		return nil
+	}
+	parent, err := url.Parse(parentRes.URL)
+	if err != nil {
+		return nil
+	}
+	name, _, _, _ := parseFamily(u)
+	parentName, _, _, _ := parseFamily(parent)
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The new urls out of the family are the yield of the parent family.
+	if name != parentName && !m.seen.Seen(req.URL) {
+		f, _, _ := m.family(parent)
+		f.yield++
+	}
+	m.seen.Add(req.URL)
+
+	f, session, keys := m.family(u)
+	if session != "" {
+		f.sessions[session] = true
+	}
+	if keys != "" {
+		f.keySets[keys] = true
+	}
+	if f.trap == nil && isPattern(name, keys) {
+		m.check(f, name, spider)
+	}
+
+	if f.trap != nil && (f.trap.Reason != TrapQueryKeys || keys != "") {
+		return &DropTaskError{Message: fmt.Sprintf("URL trap %s (%s)", name, f.trap.Reason)}
+	}
+	return nil
+}
+
+func (m *TrapDetectorMiddleware) check(f *urlFamily, name string, spider *leiogo.Spider) {
+	yield := 0.0
+	if f.pages > 0 {
+		yield = float64(f.yield) / float64(f.pages)
+	}
+
+	reason := ""
+	switch {
+	case m.MaxSessionIDs > 0 && len(f.sessions) > m.MaxSessionIDs:
+		reason = TrapSessionIDs
+	case m.MaxQueryKeySets > 0 && len(f.keySets) > m.MaxQueryKeySets:
+		reason = TrapQueryKeys
+	case f.calendar && m.CalendarPages > 0 && f.pages >= m.CalendarPages && yield < m.MinYield:
+		reason = TrapCalendar
+	case m.MinPages > 0 && f.pages >= m.MinPages && yield < m.MinYield:
+		reason = TrapLowYield
+	default:
+		return
+	}
+
+	// Only the urls with queries are dropped for the query permutations.
+	rule := f.rule + `([?#].*)?$`
+	if reason == TrapQueryKeys {
+		rule = f.rule + `\?.+$`
+	}
+	f.trap = &Trap{Family: name, Rule: rule, Reason: reason, Pages: f.pages, Yield: yield, Example: f.example}
+	m.Logger.Error(spider.Name, "Stop following %s, it seems a trap of %s, %d pages yield %.2f new urls per page",
+		name, reason, f.pages, yield)
+}
+
+// Traps returns a copy of the traps found so far, sorted by their families.
+func (m *TrapDetectorMiddleware) Traps() []*Trap {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var traps []*Trap
+	for _, f := range m.families {
+		if f.trap != nil {
+			copied := *f.trap
+			traps = append(traps, &copied)
+		}
+	}
+	sort.Slice(traps, func(i, j int) bool { return traps[i].Family < traps[j].Family })
+	return traps
+}
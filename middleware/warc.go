@@ -0,0 +1,299 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+)
+
+// WARCWriter records the http requests and responses of the downloader into WARC files, the standard
+// format of the web archives, so the crawl can be replayed by the tools like pywb.
+// The records are captured at the transport, so they have the headers and the bodies as they are sent
+// and received, before the downloader decompresses and decodes the bodies. Each record is a gzip member,
+// and a new file is started when the current one is larger than MaxSize, 0 means never.
+// A body larger than MaxBody is truncated in the record, 0 means no limitation.
+// The pages rendered by phantomjs are not recorded.
+//
+// If Bodies is set, the bodies are kept in it too, and a body which this writer has recorded before
+// is recorded as a revisit record of the identical payload digest profile, with the headers only,
+// referring to the uri and the date of the first record, so the identical bodies of many urls are archived once.
+// The bodies stored by the former crawls are recorded in full, since their records aren't in these files.
+type WARCWriter struct {
+	Base
+
+	Dir     string
+	Prefix  string
+	MaxSize int64
+	MaxBody int64
+	Bodies  BodyStore
+
+	Records int64
+
+	spider *leiogo.Spider
+	file   *os.File
+	size   int64
+	serial int
+
+	// The response records of the bodies written in full, by the payload digests.
+	originals map[string]warcOriginal
+	mutex     sync.Mutex
+}
+
+// warcOriginal is a response record which the revisit records of the same payload refer to.
+type warcOriginal struct {
+	id   string
+	uri  string
+	date string
+}
+
+func (w *WARCWriter) Open(spider *leiogo.Spider) error {
+	if err := os.MkdirAll(w.Dir, 0755); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.spider = spider
+	w.originals = make(map[string]warcOriginal)
+	return w.rotate(spider)
+}
+
+func (w *WARCWriter) Close(reason string, spider *leiogo.Spider) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.Logger.Info(spider.Name, "Recorded %d WARC records in %s", w.Records, w.Dir)
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Start a new file with a warcinfo record.
+func (w *WARCWriter) rotate(spider *leiogo.Spider) error {
+	if w.file != nil {
+		if err := w.file.Close(); err != nil {
+			return err
+		}
+	}
+	w.serial++
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", w.Prefix, time.Now().UTC().Format("20060102150405"), w.serial)
+	file, err := os.Create(path.Join(w.Dir, name))
+	if err != nil {
+		return err
+	}
+	w.file, w.size = file, 0
+
+	info := "software: leiogo\r\nformat: WARC File Format 1.0\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.0/\r\n" +
+		"isPartOf: " + spider.Name + "\r\n"
+	if spider.RunID != "" {
+		info += "runID: " + spider.RunID + "\r\n"
+	}
+	w.Logger.Info(spider.Name, "Start WARC file %s", name)
+	return w.writeRecord([][2]string{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", newRecordID()},
+		{"WARC-Date", time.Now().UTC().Format(time.RFC3339)},
+		{"WARC-Filename", name},
+		{"Content-Type", "application/warc-fields"},
+	}, []byte(info))
+}
+
+// Write a record as a gzip member, the Content-Length is added to the fields.
+func (w *WARCWriter) writeRecord(fields [][2]string, block []byte) error {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	fmt.Fprint(gz, "WARC/1.0\r\n")
+	for _, f := range fields {
+		fmt.Fprintf(gz, "%s: %s\r\n", f[0], f[1])
+	}
+	fmt.Fprintf(gz, "Content-Length: %d\r\n\r\n", len(block))
+	gz.Write(block)
+	fmt.Fprint(gz, "\r\n\r\n")
+	gz.Close()
+
+	n, err := w.file.Write(buf.Bytes())
+	w.size += int64(n)
+	if err == nil {
+		w.Records++
+	}
+	return err
+}
+
+// Write the request and the response as a pair of records.
+func (w *WARCWriter) record(req *http.Request, res *http.Response, body []byte, truncated bool, date time.Time) {
+	var reqBlock bytes.Buffer
+	fmt.Fprintf(&reqBlock, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	req.Header.Write(&reqBlock)
+	reqBlock.WriteString("\r\n")
+
+	// The body has been unchunked by the transport, and the HTTP/2 responses are written as HTTP/1.1,
+	// so the block is what a HTTP/1.1 parser expects.
+	var resBlock bytes.Buffer
+	fmt.Fprintf(&resBlock, "HTTP/1.1 %d %s\r\n", res.StatusCode, http.StatusText(res.StatusCode))
+	header := res.Header.Clone()
+	header.Del("Transfer-Encoding")
+	if !truncated {
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	header.Write(&resBlock)
+	resBlock.WriteString("\r\n")
+
+	uri := req.URL.String()
+	payloadDigest := digest(body)
+	// The truncated bodies are not complete contents, so they are never deduplicated.
+	dedup := w.Bodies != nil && !truncated && len(body) > 0
+	var original warcOriginal
+	revisit := false
+	if dedup {
+		if _, err := w.Bodies.Put(uri, body); err != nil {
+			w.Logger.Error(w.spider.Name, "Store the body of %s failed, %s", uri, err.Error())
+		}
+		w.mutex.Lock()
+		original, revisit = w.originals[payloadDigest]
+		w.mutex.Unlock()
+	}
+	if !revisit {
+		resBlock.Write(body)
+	}
+
+	warcDate := date.UTC().Format(time.RFC3339)
+	resID, reqID := newRecordID(), newRecordID()
+	resFields := [][2]string{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", resID},
+		{"WARC-Date", warcDate},
+		{"WARC-Target-URI", uri},
+		{"Content-Type", "application/http; msgtype=response"},
+		{"WARC-Block-Digest", digest(resBlock.Bytes())},
+		{"WARC-Payload-Digest", payloadDigest},
+	}
+	if revisit {
+		resFields[0][1] = "revisit"
+		resFields = append(resFields,
+			[2]string{"WARC-Profile", "http://netpreserve.org/warc/1.0/revisit/identical-payload-digest"},
+			[2]string{"WARC-Refers-To", original.id},
+			[2]string{"WARC-Refers-To-Target-URI", original.uri},
+			[2]string{"WARC-Refers-To-Date", original.date})
+	}
+	if truncated {
+		resFields = append(resFields, [2]string{"WARC-Truncated", "length"})
+	}
+	reqFields := [][2]string{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", reqID},
+		{"WARC-Date", warcDate},
+		{"WARC-Target-URI", uri},
+		{"WARC-Concurrent-To", resID},
+		{"Content-Type", "application/http; msgtype=request"},
+		{"WARC-Block-Digest", digest(reqBlock.Bytes())},
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.file == nil {
+		return
+	}
+	spider := w.spider
+	err := w.writeRecord(resFields, resBlock.Bytes())
+	if err == nil && dedup && !revisit {
+		if _, ok := w.originals[payloadDigest]; !ok {
+			w.originals[payloadDigest] = warcOriginal{id: resID, uri: uri, date: warcDate}
+		}
+	}
+	if err == nil {
+		err = w.writeRecord(reqFields, reqBlock.Bytes())
+	}
+	if err == nil && w.MaxSize > 0 && w.size > w.MaxSize {
+		err = w.rotate(spider)
+	}
+	if err != nil {
+		w.Logger.Error(spider.Name, "Write WARC record of %s failed, %s", uri, err.Error())
+	}
+}
+
+func newRecordID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func digest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// Transport wraps the transport of the downloader, so the exchanges are recorded
+// when their bodies are closed. Nil means http.DefaultTransport.
+func (w *WARCWriter) Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &warcTransport{RoundTripper: rt, writer: w}
+}
+
+type warcTransport struct {
+	http.RoundTripper
+	writer *WARCWriter
+}
+
+func (t *warcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	date := time.Now()
+	res, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	res.Body = &warcBody{ReadCloser: res.Body, transport: t, req: req, res: res, date: date}
+	return res, nil
+}
+
+// warcBody keeps a copy of the body it reads, and records the exchange when it's closed.
+// The body is truncated if it's closed before the end, or it's larger than the MaxBody.
+type warcBody struct {
+	io.ReadCloser
+	transport *warcTransport
+	req       *http.Request
+	res       *http.Response
+	date      time.Time
+	buf       bytes.Buffer
+	eof       bool
+	truncated bool
+	once      sync.Once
+}
+
+func (b *warcBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if max := b.transport.writer.MaxBody; max > 0 && int64(b.buf.Len()+n) > max {
+		b.buf.Write(p[:max-int64(b.buf.Len())])
+		b.truncated = true
+	} else if !b.truncated {
+		b.buf.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.eof = true
+	}
+	return n, err
+}
+
+func (b *warcBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.transport.writer.record(b.req, b.res, b.buf.Bytes(), b.truncated || !b.eof, b.date)
+	})
+	return err
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"sync/atomic"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/golang/snappy"
+)
+
+// The compressions of the response bodies, in the order of preference.
+// Snappy is much faster, gzip compresses more.
+var Compressions = []string{"snappy", "gzip"}
+
+type CompressedReqArgs struct {
+	ReqArgs
+
+	// The compressions the proxy accepts.
+	Accept []string
+}
+
+// CompressedResponse is the response with its body compressed by Encoding,
+// Body of the Response is moved to the Compressed field.
+type CompressedResponse struct {
+	Response   *leiogo.Response
+	Encoding   string
+	Compressed []byte
+}
+
+func compress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "snappy":
+		return snappy.Encode(nil, body), nil
+	case "gzip":
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return body, nil
+}
+
+func decompress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case "snappy":
+		return snappy.Decode(nil, data)
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return ioutil.ReadAll(r)
+	}
+	return data, nil
+}
+
+// DownloadCompressed downloads the request, and compresses the body with the first compression
+// in Compressions which the proxy accepts. The small bodies are not worth compressing.
+func (d *DownloaderServer) DownloadCompressed(args CompressedReqArgs, reply *CompressedResponse) error {
+	res := d.Downloader.Download(context.Background(), args.Req, args.Spider)
+	encodeResponse(res)
+	reply.Response = res
+
+	if len(res.Body) < 512 {
+		return nil
+	}
+	for _, encoding := range Compressions {
+		for _, accept := range args.Accept {
+			if encoding != accept {
+				continue
+			}
+			data, err := compress(encoding, res.Body)
+			if err != nil {
+				return nil
+			}
+			reply.Encoding, reply.Compressed = encoding, data
+			res.Body = nil
+			return nil
+		}
+	}
+	return nil
+}
+
+// Count the bytes of the bodies, before and after the compression.
+func (d *DownloaderProxy) count(raw int, wire int) {
+	atomic.AddInt64(&d.RawBytes, int64(raw))
+	atomic.AddInt64(&d.WireBytes, int64(wire))
+}
+
+// Saved returns the ratio of the bytes saved by the compression.
+func (d *DownloaderProxy) Saved() float64 {
+	raw, wire := atomic.LoadInt64(&d.RawBytes), atomic.LoadInt64(&d.WireBytes)
+	if raw == 0 {
+		return 0
+	}
+	return 1 - float64(wire)/float64(raw)
+}
@@ -0,0 +1,251 @@
+package proxy
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/rpc"
+	"strings"
+	"sync"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// The version of the protocol between the proxies and the servers. The servers before the handshake
+// are version 1. Bump it when the args or the replies change in a way the features can't describe.
+const ProtocolVersion = 2
+
+// The oldest version this version still talks to, with the missing features degraded. Each side rejects
+// the other side older than it, so a server newer than a proxy decides whether it still serves the proxy.
+const MinProtocolVersion = 1
+
+// VersionError is returned by the handshake with an incompatible side, the proxy never calls such a server.
+// Version is the version rejected, the Message tells the versions the rejecting side needs.
+type VersionError struct {
+	Version int
+	Message string
+}
+
+func newVersionError(version int) *VersionError {
+	return &VersionError{
+		Version: version,
+		Message: fmt.Sprintf("Protocol version %d is incompatible, need %d to %d", version, MinProtocolVersion, ProtocolVersion),
+	}
+}
+
+func (err *VersionError) Error() string {
+	return err.Message
+}
+
+// The features a proxy and a server may support, the proxy only uses the ones both sides support,
+// so a cluster of mixed versions still works, with the missing features degraded.
+const (
+	// The drop errors keep their types across the rpc, instead of becoming plain errors.
+	FeatureDropErrors = "droperrors"
+
+	// The responses carry the Header field.
+	FeatureHeader = "header"
+
+	// The server reads the streamed bodies, so the requests with 'stream' in the meta work remotely.
+	FeatureStream = "stream"
+
+	// See DownloaderServer.DownloadCompressed.
+	FeatureCompression = "compression"
+
+	// See ItemPipelineServer.ProcessBatch.
+	FeatureBatch = "batch"
+)
+
+// The features supported by this version.
+var Features = []string{FeatureDropErrors, FeatureHeader, FeatureStream, FeatureCompression, FeatureBatch}
+
+type Hello struct {
+	Version  int
+	Features []string
+}
+
+// HandshakeServer is embedded in all the servers, it replies the version, and the features
+// supported by both sides.
+type HandshakeServer struct{}
+
+func (h *HandshakeServer) Handshake(args Hello, reply *Hello) error {
+	if args.Version < MinProtocolVersion {
+		return newVersionError(args.Version)
+	}
+	reply.Version = ProtocolVersion
+	for _, f := range Features {
+		for _, g := range args.Features {
+			if f == g {
+				reply.Features = append(reply.Features, f)
+			}
+		}
+	}
+	return nil
+}
+
+// Capabilities is the result of the handshake with a server.
+type Capabilities struct {
+	Version  int
+	Features []string
+}
+
+func (c *Capabilities) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Missing returns the features of this version which the server doesn't support.
+func (c *Capabilities) Missing() []string {
+	var missing []string
+	for _, f := range Features {
+		if !c.Has(f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// Negotiate the capabilities with the service at url. The servers without the handshake
+// are treated as version 1 with no feature. It returns a VersionError if the server is older than
+// MinProtocolVersion, or the server rejects this version.
+func Negotiate(url string, srvcName string) (*Capabilities, error) {
+	reply := &Hello{}
+	err := Dial(url, func(client *rpc.Client) error {
+		return client.Call(srvcName+".Handshake", Hello{Version: ProtocolVersion, Features: Features}, reply)
+	})
+	if isMethodNotFound(err) {
+		reply.Version = 1
+	} else if isVersionError(err) {
+		return nil, &VersionError{Version: ProtocolVersion, Message: "Server rejects the protocol, " + err.Error()}
+	} else if err != nil {
+		return nil, err
+	}
+	if reply.Version < MinProtocolVersion {
+		return nil, newVersionError(reply.Version)
+	}
+	return &Capabilities{Version: reply.Version, Features: reply.Features}, nil
+}
+
+// The server rejecting this version replies the VersionError as a string.
+func isVersionError(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "Protocol version ")
+}
+
+// The servers without the method reply this error.
+func isMethodNotFound(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "can't find method")
+}
+
+// handshake negotiates once per proxy, when the proxy is first used.
+// The failed handshakes are not remembered, since the server may be not started yet,
+// but an incompatible server is, see VersionError.
+type handshake struct {
+	caps  *Capabilities
+	err   error
+	mutex sync.Mutex
+}
+
+func (h *handshake) capabilities(url string, srvcName string) *Capabilities {
+	caps, _ := h.negotiate(url, srvcName)
+	return caps
+}
+
+// The capabilities are of version 1 if the handshake fails, the error is only the VersionError.
+func (h *handshake) negotiate(url string, srvcName string) (*Capabilities, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.caps != nil || h.err != nil {
+		return h.caps, h.err
+	}
+	caps, err := Negotiate(url, srvcName)
+	if _, ok := err.(*VersionError); ok {
+		h.caps, h.err = &Capabilities{Version: 1}, err
+		return h.caps, h.err
+	} else if err != nil {
+		return &Capabilities{Version: 1}, nil
+	}
+	h.caps = caps
+	return caps, nil
+}
+
+// The error types in the responses are sent by gob, so they have to be registered.
+// Other errors are sent as RemoteError.
+func init() {
+	gob.Register(&middleware.DropTaskError{})
+	gob.Register(&middleware.DropItemError{})
+	gob.Register(&middleware.StorageError{})
+	gob.Register(&middleware.FixtureMissError{})
+	gob.Register(&middleware.CacheMissError{})
+	gob.Register(&RemoteError{})
+}
+
+type RemoteError struct {
+	Message string
+}
+
+func (err *RemoteError) Error() string {
+	return err.Message
+}
+
+// The errors returned by the rpc methods always become strings, so the drop errors are marked
+// by the prefixes of their messages.
+const (
+	dropTaskPrefix    = "DropTaskError: "
+	rescheduledPrefix = "DropTaskError(rescheduled): "
+	dropItemPrefix    = "DropItemError: "
+)
+
+func encodeErr(err error) error {
+	switch x := err.(type) {
+	case *middleware.DropTaskError:
+		if x.Rescheduled {
+			return errors.New(rescheduledPrefix + x.Message)
+		}
+		return errors.New(dropTaskPrefix + x.Message)
+	case *middleware.DropItemError:
+		return errors.New(dropItemPrefix + x.Message)
+	}
+	return err
+}
+
+func decodeErr(err error) error {
+	if x, ok := err.(rpc.ServerError); ok {
+		switch msg := string(x); {
+		case strings.HasPrefix(msg, rescheduledPrefix):
+			return &middleware.DropTaskError{Message: strings.TrimPrefix(msg, rescheduledPrefix), Rescheduled: true}
+		case strings.HasPrefix(msg, dropTaskPrefix):
+			return &middleware.DropTaskError{Message: strings.TrimPrefix(msg, dropTaskPrefix)}
+		case strings.HasPrefix(msg, dropItemPrefix):
+			return &middleware.DropItemError{Message: strings.TrimPrefix(msg, dropItemPrefix)}
+		}
+	}
+	return err
+}
+
+// Prepare the response to be sent by gob, the stream is read into the body,
+// and the error becomes one of the registered types.
+func encodeResponse(res *leiogo.Response) {
+	switch x := res.Err.(type) {
+	case nil, *middleware.DropTaskError, *middleware.DropItemError, *middleware.FixtureMissError, *middleware.CacheMissError:
+	case *middleware.StorageError:
+		res.Err = &middleware.StorageError{Err: &RemoteError{Message: x.Err.Error()}}
+	default:
+		res.Err = &RemoteError{Message: res.Err.Error()}
+	}
+
+	if res.Stream != nil {
+		var err error
+		if res.Body, err = ioutil.ReadAll(res.Stream); err != nil {
+			res.Err = &RemoteError{Message: err.Error()}
+		}
+		res.Stream.Close()
+		res.Stream = nil
+	}
+}
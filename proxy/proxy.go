@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/rpc"
+	"sync"
 
 	"github.com/SteveZhangBit/leiogo"
 	"github.com/SteveZhangBit/leiogo/middleware"
@@ -18,6 +22,18 @@ func Dial(url string, call func(client *rpc.Client) error) error {
 	return call(client)
 }
 
+// Call the method, and stop waiting for the reply when the ctx is done.
+// The server still completes the call, but the connection is closed by Dial.
+func callContext(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	call := client.Go(method, args, reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 func Serve(srvc interface{}, port string) {
 	rpc.Register(srvc)
 	if listen, err := net.Listen("tcp", port); err != nil {
@@ -79,6 +95,7 @@ func (y *YielderProxy) NewItem(item *leiogo.Item, spider *leiogo.Spider) error {
 }
 
 type YielderServer struct {
+	HandshakeServer
 	Yielder middleware.Yielder
 }
 
@@ -95,9 +112,28 @@ func (y *YielderServer) NewItem(args ItemArgs, _ *struct{}) error {
 type BaseProxy struct {
 	URL      string
 	SrvcName string
+
+	handshake handshake
+}
+
+// Capabilities returns the result of the handshake with the server, see Negotiate.
+func (d *BaseProxy) Capabilities() *Capabilities {
+	return d.handshake.capabilities(d.URL, d.SrvcName)
 }
 
+// Restore the types of the drop errors, if the server supports it.
+func (d *BaseProxy) decodeErr(err error) error {
+	if err != nil && d.Capabilities().Has(FeatureDropErrors) {
+		return decodeErr(err)
+	}
+	return err
+}
+
+// Open fails if the server is incompatible, see VersionError.
 func (d *BaseProxy) Open(spider *leiogo.Spider) error {
+	if _, err := d.handshake.negotiate(d.URL, d.SrvcName); err != nil {
+		return err
+	}
 	return Dial(d.URL, func(client *rpc.Client) error {
 		return client.Call(d.SrvcName+".Open", spider, &struct{}{})
 	})
@@ -123,23 +159,23 @@ type MiddlewareProxy struct {
 
 func (m *MiddlewareProxy) ProcessRequest(req *leiogo.Request, spider *leiogo.Spider) error {
 	args := ReqArgs{Req: req, Spider: spider}
-	return Dial(m.URL, func(client *rpc.Client) error {
+	return m.decodeErr(Dial(m.URL, func(client *rpc.Client) error {
 		return client.Call(m.SrvcName+".ProcessRequest", args, &struct{}{})
-	})
+	}))
 }
 
 func (m *MiddlewareProxy) ProcessResponse(res *leiogo.Response, req *leiogo.Request, spider *leiogo.Spider) error {
 	args := ResArgs{Req: req, Res: res, Spider: spider}
-	return Dial(m.URL, func(client *rpc.Client) error {
+	return m.decodeErr(Dial(m.URL, func(client *rpc.Client) error {
 		return client.Call(m.SrvcName+".ProcessResponse", args, &struct{}{})
-	})
+	}))
 }
 
 func (m *MiddlewareProxy) ProcessNewRequest(req *leiogo.Request, parentRes *leiogo.Response, spider *leiogo.Spider) error {
 	args := ResArgs{Req: req, Res: parentRes, Spider: spider}
-	return Dial(m.URL, func(client *rpc.Client) error {
+	return m.decodeErr(Dial(m.URL, func(client *rpc.Client) error {
 		return client.Call(m.SrvcName+".ProcessNewRequest", args, &struct{}{})
-	})
+	}))
 }
 
 type ItemPipelineProxy struct {
@@ -148,28 +184,92 @@ type ItemPipelineProxy struct {
 
 func (i *ItemPipelineProxy) Process(item *leiogo.Item, spider *leiogo.Spider) error {
 	args := ItemArgs{Item: item, Spider: spider}
-	return Dial(i.URL, func(client *rpc.Client) error {
+	return i.decodeErr(Dial(i.URL, func(client *rpc.Client) error {
 		return client.Call(i.SrvcName+".Process", args, &struct{}{})
-	})
+	}))
 }
 
+// DownloaderProxy downloads the requests with a remote DownloaderServer.
+// If Compress is true, the server compresses the bodies, see DownloadCompressed.
+// The servers which don't support the compression get the plain Download calls.
 type DownloaderProxy struct {
-	URL string
+	URL      string
+	Compress bool
+
+	// The bytes of the bodies before and after the compression, see Saved.
+	RawBytes  int64
+	WireBytes int64
+
+	handshake handshake
 }
 
-func (d *DownloaderProxy) Download(req *leiogo.Request, spider *leiogo.Spider) (leioRes *leiogo.Response) {
+func (d *DownloaderProxy) Capabilities() *Capabilities {
+	return d.handshake.capabilities(d.URL, "DownloaderServer")
+}
+
+func (d *DownloaderProxy) Download(ctx context.Context, req *leiogo.Request, spider *leiogo.Spider) (leioRes *leiogo.Response) {
+	caps, err := d.handshake.negotiate(d.URL, "DownloaderServer")
+	if err != nil {
+		leioRes = leiogo.NewResponse(req)
+		leioRes.Err = err
+		return
+	}
+
+	// The stream can't be sent by rpc, the servers supporting it read the body for us.
+	// The old servers would fail to send the response, so they download the body as usual.
+	stream, _ := req.Meta["stream"].(bool)
+	if stream && !caps.Has(FeatureStream) {
+		copied := *req
+		copied.Meta = req.Meta.Copy()
+		delete(copied.Meta, "stream")
+		req = &copied
+	}
+
 	args := ReqArgs{Req: req, Spider: spider}
-	leioRes = &leiogo.Response{}
+	if d.Compress && caps.Has(FeatureCompression) {
+		leioRes = d.downloadCompressed(ctx, args)
+	} else {
+		leioRes = &leiogo.Response{}
+		err := Dial(d.URL, func(client *rpc.Client) error {
+			return callContext(ctx, client, "DownloaderServer.Download", args, leioRes)
+		})
+		if err != nil {
+			leioRes.Err = err
+		}
+		d.count(len(leioRes.Body), len(leioRes.Body))
+	}
+
+	if stream && leioRes.Err == nil {
+		leioRes.Stream = ioutil.NopCloser(bytes.NewReader(leioRes.Body))
+		leioRes.Body = nil
+	}
+	return
+}
+
+func (d *DownloaderProxy) downloadCompressed(ctx context.Context, args ReqArgs) *leiogo.Response {
+	reply := &CompressedResponse{}
 	err := Dial(d.URL, func(client *rpc.Client) error {
-		return client.Call("DownloaderServer.Download", args, leioRes)
+		return callContext(ctx, client, "DownloaderServer.DownloadCompressed", CompressedReqArgs{ReqArgs: args, Accept: Compressions}, reply)
 	})
 	if err != nil {
-		leioRes.Err = err
+		return &leiogo.Response{Err: err}
 	}
-	return
+
+	res := reply.Response
+	if reply.Encoding == "" {
+		d.count(len(res.Body), len(res.Body))
+	} else if res.Body, err = decompress(reply.Encoding, reply.Compressed); err != nil {
+		res.Err = err
+	} else {
+		d.count(len(res.Body), len(reply.Compressed))
+	}
+	return res
 }
 
+// OpenCloseServer is embedded in all the servers of the middlewares and the pipelines,
+// so they all reply the handshake.
 type OpenCloseServer struct {
+	HandshakeServer
 	OpenClose middleware.OpenClose
 }
 
@@ -197,11 +297,11 @@ type DownloadMiddlewareServer struct {
 }
 
 func (d *DownloadMiddlewareServer) ProcessRequest(args ReqArgs, _ *struct{}) error {
-	return d.Middleware.ProcessRequest(args.Req, args.Spider)
+	return encodeErr(d.Middleware.ProcessRequest(args.Req, args.Spider))
 }
 
 func (d *DownloadMiddlewareServer) ProcessResponse(args ResArgs, _ *struct{}) error {
-	return d.Middleware.ProcessResponse(args.Res, args.Req, args.Spider)
+	return encodeErr(d.Middleware.ProcessResponse(args.Res, args.Req, args.Spider))
 }
 
 type SpiderMiddlewareServer struct {
@@ -211,29 +311,36 @@ type SpiderMiddlewareServer struct {
 }
 
 func (s *SpiderMiddlewareServer) ProcessResponse(args ResArgs, _ *struct{}) error {
-	return s.Middleware.ProcessResponse(args.Res, args.Req, args.Spider)
+	return encodeErr(s.Middleware.ProcessResponse(args.Res, args.Req, args.Spider))
 }
 
 func (s *SpiderMiddlewareServer) ProcessNewRequest(args ResArgs, _ *struct{}) error {
-	return s.Middleware.ProcessNewRequest(args.Req, args.Res, args.Spider)
+	return encodeErr(s.Middleware.ProcessNewRequest(args.Req, args.Res, args.Spider))
 }
 
 type ItemPipelineServer struct {
 	OpenCloseServer
 	HandleErrServer
 	Pipeline middleware.ItemPipeline
+
+	// The batch streams of the proxies, see ProcessBatch.
+	streams      map[string]*batchStream
+	streamsMutex sync.Mutex
 }
 
 func (i *ItemPipelineServer) Process(args ItemArgs, _ *struct{}) error {
-	return i.Pipeline.Process(args.Item, args.Spider)
+	return encodeErr(i.Pipeline.Process(args.Item, args.Spider))
 }
 
 type DownloaderServer struct {
+	HandshakeServer
 	Downloader middleware.Downloader
 }
 
 func (d *DownloaderServer) Download(args ReqArgs, leioRes *leiogo.Response) error {
-	*leioRes = *d.Downloader.Download(args.Req, args.Spider)
+	res := d.Downloader.Download(context.Background(), args.Req, args.Spider)
+	encodeResponse(res)
+	*leioRes = *res
 	return nil
 }
 
@@ -257,6 +364,10 @@ func NewDownloaderProxy(url string) middleware.Downloader {
 	return &DownloaderProxy{URL: url}
 }
 
+func NewCompressedDownloaderProxy(url string) *DownloaderProxy {
+	return &DownloaderProxy{URL: url, Compress: true}
+}
+
 func NewYielderServer(yielder middleware.Yielder) *YielderServer {
 	return &YielderServer{Yielder: yielder}
 }
@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"fmt"
+	"net/rpc"
+	"sync"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/middleware"
+)
+
+// BatchArgs is a batch of a stream, the batches of a StreamingItemPipelineProxy are numbered from 1
+// in its Stream, so the server processes them in order.
+type BatchArgs struct {
+	Stream string
+	Seq    int
+	Items  []*leiogo.Item
+	Spider *leiogo.Spider
+}
+
+// BatchAck is the reply of a batch, the errors of the items are returned as strings,
+// since the error types may not be registered to gob.
+type BatchAck struct {
+	Seq     int
+	Dropped int
+	Errors  []string
+}
+
+// The batches of a stream the server has processed. The batches up to done are in order, changed is closed
+// and replaced when it advances. The batches taken are the ones processed or being processed, counted by
+// all up to taken and the ones in the set after it, so a batch sent again is never processed twice.
+type batchStream struct {
+	done    int
+	changed chan struct{}
+	taken   int
+	takenAt map[int]bool
+}
+
+func (s *batchStream) isTaken(seq int) bool {
+	return seq <= s.taken || s.takenAt[seq]
+}
+
+func (s *batchStream) take(seq int) {
+	s.takenAt[seq] = true
+	for s.takenAt[s.taken+1] {
+		delete(s.takenAt, s.taken+1)
+		s.taken++
+	}
+}
+
+// How long a batch waits for the batches before it, a batch the proxy has given up never comes.
+var batchOrderTimeout = time.Minute
+
+// ProcessBatch processes the items of a batch in order, and acks the batch when all of them are done.
+// net/rpc serves the calls of a connection at the same time, so a batch waits for the batches before it
+// in its stream, for batchOrderTimeout at most. A batch coming after the ones behind it have given up waiting
+// is still processed, out of order. A batch sent again after a lost ack is acked without processing it again.
+// The batches without a stream, from the proxies before the streams, are not ordered.
+func (i *ItemPipelineServer) ProcessBatch(args BatchArgs, ack *BatchAck) error {
+	ack.Seq = args.Seq
+	if args.Stream != "" {
+		if !i.waitBatch(args.Stream, args.Seq) {
+			return nil
+		}
+		defer i.doneBatch(args.Stream, args.Seq)
+	}
+	for _, item := range args.Items {
+		if err := i.Pipeline.Process(item, args.Spider); err != nil {
+			if _, ok := err.(*middleware.DropItemError); ok {
+				ack.Dropped++
+			} else {
+				ack.Errors = append(ack.Errors, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// CloseStream forgets the batches of the stream, the proxy calls it when it's closed.
+func (i *ItemPipelineServer) CloseStream(stream string, _ *struct{}) error {
+	i.streamsMutex.Lock()
+	delete(i.streams, stream)
+	i.streamsMutex.Unlock()
+	return nil
+}
+
+// Wait until the batch before seq is done, and take the batch. It returns false if the batch has been taken.
+func (i *ItemPipelineServer) waitBatch(stream string, seq int) bool {
+	timeout := time.After(batchOrderTimeout)
+	timedOut := false
+	for {
+		i.streamsMutex.Lock()
+		if i.streams == nil {
+			i.streams = make(map[string]*batchStream)
+		}
+		s, ok := i.streams[stream]
+		if !ok {
+			s = &batchStream{changed: make(chan struct{}), takenAt: make(map[int]bool)}
+			i.streams[stream] = s
+		}
+		if s.isTaken(seq) {
+			i.streamsMutex.Unlock()
+			return false
+		}
+		// The next batch, or a late one which the batches after it have stopped waiting for.
+		if seq <= s.done+1 || timedOut {
+			s.take(seq)
+			i.streamsMutex.Unlock()
+			return true
+		}
+		changed := s.changed
+		i.streamsMutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-timeout:
+			timedOut = true
+		}
+	}
+}
+
+func (i *ItemPipelineServer) doneBatch(stream string, seq int) {
+	i.streamsMutex.Lock()
+	defer i.streamsMutex.Unlock()
+	// The stream may have been closed.
+	if s, ok := i.streams[stream]; ok && seq > s.done {
+		s.done = seq
+		close(s.changed)
+		s.changed = make(chan struct{})
+	}
+}
+
+// StreamingItemPipelineProxy delivers the items to a remote ItemPipelineServer in batches,
+// over a single connection, instead of dialing and calling once per item like ItemPipelineProxy.
+// A batch is sent when it has BatchSize items, or every FlushInterval. At most Window batches
+// wait for their acks at the same time, when the window is full, Process blocks until a batch is acked,
+// so a slow server slows down the crawler instead of being flooded. The Window should be at least 1.
+// Since the items are processed remotely and later, Process never returns the errors of the items,
+// they are logged when the batches are acked.
+//
+// A batch failing to be delivered, like when the connection is lost, is sent again over a new connection
+// with the same sequence number, so the server still processes the batches in order. It keeps its place
+// in the window until it's acked, or its items are counted as failed after MaxRetries retries.
+type StreamingItemPipelineProxy struct {
+	BaseProxy
+	Logger log.Logger
+
+	BatchSize     int
+	FlushInterval time.Duration
+	Window        int
+	MaxRetries    int
+
+	stream  string
+	batch   []*leiogo.Item
+	seq     int
+	window  chan struct{}
+	pending sync.WaitGroup
+	mutex   sync.Mutex
+	closed  chan bool
+
+	// The client is replaced when its connection is lost, the batches in flight share it.
+	client      *rpc.Client
+	clientMutex sync.Mutex
+
+	// The acks update the counters with their own mutex, since the sender may be blocked
+	// by the full window while holding the mutex.
+	ackMutex sync.Mutex
+
+	// The counters of the acked items.
+	Sent, Dropped, Failed int
+}
+
+func (p *StreamingItemPipelineProxy) Open(spider *leiogo.Spider) error {
+	if err := p.BaseProxy.Open(spider); err != nil {
+		return err
+	}
+	if !p.Capabilities().Has(FeatureBatch) {
+		return fmt.Errorf("The server at %s doesn't support batches, use ItemPipelineProxy instead", p.URL)
+	}
+	// Nothing can be sent without a place in the window.
+	if p.Window <= 0 {
+		return fmt.Errorf("The window of the batches is %d, it should be at least 1", p.Window)
+	}
+	p.stream = fmt.Sprintf("%s-%x", spider.Name, time.Now().UnixNano())
+
+	if _, err := p.connect(); err != nil {
+		return err
+	}
+	p.window = make(chan struct{}, p.Window)
+	p.closed = make(chan bool)
+
+	if p.FlushInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(p.FlushInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					p.mutex.Lock()
+					p.send(spider)
+					p.mutex.Unlock()
+				case <-p.closed:
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (p *StreamingItemPipelineProxy) Close(reason string, spider *leiogo.Spider) error {
+	close(p.closed)
+
+	p.mutex.Lock()
+	p.send(spider)
+	p.mutex.Unlock()
+
+	// Wait for all the batches to be acked before closing the remote pipeline.
+	p.pending.Wait()
+	if client, err := p.connect(); err == nil {
+		// The servers before CloseStream don't know it, their streams are never closed.
+		if err := client.Call(p.SrvcName+".CloseStream", p.stream, &struct{}{}); err != nil {
+			p.Logger.Debug(spider.Name, "Close stream %s fail, %s", p.stream, err)
+		}
+	}
+	p.clientMutex.Lock()
+	if p.client != nil {
+		p.client.Close()
+	}
+	p.clientMutex.Unlock()
+	p.Logger.Info(spider.Name, "Sent %d items, dropped: %d, failed: %d", p.Sent, p.Dropped, p.Failed)
+
+	err := p.BaseProxy.Close(reason, spider)
+	if err == nil && p.Failed != 0 {
+		err = fmt.Errorf("%d items failed", p.Failed)
+	}
+	return err
+}
+
+// The items are sent in batches, they are delivered at the latest when the proxy is closed.
+func (p *StreamingItemPipelineProxy) Buffered() bool {
+	return true
+}
+
+func (p *StreamingItemPipelineProxy) Process(item *leiogo.Item, spider *leiogo.Spider) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.batch = append(p.batch, item)
+	if len(p.batch) >= p.BatchSize {
+		p.send(spider)
+	}
+	return nil
+}
+
+// Send the current batch without waiting for its ack, it blocks when the window is full.
+// It must be called with the mutex held, so the batches are numbered in order.
+func (p *StreamingItemPipelineProxy) send(spider *leiogo.Spider) {
+	if len(p.batch) == 0 {
+		return
+	}
+
+	p.window <- struct{}{}
+	p.pending.Add(1)
+	p.seq++
+
+	args := BatchArgs{Stream: p.stream, Seq: p.seq, Items: p.batch, Spider: spider}
+	p.batch = nil
+	go p.deliver(args, spider)
+}
+
+// Deliver the batch, and send it again over a new connection when it fails, for MaxRetries times.
+// The batch keeps its place in the window until it's done, so the batches after it can't fill the window
+// while they wait for it in the server.
+func (p *StreamingItemPipelineProxy) deliver(args BatchArgs, spider *leiogo.Spider) {
+	defer func() {
+		<-p.window
+		p.pending.Done()
+	}()
+
+	for retry := 0; ; retry++ {
+		client, err := p.connect()
+		if err == nil {
+			ack := &BatchAck{}
+			if err = client.Call(p.SrvcName+".ProcessBatch", args, ack); err == nil {
+				p.ack(args, ack, spider)
+				return
+			}
+			p.lost(client, err)
+		}
+
+		if retry >= p.MaxRetries {
+			p.ackMutex.Lock()
+			p.Failed += len(args.Items)
+			p.ackMutex.Unlock()
+			p.Logger.Error(spider.Name, "Batch %d of %d items fail after %d retries, %s", args.Seq, len(args.Items), retry, err)
+			return
+		}
+		p.Logger.Debug(spider.Name, "Batch %d of %d items fail, send it again, %s", args.Seq, len(args.Items), err)
+		time.Sleep(time.Duration(retry+1) * streamRetryDelay)
+	}
+}
+
+// The client of the connection, a new connection is dialed if the last one is lost.
+func (p *StreamingItemPipelineProxy) connect() (*rpc.Client, error) {
+	p.clientMutex.Lock()
+	defer p.clientMutex.Unlock()
+
+	if p.client == nil {
+		client, err := rpc.Dial("tcp", p.URL)
+		if err != nil {
+			return nil, err
+		}
+		p.client = client
+	}
+	return p.client, nil
+}
+
+// The errors other than the ones of the server mean the connection is lost, so the client is closed,
+// unless it has been replaced by another failed batch.
+func (p *StreamingItemPipelineProxy) lost(client *rpc.Client, err error) {
+	if _, ok := err.(rpc.ServerError); ok {
+		return
+	}
+	p.clientMutex.Lock()
+	defer p.clientMutex.Unlock()
+	if p.client == client {
+		client.Close()
+		p.client = nil
+	}
+}
+
+func (p *StreamingItemPipelineProxy) ack(args BatchArgs, ack *BatchAck, spider *leiogo.Spider) {
+	p.ackMutex.Lock()
+	defer p.ackMutex.Unlock()
+
+	p.Sent += len(args.Items)
+	p.Dropped += ack.Dropped
+	p.Failed += len(ack.Errors)
+	for _, err := range ack.Errors {
+		p.Logger.Error(spider.Name, "Batch %d, %s", ack.Seq, err)
+	}
+}
+
+// The failed batches are sent again for streamMaxRetries times, after streamRetryDelay times the retries.
+const (
+	streamMaxRetries = 3
+	streamRetryDelay = time.Second
+)
+
+func NewStreamingItemPipelineProxy(url string, batchSize int, flushInterval time.Duration, window int) middleware.ItemPipeline {
+	return &StreamingItemPipelineProxy{
+		BaseProxy:     BaseProxy{URL: url, SrvcName: "ItemPipelineServer"},
+		Logger:        log.New("StreamingItemPipelineProxy"),
+		BatchSize:     batchSize,
+		FlushInterval: flushInterval,
+		Window:        window,
+		MaxRetries:    streamMaxRetries,
+	}
+}
@@ -0,0 +1,160 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo"
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/util"
+	"github.com/garyburd/redigo/redis"
+)
+
+// With the Scheduler and the DupeFilter, several crawler processes on different machines
+// are able to share one request queue and one set of crawled urls. Simply set them to the builder:
+//   builder.SetScheduler(redis.NewScheduler(addr, key)).SetDupeFilter(redis.NewDupeFilter(addr, key))
+
+func newPool(addr string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     8,
+		IdleTimeout: 240 * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", addr)
+		},
+	}
+}
+
+// Scheduler stores the serialized requests in a redis sorted set. The score is the negative priority,
+// so BZPOPMIN pops the requests with the highest priority first, and each member is prefixed with
+// an increasing sequence number to keep the requests with the same priority in FIFO order.
+// A crawler process can't know whether the others are still producing requests, so Pop returns false
+// only after the queue has been empty for IdleTimeout, which should be longer than a request takes.
+// This requires redis 5.0 or later.
+//
+// The errors never crash the crawler, they are logged. The requests which can't be encoded or decoded
+// are kept in the redis list DeadLetterKey, as the url and the error, or as the undecodable member,
+// so they can be inspected and pushed again.
+type Scheduler struct {
+	Logger log.Logger
+
+	Key           string
+	DeadLetterKey string
+	IdleTimeout   time.Duration
+
+	pool   *redis.Pool
+	closed int32
+}
+
+func NewScheduler(addr string, key string) *Scheduler {
+	return &Scheduler{
+		Logger:        log.New("RedisScheduler"),
+		Key:           key,
+		DeadLetterKey: key + ":dead",
+		IdleTimeout:   60 * time.Second,
+		pool:          newPool(addr),
+	}
+}
+
+func (s *Scheduler) Push(req *leiogo.Request) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(req); err != nil {
+		s.Logger.Error("scheduler", "Encode request %s failed, %s", req.URL, err)
+		s.deadLetter(conn, fmt.Sprintf("%s\t%s", req.URL, err))
+		return
+	}
+	seq, err := redis.Int64(conn.Do("INCR", s.Key+":seq"))
+	if err == nil {
+		member := append([]byte(fmt.Sprintf("%020d", seq)), buf.Bytes()...)
+		_, err = conn.Do("ZADD", s.Key, -req.Priority, member)
+	}
+	if err != nil {
+		s.Logger.Error("scheduler", "Push request %s failed, it's lost, %s", req.URL, err)
+	}
+}
+
+// Keep the bad entry in the dead letter list, the error is only logged.
+func (s *Scheduler) deadLetter(conn redis.Conn, entry interface{}) {
+	if _, err := conn.Do("RPUSH", s.DeadLetterKey, entry); err != nil {
+		s.Logger.Error("scheduler", "Push to the dead letters %s failed, %s", s.DeadLetterKey, err)
+	}
+}
+
+func (s *Scheduler) Pop() (*leiogo.Request, bool) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	idle := time.Duration(0)
+	for {
+		// BZPOPMIN returns the key, the member and the score, or nil on timeout.
+		vals, err := redis.ByteSlices(conn.Do("BZPOPMIN", s.Key, 1))
+		if err == redis.ErrNil {
+			idle += time.Second
+			if atomic.LoadInt32(&s.closed) == 1 || idle >= s.IdleTimeout {
+				return nil, false
+			}
+			continue
+		} else if err != nil {
+			s.Logger.Error("scheduler", "Pop request failed, %s", err)
+			return nil, false
+		}
+
+		if len(vals) != 3 || len(vals[1]) < 20 {
+			s.Logger.Error("scheduler", "Malformed member in %s, move it to %s", s.Key, s.DeadLetterKey)
+			if len(vals) > 1 {
+				s.deadLetter(conn, vals[1])
+			}
+			continue
+		}
+		var req leiogo.Request
+		if err := gob.NewDecoder(bytes.NewReader(vals[1][20:])).Decode(&req); err != nil {
+			s.Logger.Error("scheduler", "Decode request failed, move it to %s, %s", s.DeadLetterKey, err)
+			s.deadLetter(conn, vals[1])
+			continue
+		}
+		return &req, true
+	}
+}
+
+// Len is the number of the requests in the shared queue, including the ones pushed by the other crawlers.
+func (s *Scheduler) Len() int {
+	conn := s.pool.Get()
+	defer conn.Close()
+	n, _ := redis.Int(conn.Do("ZCARD", s.Key))
+	return n
+}
+
+// After Close, Pop stops as soon as the shared queue is empty.
+func (s *Scheduler) Close() {
+	atomic.StoreInt32(&s.closed, 1)
+}
+
+// DupeFilter stores the hashes of the keys in a redis set, the keys are usually the request fingerprints.
+type DupeFilter struct {
+	Key  string
+	pool *redis.Pool
+}
+
+func NewDupeFilter(addr string, key string) *DupeFilter {
+	return &DupeFilter{Key: key, pool: newPool(addr)}
+}
+
+func (f *DupeFilter) Seen(key string) bool {
+	conn := f.pool.Get()
+	defer conn.Close()
+
+	seen, err := redis.Bool(conn.Do("SISMEMBER", f.Key, util.Hash(key)))
+	return err == nil && seen
+}
+
+func (f *DupeFilter) Add(key string) {
+	conn := f.pool.Get()
+	defer conn.Close()
+
+	conn.Do("SADD", f.Key, util.Hash(key))
+}
@@ -0,0 +1,98 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/garyburd/redigo/redis"
+)
+
+// CacheStorage keeps the HTTP cache in redis, so the crawler processes on many machines share one cache,
+// and the parsers can be run again by any of them without downloading the pages. See middleware.HttpCacheStorage.
+// A version of a response is stored under Key:key:time, and the times of the versions are in the sorted set Key:key.
+// The versions expire after TTL, 0 means never. Redis keeps everything in memory, so the responses with
+// the bodies larger than MaxEntrySize bytes are not cached, 0 means no limit.
+// Set it to the HttpCacheStorage of the crawler package before the builder is created.
+type CacheStorage struct {
+	Key          string
+	TTL          time.Duration
+	MaxEntrySize int
+
+	pool *redis.Pool
+}
+
+func NewCacheStorage(addr string, key string) *CacheStorage {
+	return &CacheStorage{Key: key, pool: newPool(addr)}
+}
+
+func (s *CacheStorage) versions(key string) string {
+	return s.Key + ":" + key
+}
+
+func (s *CacheStorage) entry(key string, t int64) string {
+	return fmt.Sprintf("%s:%d", s.versions(key), t)
+}
+
+func (s *CacheStorage) Store(key string, res *middleware.CachedResponse) error {
+	if s.MaxEntrySize > 0 && len(res.Body) > s.MaxEntrySize {
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(res); err != nil {
+		return err
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	t := res.Time.UnixNano()
+	conn.Send("MULTI")
+	if s.TTL > 0 {
+		ttl := int64(s.TTL / time.Millisecond)
+		conn.Send("SET", s.entry(key, t), buf.Bytes(), "PX", ttl)
+		conn.Send("ZADD", s.versions(key), t, t)
+		// The set of the versions lives as long as the latest version.
+		conn.Send("PEXPIRE", s.versions(key), ttl)
+	} else {
+		conn.Send("SET", s.entry(key, t), buf.Bytes())
+		conn.Send("ZADD", s.versions(key), t, t)
+	}
+	_, err := conn.Do("EXEC")
+	return err
+}
+
+func (s *CacheStorage) Retrieve(key string, asOf time.Time) (*middleware.CachedResponse, error) {
+	conn := s.pool.Get()
+	defer conn.Close()
+
+	max := "+inf"
+	if !asOf.IsZero() {
+		max = strconv.FormatInt(asOf.UnixNano(), 10)
+	}
+	times, err := redis.Int64s(conn.Do("ZREVRANGEBYSCORE", s.versions(key), max, "-inf"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range times {
+		buf, err := redis.Bytes(conn.Do("GET", s.entry(key, t)))
+		if err == redis.ErrNil {
+			// The version has expired, try an older one.
+			conn.Do("ZREM", s.versions(key), t)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		res := &middleware.CachedResponse{}
+		if err := gob.NewDecoder(bytes.NewReader(buf)).Decode(res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+	return nil, nil
+}
@@ -66,6 +66,10 @@ func (r *RedisWriter) WriteFile(req *leiogo.Request, res *http.Response) (info s
 				writerErr = &middleware.DropTaskError{Message: "File cached completed"}
 			}
 		}
+		// The body has been read, so the other errors are from redis.
+		if _, ok := writerErr.(*middleware.DropTaskError); !ok && writerErr != nil {
+			writerErr = &middleware.StorageError{Err: writerErr}
+		}
 	}
 
 	// put back the connection
@@ -0,0 +1,56 @@
+package s3
+
+import (
+	"context"
+	"io"
+
+	"github.com/SteveZhangBit/leiogo/middleware"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Store is an ObjectStore of a S3 bucket, it works with any S3 compatible service, like MinIO.
+type Store struct {
+	Client *minio.Client
+	Bucket string
+}
+
+func NewStore(endpoint string, accessKey string, secretKey string, bucket string, secure bool) (*Store, error) {
+	client, err := minio.New(endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(accessKey, secretKey, ""),
+		Secure: secure,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Client: client, Bucket: bucket}, nil
+}
+
+// Exists sends a HEAD request of the object.
+func (s *Store) Exists(key string) (bool, error) {
+	_, err := s.Client.StatObject(context.Background(), s.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// Put streams the body to the bucket. If the size is unknown, the body is uploaded in parts.
+func (s *Store) Put(key string, body io.Reader, size int64, contentType string) error {
+	_, err := s.Client.PutObject(context.Background(), s.Bucket, key, body, size,
+		minio.PutObjectOptions{ContentType: contentType})
+	return err
+}
+
+// NewS3Writer creates a FileWriter which uploads the files to the bucket, set it to
+// crawler.DownloaderFileWriter before creating the crawler.
+func NewS3Writer(endpoint string, accessKey string, secretKey string, bucket string, secure bool) (*middleware.ObjectWriter, error) {
+	store, err := NewStore(endpoint, accessKey, secretKey, bucket, secure)
+	if err != nil {
+		return nil, err
+	}
+	return &middleware.ObjectWriter{Store: store}, nil
+}
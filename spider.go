@@ -1,21 +1,111 @@
 package leiogo
 
 import (
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/SteveZhangBit/leiogo/log"
+	"github.com/SteveZhangBit/leiogo/util"
 )
 
 type Dict map[string]interface{}
 
+// The types of the values in the meta have to be registered, so the requests can be encoded by encoding/gob,
+// like the pending requests in the job directory and the requests in the disk or the redis scheduler.
+// The basic types are registered by gob itself, these are the other types set by the options,
+// like the map[string]string of 'headers' and 'cookies'.
+func init() {
+	gob.Register(map[string]string{})
+	gob.Register(map[string]interface{}{})
+	gob.Register(map[string][]string{})
+	gob.Register([]interface{}{})
+	gob.Register([]map[string]interface{}{})
+	gob.Register(Dict{})
+	gob.Register(time.Time{})
+}
+
+// Copy returns a shallow copy of the dict, the values like the maps and the slices are still shared.
+// The copy of a nil dict is an empty one.
+func (d Dict) Copy() Dict {
+	copied := make(Dict, len(d))
+	for k, v := range d {
+		copied[k] = v
+	}
+	return copied
+}
+
+// Float returns the number of the key, the numbers in the meta may be set as int, int64 or float64,
+// like the 'timeout' of 30 or 2.5. It's false if the key is not a number.
+func (d Dict) Float(key string) (float64, bool) {
+	switch x := d[key].(type) {
+	case float64:
+		return x, true
+	case int:
+		return float64(x), true
+	case int64:
+		return float64(x), true
+	}
+	return 0, false
+}
+
 type Spider struct {
 	Name           string
 	StartURLs      []*Request
 	AllowedDomains []string
+
+	// The tenant which owns the spider, when a service runs the spiders of many users.
+	// The spiders of a tenant share its quotas, see TenantQuotaMiddleware in middleware package.
+	Tenant string
+
+	// The unique ID of the current run, it's set by the crawler when the spider starts.
+	// The pipelines writing to the shared sinks can tag the items with it, so the items of a run
+	// can be filtered or cleaned up.
+	RunID string
 }
 
+// Callback parses the response of a request, it has the same signature as middleware.Parser.
+type Callback func(res *Response, req *Request, spider *Spider)
+
 type Request struct {
-	URL        string
-	Meta       Dict
+	URL string
+
+	// The options of the request for the middlewares and the downloader, and the data passed to the parser.
+	// The keys in double underscores, like '__type__', '__filepath__', '__sha256__', '__retryat__' and '__trace__',
+	// are owned by the engine, and so are 'retry', 'depth' and 'encoding', they are set by the crawler
+	// and the middlewares, and should never be set by the spiders. The other keys, like 'class', 'dontfilter', 'headers',
+	// 'method', 'phantomjs', 'render', 'waitfor', 'script', 'proxy', 'stream' and 'timeout', are the options
+	// for the spiders to set.
+	Meta Dict
+
+	// The name of the parser of the response, empty means the parser is selected by the url,
+	// see AddURLParser of the crawler builder.
 	ParserName string
+
+	// The parser of the request, it's used instead of the parser named ParserName when it's not nil.
+	// So a closure can capture the local variables, instead of passing them in the Meta.
+	// The functions can't be encoded, so the Callback is lost when the request is saved to the job directory,
+	// or sent to a remote scheduler or proxy, and the request falls back to ParserName.
+	Callback Callback
+
+	// Requests with higher priority will be crawled first, the default value is 0.
+	Priority int
+
+	// The name of the errback called when the request fails after the retries, for example,
+	// to request a fallback url, or to yield the failure as an item. Empty means no errback.
+	// The requests dropped before downloading, like the duplicated or the off site ones, are not failures.
+	ErrbackName string
+}
+
+// NewCallbackRequest creates a request parsed by the callback.
+func NewCallbackRequest(url string, callback Callback) *Request {
+	req := NewRequest(url)
+	req.Callback = callback
+	return req
 }
 
 func NewRequest(url string) *Request {
@@ -26,24 +116,140 @@ func NewRequest(url string) *Request {
 	}
 }
 
+// TraceID returns the trace ID of the request, which is set by the crawler in '__trace__' of the meta
+// when the request is yielded or added as a start url. The retries of the request keep the same trace ID.
+func (r *Request) TraceID() string {
+	id, _ := r.Meta["__trace__"].(string)
+	return id
+}
+
+// LogContext returns the context of the logs about the request, the name of the spider with
+// the trace ID of the request, so all the logs of a request can be found by its trace ID.
+func (r *Request) LogContext(spider *Spider) string {
+	return log.Traced(spider.Name, r.TraceID())
+}
+
+// Fingerprint identifies the request, the requests with the same fingerprint are treated as duplicated.
+// The 'method' in the meta is a part of it unless it's GET, so a HEAD request never stands for a GET.
+// See util.Fingerprint for more information.
+func (r *Request) Fingerprint() string {
+	if method, ok := r.Meta["method"].(string); ok && method != "" && method != "GET" {
+		return util.Fingerprint(r.URL, method)
+	}
+	return util.Fingerprint(r.URL)
+}
+
 type Response struct {
 	Err        error
 	StatusCode int
+	Header     http.Header
 	Body       []byte
 	Meta       Dict
 	URL        string
+
+	// The time the downloader takes to get the response.
+	Latency time.Duration
+
+	// The redirects the downloader has followed, in order. The status code of the final response
+	// is still StatusCode, and URL is still the url of the request.
+	Redirects []Redirect
+
+	// If the request has 'stream' = true in its meta, the downloader leaves the body unread in Stream,
+	// and Body is empty, so the middlewares and the parser can consume a large body as an io.Reader.
+	// The crawler closes the stream after the parser returns.
+	Stream io.ReadCloser
+
+	// The JSON value of the 'script' in the meta of a rendered page, evaluated in the page before it's captured.
+	ScriptResult json.RawMessage
+
+	// The PNG of a rendered page with 'screenshot' = true in the meta, see ScreenshotMiddleware in middleware package.
+	Screenshot []byte
+
+	// The context of parsing the response, see Context.
+	ctx context.Context
 }
 
+// Context returns the context of parsing the response. The crawler cancels it when the parser times out,
+// see ParserTimeout of the crawler, so a long running parser should check it in its loops and return
+// when it's done, otherwise the parser keeps running in background, and the crawler waits for it before closing.
+func (r *Response) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// SetContext sets the context of parsing the response, the crawler calls it before the parser runs.
+func (r *Response) SetContext(ctx context.Context) {
+	r.ctx = ctx
+}
+
+// FinalURL returns the url the response came from, the location of the last redirect,
+// or URL if the request wasn't redirected. The relative links of the page are resolved against it.
+func (r *Response) FinalURL() string {
+	if len(r.Redirects) != 0 {
+		return r.Redirects[len(r.Redirects)-1].Location
+	}
+	return r.URL
+}
+
+// Redirect is a hop of a redirect chain, the page at URL responded StatusCode and redirected to Location.
+type Redirect struct {
+	URL        string
+	StatusCode int
+	Location   string
+}
+
+// TraceID returns the trace ID of the request of the response.
+func (r *Response) TraceID() string {
+	id, _ := r.Meta["__trace__"].(string)
+	return id
+}
+
+// LogContext returns the context of the logs about the response, see Request.LogContext.
+func (r *Response) LogContext(spider *Spider) string {
+	return log.Traced(spider.Name, r.TraceID())
+}
+
+// Close the stream of the response, if it has one.
+func (r *Response) Close() error {
+	if r.Stream != nil {
+		return r.Stream.Close()
+	}
+	return nil
+}
+
+// With ShareResponseMeta, the responses share the meta with their requests, as the old versions did,
+// so a middleware changing the meta of a response changes the meta of the request too, and the retries of the request
+// inherit the changes. Otherwise a response gets a shallow copy of the meta of its request when it's created.
+var ShareResponseMeta = false
+
+// NewResponse creates the response of the request, with a copy of the meta of the request,
+// unless ShareResponseMeta is true. The changes of the request's meta during the download, like the
+// '__filepath__' of the saved files, are only seen on the request.
 func NewResponse(req *Request) *Response {
+	meta := req.Meta
+	if !ShareResponseMeta {
+		meta = meta.Copy()
+	}
 	return &Response{
 		URL:  req.URL,
-		Meta: req.Meta,
+		Meta: meta,
 	}
 }
 
 type Item struct {
 	// ID   string
 	Data Dict
+
+	// The trace ID of the request whose page yields the item, it's set by NewPageItem of the crawler,
+	// and the item counts for the page, see NewItem of the crawler.
+	// It isn't a part of the data, so it's not exported.
+	TraceID string
+
+	// The field of the run ID added by the crawler, see RunIDField of the crawler. It's not a part
+	// of the key of the whole data, so the same item of different runs has the same key.
+	RunIDField string
 }
 
 func NewItem(data Dict) *Item {
@@ -53,7 +259,85 @@ func NewItem(data Dict) *Item {
 	}
 }
 
+// LogContext returns the context of the logs about the item, see Request.LogContext.
+func (i *Item) LogContext(spider *Spider) string {
+	return log.Traced(spider.Name, i.TraceID)
+}
+
 func (i *Item) String() string {
 	data, _ := json.Marshal(i.Data)
 	return string(data)
 }
+
+// The items can be nested, a field may hold an *Item, a Dict, or a slice of them,
+// like product -> offers[] -> seller. They are encoded as the nested JSON objects.
+func (i *Item) MarshalJSON() ([]byte, error) {
+	return json.Marshal(i.Data)
+}
+
+// Flatten turns a nested item into a flat Dict for the exporters which only accept flat rows,
+// like CSV and SQL. The keys of the nested fields are joined by sep, and the elements of
+// the slices are keyed by their indexes, so {"offers": [{"price": 1}]} becomes {"offers.0.price": 1}.
+func (i *Item) Flatten(sep string) Dict {
+	flat := make(Dict)
+	flatten(flat, "", sep, i.Data)
+	return flat
+}
+
+func flatten(flat Dict, prefix string, sep string, val interface{}) {
+	join := func(key string) string {
+		if prefix == "" {
+			return key
+		}
+		return prefix + sep + key
+	}
+
+	switch x := val.(type) {
+	case *Item:
+		flatten(flat, prefix, sep, x.Data)
+	case Dict:
+		for key, v := range x {
+			flatten(flat, join(key), sep, v)
+		}
+	case map[string]interface{}:
+		flatten(flat, prefix, sep, Dict(x))
+	case []*Item:
+		for n, v := range x {
+			flatten(flat, join(strconv.Itoa(n)), sep, v)
+		}
+	case []Dict:
+		for n, v := range x {
+			flatten(flat, join(strconv.Itoa(n)), sep, v)
+		}
+	case []interface{}:
+		for n, v := range x {
+			flatten(flat, join(strconv.Itoa(n)), sep, v)
+		}
+	default:
+		flat[prefix] = val
+	}
+}
+
+// Key returns an idempotency key of the item. It is a hash of the given fields,
+// or of the whole data if no field is given. Since encoding/json sorts the map keys,
+// the same data always produces the same key, so pipelines writing to external
+// storages can use it to upsert or skip the items they have already exported.
+// The run ID of the item is excluded from the whole data, see RunIDField.
+func (i *Item) Key(fields ...string) string {
+	data := i.Data
+	if len(fields) != 0 {
+		data = make(Dict)
+		for _, field := range fields {
+			data[field] = i.Data[field]
+		}
+	} else if _, ok := i.Data[i.RunIDField]; ok && i.RunIDField != "" {
+		data = make(Dict, len(i.Data))
+		for k, v := range i.Data {
+			if k != i.RunIDField {
+				data[k] = v
+			}
+		}
+	}
+	buf, _ := json.Marshal(data)
+	return util.Hash(string(buf))
+}
@@ -0,0 +1,251 @@
+// Package testsite is a local website for the integration tests of the crawler, so the behaviors of the engine
+// and the middlewares can be verified without the external network. It's built on net/http/httptest.
+// The end-to-end tests of the default crawler on the site are in crawler/testsite_test.go.
+//
+// The pages of the site:
+//
+//	/                       the index, links to /page/0 and the other sections
+//	/page/{n}               the pages 0 to Pages-1, each links to the next Links pages
+//	/redirect/{n}           redirects n times and ends at /page/0, /redirect/loop redirects to itself
+//	/slow/{ms}              responds after ms milliseconds
+//	/gzip                   a page compressed by gzip
+//	/status/{code}          responds the status code
+//	/cookie/set, /cookie/check
+//	                        sets a cookie, and checks it, 403 without the cookie
+//	/login, /private        a login form with a CSRF token, and a page which needs the session,
+//	                        the user is Username and the password is Password
+//	/calendar/{yyyy}/{mm}   an infinite calendar trap, every month links to the previous and the next month
+//	/file/{name}            a binary file of 1KB
+//	/links                  a page with the broken links, to a missing page, a 500 page and a missing image
+package testsite
+
+import (
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	Username = "leiogo"
+	Password = "secret"
+
+	csrfToken = "token-1234"
+	session   = "session-5678"
+)
+
+// Site is a running test site, close it after the test.
+type Site struct {
+	*httptest.Server
+
+	// The number of the /page/{n} pages, and the links to the following pages on each page.
+	Pages int
+	Links int
+
+	hits  map[string]int
+	mutex sync.Mutex
+}
+
+// New starts a site with the pages, each page links to the next links pages.
+func New(pages int, links int) *Site {
+	s := &Site{Pages: pages, Links: links, hits: make(map[string]int)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.index)
+	mux.HandleFunc("/page/", s.page)
+	mux.HandleFunc("/redirect/", s.redirect)
+	mux.HandleFunc("/slow/", s.slow)
+	mux.HandleFunc("/gzip", s.gzip)
+	mux.HandleFunc("/status/", s.status)
+	mux.HandleFunc("/cookie/set", s.setCookie)
+	mux.HandleFunc("/cookie/check", s.checkCookie)
+	mux.HandleFunc("/login", s.login)
+	mux.HandleFunc("/private", s.private)
+	mux.HandleFunc("/calendar/", s.calendar)
+	mux.HandleFunc("/file/", s.file)
+	mux.HandleFunc("/links", s.links)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.hits[r.URL.Path]++
+		s.mutex.Unlock()
+		mux.ServeHTTP(w, r)
+	}))
+	return s
+}
+
+// Hits returns the times the path has been requested.
+func (s *Site) Hits(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.hits[path]
+}
+
+// TotalHits returns the times all the paths have been requested.
+func (s *Site) TotalHits() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	total := 0
+	for _, n := range s.hits {
+		total += n
+	}
+	return total
+}
+
+// URLOf returns the absolute url of the path.
+func (s *Site) URLOf(path string) string {
+	return s.Server.URL + path
+}
+
+func writeHTML(w http.ResponseWriter, title string, body string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprintf(w, "<html><head><title>%s</title></head><body><h1>%s</h1>%s</body></html>", title, title, body)
+}
+
+func links(paths ...string) string {
+	var b strings.Builder
+	for _, p := range paths {
+		fmt.Fprintf(&b, `<a href="%s">%s</a>`, p, p)
+	}
+	return b.String()
+}
+
+// The last part of the path as an integer.
+func param(r *http.Request, prefix string) (int, bool) {
+	n, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix))
+	return n, err == nil
+}
+
+func (s *Site) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	writeHTML(w, "Index", links("/page/0", "/redirect/2", "/gzip", "/cookie/set", "/login", "/calendar/2020/01", "/file/a.bin", "/links"))
+}
+
+func (s *Site) page(w http.ResponseWriter, r *http.Request) {
+	n, ok := param(r, "/page/")
+	if !ok || n < 0 || n >= s.Pages {
+		http.NotFound(w, r)
+		return
+	}
+	var paths []string
+	for i := n + 1; i <= n+s.Links && i < s.Pages; i++ {
+		paths = append(paths, fmt.Sprintf("/page/%d", i))
+	}
+	writeHTML(w, fmt.Sprintf("Page %d", n), links(paths...))
+}
+
+func (s *Site) redirect(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/redirect/loop" {
+		http.Redirect(w, r, "/redirect/loop", http.StatusFound)
+		return
+	}
+	n, ok := param(r, "/redirect/")
+	if !ok || n <= 0 {
+		http.Redirect(w, r, "/page/0", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("/redirect/%d", n-1), http.StatusFound)
+}
+
+func (s *Site) slow(w http.ResponseWriter, r *http.Request) {
+	ms, _ := param(r, "/slow/")
+	select {
+	case <-time.After(time.Duration(ms) * time.Millisecond):
+		writeHTML(w, "Slow", "")
+	case <-r.Context().Done():
+	}
+}
+
+func (s *Site) gzip(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Encoding", "gzip")
+	gz := gzip.NewWriter(w)
+	defer gz.Close()
+	fmt.Fprint(gz, "<html><head><title>Gzip</title></head><body><h1>Gzip</h1></body></html>")
+}
+
+func (s *Site) status(w http.ResponseWriter, r *http.Request) {
+	code, ok := param(r, "/status/")
+	if !ok || code < 100 || code > 999 {
+		code = http.StatusBadRequest
+	}
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "Status %d", code)
+}
+
+func (s *Site) setCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: "visited", Value: "yes", Path: "/"})
+	writeHTML(w, "Cookie", links("/cookie/check"))
+}
+
+func (s *Site) checkCookie(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie("visited"); err != nil || c.Value != "yes" {
+		w.WriteHeader(http.StatusForbidden)
+		writeHTML(w, "No cookie", "")
+		return
+	}
+	writeHTML(w, "Cookie checked", "")
+}
+
+func (s *Site) login(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		if r.PostForm.Get("csrf") != csrfToken {
+			w.WriteHeader(http.StatusForbidden)
+			writeHTML(w, "Invalid token", "")
+			return
+		}
+		if r.PostForm.Get("username") != Username || r.PostForm.Get("password") != Password {
+			writeHTML(w, "Invalid password", "")
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: session, Path: "/"})
+		writeHTML(w, "Welcome", links("/private"))
+		return
+	}
+	writeHTML(w, "Login", `<form action="/login" method="post">`+
+		`<input type="hidden" name="csrf" value="`+csrfToken+`">`+
+		`<input type="text" name="username"><input type="password" name="password">`+
+		`<input type="submit" value="Login"></form>`)
+}
+
+func (s *Site) private(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie("session"); err != nil || c.Value != session {
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return
+	}
+	writeHTML(w, "Private", "")
+}
+
+func (s *Site) calendar(w http.ResponseWriter, r *http.Request) {
+	t, err := time.Parse("2006/01", strings.TrimPrefix(r.URL.Path, "/calendar/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeHTML(w, t.Format("January 2006"), links(
+		t.AddDate(0, -1, 0).Format("/calendar/2006/01"),
+		t.AddDate(0, 1, 0).Format("/calendar/2006/01"),
+	))
+}
+
+func (s *Site) file(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", "1024")
+	buf := make([]byte, 1024)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+	w.Write(buf)
+}
+
+func (s *Site) links(w http.ResponseWriter, r *http.Request) {
+	writeHTML(w, "Links", links("/page/0", "/missing", "/status/500")+`<img src="/missing.png">`)
+}
@@ -0,0 +1,132 @@
+package leiogo
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// NewTypedItem creates an item from a user defined struct, so hand-written spiders get
+// compile-time safety for their items, while the pipelines still work with the Dict.
+// The exported fields become the keys of the Dict, named by their json tags if they have,
+// and the fields tagged with json:"-" are skipped. Nested structs become nested Dicts,
+// see Item.Flatten for the exporters which need flat rows. It returns an error if v is not a struct
+// or a pointer to one, like a nil pointer.
+func NewTypedItem[T any](v T) (*Item, error) {
+	data, ok := toValue(reflect.ValueOf(v)).(Dict)
+	if !ok {
+		return nil, fmt.Errorf("NewTypedItem needs a struct, get %T", v)
+	}
+	return NewItem(data), nil
+}
+
+// ItemAs converts the item back to the struct, the fields are matched by their json names.
+func ItemAs[T any](item *Item) (T, error) {
+	var v T
+	buf, err := json.Marshal(item.Data)
+	if err == nil {
+		err = json.Unmarshal(buf, &v)
+	}
+	return v, err
+}
+
+// Columns returns the flattened fields of the items of the struct, sorted like the columns which
+// the CSVPipeline takes from its first item, so a CSV of the typed items can have all the columns ahead of time,
+// even if the first item lacks some of them:
+//
+//	columns, err := leiogo.Columns[Product](".")
+//	crawler.NewCSVPipeline("items.csv", columns...)
+//
+// The nil pointers, slices and maps of the zero struct are single columns, since their fields are unknown.
+// It returns the error of NewTypedItem if T is not a struct.
+func Columns[T any](sep string) ([]string, error) {
+	var v T
+	item, err := NewTypedItem(v)
+	if err != nil {
+		return nil, err
+	}
+	flat := item.Flatten(sep)
+	columns := make([]string, 0, len(flat))
+	for key := range flat {
+		columns = append(columns, key)
+	}
+	sort.Strings(columns)
+	return columns, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func toValue(v reflect.Value) interface{} {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return toValue(v.Elem())
+
+	case reflect.Struct:
+		// time.Time is a struct, but it's better to keep it as it is.
+		if v.Type() == timeType {
+			return v.Interface()
+		}
+
+		data := make(Dict)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue
+			}
+
+			name := field.Name
+			if tag := field.Tag.Get("json"); tag != "" {
+				if tag == "-" {
+					continue
+				}
+				if n := strings.Split(tag, ",")[0]; n != "" {
+					name = n
+				}
+			}
+			data[name] = toValue(v.Field(i))
+		}
+		return data
+
+	case reflect.Slice, reflect.Array:
+		// []byte and the slices of the basic types are kept as they are.
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		switch v.Type().Elem().Kind() {
+		case reflect.Struct, reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			a := make([]interface{}, v.Len())
+			for i := range a {
+				a[i] = toValue(v.Index(i))
+			}
+			return a
+		default:
+			return v.Interface()
+		}
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Key().Kind() != reflect.String {
+			return v.Interface()
+		}
+		data := make(Dict)
+		for _, key := range v.MapKeys() {
+			data[key.String()] = toValue(v.MapIndex(key))
+		}
+		return data
+
+	default:
+		if v.IsValid() {
+			return v.Interface()
+		}
+		return nil
+	}
+}
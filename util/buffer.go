@@ -0,0 +1,34 @@
+package util
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// The buffers reading the bodies are reused, the ones grown over maxPooledBuffer are left to the GC,
+// so a few huge pages don't keep their memory forever.
+const maxPooledBuffer = 8 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+// ReadAll reads r until EOF like ioutil.ReadAll, but it reads into a pooled buffer, and returns
+// a copy of the exact size, so reading a megabyte page allocates it once instead of growing a slice
+// again and again. The size is a hint of the length, like the Content-Length, -1 if it's unknown.
+func ReadAll(r io.Reader, size int64) ([]byte, error) {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	if size > 0 && size <= maxPooledBuffer {
+		buf.Grow(int(size))
+	}
+	_, err := buf.ReadFrom(r)
+
+	data := make([]byte, buf.Len())
+	copy(data, buf.Bytes())
+	if buf.Cap() <= maxPooledBuffer {
+		bufferPool.Put(buf)
+	}
+	return data, err
+}
@@ -0,0 +1,35 @@
+package util
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+var benchBody = bytes.Repeat([]byte("<p>Some text of the page</p>"), 40000)
+
+func TestReadAll(t *testing.T) {
+	for _, size := range []int64{-1, 10, int64(len(benchBody))} {
+		data, err := ReadAll(bytes.NewReader(benchBody), size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, benchBody) {
+			t.Fatalf("read %d bytes with the size %d, want %d bytes", len(data), size, len(benchBody))
+		}
+	}
+}
+
+func BenchmarkIoutilReadAll(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ioutil.ReadAll(bytes.NewReader(benchBody))
+	}
+}
+
+func BenchmarkReadAll(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ReadAll(bytes.NewReader(benchBody), -1)
+	}
+}
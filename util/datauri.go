@@ -0,0 +1,146 @@
+package util
+
+import (
+	"encoding/base64"
+	"errors"
+	"mime"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// IsDataURI reports whether the url is a data: URI, which holds the content itself.
+func IsDataURI(raw string) bool {
+	return len(raw) > 5 && strings.EqualFold(raw[:5], "data:")
+}
+
+// ParseDataURI decodes a data: URI like "data:image/png;base64,iVBOR...", and returns
+// the media type and the content. The media type is "text/plain" if it's omitted.
+func ParseDataURI(raw string) (string, []byte, error) {
+	if !IsDataURI(raw) {
+		return "", nil, errors.New("Not a data URI")
+	}
+	comma := strings.IndexByte(raw, ',')
+	if comma < 0 {
+		return "", nil, errors.New("Data URI without a comma")
+	}
+
+	header, payload := raw[5:comma], raw[comma+1:]
+	isBase64 := false
+	if strings.HasSuffix(strings.ToLower(header), ";base64") {
+		isBase64 = true
+		header = header[:len(header)-len(";base64")]
+	}
+	mediaType := "text/plain"
+	if header != "" {
+		if t, _, err := mime.ParseMediaType(header); err == nil {
+			mediaType = t
+		}
+	}
+
+	if isBase64 {
+		// The base64 data may be percent-encoded, or contain spaces when it's copied from the html.
+		if unescaped, err := url.PathUnescape(payload); err == nil {
+			payload = unescaped
+		}
+		payload = strings.Map(func(r rune) rune {
+			if r == ' ' || r == '\n' || r == '\r' || r == '\t' {
+				return -1
+			}
+			return r
+		}, payload)
+		data, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil {
+			data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(payload, "="))
+		}
+		return mediaType, data, err
+	}
+
+	data, err := url.PathUnescape(payload)
+	return mediaType, []byte(data), err
+}
+
+// DataURIExt returns the file extension of the media type, like ".png" for "image/png".
+func DataURIExt(mediaType string) string {
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/svg+xml":
+		return ".svg"
+	case "text/plain":
+		return ".txt"
+	}
+	if exts, err := mime.ExtensionsByType(mediaType); err == nil && len(exts) != 0 {
+		return exts[0]
+	}
+	return ""
+}
+
+// LargestSrcset returns the url of the largest candidate in a srcset attribute,
+// like "a.jpg 480w, b.jpg 1080w" returns "b.jpg". The width descriptors are preferred
+// to the density ones, and a candidate without a descriptor is "1x".
+func LargestSrcset(srcset string) string {
+	best, bestW, bestX := "", -1.0, -1.0
+	for _, c := range parseSrcset(srcset) {
+		w, x := -1.0, 1.0
+		if c.desc != "" {
+			n, err := strconv.ParseFloat(c.desc[:len(c.desc)-1], 64)
+			switch {
+			case err != nil:
+				continue
+			case strings.HasSuffix(c.desc, "w"):
+				w, x = n, -1
+			case strings.HasSuffix(c.desc, "x"):
+				x = n
+			default:
+				continue
+			}
+		}
+		if w > bestW || (w == bestW && x > bestX) {
+			best, bestW, bestX = c.url, w, x
+		}
+	}
+	return best
+}
+
+type srcsetCandidate struct {
+	url  string
+	desc string
+}
+
+// Parse the srcset like the browsers do: a url is a run of non-space characters, so a data: URI
+// keeps its commas, and the descriptors go until the next comma.
+func parseSrcset(srcset string) []srcsetCandidate {
+	var candidates []srcsetCandidate
+	isSpace := func(c byte) bool { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+
+	for i := 0; i < len(srcset); {
+		for i < len(srcset) && (isSpace(srcset[i]) || srcset[i] == ',') {
+			i++
+		}
+		start := i
+		for i < len(srcset) && !isSpace(srcset[i]) {
+			i++
+		}
+		if start == i {
+			break
+		}
+
+		u := srcset[start:i]
+		if strings.HasSuffix(u, ",") {
+			candidates = append(candidates, srcsetCandidate{url: strings.TrimRight(u, ",")})
+			continue
+		}
+
+		start = i
+		for i < len(srcset) && srcset[i] != ',' {
+			i++
+		}
+		c := srcsetCandidate{url: u}
+		if desc := strings.Fields(srcset[start:i]); len(desc) != 0 {
+			c.desc = strings.ToLower(desc[0])
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates
+}
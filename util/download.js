@@ -1,28 +1,34 @@
 "use strict";
 
-var page = require('webpage').create(),
-    system = require('system'),
-    fs = require('fs');
+var webpage = require('webpage'),
+    system = require('system');
 
+// download.js URL [OPTIONS] renders a page, writes it and exits.
+// download.js --worker renders the pages of the tasks read from stdin, one JSON per line
+// like {"url": URL, "options": OPTIONS}, and writes one JSON line for each of them.
+// A {"ping": true} is answered with {"Pong": true}, so the pool knows the worker is healthy.
 if (system.args.length < 2) {
-  console.log('Usage: download.js URL');
+  console.log('Usage: download.js URL [OPTIONS] | download.js --worker');
   phantom.exit();
 }
 
-var address = system.args[1];
+function render(address, options, done) {
+  var page = webpage.create();
 
-page.settings.loadImages = false;
-page.settings.resourceTimeout = 10000;
-page.settings.webSecurityEnabled = false;
-
-page.onResourceRequested = function(requestData, request) {
-  if ((/http:\/\/.+?\.css/gi).test(requestData['url'])) {
-    request.abort();
+  page.settings.loadImages = false;
+  page.settings.resourceTimeout = 10000;
+  page.settings.webSecurityEnabled = false;
+  if (options.width && options.height) {
+    page.viewportSize = { width: options.width, height: options.height };
   }
-};
 
-page.open(address, function(status) {
-  if (status === 'success') {
+  page.onResourceRequested = function(requestData, request) {
+    if ((/http:\/\/.+?\.css/gi).test(requestData['url'])) {
+      request.abort();
+    }
+  };
+
+  function capture() {
     var html = '',
         count = page.framesCount + 1;
 
@@ -31,15 +37,97 @@ page.open(address, function(status) {
       page.switchToMainFrame();
       page.switchToFrame(i);
     }
+    page.switchToMainFrame();
+
+    var result = null;
+    if (options.script) {
+      result = page.evaluate(function(script) {
+        return eval(script);
+      }, options.script);
+    }
 
     var leioRes = {
       Err: '',
-      Body: html
+      Body: html,
+      Result: result === undefined ? null : result,
+      Screenshot: options.screenshot ? page.renderBase64('PNG') : null
     };
 
-    system.stdout.write(html);
-    phantom.exit();
-  } else {
+    page.close();
+    done(leioRes);
+  }
+
+  // Wait for the element of the selector, the page is captured as it is after the timeout.
+  function waitFor(selector, timeout) {
+    var start = Date.now();
+    var timer = setInterval(function() {
+      var found = page.evaluate(function(selector) {
+        return document.querySelector(selector) !== null;
+      }, selector);
+      if (found || Date.now() - start > timeout) {
+        clearInterval(timer);
+        capture();
+      }
+    }, 100);
+  }
+
+  page.open(address, function(status) {
+    if (status === 'success') {
+      if (options.waitfor) {
+        waitFor(options.waitfor, (options.waittimeout || 10) * 1000);
+      } else {
+        capture();
+      }
+    } else {
+      page.close();
+      done({ Err: 'Open ' + address + ' failed', Body: '' });
+    }
+  });
+}
+
+function reply(leioRes) {
+  system.stdout.write(JSON.stringify(leioRes) + '\n');
+  system.stdout.flush();
+}
+
+// Read the tasks one by one, the worker exits when stdin is closed.
+function work() {
+  if (system.stdin.atEnd()) {
     phantom.exit();
+    return;
+  }
+  var line = system.stdin.readLine();
+  if (!line) {
+    setTimeout(work, 0);
+    return;
+  }
+
+  var task;
+  try {
+    task = JSON.parse(line);
+  } catch (e) {
+    reply({ Err: 'Invalid task, ' + e, Body: '' });
+    setTimeout(work, 0);
+    return;
   }
-});
+  if (task.ping) {
+    reply({ Pong: true });
+    setTimeout(work, 0);
+    return;
+  }
+  render(task.url, task.options || {}, function(leioRes) {
+    reply(leioRes);
+    setTimeout(work, 0);
+  });
+}
+
+if (system.args[1] === '--worker') {
+  work();
+} else {
+  // The options of the page in JSON: waitfor, waittimeout, width, height, script and screenshot.
+  var options = system.args.length > 2 ? JSON.parse(system.args[2]) : {};
+  render(system.args[1], options, function(leioRes) {
+    system.stdout.write(JSON.stringify(leioRes));
+    phantom.exit();
+  });
+}
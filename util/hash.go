@@ -0,0 +1,46 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hasher creates the hash function used by the file names, the request fingerprints and the dedup keys.
+type Hasher func() hash.Hash
+
+// The available hashers by their names. xxhash is much faster, but it's not a cryptographic hash,
+// it's fine for dedup but not for the content which may be crafted by others.
+var Hashers = map[string]Hasher{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"xxhash": func() hash.Hash { return xxhash.New() },
+}
+
+// DefaultHasher is used by Hash and Fingerprint, the default one is md5 for compatibility.
+// Changing the hasher changes all the file names and fingerprints, so the files and the job
+// directories saved with the previous hasher won't be recognized.
+var DefaultHasher Hasher = md5.New
+
+// SetHasher changes the DefaultHasher by its name, see Hashers.
+func SetHasher(name string) error {
+	h, ok := Hashers[name]
+	if !ok {
+		return fmt.Errorf("Unknown hasher %s", name)
+	}
+	DefaultHasher = h
+	return nil
+}
+
+// Hash returns the hex digest of the input with the DefaultHasher.
+func Hash(input string) string {
+	h := DefaultHasher()
+	io.WriteString(h, input)
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
@@ -0,0 +1,94 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+)
+
+// JSONPath queries the decoded JSON value (from encoding/json with interface{}) by a simple path,
+// like "$.data.items[0].id". Only the child operator "." and the index operator "[n]" are supported,
+// the leading "$" is optional. The second return value is false if the path doesn't exist.
+func JSONPath(data interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(path, "$")
+	// Turn "a[0].b" into "a.[0].b", so we can split the path by dots.
+	path = strings.Replace(path, "[", ".[", -1)
+
+	cur := data
+	for _, token := range strings.Split(path, ".") {
+		if token == "" {
+			continue
+		}
+
+		if strings.HasPrefix(token, "[") && strings.HasSuffix(token, "]") {
+			a, ok := cur.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			i, err := strconv.Atoi(token[1 : len(token)-1])
+			if err != nil {
+				return nil, false
+			}
+			// Negative index counts from the end.
+			if i < 0 {
+				i += len(a)
+			}
+			if i < 0 || i >= len(a) {
+				return nil, false
+			}
+			cur = a[i]
+		} else {
+			m, ok := cur.(map[string]interface{})
+			if !ok {
+				return nil, false
+			}
+			if cur, ok = m[token]; !ok {
+				return nil, false
+			}
+		}
+	}
+	return cur, true
+}
+
+// JSON wraps a decoded JSON value, so the parsers can query it by the paths of JSONPath.
+// The getters return the zero values if the path doesn't exist or has another type.
+type JSON struct {
+	Value interface{}
+}
+
+// Get returns the value at the path, or nil if the path doesn't exist.
+func (j *JSON) Get(path string) *JSON {
+	if v, ok := JSONPath(j.Value, path); ok {
+		return &JSON{Value: v}
+	}
+	return nil
+}
+
+func (j *JSON) String(path string) string {
+	v, _ := JSONPath(j.Value, path)
+	s, _ := v.(string)
+	return s
+}
+
+// JSON numbers are decoded as float64.
+func (j *JSON) Float(path string) float64 {
+	v, _ := JSONPath(j.Value, path)
+	f, _ := v.(float64)
+	return f
+}
+
+func (j *JSON) Bool(path string) bool {
+	v, _ := JSONPath(j.Value, path)
+	b, _ := v.(bool)
+	return b
+}
+
+// Array returns the elements of the array at the path.
+func (j *JSON) Array(path string) []*JSON {
+	v, _ := JSONPath(j.Value, path)
+	a, _ := v.([]interface{})
+	elems := make([]*JSON, len(a))
+	for i, x := range a {
+		elems[i] = &JSON{Value: x}
+	}
+	return elems
+}
@@ -0,0 +1,38 @@
+package util
+
+import (
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// NewRand creates a random generator for a component. With the same seed, a component always gets
+// the same sequence, no matter in which order the components are created, since the name is mixed into the seed.
+// A seed of 0 means a random seed from the current time.
+// Unlike rand.New, the generator is safe for concurrent use.
+func NewRand(seed int64, name string) *rand.Rand {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return rand.New(&lockedSource{src: rand.NewSource(seed ^ int64(h.Sum64()))})
+}
+
+type lockedSource struct {
+	src   rand.Source
+	mutex sync.Mutex
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,144 @@
+package util
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// The elements which are never a part of the main text.
+var unreadable = map[string]bool{
+	"script": true, "style": true, "noscript": true, "nav": true, "header": true, "footer": true,
+	"aside": true, "form": true, "iframe": true, "svg": true, "button": true, "select": true, "template": true,
+}
+
+// The elements which start a new line in the text.
+var blockElements = map[string]bool{
+	"p": true, "div": true, "br": true, "li": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true,
+	"h6": true, "pre": true, "blockquote": true, "tr": true, "section": true, "article": true, "td": true,
+}
+
+// Readable extracts the title and the main text of a HTML page, like the reader mode of the browsers.
+// It's a simple version of the readability algorithm: the paragraphs score their parents by their length
+// and commas, and the text of the best scored element is the main text, the navigations, the scripts
+// and the forms are skipped. The whole body is used if there's no paragraph.
+// The title is the <title>, or the first <h1> if the page has no title.
+func Readable(body []byte) (title string, text string, err error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return "", "", err
+	}
+
+	var h1, bodyNode *html.Node
+	scores := make(map[*html.Node]float64)
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if unreadable[n.Data] {
+				return
+			}
+			switch n.Data {
+			case "title":
+				if title == "" {
+					title = collapse(nodeText(n))
+				}
+			case "h1":
+				if h1 == nil {
+					h1 = n
+				}
+			case "body":
+				bodyNode = n
+			case "p", "pre":
+				if p := collapse(nodeText(n)); len(p) >= 25 {
+					score := 1 + float64(strings.Count(p, ",")) + float64(min(len(p)/100, 3))
+					if n.Parent != nil {
+						scores[n.Parent] += score
+						if n.Parent.Parent != nil {
+							scores[n.Parent.Parent] += score / 2
+						}
+					}
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	if title == "" && h1 != nil {
+		title = collapse(nodeText(h1))
+	}
+
+	best, bestScore := bodyNode, 0.0
+	for n, score := range scores {
+		if score > bestScore {
+			best, bestScore = n, score
+		}
+	}
+	if best == nil {
+		best = doc
+	}
+
+	var lines []string
+	for _, line := range strings.Split(blockText(best), "\n") {
+		if line = collapse(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return title, strings.Join(lines, "\n"), nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func collapse(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// The text of the node, the unreadable elements are skipped.
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && unreadable[n.Data] {
+			return
+		} else if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
+
+// The text of the node, and the block elements are separated by new lines.
+func blockText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			if unreadable[n.Data] {
+				return
+			}
+			if blockElements[n.Data] {
+				b.WriteString("\n")
+				defer b.WriteString("\n")
+			}
+		} else if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(n)
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package util
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Hostname returns the lowercased host of the url without the port.
+func Hostname(raw string) string {
+	if u, err := url.Parse(raw); err == nil {
+		return strings.ToLower(u.Hostname())
+	}
+	return ""
+}
+
+// StripPort returns the host without its port, like "example.com" of "example.com:8080",
+// and "::1" of "[::1]:8080". A host without a port is returned as it is.
+func StripPort(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	u := url.URL{Host: host}
+	return u.Hostname()
+}
+
+// RegistrableDomain returns the domain a host belongs to, which is one label more than its public suffix,
+// like "example.co.uk" for "www.shop.example.co.uk". The IPs, and the hosts which are public suffixes
+// themselves, like "localhost", are returned as they are.
+func RegistrableDomain(host string) string {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// MatchDomain reports whether the host is the domain or its subdomain. The labels are matched
+// as a whole, so "notexample.com" doesn't match "example.com", but "www.example.com" does.
+func MatchDomain(host string, domain string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	domain = strings.TrimPrefix(strings.TrimSuffix(strings.ToLower(domain), "."), ".")
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// AddQuery sets the query parameter of the url, replacing the existing values.
+func AddQuery(raw string, key string, value string) string {
+	return editQuery(raw, func(query url.Values) { query.Set(key, value) })
+}
+
+// RemoveQuery removes the query parameters of the url, like the session ids or the tracking parameters.
+func RemoveQuery(raw string, keys ...string) string {
+	return editQuery(raw, func(query url.Values) {
+		for _, key := range keys {
+			query.Del(key)
+		}
+	})
+}
+
+// SortQuery sorts the query parameters of the url by their keys.
+func SortQuery(raw string) string {
+	return editQuery(raw, func(query url.Values) {})
+}
+
+// The url is returned as it is if it can't be parsed.
+// Pay attention that url.Values.Encode always sorts the parameters.
+func editQuery(raw string, edit func(query url.Values)) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	query := u.Query()
+	edit(query)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// ExpandPath fills the {name} placeholders in the template with the escaped values,
+// like ExpandPath("/users/{id}/posts", map[string]string{"id": "a b"}) returns "/users/a%20b/posts".
+func ExpandPath(template string, values map[string]string) string {
+	for name, value := range values {
+		template = strings.Replace(template, "{"+name+"}", url.PathEscape(value), -1)
+	}
+	return template
+}
+
+// JoinURL resolves the reference against the base url, like a browser following a link.
+// Only http and https urls can be crawled, so the links like "javascript:" and "mailto:" are errors.
+func JoinURL(base string, ref string) (string, error) {
+	b, err := url.Parse(base)
+	if err != nil {
+		return "", err
+	}
+	r, err := url.Parse(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+
+	u := b.ResolveReference(r)
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("Unsupported url scheme %s", u.Scheme)
+	}
+	return u.String(), nil
+}
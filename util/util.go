@@ -2,12 +2,17 @@ package util
 
 import (
 	"crypto/md5"
+	"encoding/gob"
 	"fmt"
 	"io"
 	"net/url"
+	"os"
+	"sort"
+	"strings"
 	"time"
 )
 
+// MD5Hash always uses md5, use Hash for the configurable hasher.
 func MD5Hash(input string) string {
 	h := md5.New()
 	io.WriteString(h, input)
@@ -37,3 +42,86 @@ func GetHost(raw string) string {
 	}
 	return ""
 }
+
+// CanonicalURL normalizes the url, so the urls pointing to the same resource are equal:
+// the scheme and the host are lowercased, the default port and the fragment are removed,
+// an empty path becomes "/", and the query parameters are sorted.
+// If the url can't be parsed, it's returned as it is.
+func CanonicalURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	u.Host = strings.ToLower(u.Host)
+	if (u.Scheme == "http" && strings.HasSuffix(u.Host, ":80")) ||
+		(u.Scheme == "https" && strings.HasSuffix(u.Host, ":443")) {
+		u.Host = u.Host[:strings.LastIndex(u.Host, ":")]
+	}
+	u.Fragment = ""
+	if u.Path == "" && u.Opaque == "" {
+		u.Path = "/"
+	}
+
+	// url.Values.Encode sorts the parameters by their keys,
+	// and we also sort the values of the same key.
+	return editQuery(u.String(), func(query url.Values) {
+		for _, vals := range query {
+			sort.Strings(vals)
+		}
+	})
+}
+
+// Fingerprint returns a hash identifying a request, it's based on the canonical url, see CanonicalURL.
+// Extra parts of the request, like the method or the body, can be added to the fingerprint.
+func Fingerprint(raw string, extras ...string) string {
+	h := DefaultHasher()
+	io.WriteString(h, CanonicalURL(raw))
+	for _, extra := range extras {
+		io.WriteString(h, "\n")
+		io.WriteString(h, extra)
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// SaveGob encodes the value with encoding/gob and writes it to the file.
+// We write to a temporary file first, so an interrupted save won't break the previous one.
+func SaveGob(filename string, v interface{}) error {
+	return SaveGobPerm(filename, v, 0644)
+}
+
+// SaveGobPerm is SaveGob with the permission of the file, the secrets like the sessions are saved with 0600.
+func SaveGobPerm(filename string, v interface{}, perm os.FileMode) error {
+	file, err := os.OpenFile(filename+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	// The temporary file left by a crash may have another permission.
+	if err = file.Chmod(perm); err != nil {
+		file.Close()
+		return err
+	}
+	if err = gob.NewEncoder(file).Encode(v); err != nil {
+		file.Close()
+		os.Remove(filename + ".tmp")
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(filename+".tmp", filename)
+}
+
+// LoadGob decodes the file written by SaveGob into v.
+// It's not an error if the file doesn't exist, v will be left unchanged.
+func LoadGob(filename string, v interface{}) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	return gob.NewDecoder(file).Decode(v)
+}